@@ -14,6 +14,8 @@
 
 package parser
 
+import "fmt"
+
 // Char describes the position and validity of one UTF-8 character.
 type Char struct {
 	Pos   uint32
@@ -130,25 +132,51 @@ func IsHexDigit(c uint8) bool {
 	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
 }
 
-// HexDigit converts a hex digit character to its numeric value (0-15).
+// HexDigit converts a hex digit character to its numeric value (0-15).  It
+// panics if c is not a hex digit.
 func HexDigit(c uint8) uint8 {
-	if c >= '0' && c <= '9' {
-		return c - '0'
-	}
-	if c >= 'a' && c <= 'z' {
-		return c - 'a' + 10
+	value, err := hexDigit(c)
+	if err != nil {
+		panic(err.Error())
 	}
-	if c >= 'A' && c <= 'Z' {
-		return c - 'A' + 10
-	}
-	panic("Invalid hex digit: " + string(c))
+	return value
 }
 
 // HexToChar converts two hex digit characters to their combined byte value.
+// It panics if either is not a hex digit.
 func HexToChar(hi, lo uint8) uint8 {
 	return (HexDigit(hi) << 4) | HexDigit(lo)
 }
 
+// hexDigit converts a hex digit character to its numeric value (0-15), and
+// returns an error if c is not a hex digit.
+func hexDigit(c uint8) (uint8, error) {
+	if c >= '0' && c <= '9' {
+		return c - '0', nil
+	}
+	if c >= 'a' && c <= 'f' {
+		return c - 'a' + 10, nil
+	}
+	if c >= 'A' && c <= 'F' {
+		return c - 'A' + 10, nil
+	}
+	return 0, fmt.Errorf("Invalid hex digit: %q", c)
+}
+
+// hexToChar converts two hex digit characters to their combined byte value,
+// and returns an error if either is not a hex digit.
+func hexToChar(hi, lo uint8) (uint8, error) {
+	hiValue, err := hexDigit(hi)
+	if err != nil {
+		return 0, err
+	}
+	loValue, err := hexDigit(lo)
+	if err != nil {
+		return 0, err
+	}
+	return hiValue<<4 | loValue, nil
+}
+
 // encodingIsOverlong returns true if the UTF-8 encoding is overly long.
 // All valid encodings are the shortest possible.
 // E.g. 0xC041 encodes 'A', but is 2 bytes.
@@ -194,6 +194,14 @@ func TestHex(t *testing.T) {
 	if HexDigit('A') != 0xa {
 		t.Errorf("HexDigit('A'): expected 0xa, got 0x%x", HexDigit('A'))
 	}
+
+	// Letters past f are not hex digits.
+	if _, err := hexDigit('g'); err == nil {
+		t.Errorf("hexDigit('g'): expected an error")
+	}
+	if _, err := hexToChar('4', 'Z'); err == nil {
+		t.Errorf("hexToChar('4', 'Z'): expected an error")
+	}
 }
 
 func TestWhitespace(t *testing.T) {
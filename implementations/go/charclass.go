@@ -0,0 +1,74 @@
+// Copyright 2023 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "fmt"
+
+// CharRange is an inclusive range of runes.
+type CharRange struct {
+	Lo rune
+	Hi rune
+}
+
+// CharClass is a set of runes written in a grammar as [a-z0-9_] or [^"].
+type CharClass struct {
+	Ranges  []CharRange
+	Negated bool // Set for [^...] classes
+}
+
+// Contains returns true if r is in the class.
+func (cc *CharClass) Contains(r rune) bool {
+	found := false
+	for _, cr := range cc.Ranges {
+		if r >= cr.Lo && r <= cr.Hi {
+			found = true
+			break
+		}
+	}
+	return found != cc.Negated
+}
+
+// ToString returns the class in grammar syntax.
+func (cc *CharClass) ToString() string {
+	s := "["
+	if cc.Negated {
+		s += "^"
+	}
+	for _, cr := range cc.Ranges {
+		s += charClassRuneToString(cr.Lo)
+		if cr.Hi != cr.Lo {
+			s += "-" + charClassRuneToString(cr.Hi)
+		}
+	}
+	return s + "]"
+}
+
+// charClassRuneToString escapes r for use inside a character class.
+func charClassRuneToString(r rune) string {
+	switch r {
+	case ']', '[', '-', '^', '\\':
+		return "\\" + string(r)
+	case '\n':
+		return "\\n"
+	case '\r':
+		return "\\r"
+	case '\t':
+		return "\\t"
+	}
+	if r < ' ' || r == 0x7f {
+		return fmt.Sprintf("\\x%02x", r)
+	}
+	return string(r)
+}
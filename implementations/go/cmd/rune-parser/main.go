@@ -45,6 +45,9 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Error parsing grammar: %v\n", err)
 		os.Exit(1)
 	}
+	for _, warning := range peg.Warnings() {
+		fmt.Fprintln(os.Stderr, warning)
+	}
 	fmt.Printf("✅ Grammar loaded: %d rules\n\n", len(peg.OrderedRules()))
 
 	// Parse the input file
@@ -0,0 +1,101 @@
+// Copyright 2023 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity says how serious a Diagnostic is.
+type Severity uint32
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+// String returns "warning" or "error".
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", uint32(s))
+}
+
+// Diagnostic is a problem found in a grammar by ParseRules, or in an input
+// file by ParseFile.  Errors are also returned by ParseRules, after all of
+// them have been reported.
+type Diagnostic struct {
+	Severity Severity
+	Location Location
+	Message  string
+}
+
+// String returns the diagnostic as "file:line: severity: message".
+func (d Diagnostic) String() string {
+	if d.Location.Filepath == nil {
+		return fmt.Sprintf("%v: %s", d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: %v: %s", d.Location.Filepath.Name, d.Location.Line, d.Severity, d.Message)
+}
+
+// UndefinedRuleRef is a reference to a rule that is not defined.
+type UndefinedRuleRef struct {
+	Name     string
+	Location Location
+}
+
+// UndefinedRuleError is returned by ParseRules when expressions refer to rules
+// that are not defined.
+type UndefinedRuleError struct {
+	Refs []UndefinedRuleRef
+}
+
+// Error lists each undefined rule with the line it was referenced on.
+func (e *UndefinedRuleError) Error() string {
+	refs := make([]string, len(e.Refs))
+	for i, ref := range e.Refs {
+		refs[i] = fmt.Sprintf("undefined rule '%s' at line %d", ref.Name, ref.Location.Line)
+	}
+	return "ParseRules: " + strings.Join(refs, ", ")
+}
+
+// SetDiagnosticSink makes ParseRules pass each diagnostic to sink.  Errors are
+// also returned by ParseRules, and warnings are kept for Warnings.
+func (p *Peg) SetDiagnosticSink(sink func(Diagnostic)) {
+	p.diagnosticSink = sink
+}
+
+// Warnings returns the warnings found by the last call to ParseRules, such as
+// "main.syn:3: warning: unused rule 'x'".
+func (p *Peg) Warnings() []string {
+	return append([]string(nil), p.warnings...)
+}
+
+// report sends a diagnostic to the sink, if there is one.  Warnings are kept
+// for Warnings.
+func (p *Peg) report(severity Severity, location Location, format string, args ...interface{}) {
+	diagnostic := Diagnostic{severity, location, fmt.Sprintf(format, args...)}
+	if severity == SeverityWarning {
+		p.warnings = append(p.warnings, diagnostic.String())
+	}
+	if p.diagnosticSink != nil {
+		p.diagnosticSink(diagnostic)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2023 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GrammarDiffKind says how a rule differs between two grammars.
+type GrammarDiffKind uint32
+
+const (
+	GrammarDiffAdded GrammarDiffKind = iota
+	GrammarDiffRemoved
+	GrammarDiffModified
+)
+
+// String returns "added", "removed" or "modified".
+func (k GrammarDiffKind) String() string {
+	switch k {
+	case GrammarDiffAdded:
+		return "added"
+	case GrammarDiffRemoved:
+		return "removed"
+	case GrammarDiffModified:
+		return "modified"
+	}
+	return fmt.Sprintf("GrammarDiffKind(%d)", uint32(k))
+}
+
+// GrammarDiff describes one rule that differs between two grammars.
+type GrammarDiff struct {
+	Kind     GrammarDiffKind
+	RuleName string
+	// Detail is the rule for added and removed rules.  For modified rules,
+	// it is the first difference, such as `"+" term -> "+" factor`.
+	Detail string
+}
+
+// String returns the difference as one line, such as "modified expr: ...".
+func (d GrammarDiff) String() string {
+	return fmt.Sprintf("%v %s: %s", d.Kind, d.RuleName, d.Detail)
+}
+
+// DiffGrammars compares the rules of a and b, matching them by name.  Removed
+// and modified rules are reported in a's rule order, followed by added rules in
+// b's rule order.  Rules are modified if their expressions differ, as
+// determined by Pexpr.Equal, or their weakness, display names or %error
+// messages differ.
+func DiffGrammars(a, b *Peg) []GrammarDiff {
+	var diffs []GrammarDiff
+	for _, ruleA := range a.OrderedRules() {
+		ruleB := b.FindRule(ruleA.Sym)
+		if ruleB == nil {
+			diffs = append(diffs, GrammarDiff{GrammarDiffRemoved, ruleA.Sym.Name, ruleA.ToString()})
+		} else if detail := diffRules(ruleA, ruleB); detail != "" {
+			diffs = append(diffs, GrammarDiff{GrammarDiffModified, ruleA.Sym.Name, detail})
+		}
+	}
+	for _, ruleB := range b.OrderedRules() {
+		if a.FindRule(ruleB.Sym) == nil {
+			diffs = append(diffs, GrammarDiff{GrammarDiffAdded, ruleB.Sym.Name, ruleB.ToString()})
+		}
+	}
+	return diffs
+}
+
+// diffRules returns a brief description of how ruleB differs from ruleA, or ""
+// if they are the same.
+func diffRules(ruleA, ruleB *Rule) string {
+	var details []string
+	if ruleA.Weak != ruleB.Weak {
+		details = append(details, fmt.Sprintf("%s -> %s", weakOrStrong(ruleA.Weak), weakOrStrong(ruleB.Weak)))
+	}
+	pexprA := ruleA.Pexpr()
+	pexprB := ruleB.Pexpr()
+	if pexprA != nil && pexprB != nil {
+		if diffA, diffB := pexprA.firstDifference(pexprB); diffA != nil {
+			details = append(details, fmt.Sprintf("%s -> %s", describePexpr(diffA, diffB), describePexpr(diffB, diffA)))
+		}
+	} else if pexprA != pexprB {
+		details = append(details, fmt.Sprintf("%s -> %s", ruleA.ToString(), ruleB.ToString()))
+	}
+	if displayA, displayB := displayName(ruleA), displayName(ruleB); displayA != displayB {
+		details = append(details, fmt.Sprintf("display name %s -> %s", displayA, displayB))
+	}
+	if ruleA.ErrorMessage != ruleB.ErrorMessage {
+		details = append(details, fmt.Sprintf("%%error %q -> %%error %q", ruleA.ErrorMessage, ruleB.ErrorMessage))
+	}
+	if precedenceA, precedenceB := ruleA.precedenceString(), ruleB.precedenceString(); precedenceA != precedenceB {
+		details = append(details, fmt.Sprintf("%%precedence {%s } -> %%precedence {%s }", precedenceA, precedenceB))
+	}
+	return strings.Join(details, "; ")
+}
+
+// describePexpr returns pexpr's string, with its weakness if that is all that
+// tells it apart from other, as for "(" and '('.
+func describePexpr(pexpr, other *Pexpr) string {
+	s := pexpr.ToString()
+	if pexpr.Weak != other.Weak && s == other.ToString() {
+		s = weakOrStrong(pexpr.Weak) + " " + s
+	}
+	return s
+}
+
+// displayName returns the name of a rule's DisplayName, or "none".
+func displayName(rule *Rule) string {
+	if rule.DisplayName == nil {
+		return "none"
+	}
+	return rule.DisplayName.Name
+}
+
+// weakOrStrong describes a rule's weakness.
+func weakOrStrong(weak bool) string {
+	if weak {
+		return "weak"
+	}
+	return "strong"
+}
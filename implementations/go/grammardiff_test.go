@@ -0,0 +1,80 @@
+// Copyright 2023 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "testing"
+
+func TestDiffGrammars(t *testing.T) {
+	a := newTestPeg(t, `expr := expr "+" term | term
+term := INTEGER | IDENT | paren
+paren : '(' expr ')'`)
+	b := newTestPeg(t, `expr := expr "+" term | term
+term := INTEGER | FLOAT | paren
+paren : '(' expr ')'
+call := IDENT paren`)
+
+	diffs := DiffGrammars(a, b)
+	expected := []string{
+		"modified term: IDENT -> FLOAT",
+		"added call: call: IDENT paren",
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("Expected %d differences, got %v", len(expected), diffs)
+	}
+	for i, diff := range diffs {
+		if diff.String() != expected[i] {
+			t.Errorf("Difference %d: expected %q, got %q", i, expected[i], diff.String())
+		}
+	}
+	if diffs[0].Kind != GrammarDiffModified || diffs[1].Kind != GrammarDiffAdded {
+		t.Errorf("Unexpected kinds %v and %v", diffs[0].Kind, diffs[1].Kind)
+	}
+
+	reversed := DiffGrammars(b, a)
+	if len(reversed) != 2 || reversed[1].Kind != GrammarDiffRemoved || reversed[1].RuleName != "call" {
+		t.Errorf("Expected call to be removed, got %v", reversed)
+	}
+	if same := DiffGrammars(a, a); len(same) != 0 {
+		t.Errorf("Expected no differences between a grammar and itself, got %v", same)
+	}
+}
+
+func TestDiffGrammarsWeakness(t *testing.T) {
+	a := newTestPeg(t, `goal := item*
+item := '(' IDENT ')'`)
+	b := newTestPeg(t, `goal := item*
+item : "(" IDENT ')'`)
+
+	diffs := DiffGrammars(a, b)
+	expected := `modified item: strong -> weak; weak "(" -> strong "("`
+	if len(diffs) != 1 || diffs[0].String() != expected {
+		t.Errorf("Expected %q, got %v", expected, diffs)
+	}
+}
+
+func TestPexprEqualNil(t *testing.T) {
+	peg := newTestPeg(t, `goal := IDENT`)
+	pexpr := peg.RuleByName("goal").Pexpr()
+	var none *Pexpr
+	if !none.Equal(nil) {
+		t.Errorf("Expected two nil expressions to be equal")
+	}
+	if pexpr.Equal(nil) || none.Equal(pexpr) {
+		t.Errorf("Expected nil to differ from %s", pexpr.ToString())
+	}
+	if !pexpr.Equal(pexpr) {
+		t.Errorf("Expected %s to equal itself", pexpr.ToString())
+	}
+}
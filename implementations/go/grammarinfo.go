@@ -0,0 +1,99 @@
+// Copyright 2023 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+// RuleInfo describes a grammar rule for tools that analyze or document
+// grammars.  It is a copy, so changing it does not change the grammar.
+type RuleInfo struct {
+	Name        string
+	DisplayName string // Set with name -> displayName, or ""
+	Weak        bool
+	Nullable    bool   // Whether the rule can match empty input
+	Doc         string // The rule's doc comment, or ""
+
+	// The keywords and token types that can start a match, as returned by
+	// Rule.FirstSet
+	FirstKeywords []string
+	FirstTokens   []TokenType
+
+	Pexpr PexprInfo
+}
+
+// PexprInfo describes a parsing expression in a RuleInfo.
+type PexprInfo struct {
+	Type PexprType
+	// Name is the rule a nonterminal refers to, the text of a keyword or soft
+	// keyword, the token type of a terminal, such as INTEGER, or the grammar
+	// text of a character class or byte range.  It is "" for operators.
+	Name     string
+	Label    string // Set by label=expr, or ""
+	Weak     bool   // Whether a keyword or soft keyword is left out of trees
+	Nullable bool   // Whether the expression can match empty input
+	// Children are the operands of an operator, or the arguments of a
+	// parameterized rule reference.
+	Children []PexprInfo
+}
+
+// Grammar returns a description of each rule, in order.  First sets and
+// nullability are found by ParseRules, so call it first.
+func (p *Peg) Grammar() []RuleInfo {
+	var infos []RuleInfo
+	for _, rule := range p.OrderedRules() {
+		infos = append(infos, rule.info())
+	}
+	return infos
+}
+
+// info returns the RuleInfo describing this rule.
+func (r *Rule) info() RuleInfo {
+	info := RuleInfo{
+		Name:     r.Sym.Name,
+		Weak:     r.Weak,
+		Nullable: r.CanBeEmpty,
+		Doc:      r.Doc,
+	}
+	if r.DisplayName != nil {
+		info.DisplayName = r.DisplayName.Name
+	}
+	info.FirstKeywords, info.FirstTokens = r.FirstSet()
+	if r.pexpr != nil {
+		info.Pexpr = r.pexpr.info()
+	}
+	return info
+}
+
+// info returns the PexprInfo describing this expression and its children.
+func (p *Pexpr) info() PexprInfo {
+	info := PexprInfo{
+		Type:     p.Type,
+		Label:    p.Label,
+		Nullable: p.CanBeEmpty,
+	}
+	switch p.Type {
+	case PexprTypeNonterm, PexprTypeKeyword, PexprTypeSoftKeyword:
+		if p.Sym != nil {
+			info.Name = p.Sym.Name
+		}
+		info.Weak = p.Weak
+	case PexprTypeTerm:
+		info.Name = p.TokenType.String()
+	case PexprTypeCharClass, PexprTypeByteRange:
+		info.Name = p.RawToString()
+	}
+	for _, child := range p.ChildPexprs() {
+		info.Children = append(info.Children, child.info())
+	}
+	return info
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGrammar(t *testing.T) {
+	peg := newTestPeg(t, `expr := expr "+" term | term
+term : INTEGER | '(' value=expr ')' | "-"? IDENT`)
+	infos := peg.Grammar()
+	if len(infos) != 2 || infos[0].Name != "expr" || infos[1].Name != "term" {
+		t.Fatalf("Expected rules expr and term, got %+v", infos)
+	}
+	expected := RuleInfo{
+		Name:          "term",
+		Weak:          true,
+		FirstKeywords: []string{"(", "-"},
+		FirstTokens:   []TokenType{TokenTypeIdent, TokenTypeInteger},
+		Pexpr: PexprInfo{Type: PexprTypeChoice, Children: []PexprInfo{
+			{Type: PexprTypeTerm, Name: "INTEGER"},
+			{Type: PexprTypeSequence, Children: []PexprInfo{
+				{Type: PexprTypeKeyword, Name: "(", Weak: true},
+				{Type: PexprTypeNonterm, Name: "expr", Label: "value"},
+				{Type: PexprTypeKeyword, Name: ")", Weak: true},
+			}},
+			{Type: PexprTypeSequence, Children: []PexprInfo{
+				{Type: PexprTypeOptional, Nullable: true, Children: []PexprInfo{
+					{Type: PexprTypeKeyword, Name: "-"},
+				}},
+				{Type: PexprTypeTerm, Name: "IDENT"},
+			}},
+		}},
+	}
+	if !reflect.DeepEqual(infos[1], expected) {
+		t.Errorf("Expected %+v\ngot %+v", expected, infos[1])
+	}
+	if infos[0].Weak || infos[0].Nullable || infos[0].Pexpr.Type.String() != "choice" {
+		t.Errorf("Unexpected info for expr: %+v", infos[0])
+	}
+}
+
+func TestRuleDoc(t *testing.T) {
+	peg, err := NewPeg("test_doc.syn")
+	if err != nil {
+		t.Fatalf("Failed to load test_doc.syn: %v", err)
+	}
+	expected := map[string]string{
+		"goal":      "A program is a list of statements.",
+		"statement": "",
+		"assign":    "Assigns an expression to a variable.",
+		"print":     "",
+	}
+	for _, info := range peg.Grammar() {
+		if info.Doc != expected[info.Name] {
+			t.Errorf("%s: expected doc %q, got %q", info.Name, expected[info.Name], info.Doc)
+		}
+	}
+	if doc := peg.Clone().FindRule(NewSym("assign")).Doc; doc != expected["assign"] {
+		t.Errorf("Expected a clone to keep rule docs, got %q", doc)
+	}
+}
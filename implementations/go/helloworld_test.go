@@ -21,7 +21,6 @@ func TestHelloWorld(t *testing.T) {
 		Keytab:      NewKeytab(),
 		numKeywords: 0,
 		initialized: false,
-		maxTokenPos: 0,
 		ruleTable:   make([]*Rule, 0),
 		numRules:    0,
 	}
@@ -61,3 +60,35 @@ func TestHelloWorld(t *testing.T) {
 	fmt.Printf("\n=== SIMPLIFIED TREE ===\n")
 	fmt.Println(node.ToString())
 }
+
+// TestHelloWorldUnparse checks that unparsing helloworld.rn gives the same
+// tokens, in the same order, as the original.
+func TestHelloWorldUnparse(t *testing.T) {
+	peg, err := NewPeg("rune.syn")
+	if err != nil {
+		t.Fatalf("Error loading rune.syn: %v", err)
+	}
+	parser := peg.NewParser()
+	node, err := parser.Parse("../../examples/inputs/helloworld.rn", false)
+	if err != nil {
+		t.Fatalf("Failed to parse helloworld.rn: %v", err)
+	}
+	var original []string
+	for _, token := range parser.Tokens() {
+		original = append(original, token.GetName())
+	}
+
+	text := node.Unparse()
+	fp := NewFilepath("unparsed.rn", nil, false)
+	fp.Text = text
+	if _, err := parser.Parse(fp, false); err != nil {
+		t.Fatalf("Failed to parse unparsed text %q: %v", text, err)
+	}
+	var unparsed []string
+	for _, token := range parser.Tokens() {
+		unparsed = append(unparsed, token.GetName())
+	}
+	if fmt.Sprint(unparsed) != fmt.Sprint(original) {
+		t.Errorf("Expected tokens %q, got %q", original, unparsed)
+	}
+}
@@ -14,25 +14,97 @@
 
 package parser
 
+import (
+	"strconv"
+	"sync"
+)
+
 // Sym represents a symbol (interned string).
 type Sym struct {
 	Name string
 }
 
-// NewSym creates or returns a cached Sym for the given name.
-var symCache = make(map[string]*Sym)
+// SymTable interns Syms, so that Syms with the same name are the same *Sym.
+// A SymTable with a parent returns the parent's Sym for names the parent
+// already has, and interns other names itself, so that names that are only
+// needed for a while can be dropped with the table.  It is safe for concurrent
+// use.
+type SymTable struct {
+	parent *SymTable
+	mutex  sync.RWMutex
+	syms   map[string]*Sym
+}
 
-// NewSym creates a new Sym with the given name.
-// Symbols are interned, so multiple calls with the same name return the same *Sym.
-func NewSym(name string) *Sym {
-	if s, exists := symCache[name]; exists {
+// globalSyms holds the Syms made by NewSym.
+var globalSyms = NewSymTable(nil)
+
+// NewSymTable creates an empty SymTable.  parent may be nil.
+func NewSymTable(parent *SymTable) *SymTable {
+	return &SymTable{
+		parent: parent,
+		syms:   make(map[string]*Sym),
+	}
+}
+
+// NewScopedSymTable creates an empty SymTable whose parent holds the Syms made
+// by NewSym.
+func NewScopedSymTable() *SymTable {
+	return NewSymTable(globalSyms)
+}
+
+// Lookup returns the Sym with the given name in this table or its parents, or
+// nil if there is none.
+func (st *SymTable) Lookup(name string) *Sym {
+	for table := st; table != nil; table = table.parent {
+		table.mutex.RLock()
+		s := table.syms[name]
+		table.mutex.RUnlock()
+		if s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// NewSym returns the Sym with the given name, creating it in this table if
+// neither it nor its parents have one.
+func (st *SymTable) NewSym(name string) *Sym {
+	if s := st.Lookup(name); s != nil {
+		return s
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	// Another goroutine may have added it since the lookup
+	if s, exists := st.syms[name]; exists {
 		return s
 	}
 	s := &Sym{Name: name}
-	symCache[name] = s
+	st.syms[name] = s
 	return s
 }
 
+// Len returns the number of Syms in this table, not counting its parents.
+func (st *SymTable) Len() int {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return len(st.syms)
+}
+
+// Reset removes all Syms from this table, not its parents.  Syms already
+// returned are not changed, but are no longer the same as Syms made later
+// with the same names.
+func (st *SymTable) Reset() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	clear(st.syms)
+}
+
+// NewSym creates a new Sym with the given name.
+// Symbols are interned, so multiple calls with the same name return the same *Sym.
+func NewSym(name string) *Sym {
+	return globalSyms.NewSym(name)
+}
+
 // Keyword represents a keyword token with an optional numeric ID.
 type Keyword struct {
 	Sym           *Sym
@@ -44,7 +116,8 @@ type Keyword struct {
 
 // Keytab is a symbol-based hash table for keywords.
 type Keytab struct {
-	Keywords map[string]*Keyword // Hashed by Sym.Name
+	Keywords        map[string]*Keyword // Hashed by Sym.Name
+	orderedKeywords []*Keyword          // In insertion order
 }
 
 // NewKeytab creates a new empty keyword table.
@@ -70,36 +143,95 @@ func (kt *Keytab) New(name string) *Keyword {
 		Num:    0,
 		Tokens: make([]*Token, 0),
 	}
-	kt.Keywords[name] = kw
+	kt.InsertKeyword(kw)
 	return kw
 }
 
-// InsertKeyword adds a keyword to this keytab.
+// InsertKeyword adds a keyword to this keytab.  A keyword with the same name
+// is replaced in place, keeping its position in OrderedKeywords.
 func (kt *Keytab) InsertKeyword(kw *Keyword) {
+	if old, exists := kt.Keywords[kw.Sym.Name]; exists {
+		for i, entry := range kt.orderedKeywords {
+			if entry == old {
+				kt.orderedKeywords[i] = kw
+			}
+		}
+	} else {
+		kt.orderedKeywords = append(kt.orderedKeywords, kw)
+	}
 	kt.Keywords[kw.Sym.Name] = kw
 }
 
+// Remove removes the keyword with the given name, if there is one.  Keyword
+// numbers are not changed until SetKeywordNums is called again.
+func (kt *Keytab) Remove(name string) {
+	kw, exists := kt.Keywords[name]
+	if !exists {
+		return
+	}
+	delete(kt.Keywords, name)
+	for i, entry := range kt.orderedKeywords {
+		if entry == kw {
+			kt.orderedKeywords = append(kt.orderedKeywords[:i], kt.orderedKeywords[i+1:]...)
+			break
+		}
+	}
+}
+
+// Clear removes all keywords.
+func (kt *Keytab) Clear() {
+	clear(kt.Keywords)
+	kt.orderedKeywords = nil
+}
+
+// OrderedKeywords returns a slice of all keywords in the order they were
+// added.
+func (kt *Keytab) OrderedKeywords() []*Keyword {
+	keywords := make([]*Keyword, len(kt.orderedKeywords))
+	copy(keywords, kt.orderedKeywords)
+	return keywords
+}
+
 // FindKeyword finds a keyword by Sym.
 func (kt *Keytab) FindKeyword(sym *Sym) *Keyword {
 	return kt.Keywords[sym.Name]
 }
 
-// SetKeywordNums assigns numeric IDs to all keywords in order.
-// Returns the total number of keywords.
+// SetKeywordNums assigns numeric IDs to all keywords in the order they were
+// added.  Returns the total number of keywords.
 func (kt *Keytab) SetKeywordNums() uint32 {
 	num := uint32(0)
-	for _, kw := range kt.Keywords {
+	for _, kw := range kt.orderedKeywords {
 		kw.Num = num
 		num++
 	}
 	return num
 }
 
+// clone returns a copy of this keytab, with new keywords with the same names
+// and numbers, in the same order.  Keyword pexprs and tokens are not copied.
+func (kt *Keytab) clone() *Keytab {
+	clone := NewKeytab()
+	for _, kw := range kt.orderedKeywords {
+		clone.InsertKeyword(&Keyword{
+			Sym:    kw.Sym,
+			Num:    kw.Num,
+			Tokens: make([]*Token, 0),
+		})
+	}
+	return clone
+}
+
 // NewKeyword creates a new keyword in the given keytab.
 func NewKeyword(kt *Keytab, name string) *Keyword {
 	return kt.New(name)
 }
 
+// String returns the keyword's name quoted, such as "if", or "\n" for a newline.
+func (kw *Keyword) String() string {
+	return strconv.Quote(kw.Sym.Name)
+}
+
 // ============================================================================
 // TailLinked Keyword Pexpr cascade
 // ============================================================================
@@ -15,6 +15,8 @@
 package parser
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -114,3 +116,158 @@ func TestSetKeywordNums(t *testing.T) {
 		nums[kw.Num] = true
 	}
 }
+
+func TestRemoveKeywords(t *testing.T) {
+	keytab := NewKeytab()
+	for _, name := range []string{"a", "b", "c"} {
+		keytab.New(name)
+	}
+	keytab.Remove("b")
+	keytab.Remove("missing")
+	if keytab.Lookup("b") != nil {
+		t.Errorf("Expected b to be removed")
+	}
+	if count := keytab.SetKeywordNums(); count != 2 || keytab.Lookup("c").Num != 1 {
+		t.Errorf("Expected a and c to be numbered 0 and 1, got %d keywords", count)
+	}
+	keytab.Clear()
+	if keytab.Lookup("a") != nil || len(keytab.OrderedKeywords()) != 0 {
+		t.Errorf("Expected Clear to remove all keywords")
+	}
+	if keytab.New("d"); keytab.SetKeywordNums() != 1 {
+		t.Errorf("Expected keywords to be added after Clear")
+	}
+}
+
+// TestKeywordNumsInInsertionOrder verifies keywords are numbered in the order
+// they were added, so two keytabs built alike number their keywords alike.
+func TestKeywordNumsInInsertionOrder(t *testing.T) {
+	names := []string{"while", "(", ")", "{", "}", "if", "else", "return", ";"}
+	build := func() *Keytab {
+		keytab := NewKeytab()
+		for _, name := range names {
+			keytab.New(name)
+		}
+		keytab.New("if") // Adding a keyword again doesn't move it
+		keytab.SetKeywordNums()
+		return keytab
+	}
+	first, second := build(), build()
+	for i, name := range names {
+		if first.Lookup(name).Num != uint32(i) || second.Lookup(name).Num != uint32(i) {
+			t.Errorf("Expected %s to be numbered %d, got %d and %d",
+				name, i, first.Lookup(name).Num, second.Lookup(name).Num)
+		}
+	}
+}
+
+// TestStableKeywordNums verifies keywords are numbered in the order the
+// grammar uses them, so every Peg made from a grammar numbers them the same.
+func TestStableKeywordNums(t *testing.T) {
+	grammar := `goal := stmt*
+stmt := "if" expr "then" stmt | "while" expr "do" stmt | expr ";"
+expr := IDENT (("+" | "-" | "*" | "/") IDENT)*`
+	expected := []string{"if", "then", "while", "do", ";", "+", "-", "*", "/"}
+	for run := 0; run < 20; run++ {
+		keywords := newTestPeg(t, grammar).Keytab.OrderedKeywords()
+		if len(keywords) != len(expected) {
+			t.Fatalf("Expected %d keywords, got %d", len(expected), len(keywords))
+		}
+		for i, keyword := range keywords {
+			if keyword.Sym.Name != expected[i] || keyword.Num != uint32(i) {
+				t.Fatalf("Run %d: expected keyword %d to be %s, got %s numbered %d",
+					run, i, expected[i], keyword.Sym.Name, keyword.Num)
+			}
+		}
+	}
+}
+
+func TestOrderedKeywords(t *testing.T) {
+	keytab := NewKeytab()
+	names := []string{"while", "(", "if", ")", "else", "{", "}"}
+	for _, name := range names {
+		keytab.New(name)
+	}
+	keytab.New("if")
+	keytab.InsertKeyword(&Keyword{Sym: NewSym("(")})
+
+	for i := 0; i < 10; i++ {
+		keywords := keytab.OrderedKeywords()
+		if len(keywords) != len(names) {
+			t.Fatalf("Expected %d keywords, got %d", len(names), len(keywords))
+		}
+		for j, kw := range keywords {
+			if kw.Sym.Name != names[j] {
+				t.Errorf("Keyword %d should be '%s', got '%s'", j, names[j], kw.Sym.Name)
+			}
+		}
+	}
+	if keytab.OrderedKeywords()[1] != keytab.Lookup("(") {
+		t.Errorf("InsertKeyword should replace '(' in place")
+	}
+
+	keytab.SetKeywordNums()
+	for i, kw := range keytab.OrderedKeywords() {
+		if kw.Num != uint32(i) {
+			t.Errorf("Keyword '%s' should have Num %d, got %d", kw.Sym.Name, i, kw.Num)
+		}
+	}
+}
+
+// TestNewSymConcurrent interns overlapping and distinct names from several
+// goroutines at once.  Run with -race to check the cache is locked.
+func TestNewSymConcurrent(t *testing.T) {
+	const numGoroutines = 8
+	const numNames = 200
+	syms := make([][]*Sym, numGoroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < numGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < numNames; i++ {
+				syms[g] = append(syms[g], NewSym(fmt.Sprintf("concurrentShared%d", i)))
+				NewSym(fmt.Sprintf("concurrentDistinct%d_%d", g, i))
+			}
+		}(g)
+	}
+	wg.Wait()
+	for g := 1; g < numGoroutines; g++ {
+		for i := 0; i < numNames; i++ {
+			if syms[g][i] != syms[0][i] {
+				t.Fatalf("Expected one Sym for %s, got two", syms[0][i].Name)
+			}
+		}
+	}
+	for g := 0; g < numGoroutines; g++ {
+		name := fmt.Sprintf("concurrentDistinct%d_%d", g, numNames-1)
+		if sym := globalSyms.Lookup(name); sym == nil || sym.Name != name {
+			t.Errorf("Expected %s to be interned", name)
+		}
+	}
+}
+
+func TestScopedSymTable(t *testing.T) {
+	global := NewSym("scopedGlobal")
+	table := NewScopedSymTable()
+	if table.NewSym("scopedGlobal") != global {
+		t.Errorf("Expected the global Sym for a name NewSym has interned")
+	}
+	local := table.NewSym("scopedLocal")
+	if table.NewSym("scopedLocal") != local {
+		t.Errorf("Expected scoped Syms to be interned")
+	}
+	if globalSyms.Lookup("scopedLocal") != nil {
+		t.Errorf("Expected scoped Sym not to be interned globally")
+	}
+	if table.Len() != 1 {
+		t.Errorf("Expected 1 scoped Sym, got %d", table.Len())
+	}
+	table.Reset()
+	if table.Len() != 0 || table.Lookup("scopedLocal") != nil {
+		t.Errorf("Expected Reset to remove scoped Syms")
+	}
+	if table.Lookup("scopedGlobal") != global {
+		t.Errorf("Expected Reset to keep the parent's Syms")
+	}
+}
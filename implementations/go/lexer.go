@@ -17,6 +17,9 @@ package parser
 import (
 	"fmt"
 	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 // Lexer tokenizes input from a Filepath.
@@ -28,20 +31,60 @@ type Lexer struct {
 	Len                   uint32
 	Line                  uint32
 	AllowIdentUnderscores bool
-	UseWeakStrings        bool
+	UseWeakStrings        bool // See EnableWeakStrings
+	IgnoreKeywordCase     bool // See EnableIgnoreKeywordCase
+	KeepComments          bool // Return comments as TokenTypeComment tokens
+	ShowSnippets          bool // Show the source line in errors, as Location.Snippet does
+	sharedKeytab          bool // Keytab is shared, so tokens aren't added to its keywords
 	StartPos              uint32
+	syms                  *SymTable      // Where identifiers are interned, if not by NewSym
+	leadingWhitespace     bool           // Whether space or a comment preceded StartPos
+	docLines              []string       // Pending doc comment for the next token
+	docLine               uint32         // Line on which the pending doc comment ended
 	Tokens                []*Token       // ArrayList relation
 	ParseResults          []*ParseResult // DoublyLinked relation
+
+	// AllowNegativeNumberLiterals makes a '-' just before a number part of the
+	// number, as in -5, unless it follows a value, as in a-5 or (a)-5, where it
+	// is a subtraction.
+	AllowNegativeNumberLiterals bool
+	negative                    bool // Whether the number being parsed follows such a '-'
+
+	// NestedBlockComments makes each "/*" in a block comment need its own
+	// "*/".  It is set by NewLexer.  Clear it for C semantics, where the
+	// first "*/" ends the comment.
+	NestedBlockComments bool
+
+	// IndentSensitive makes the lexer return an INDENT token before the first
+	// token of a line indented more than the lines before it, and a DEDENT
+	// token for each indentation level a line closes, as in Python.  Blank
+	// lines and lines with only comments don't change the indentation, and
+	// DEDENTs closing the levels still open precede EOF.  Indentation is
+	// compared as text, so a line indented with a tab is not at the same
+	// level as one indented with spaces.
+	IndentSensitive bool
+	indents         []string // The indentation of each open level, when IndentSensitive
+	midLine         bool     // Whether a token has been read on the current line
+	dedents         uint32   // DEDENT tokens to return before the token at Pos
+	indentSpace     bool     // leadingWhitespace of the token at Pos after INDENT or DEDENTs
 }
 
 // NewLexer creates a new Lexer for a file.
-// If readFile is true, the file is read from disk first.
+// If readFile is true, the file is read from disk first.  If the file's Text
+// starts with a UTF-8 byte order mark, the lexer's Filepath is a copy of the
+// file without it, so the caller's file is left as is.
 func NewLexer(filepath *Filepath, keytab *Keytab, readFile bool) (*Lexer, error) {
 	if readFile {
 		if err := filepath.ReadFile(); err != nil {
 			return nil, err
 		}
 	}
+	if text := stripBOM(filepath.Text); len(text) != len(filepath.Text) {
+		withoutBOM := NewFilepath(filepath.Name, filepath.Parent, filepath.IsDir)
+		withoutBOM.Text = text
+		withoutBOM.TabWidth = filepath.TabWidth
+		filepath = withoutBOM
+	}
 
 	lexer := &Lexer{
 		Filepath:              filepath,
@@ -51,6 +94,7 @@ func NewLexer(filepath *Filepath, keytab *Keytab, readFile bool) (*Lexer, error)
 		Line:                  1,
 		AllowIdentUnderscores: false,
 		UseWeakStrings:        false,
+		NestedBlockComments:   true,
 		StartPos:              0,
 		Tokens:                make([]*Token, 0),
 		ParseResults:          make([]*ParseResult, 0),
@@ -59,11 +103,55 @@ func NewLexer(filepath *Filepath, keytab *Keytab, readFile bool) (*Lexer, error)
 	return lexer, nil
 }
 
+// newSym interns an identifier in the lexer's SymTable.
+func (l *Lexer) newSym(name string) *Sym {
+	if l.syms != nil {
+		return l.syms.NewSym(name)
+	}
+	return NewSym(name)
+}
+
 // AppendToken adds a token to this lexer's token list (ArrayList relation).
 func (l *Lexer) AppendToken(token *Token) {
 	l.Tokens = append(l.Tokens, token)
 }
 
+// TokensOfType returns the lexer's tokens of type tokenType, in source order,
+// such as all of the identifiers in a parsed file.  Node.Tokens returns the
+// tokens under a node of the parse tree.
+func (l *Lexer) TokensOfType(tokenType TokenType) []*Token {
+	var tokens []*Token
+	for _, token := range l.Tokens {
+		if token.Type == tokenType {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// TokensString returns the lexer's tokens as a table with a row per token,
+// giving its index, type, line and column, and quoted text, such as:
+//
+//	0  IDENT        1:1    "foo"
+func (l *Lexer) TokensString() string {
+	var b strings.Builder
+	for i, token := range l.Tokens {
+		line, col := token.Location.Line, token.Location.Column()
+		if token.Location.Filepath != nil {
+			// Location.Line puts newline tokens on the next line, so take both
+			// from Pos
+			line, col = token.Location.Filepath.LineColumn(token.Location.Pos)
+		}
+		fmt.Fprintf(&b, "%4d  %-10s %4d:%-4d %q\n", i, token.Type, line, col, token.GetName())
+	}
+	return b.String()
+}
+
+// DumpTokens prints the lexer's tokens, as formatted by TokensString.
+func (l *Lexer) DumpTokens() {
+	fmt.Print(l.TokensString())
+}
+
 // Close is a cleanup method (for now, just a placeholder).
 func (l *Lexer) Close() {
 	// Cleanup if needed
@@ -121,14 +209,36 @@ func (l *Lexer) RemoveParseResult(pr *ParseResult) {
 
 // ParseToken reads and returns the next token from input.
 func (l *Lexer) ParseToken() (*Token, error) {
+	if l.dedents != 0 {
+		l.dedents--
+		return l.newIndentToken(TokenTypeDedent), nil
+	}
+	l.leadingWhitespace = false
 	if l.Eof() {
-		return l.EofToken(), nil
+		return l.parseEof(), nil
 	}
 
-	// No further checks for eof are needed because the file always ends in a newline
-	// (we add one if we detect it is missing when we read the file).
-	l.skipSpace()
+	// The file always ends in a newline (we add one if we detect it is missing
+	// when we read the file), so we only reach eof here if newlines are skipped.
+	spaceStart := l.skipSpace()
+	if l.Eof() {
+		return l.parseEof(), nil
+	}
 	l.StartPos = l.Pos
+	l.leadingWhitespace = l.Pos > spaceStart || l.indentSpace
+	l.indentSpace = false
+	if l.atComment() {
+		return l.parseComment(), nil
+	}
+	if length := l.newlineLength(); length != 0 {
+		return l.parseNewline(length), nil
+	}
+	if l.IndentSensitive && !l.midLine {
+		if token, err := l.parseIndentation(); token != nil || err != nil {
+			return token, err
+		}
+	}
+	l.midLine = true
 	char := l.readChar()
 	if err := l.checkCharValid(char); err != nil {
 		return nil, err
@@ -136,12 +246,18 @@ func (l *Lexer) ParseToken() (*Token, error) {
 
 	c := l.Filepath.Text[char.Pos]
 
+	// A single quote starts a weak string only when lexing .syn grammars.
+	// Everywhere else it starts a character literal.
 	if c == '"' || (l.UseWeakStrings && c == '\'') {
 		return l.parseString(c)
 	} else if c == '\'' {
 		return l.parseAsciiChar()
+	} else if l.UseWeakStrings && c == '[' {
+		return l.parseCharClass()
 	} else if IsDigit(c) {
 		return l.parseNumber()
+	} else if c == '-' && l.atNegativeNumber() {
+		return l.parseNegativeNumber()
 	} else if c == '\\' {
 		return l.parseEscapedIdent()
 	}
@@ -161,6 +277,202 @@ func (l *Lexer) ParseToken() (*Token, error) {
 	return l.parseNonAlphaKeyword(char)
 }
 
+// parseEof returns a DEDENT token for the innermost indentation level still
+// open, if IndentSensitive is set, and otherwise the EOF token.
+func (l *Lexer) parseEof() *Token {
+	if l.IndentSensitive && len(l.indents) != 0 {
+		l.indents = l.indents[:len(l.indents)-1]
+		l.StartPos = l.Len
+		return l.newIndentToken(TokenTypeDedent)
+	}
+	return l.EofToken()
+}
+
+// parseIndentation compares the indentation of the line starting with the
+// token at Pos with that of the open levels.  If it is deeper, it opens a level
+// and returns an INDENT token, and if it closes levels, it returns a DEDENT
+// token, leaving the rest to be returned before the token at Pos.  It returns
+// nil if the level is unchanged, and an error if the indentation matches no
+// open level.
+func (l *Lexer) parseIndentation() (*Token, error) {
+	l.midLine = true
+	indent := l.lineIndentation()
+	level := len(l.indents)
+	for level != 0 && !strings.HasPrefix(indent, l.indents[level-1]) {
+		level--
+	}
+	outer := ""
+	if level != 0 {
+		outer = l.indents[level-1]
+	}
+	if level == len(l.indents) {
+		if indent == outer {
+			return nil, nil
+		}
+		l.indents = append(l.indents, indent)
+		l.indentSpace = l.leadingWhitespace
+		return l.newIndentToken(TokenTypeIndent), nil
+	}
+	if indent != outer {
+		location := NewLocation(l.Filepath, l.StartPos-uint32(len(indent)), uint32(len(indent)), l.Line)
+		return nil, l.errorAt(location, "Dedent does not match any outer indentation level")
+	}
+	l.dedents = uint32(len(l.indents)-level) - 1
+	l.indents = l.indents[:level]
+	l.indentSpace = l.leadingWhitespace
+	return l.newIndentToken(TokenTypeDedent), nil
+}
+
+// lineIndentation returns the spaces and tabs starting the line StartPos is
+// on.
+func (l *Lexer) lineIndentation() string {
+	text := l.Filepath.Text
+	start := l.StartPos
+	for start > 0 && text[start-1] != '\n' && text[start-1] != '\r' {
+		start--
+	}
+	end := start
+	for end < l.StartPos && (text[end] == ' ' || text[end] == '\t') {
+		end++
+	}
+	return text[start:end]
+}
+
+// newIndentToken returns an empty INDENT or DEDENT token at StartPos.
+func (l *Lexer) newIndentToken(tokenType TokenType) *Token {
+	return NewToken(l, tokenType, NewLocation(l.Filepath, l.StartPos, 0, l.Line), nil, NewValue(nil))
+}
+
+// SkipToNewline skips the rest of the current line, through its newline, so
+// that lexing resumes at the start of the next line, such as after a lexer
+// error in a line typed into a REPL.  The newline is skipped even if it is a
+// keyword, and DEDENTs and doc comments still pending are dropped.  On the
+// last line, it skips to EOF.
+func (l *Lexer) SkipToNewline() {
+	for l.Pos < l.Len {
+		if length := l.newlineLength(); length != 0 {
+			l.Pos += length
+			l.Line++
+			break
+		}
+		l.Pos++
+	}
+	l.StartPos = l.Pos
+	l.midLine = false
+	l.dedents = 0
+	l.docLines = nil
+}
+
+// AllTokens reads the rest of the input and returns all of this lexer's tokens,
+// ending with EOF.  If a token can't be read, it returns the tokens read so far
+// and the error.
+func (l *Lexer) AllTokens() ([]*Token, error) {
+	for {
+		token, err := l.ParseToken()
+		if err != nil {
+			return l.Tokens, err
+		}
+		if token.IsEof() {
+			return l.Tokens, nil
+		}
+	}
+}
+
+// LexerOptions configures the Lexer used by Tokenize.
+type LexerOptions struct {
+	// Keywords are the keywords to recognize, such as "if" and "+".  Input
+	// that is not a keyword, identifier, number, string or comment is an error.
+	Keywords []string
+
+	AllowIdentUnderscores       bool // See Lexer.AllowIdentUnderscores
+	UseWeakStrings              bool // See Lexer.EnableWeakStrings
+	IgnoreKeywordCase           bool // See Lexer.EnableIgnoreKeywordCase
+	KeepComments                bool // See Lexer.KeepComments
+	AllowNegativeNumberLiterals bool // See Lexer.AllowNegativeNumberLiterals
+	FlatBlockComments           bool // Clears Lexer.NestedBlockComments
+	IndentSensitive             bool // See Lexer.IndentSensitive
+}
+
+// Tokenize lexes source, which is named name in errors, without a grammar,
+// for tools such as syntax highlighters.  It returns all of its tokens, with
+// newlines as "\n" keywords, ending with EOF.  If a token can't be read, it
+// returns the tokens read so far and the error.
+func Tokenize(name, source string, opts LexerOptions) ([]*Token, error) {
+	keytab := NewKeytab()
+	keytab.New("\n")
+	for _, keyword := range opts.Keywords {
+		keytab.New(keyword)
+	}
+	keytab.SetKeywordNums()
+	filepath := NewFilepath(name, nil, false)
+	if len(source) == 0 || source[len(source)-1] != '\n' {
+		source += "\n"
+	}
+	filepath.Text = source
+	lexer, err := NewLexer(filepath, keytab, false)
+	if err != nil {
+		return nil, err
+	}
+	lexer.AllowIdentUnderscores = opts.AllowIdentUnderscores
+	lexer.EnableWeakStrings(opts.UseWeakStrings)
+	lexer.EnableIgnoreKeywordCase(opts.IgnoreKeywordCase)
+	lexer.KeepComments = opts.KeepComments
+	lexer.AllowNegativeNumberLiterals = opts.AllowNegativeNumberLiterals
+	lexer.NestedBlockComments = !opts.FlatBlockComments
+	lexer.IndentSensitive = opts.IndentSensitive
+	return lexer.AllTokens()
+}
+
+// TokenIterator reads tokens from a Lexer one at a time, for callers that
+// want to stream them:
+//
+//	for iter.HasNext() {
+//		token := iter.Token()
+//		...
+//	}
+//	if err := iter.Err(); err != nil {
+//		...
+//	}
+type TokenIterator struct {
+	lexer *Lexer
+	token *Token
+	err   error
+	done  bool
+}
+
+// NewTokenIterator returns an iterator over the tokens of lexer, starting at
+// its current position.
+func NewTokenIterator(lexer *Lexer) *TokenIterator {
+	return &TokenIterator{lexer: lexer}
+}
+
+// HasNext reads the next token and returns true if there was one.  The EOF
+// token is the last one returned.  After an error, HasNext returns false and
+// Err returns the error.
+func (it *TokenIterator) HasNext() bool {
+	if it.done {
+		return false
+	}
+	it.token, it.err = it.lexer.ParseToken()
+	if it.err != nil {
+		it.token = nil
+		it.done = true
+		return false
+	}
+	it.done = it.token.IsEof()
+	return true
+}
+
+// Token returns the token read by the last call to HasNext.
+func (it *TokenIterator) Token() *Token {
+	return it.token
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *TokenIterator) Err() error {
+	return it.err
+}
+
 // Eof returns true if we've reached the end of input.
 func (l *Lexer) Eof() bool {
 	return l.Pos >= l.Len
@@ -193,38 +505,114 @@ func (l *Lexer) location() Location {
 
 // errorMsg creates an error with current location.
 func (l *Lexer) errorMsg(msg string) error {
-	return l.location().Error(msg)
+	return l.errorAt(l.location(), msg)
+}
+
+// errorAt creates an error at location, showing its source line if
+// ShowSnippets is set.
+func (l *Lexer) errorAt(location Location, msg string) error {
+	if l.ShowSnippets {
+		return location.ErrorWithSnippet(msg)
+	}
+	return location.Error(msg)
 }
 
 // ============================================================================
 // WHITESPACE AND COMMENT HANDLING
 // ============================================================================
 
-// skipSpace skips whitespace and comments, but not newlines.
-func (l *Lexer) skipSpace() {
+// skipSpace skips whitespace and comments.  Newlines, which may be "\n", "\r\n"
+// or a lone "\r", are only skipped when "\n" is not a keyword in the Keytab;
+// otherwise they are returned as tokens.  Comments are not skipped if
+// KeepComments is set.  It returns the position at which the spacing on the
+// current line started.
+func (l *Lexer) skipSpace() uint32 {
+	lineStart := l.Pos
 	l.rawSkipSpace()
 	for {
-		skippedComment := false
-		if l.inputHas("//") {
+		skipped := false
+		start := l.Pos
+		if l.KeepComments && l.atComment() {
+			break
+		} else if l.inputHas("//") {
 			l.skipSingleLineComment()
+			l.collectDocComment(start)
 			l.rawSkipSpace()
-			skippedComment = true
+			skipped = true
 		} else if l.inputHas("/*") {
 			l.skipBlockComment()
+			l.collectDocComment(start)
+			l.rawSkipSpace()
+			skipped = true
+		} else if length := l.newlineLength(); length != 0 && l.Keytab.Lookup("\n") == nil {
+			l.Pos += length
+			l.Line++
+			l.midLine = false
+			lineStart = l.Pos
 			l.rawSkipSpace()
-			skippedComment = true
+			skipped = true
 		}
-		if !skippedComment {
+		if !skipped {
 			break
 		}
 	}
+	return lineStart
+}
+
+// atComment returns true if a comment starts at Pos.
+func (l *Lexer) atComment() bool {
+	return l.inputHas("//") || l.inputHas("/*")
+}
+
+// parseComment returns the comment at Pos as a TokenTypeComment token, whose
+// value is the comment's text, including the comment markers.  The token is
+// located on the comment's first line.
+func (l *Lexer) parseComment() *Token {
+	startLine := l.Line
+	if l.inputHas("//") {
+		l.skipSingleLineComment()
+	} else {
+		l.skipBlockComment()
+	}
+	l.collectDocComment(l.StartPos)
+	text := l.Filepath.Text[l.StartPos:l.Pos]
+	location := NewLocation(l.Filepath, l.StartPos, l.Pos-l.StartPos, startLine)
+	return NewToken(l, TokenTypeComment, location, nil, NewValue(text))
+}
+
+// newlineLength returns the length of the newline at Pos, which is 2 for
+// "\r\n", 1 for "\n" or a lone "\r", and 0 if there is no newline.
+func (l *Lexer) newlineLength() uint32 {
+	if l.inputHas("\r\n") {
+		return 2
+	}
+	if l.inputHas("\n") || l.inputHas("\r") {
+		return 1
+	}
+	return 0
+}
+
+// endsLine returns true if the character at Pos is the last of a newline, so
+// that "\r\n" is only counted once.
+func (l *Lexer) endsLine() bool {
+	c := l.Filepath.Text[l.Pos]
+	return c == '\n' || (c == '\r' && !l.inputHas("\r\n"))
+}
+
+// parseNewline returns a "\n" keyword token for the newline of length bytes at
+// Pos.
+func (l *Lexer) parseNewline(length uint32) *Token {
+	l.Pos += length
+	l.Line++
+	l.midLine = false
+	return NewToken(l, TokenTypeKeyword, l.location(), l.Keytab.Lookup("\n"), NewValue(nil))
 }
 
 // rawSkipSpace skips just whitespace, not comments or newlines.
 func (l *Lexer) rawSkipSpace() {
 	for l.Pos < l.Len {
 		c := l.Filepath.Text[l.Pos]
-		if c == ' ' || c == '\r' || c == '\t' {
+		if c == ' ' || c == '\t' {
 			l.Pos++
 		} else {
 			break
@@ -236,7 +624,7 @@ func (l *Lexer) rawSkipSpace() {
 func (l *Lexer) skipSingleLineComment() {
 	for l.Pos < l.Len {
 		c := l.Filepath.Text[l.Pos]
-		if c != '\n' {
+		if c != '\n' && c != '\r' {
 			l.Pos++
 		} else {
 			break
@@ -244,25 +632,81 @@ func (l *Lexer) skipSingleLineComment() {
 	}
 }
 
-// skipBlockComment skips nested block comments.
-// They can be nested, so we maintain a depth counter.
+// skipBlockComment skips block comments, counting the lines they span.
+// They can be nested, so we maintain a depth counter, unless
+// NestedBlockComments is cleared.
 func (l *Lexer) skipBlockComment() {
 	depth := 1
 	l.Pos += 2 // Skip the "/*"
 
 	for l.Pos < l.Len && depth != 0 {
-		if l.inputHas("/*") {
+		if l.NestedBlockComments && l.inputHas("/*") {
 			depth++
 			l.Pos += 2
 		} else if l.inputHas("*/") {
 			depth--
 			l.Pos += 2
 		} else {
+			if l.endsLine() {
+				l.Line++
+			}
 			l.Pos++
 		}
 	}
 }
 
+// collectDocComment records the comment just skipped from start to Pos if it
+// is a doc comment.  A "///" line comment is added to the pending doc comment,
+// unless a blank line separates it from the previous one, and a "/** */" block
+// comment replaces it.  Any other comment discards the pending doc comment.
+func (l *Lexer) collectDocComment(start uint32) {
+	text := l.Filepath.Text[start:l.Pos]
+	if strings.HasPrefix(text, "///") && !strings.HasPrefix(text, "////") {
+		if len(l.docLines) != 0 && l.Line > l.docLine+1 {
+			l.docLines = nil
+		}
+		line := strings.TrimPrefix(text[3:], " ")
+		l.docLines = append(l.docLines, strings.TrimRight(line, " \t\r"))
+	} else if strings.HasPrefix(text, "/**") && !strings.HasPrefix(text, "/**/") &&
+		!strings.HasPrefix(text, "/***") && strings.HasSuffix(text, "*/") && len(text) >= 5 {
+		l.docLines = nil
+		for _, line := range strings.Split(text[3:len(text)-2], "\n") {
+			line = strings.TrimSpace(line)
+			if line != "*" {
+				line = strings.TrimPrefix(line, "* ")
+			} else {
+				line = ""
+			}
+			l.docLines = append(l.docLines, line)
+		}
+		for len(l.docLines) != 0 && l.docLines[0] == "" {
+			l.docLines = l.docLines[1:]
+		}
+		for len(l.docLines) != 0 && l.docLines[len(l.docLines)-1] == "" {
+			l.docLines = l.docLines[:len(l.docLines)-1]
+		}
+	} else {
+		l.docLines = nil
+	}
+	l.docLine = l.Line
+}
+
+// takeDocComment returns the pending doc comment for token and clears it.  The
+// newline and comment tokens between "///" lines do not take it, and a doc
+// comment followed by a blank line is not attached to anything.
+func (l *Lexer) takeDocComment(token *Token) string {
+	if len(l.docLines) == 0 || token.IsKeyword("\n") || token.Type == TokenTypeComment ||
+		token.Type == TokenTypeIndent || token.Type == TokenTypeDedent {
+		return ""
+	}
+	docComment := ""
+	if token.Type != TokenTypeEof && token.Location.Line <= l.docLine+1 {
+		docComment = strings.Join(l.docLines, "\n")
+	}
+	l.docLines = nil
+	return docComment
+}
+
 // inputHas returns true if the input at current Pos starts with text.
 func (l *Lexer) inputHas(text string) bool {
 	if l.Pos+uint32(len(text)) > l.Len {
@@ -283,9 +727,15 @@ func (l *Lexer) isValidIdentChar(char Char) bool {
 }
 
 // parseString parses a quoted string, handling escape sequences.
-// target is the quote character (' or ")
+// target is the quote character (' or ").  A string without escapes is sliced
+// from the input, and one with escapes is built as it is read.
 func (l *Lexer) parseString(target uint8) (*Token, error) {
-	s := ""
+	if target == '"' && l.inputHas(`""`) {
+		return l.parseRawString()
+	}
+	start := l.Pos
+	var builder strings.Builder
+	escaped := false
 
 	for {
 		if l.Eof() {
@@ -298,17 +748,23 @@ func (l *Lexer) parseString(target uint8) (*Token, error) {
 			break
 		}
 		if c == '\\' {
-			escapedChar, err := l.readEscapedChar(target == '\'')
+			if !escaped {
+				builder.WriteString(l.Filepath.Text[start:char.Pos])
+				escaped = true
+			}
+			escapedChar, err := l.readEscapedChar()
 			if err != nil {
 				return nil, err
 			}
-			s += string(escapedChar)
-		} else {
-			for i := char.Pos; i < char.Pos+uint32(char.Len); i++ {
-				s += string(l.Filepath.Text[i])
-			}
+			builder.WriteRune(rune(escapedChar))
+		} else if escaped {
+			builder.WriteString(l.Filepath.Text[char.Pos : char.Pos+uint32(char.Len)])
 		}
 	}
+	s := l.Filepath.Text[start : l.Pos-1]
+	if escaped {
+		s = builder.String()
+	}
 
 	token := NewValueToken(l, s, l.location())
 	if l.UseWeakStrings && target == '\'' {
@@ -317,9 +773,37 @@ func (l *Lexer) parseString(target uint8) (*Token, error) {
 	return token, nil
 }
 
-// readEscapedChar reads the character after a backslash.
-// singleQuotes indicates if we're in single quotes (for escape validation).
-func (l *Lexer) readEscapedChar(singleQuotes bool) (uint8, error) {
+// parseRawString parses a """ raw string, whose value is the text up to the
+// closing """, verbatim.  It may contain newlines and lone quotes, and
+// backslashes are not escapes.  The token is located on its first line.
+func (l *Lexer) parseRawString() (*Token, error) {
+	startLine := l.Line
+	l.Pos += 2 // Skip the rest of the opening """
+	start := l.Pos
+	for !l.inputHas(`"""`) {
+		if l.Eof() {
+			location := NewLocation(l.Filepath, l.StartPos, l.Pos-l.StartPos, startLine)
+			return nil, l.errorAt(location, "End of file while reading string")
+		}
+		if l.endsLine() {
+			l.Line++
+		}
+		l.Pos++
+	}
+	s := l.Filepath.Text[start:l.Pos]
+	l.Pos += 3
+	location := NewLocation(l.Filepath, l.StartPos, l.Pos-l.StartPos, startLine)
+	return NewValueToken(l, s, location), nil
+}
+
+// readEscapedChar reads the character after a backslash.  The same escapes are
+// valid in single and double quotes, so either quote can be escaped in both.
+// Errors are located at the escape sequence, rather than the whole literal.
+func (l *Lexer) readEscapedChar() (uint8, error) {
+	start := l.Pos - 1 // The backslash
+	if l.Eof() {
+		return 0, l.escapeError(start, "End of file in escape sequence")
+	}
 	char := l.readChar()
 	c := l.Filepath.Text[char.Pos]
 
@@ -343,25 +827,31 @@ func (l *Lexer) readEscapedChar(singleQuotes bool) (uint8, error) {
 	case '\\':
 		return '\\', nil
 	case '"':
-		if !singleQuotes {
-			return '"', nil
-		}
+		return '"', nil
 	case '\'':
-		if singleQuotes {
-			return '\'', nil
-		}
+		return '\'', nil
 	case '0':
 		return 0, nil
 	case 'x':
-		hi := l.readChar()
-		lo := l.readChar()
-		if !IsHexDigit(l.Filepath.Text[hi.Pos]) || !IsHexDigit(l.Filepath.Text[lo.Pos]) {
-			return 0, l.errorMsg("Non-hex digit in hexadecimal escape sequence")
+		if l.Pos+2 > l.Len {
+			l.Pos = l.Len
+			return 0, l.escapeError(start, "End of file in hexadecimal escape sequence")
 		}
-		return HexToChar(l.Filepath.Text[hi.Pos], l.Filepath.Text[lo.Pos]), nil
+		l.Pos += 2
+		value, err := hexToChar(l.Filepath.Text[l.Pos-2], l.Filepath.Text[l.Pos-1])
+		if err != nil {
+			return 0, l.escapeError(start, "Non-hex digit in hexadecimal escape sequence")
+		}
+		return value, nil
 	}
 
-	return 0, l.errorMsg("Invalid escape sequence")
+	return 0, l.escapeError(start, "Invalid escape sequence")
+}
+
+// escapeError returns an error located at the escape sequence from start to
+// Pos.
+func (l *Lexer) escapeError(start uint32, msg string) error {
+	return l.errorAt(NewLocation(l.Filepath, start, l.Pos-start, l.Line), msg)
 }
 
 // parseAsciiChar returns a single-quoted character as a u8 integer token.
@@ -377,7 +867,7 @@ func (l *Lexer) parseAsciiChar() (*Token, error) {
 
 	c := l.Filepath.Text[char.Pos]
 	if c == '\\' {
-		escapedChar, err := l.readEscapedChar(true)
+		escapedChar, err := l.readEscapedChar()
 		if err != nil {
 			return nil, err
 		}
@@ -390,8 +880,83 @@ func (l *Lexer) parseAsciiChar() (*Token, error) {
 	return NewValueToken(l, uint8(c), l.location()), nil
 }
 
+// parseCharClass parses a grammar character class such as [a-z] or [^\]].
+// Inside the brackets, \], \[, \-, \^ and the usual string escapes may be
+// used.
+func (l *Lexer) parseCharClass() (*Token, error) {
+	class := &CharClass{}
+	if l.inputHas("^") {
+		class.Negated = true
+		l.Pos++
+	}
+	for {
+		lo, done, err := l.readCharClassRune()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+		hi := lo
+		if l.inputHas("-") && !l.inputHas("-]") {
+			l.Pos++
+			hi, done, err = l.readCharClassRune()
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				return nil, l.errorMsg("Missing end of character class range")
+			}
+			if hi < lo {
+				return nil, l.errorMsg("Character class range is reversed")
+			}
+		}
+		class.Ranges = append(class.Ranges, CharRange{lo, hi})
+	}
+	if len(class.Ranges) == 0 {
+		return nil, l.errorMsg("Empty character class")
+	}
+	return NewToken(l, TokenTypeCharClass, l.location(), nil, NewValue(class)), nil
+}
+
+// readCharClassRune reads one possibly escaped rune in a character class.
+// done is set when the closing ']' is read instead.
+func (l *Lexer) readCharClassRune() (r rune, done bool, err error) {
+	if l.Eof() || l.newlineLength() != 0 {
+		return 0, false, l.errorMsg("End of line while reading character class")
+	}
+	char := l.readChar()
+	if err := l.checkCharValid(char); err != nil {
+		return 0, false, err
+	}
+	c := l.Filepath.Text[char.Pos]
+	if c == ']' {
+		return 0, true, nil
+	}
+	if c != '\\' {
+		r, _ := utf8.DecodeRuneInString(l.Filepath.Text[char.Pos : char.Pos+uint32(char.Len)])
+		return r, false, nil
+	}
+	if l.Eof() {
+		return 0, false, l.errorMsg("End of file while reading character class")
+	}
+	switch l.Filepath.Text[l.Pos] {
+	case ']', '[', '-', '^':
+		l.Pos++
+		return rune(l.Filepath.Text[l.Pos-1]), false, nil
+	}
+	escapedChar, err := l.readEscapedChar()
+	if err != nil {
+		return 0, false, err
+	}
+	return rune(escapedChar), false, nil
+}
+
 // expectChar reads a character and returns an error if it doesn't match expected.
 func (l *Lexer) expectChar(expectedChar uint8) error {
+	if l.Eof() {
+		return l.errorMsg(fmt.Sprintf("Expected %s, got end of file", string(expectedChar)))
+	}
 	char := l.readChar()
 	c := l.Filepath.Text[char.Pos]
 	if c != expectedChar {
@@ -404,7 +969,9 @@ func (l *Lexer) expectChar(expectedChar uint8) error {
 // NUMBER PARSING
 // ============================================================================
 
-// parseNumber parses numeric literals (integers or floats).
+// parseNumber parses numeric literals (integers or floats).  A letter after the
+// number that does not start an exponent or a width suffix is left for the next
+// token, so 10px is the integer 10 followed by the identifier px.
 func (l *Lexer) parseNumber() (*Token, error) {
 	l.Pos-- // Rewind to start
 
@@ -412,21 +979,68 @@ func (l *Lexer) parseNumber() (*Token, error) {
 	
 	// Check if we're at end of file
 	if l.Pos >= l.Len {
-		return l.parseIntegerSuffix(intVal)
+		return l.parseIntegerSuffix(intVal, 10)
 	}
 	
 	c := l.Filepath.Text[l.Pos]
 
-	if c == '.' || c == 'f' || c == 'e' || c == 'E' {
-		return l.parseFloat(intVal)
+	if c == '.' || l.atFloatWidth() || l.atExponent() {
+		return l.parseFloat()
 	}
 
+	radix := 10
 	if c == 'x' && l.Pos == l.StartPos+1 && l.Filepath.Text[l.StartPos] == '0' {
 		l.Pos++
 		intVal = l.parseHexInteger()
+		radix = 16
 	}
 
-	return l.parseIntegerSuffix(intVal)
+	return l.parseIntegerSuffix(intVal, radix)
+}
+
+// atNegativeNumber returns true if the '-' just read starts a negative number:
+// AllowNegativeNumberLiterals is set, a digit follows it, and it does not
+// follow a value, which it would be subtracted from.
+func (l *Lexer) atNegativeNumber() bool {
+	if !l.AllowNegativeNumberLiterals || l.Pos >= l.Len || !IsDigit(l.Filepath.Text[l.Pos]) {
+		return false
+	}
+	for i := len(l.Tokens) - 1; i >= 0; i-- {
+		token := l.Tokens[i]
+		switch token.Type {
+		case TokenTypeComment, TokenTypeIndent, TokenTypeDedent:
+			continue
+		case TokenTypeKeyword:
+			name := token.Keyword.Sym.Name
+			return name != ")" && name != "]" && name != "}"
+		}
+		return false
+	}
+	return true
+}
+
+// parseNegativeNumber parses a number after a '-', and negates it.
+func (l *Lexer) parseNegativeNumber() (*Token, error) {
+	minusPos := l.StartPos
+	l.StartPos = l.Pos
+	l.Pos++ // parseNumber rewinds to the first digit
+	l.negative = true
+	token, err := l.parseNumber()
+	l.negative = false
+	if err != nil {
+		return nil, err
+	}
+	switch value := token.Value.Val.(type) {
+	case *big.Int:
+		// parseIntegerSuffix checked the width of the negated value
+		value.Neg(value)
+	case float64:
+		token.Value = NewValue(-value)
+		token.BigFloat.Neg(token.BigFloat)
+	}
+	l.StartPos = minusPos
+	token.Location = l.location()
+	return token, nil
 }
 
 // parseRawInteger parses an integer without width spec.
@@ -456,26 +1070,29 @@ func (l *Lexer) parseHexInteger() *big.Int {
 
 	for l.Pos < l.Len {
 		c := l.Filepath.Text[l.Pos]
-		if IsHexDigit(c) || c == '_' {
-			if c != '_' {
-				intVal.Lsh(intVal, 4)
-				intVal.Or(intVal, big.NewInt(int64(HexDigit(c))))
+		if c != '_' {
+			digit, err := hexDigit(c)
+			if err != nil {
+				break
 			}
-			l.Pos++
-		} else {
-			break
+			intVal.Lsh(intVal, 4)
+			intVal.Or(intVal, big.NewInt(int64(digit)))
 		}
+		l.Pos++
 	}
 
 	return intVal
 }
 
-// parseIntegerSuffix handles integer width specifiers (e.g., u32, i64).
-func (l *Lexer) parseIntegerSuffix(intVal *big.Int) (*Token, error) {
+// parseIntegerSuffix handles integer width specifiers (e.g., u32, i64), and
+// returns the token for an integer literal written in radix.
+func (l *Lexer) parseIntegerSuffix(intVal *big.Int, radix int) (*Token, error) {
 	// Check if we're at end of file
 	if l.Pos >= l.Len {
 		// No suffix, just return the integer
-		return NewValueToken(l, intVal, l.location()), nil
+		token := NewValueToken(l, intVal, l.location())
+		token.IntRadix = radix
+		return token, nil
 	}
 
 	c := l.Filepath.Text[l.Pos]
@@ -490,11 +1107,40 @@ func (l *Lexer) parseIntegerSuffix(intVal *big.Int) (*Token, error) {
 		if width == 0 {
 			// Width spec parsing failed, restore position and continue
 			l.Pos = savedPos - 1 // Go back to the 'u' or 'i'
+		} else {
+			signed := c == 'i'
+			value := intVal
+			if l.negative {
+				value = new(big.Int).Neg(intVal)
+			}
+			if !intFitsWidth(value, width, signed) {
+				return nil, l.errorMsg(fmt.Sprintf("Integer %v does not fit in %c%d", value, c, width))
+			}
+			token := NewValueToken(l, intVal, l.location())
+			token.IntWidth = width
+			token.IntSigned = signed
+			token.IntRadix = radix
+			return token, nil
 		}
 	}
 
-	// For now, just store the Bigint as-is; type checking happens later
-	return NewValueToken(l, intVal, l.location()), nil
+	token := NewValueToken(l, intVal, l.location())
+	token.IntRadix = radix
+	return token, nil
+}
+
+// intFitsWidth returns true if intVal fits in an integer of width bits: from 0
+// to 2^width-1 if unsigned, or from -2^(width-1) to 2^(width-1)-1 if signed.
+func intFitsWidth(intVal *big.Int, width uint32, signed bool) bool {
+	if !signed {
+		return intVal.Sign() >= 0 && intVal.BitLen() <= int(width)
+	}
+	if intVal.Sign() < 0 {
+		// -2^(width-1) is the only value whose magnitude needs width bits
+		magnitude := new(big.Int).Neg(intVal)
+		return magnitude.Sub(magnitude, big.NewInt(1)).BitLen() <= int(width-1)
+	}
+	return intVal.BitLen() <= int(width-1)
 }
 
 // parseWidthSpec parses a width specifier (e.g., the "32" in "u32").
@@ -529,41 +1175,26 @@ func (l *Lexer) parseWidthSpec() (uint32, error) {
 	return uint32(newWidth.Int64()), nil
 }
 
-// parseFloat parses floating point numbers.
-func (l *Lexer) parseFloat(intVal *big.Int) (*Token, error) {
-	fracVal := big.NewInt(0)
+// parseFloat parses floating point numbers.  The integer part has already
+// been read.
+func (l *Lexer) parseFloat() (*Token, error) {
 	width := uint32(64)
-	exp := int32(0)
-	fracDigits := uint32(0)
-
-	c := l.Filepath.Text[l.Pos]
 
-	if c == '.' {
+	if l.Filepath.Text[l.Pos] == '.' {
 		l.Pos++
-		fracDigits = l.countDigits()
-		fracVal = l.parseRawInteger()
-		c = l.Filepath.Text[l.Pos]
+		l.parseRawInteger()
 	}
 
-	if c == 'e' || c == 'E' {
+	if l.atExponent() {
 		l.Pos++
-		negateExp := false
-		if l.Pos < l.Len && l.Filepath.Text[l.Pos] == '-' {
+		if l.Filepath.Text[l.Pos] == '-' {
 			l.Pos++
-			negateExp = true
 		}
-		if l.Pos >= l.Len || !IsDigit(l.Filepath.Text[l.Pos]) {
-			return nil, l.errorMsg("Missing exponent after 'e' in floating point number")
-		}
-		expVal := l.parseRawInteger()
-		exp = int32(expVal.Int64())
-		if negateExp {
-			exp = -exp
-		}
-		c = l.Filepath.Text[l.Pos]
+		l.parseRawInteger()
 	}
+	text := l.Filepath.Text[l.StartPos:l.Pos]
 
-	if c == 'f' {
+	if l.atFloatWidth() {
 		l.Pos++
 		widthVal := l.parseRawInteger()
 		width = uint32(widthVal.Int64())
@@ -572,52 +1203,63 @@ func (l *Lexer) parseFloat(intVal *big.Int) (*Token, error) {
 		}
 	}
 
-	return l.buildFloatToken(intVal, fracVal, fracDigits, exp, width), nil
-}
-
-// buildFloatToken constructs a float token from components.
-func (l *Lexer) buildFloatToken(intVal, fracVal *big.Int, fracDigits uint32, exp int32, width uint32) *Token {
-	intFloat := float64(intVal.Int64())
-	fracFloat := float64(fracVal.Int64())
-
-	val := intFloat + fracFloat/pow(10.0, float64(fracDigits))
-	val *= pow(10.0, float64(exp))
-
-	return NewValueToken(l, val, l.location())
+	return l.buildFloatToken(text, width)
 }
 
-// pow computes base^exp for floats.
-func pow(base, expVal float64) float64 {
-	result := 1.0
-	invert := expVal < 0
-	exp := int64(expVal)
-	if invert {
-		exp = -exp
-	}
-	for i := int64(0); i < exp; i++ {
-		result *= base
+// atExponent returns true if the input at Pos is an exponent, such as e10 or
+// E-3.
+func (l *Lexer) atExponent() bool {
+	if l.Pos >= l.Len || (l.Filepath.Text[l.Pos] != 'e' && l.Filepath.Text[l.Pos] != 'E') {
+		return false
 	}
-	if invert {
-		return 1.0 / result
+	pos := l.Pos + 1
+	if pos < l.Len && l.Filepath.Text[pos] == '-' {
+		pos++
 	}
-	return result
+	return pos < l.Len && IsDigit(l.Filepath.Text[pos])
+}
+
+// atFloatWidth returns true if the input at Pos is a float width suffix, such
+// as f32.
+func (l *Lexer) atFloatWidth() bool {
+	return l.Pos+1 < l.Len && l.Filepath.Text[l.Pos] == 'f' && IsDigit(l.Filepath.Text[l.Pos+1])
 }
 
-// countDigits counts consecutive digits starting at current Pos.
-func (l *Lexer) countDigits() uint32 {
-	numDigits := uint32(0)
-	for l.Pos+numDigits < l.Len && IsDigit(l.Filepath.Text[l.Pos+numDigits]) {
-		numDigits++
+// bigFloatPrec is the precision in bits of FLOAT token's BigFloat values.  It
+// is far more than float64 has, so literals with more digits than float64 can
+// hold keep them.
+const bigFloatPrec = 512
+
+// buildFloatToken constructs a float token from the text of a literal, such as
+// 1_000.5e-3, without its width suffix.  The value is the literal correctly
+// rounded to width bits by strconv.ParseFloat, since rounding the BigFloat
+// would round twice.
+func (l *Lexer) buildFloatToken(text string, width uint32) (*Token, error) {
+	text = strings.ReplaceAll(text, "_", "")
+	val, err := strconv.ParseFloat(text, int(width))
+	if err != nil {
+		return nil, l.errorMsg("Floating point number out of range")
+	}
+	bigFloat, _, err := big.ParseFloat(text, 10, bigFloatPrec, big.ToNearestEven)
+	if err != nil {
+		return nil, l.errorMsg("Floating point number out of range")
 	}
-	return numDigits
+	token := NewValueToken(l, val, l.location())
+	token.BigFloat = bigFloat
+	return token, nil
 }
 
 // ============================================================================
 // IDENTIFIER PARSING
 // ============================================================================
 
-// parseEscapedIdent parses an identifier starting with backslash.
+// parseEscapedIdent parses an identifier starting with backslash.  Its name is
+// everything up to the next whitespace, or in the \{...} form, any characters
+// but newlines up to the closing brace.
 func (l *Lexer) parseEscapedIdent() (*Token, error) {
+	if l.Pos < l.Len && l.Filepath.Text[l.Pos] == '{' {
+		return l.parseBracedIdent()
+	}
 	l.StartPos = l.Pos // Don't include the backslash in the name
 	for l.Pos < l.Len {
 		char := l.readChar()
@@ -628,7 +1270,31 @@ func (l *Lexer) parseEscapedIdent() (*Token, error) {
 		}
 	}
 	name := l.Filepath.Text[l.StartPos:l.Pos]
-	return NewValueToken(l, NewSym(name), l.location()), nil
+	return NewValueToken(l, l.newSym(name), l.location()), nil
+}
+
+// parseBracedIdent parses the \{...} form of an escaped identifier, with Pos
+// at the opening brace.
+func (l *Lexer) parseBracedIdent() (*Token, error) {
+	l.Pos++
+	nameStart := l.Pos
+	for {
+		if l.Pos >= l.Len || l.endsLine() {
+			return nil, l.errorMsg("Unterminated escaped identifier")
+		}
+		char := l.readChar()
+		if err := l.checkCharValid(char); err != nil {
+			return nil, err
+		}
+		if l.Filepath.Text[char.Pos] == '}' {
+			break
+		}
+	}
+	name := l.Filepath.Text[nameStart : l.Pos-1]
+	if name == "" {
+		return nil, l.errorMsg("Empty escaped identifier")
+	}
+	return NewValueToken(l, l.newSym(name), l.location()), nil
 }
 
 // tryToParseUintIntOrRandType tries to parse tokens like u32, i64, rand256.
@@ -681,13 +1347,28 @@ func (l *Lexer) readIdentOrKeyword() (*Token, error) {
 	}
 
 	name := l.Filepath.Text[l.StartPos:l.Pos]
-	keyword := l.Keytab.Lookup(name)
+	var keyword *Keyword
+	if l.IgnoreKeywordCase {
+		keyword = l.Keytab.Lookup(lowerAscii(name))
+	} else {
+		keyword = l.Keytab.Lookup(name)
+	}
 
 	if keyword != nil {
 		return NewToken(l, TokenTypeKeyword, l.location(), keyword, NewValue(nil)), nil
 	}
 
-	return NewValueToken(l, NewSym(name), l.location()), nil
+	return NewValueToken(l, l.newSym(name), l.location()), nil
+}
+
+// lowerAscii returns name with ASCII letters converted to lowercase.  Other
+// characters, including UTF-8 encoded ones, are unchanged.
+func lowerAscii(name string) string {
+	lower := []byte(name)
+	for i, c := range lower {
+		lower[i] = Lower(c)
+	}
+	return string(lower)
 }
 
 // parseNonAlphaKeyword tries to parse operators and punctuation (up to 4 characters).
@@ -696,10 +1377,6 @@ func (l *Lexer) parseNonAlphaKeyword(char Char) (*Token, error) {
 		l.Pos = l.StartPos
 		keyword := l.tryNonAlphaKeyword(uint64(i))
 		if keyword != nil {
-			// Check if it's a newline
-			if i == 1 && keyword.Sym.Name == "\n" {
-				l.Line++
-			}
 			return NewToken(l, TokenTypeKeyword, l.location(), keyword, NewValue(nil)), nil
 		}
 	}
@@ -726,6 +1403,18 @@ func (l *Lexer) EnableIdentUnderscores(value bool) {
 }
 
 // EnableWeakStrings enables single-quoted strings as weak strings.
+// Weak strings are a grammar-only concept: the Peg enables them on the lexer
+// for .syn files, where 'x' is a keyword that is left out of the parse tree.
+// Lexers for input files leave them disabled, so 'x' is always a character
+// literal, returned as an INTEGER token holding the character's value.
 func (l *Lexer) EnableWeakStrings(value bool) {
 	l.UseWeakStrings = value
 }
+
+// EnableIgnoreKeywordCase makes identifiers match keywords regardless of the
+// case of their ASCII letters, so WHILE and While match the keyword while.
+// Keywords must be lowercase to be matched.  The token's text keeps the case
+// it had in the input.
+func (l *Lexer) EnableIgnoreKeywordCase(value bool) {
+	l.IgnoreKeywordCase = value
+}
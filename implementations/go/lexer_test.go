@@ -16,6 +16,8 @@ package parser
 
 import (
 	"math/big"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -111,6 +113,97 @@ func TestParseEscapedCharsTest(t *testing.T) {
 	}
 }
 
+func TestRawStringTest(t *testing.T) {
+	lexer := newLexer("\"\"\"a \"quoted\" \\n\nline \"\"two\"\"\" x \"\"\"\"\"\"")
+	token, err := lexer.ParseToken()
+	if err != nil {
+		t.Fatalf("Failed to parse raw string: %v", err)
+	}
+	expected := "a \"quoted\" \\n\nline \"\"two"
+	if token.Type != TokenTypeString || token.Value.Val.(string) != expected {
+		t.Errorf("Expected string %q, got %v %q", expected, token.Type, token.Value.Val)
+	}
+	if token.Location.Line != 1 || lexer.Line != 2 {
+		t.Errorf("Expected the string on line 1 and the lexer on line 2, got %d and %d",
+			token.Location.Line, lexer.Line)
+	}
+	token, err = lexer.ParseToken()
+	if err != nil || token.Type != TokenTypeIdent {
+		t.Fatalf("Expected an identifier after the raw string, got %v, %v", token, err)
+	}
+	token, err = lexer.ParseToken()
+	if err != nil || token.Type != TokenTypeString || token.Value.Val.(string) != "" {
+		t.Errorf("Expected an empty raw string, got %v, %v", token, err)
+	}
+
+	lexer = newLexer("x\n\"\"\"unterminated \"\"\n")
+	lexer.Keytab.New("x")
+	for i := 0; i < 2; i++ {
+		if _, err := lexer.ParseToken(); err != nil {
+			t.Fatalf("Token %d: failed to parse: %v", i, err)
+		}
+	}
+	token, err = lexer.ParseToken()
+	if err == nil {
+		t.Fatalf("Expected an error for an unterminated raw string, got %v", token)
+	}
+	if err.Error() != "testdata/test:2: End of file while reading string" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestAllTokensTest(t *testing.T) {
+	lexer := newLexer("a 1\nb")
+	tokens, err := lexer.AllTokens()
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	if len(tokens) != 6 || !tokens[5].IsEof() {
+		t.Fatalf("Expected 6 tokens ending with EOF, got %d", len(tokens))
+	}
+
+	lexer = newLexer("a 1 @ b")
+	tokens, err = lexer.AllTokens()
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown character, got %d tokens", len(tokens))
+	}
+	if len(tokens) != 2 {
+		t.Errorf("Expected the 2 tokens before the error, got %d", len(tokens))
+	}
+}
+
+func TestTokenIteratorTest(t *testing.T) {
+	iter := NewTokenIterator(newLexer("a \"b\" 3"))
+	var types []TokenType
+	for iter.HasNext() {
+		types = append(types, iter.Token().Type)
+	}
+	if iter.Err() != nil {
+		t.Fatalf("Unexpected error: %v", iter.Err())
+	}
+	expected := []TokenType{TokenTypeIdent, TokenTypeString, TokenTypeInteger, TokenTypeKeyword, TokenTypeEof}
+	if len(types) != len(expected) {
+		t.Fatalf("Expected token types %v, got %v", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Errorf("Token %d: expected %v, got %v", i, expected[i], types[i])
+		}
+	}
+	if iter.HasNext() {
+		t.Errorf("HasNext should be false after EOF")
+	}
+
+	iter = NewTokenIterator(newLexer("a @"))
+	count := 0
+	for iter.HasNext() {
+		count++
+	}
+	if count != 1 || iter.Err() == nil || iter.Token() != nil {
+		t.Errorf("Expected 1 token then an error, got %d tokens and error %v", count, iter.Err())
+	}
+}
+
 func TestBadInputTest(t *testing.T) {
 	// Test overlong encoding of '\0' - should return an error
 	filepath := NewFilepath("testdata/test", nil, false)
@@ -165,6 +258,95 @@ func TestParseEscapedSingleQuotedCharsTest(t *testing.T) {
 	}
 }
 
+func TestWeakStringsTest(t *testing.T) {
+	lexer := newLexer("'a' 'if' \"if\"")
+	lexer.EnableWeakStrings(true)
+	expTypes := []TokenType{TokenTypeWeakString, TokenTypeWeakString, TokenTypeString}
+	expRes := []string{"a", "if", "if"}
+
+	for i, expected := range expRes {
+		token, err := lexer.ParseToken()
+		if err != nil {
+			t.Fatalf("Token %d: failed to parse: %v", i, err)
+		}
+		if token.Type != expTypes[i] {
+			t.Errorf("Token %d: expected %v, got %v", i, expTypes[i], token.Type)
+			continue
+		}
+		if !token.IsValue(expected) {
+			t.Errorf("Token %d: expected %s, got %v", i, expected, token.Value.Val)
+		}
+	}
+
+	// Without weak strings, 'a' is a character literal.
+	lexer = newLexer("'a'")
+	token, err := lexer.ParseToken()
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	if token.Type != TokenTypeInteger || !token.IsValue(uint8('a')) {
+		t.Errorf("Expected 'a' to be the integer 97, got %v %v", token.Type, token.Value.Val)
+	}
+}
+
+func TestCharClassTest(t *testing.T) {
+	lexer := newLexer(`[a-z] [^0-9A-F] [\]\-_] [\x41-\x43\n]`)
+	lexer.EnableWeakStrings(true)
+	expRes := []string{"[a-z]", "[^0-9A-F]", "[\\]\\-_]", "[A-C\\n]"}
+
+	for i, expected := range expRes {
+		token, err := lexer.ParseToken()
+		if err != nil {
+			t.Fatalf("Token %d: failed to parse: %v", i, err)
+		}
+		if token.Type != TokenTypeCharClass {
+			t.Errorf("Token %d: expected TokenTypeCharClass, got %v", i, token.Type)
+			continue
+		}
+		class := token.Value.Val.(*CharClass)
+		if class.ToString() != expected {
+			t.Errorf("Token %d: expected %s, got %s", i, expected, class.ToString())
+		}
+	}
+
+	for _, bad := range []string{"[]", "[z-a]", "[a-", "[abc"} {
+		lexer := newLexer(bad)
+		lexer.EnableWeakStrings(true)
+		if _, err := lexer.ParseToken(); err == nil {
+			t.Errorf("Expected error for %s", bad)
+		}
+	}
+}
+
+func TestIgnoreKeywordCaseTest(t *testing.T) {
+	for _, ignoreCase := range []bool{true, false} {
+		lexer := newLexer("while WHILE While wHiLe whilé WHILÉ")
+		while := createKeyword(lexer.Keytab, "while")
+		createKeyword(lexer.Keytab, "whilé")
+		lexer.EnableIgnoreKeywordCase(ignoreCase)
+		expRes := []string{"while", "WHILE", "While", "wHiLe", "whilé", "WHILÉ"}
+
+		for i, expected := range expRes {
+			token, err := lexer.ParseToken()
+			if err != nil {
+				t.Fatalf("Token %d: failed to parse: %v", i, err)
+			}
+			if token.GetName() != expected {
+				t.Errorf("Token %d: expected name %s, got %s", i, expected, token.GetName())
+			}
+			// The É is not ASCII, so it never matches é.
+			isKeyword := i == 0 || i == 4 || (ignoreCase && i < 4)
+			if isKeyword != (token.Type == TokenTypeKeyword) {
+				t.Errorf("ignoreCase=%v: token %d '%s': expected keyword %v, got %v",
+					ignoreCase, i, expected, isKeyword, token.Type)
+			}
+			if isKeyword && i < 4 && token.Keyword != while {
+				t.Errorf("Token %d: expected keyword while", i)
+			}
+		}
+	}
+}
+
 func TestParseIntegerTest(t *testing.T) {
 	lexer := newLexer("0 1u2 3i3 57896044618658097711785492504343953926634992332820282019728792003956564819949u256")
 	expRes := []string{
@@ -203,6 +385,68 @@ func TestParseIntegerTest(t *testing.T) {
 	}
 }
 
+func TestIntegerWidthOverflowTest(t *testing.T) {
+	tests := []struct {
+		text   string
+		err    string
+		width  uint32
+		signed bool
+	}{
+		{"255u8", "", 8, false},
+		{"256u8", "Integer 256 does not fit in u8", 0, false},
+		{"127i8", "", 8, true},
+		{"128i8", "Integer 128 does not fit in i8", 0, false},
+		{"0xffffu16", "", 16, false},
+		{"0x10000u16", "Integer 65536 does not fit in u16", 0, false},
+		{"300", "", 0, false},
+	}
+	for _, test := range tests {
+		token, err := newLexer(test.text).ParseToken()
+		if test.err != "" {
+			if err == nil || err.Error() != "testdata/test:1: "+test.err {
+				t.Errorf("%s: expected error %q, got %v", test.text, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.text, err)
+			continue
+		}
+		if token.IntWidth != test.width || token.IntSigned != test.signed {
+			t.Errorf("%s: expected width %d signed %v, got %d %v",
+				test.text, test.width, test.signed, token.IntWidth, token.IntSigned)
+		}
+	}
+}
+
+func TestIntegerLiteralFormTest(t *testing.T) {
+	lexer := newLexer("255 0xFF 10u16 0x7fi32 'a'")
+	expected := []struct {
+		width  uint32
+		signed bool
+		radix  int
+	}{
+		{0, false, 10},
+		{0, false, 16},
+		{16, false, 10},
+		{32, true, 16},
+		{0, false, 0},
+	}
+	for i, exp := range expected {
+		token, err := lexer.ParseToken()
+		if err != nil {
+			t.Fatalf("Token %d: failed to parse: %v", i, err)
+		}
+		if token.Type != TokenTypeInteger {
+			t.Fatalf("Token %d: expected TokenTypeInteger, got %v", i, token.Type)
+		}
+		if token.IntWidth != exp.width || token.IntSigned != exp.signed || token.IntRadix != exp.radix {
+			t.Errorf("Token %d: expected width %d signed %v radix %d, got %d %v %d", i,
+				exp.width, exp.signed, exp.radix, token.IntWidth, token.IntSigned, token.IntRadix)
+		}
+	}
+}
+
 func TestParseHexTest(t *testing.T) {
 	lexer := newLexer("0x0 0xau4 0x3i3 0x7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed 0xffffu256")
 	expRes := []string{
@@ -262,6 +506,154 @@ func TestParseFloatTest(t *testing.T) {
 	}
 }
 
+func TestParseFloatExactTest(t *testing.T) {
+	literals := []string{
+		"0.1", "123456789.123456789", "9007199254740993.0", "2.2250738585072011e-308",
+		"1.7976931348623157e308", "4.9e-324", "0.000001234567890123456789", "1_000.5e-3",
+		"0.3f32", "16777217.0f32",
+	}
+	lexer := newLexer(strings.Join(literals, " "))
+	for i, literal := range literals {
+		token, err := lexer.ParseToken()
+		if err != nil {
+			t.Fatalf("Token %d: failed to parse: %v", i, err)
+		}
+		bitSize := 64
+		text := strings.ReplaceAll(literal, "_", "")
+		if strings.HasSuffix(text, "f32") {
+			bitSize = 32
+			text = strings.TrimSuffix(text, "f32")
+		}
+		expected, err := strconv.ParseFloat(text, bitSize)
+		if err != nil {
+			t.Fatalf("strconv failed to parse %s: %v", text, err)
+		}
+		if token.Type != TokenTypeFloat || token.Value.Val.(float64) != expected {
+			t.Errorf("%s: expected %v, got %v", literal, expected, token.Value.Val)
+		}
+		if token.BigFloat == nil {
+			t.Errorf("%s: expected a BigFloat value", literal)
+		}
+	}
+}
+
+// TestParseFloatHalfway verifies a literal just above halfway between two
+// float64 values is rounded up, as rounding a BigFloat first would round it to
+// the halfway point, and then down to even.
+func TestParseFloatHalfway(t *testing.T) {
+	literal := "9007199254740993." + strings.Repeat("0", 200) + "1"
+	token, err := newLexer(literal).ParseToken()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if val := token.Value.Val.(float64); val != 9007199254740994 {
+		t.Errorf("Expected 9007199254740994, got %v", val)
+	}
+	if _, err := newLexer("1e400").ParseToken(); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("Expected 1e400 to be out of range, got %v", err)
+	}
+}
+
+func TestNumberUnitSuffixTest(t *testing.T) {
+	lexer := newLexer("10px 2.5em 10e2 10f32 1.5e-1s 3fr 0x1Fpx 7u8")
+	expTypes := []TokenType{
+		TokenTypeInteger, TokenTypeIdent, TokenTypeFloat, TokenTypeIdent,
+		TokenTypeFloat, TokenTypeFloat, TokenTypeFloat, TokenTypeIdent,
+		TokenTypeInteger, TokenTypeIdent, TokenTypeInteger, TokenTypeIdent,
+		TokenTypeInteger,
+	}
+	expNames := []string{"10", "px", "2.5", "em", "10e2", "10f32", "1.5e-1", "s", "3", "fr", "0x1F", "px", "7u8"}
+
+	for i, expType := range expTypes {
+		token, err := lexer.ParseToken()
+		if err != nil {
+			t.Fatalf("Token %d: failed to parse: %v", i, err)
+		}
+		if token.Type != expType || token.GetName() != expNames[i] {
+			t.Errorf("Token %d: expected %v %s, got %v %s", i, expType, expNames[i], token.Type, token.GetName())
+		}
+		if i == 4 && token.Value.Val.(float64) != 1000.0 {
+			t.Errorf("Token %d: expected 1000, got %v", i, token.Value.Val)
+		}
+	}
+}
+
+func TestNegativeNumberLiteralsTest(t *testing.T) {
+	lexer := newLexer("-5 (-3.14) a-5 (a)-0x10 [-2i8]")
+	for _, name := range []string{"-", "(", ")", "[", "]"} {
+		createKeyword(lexer.Keytab, name)
+	}
+	lexer.AllowNegativeNumberLiterals = true
+	tokens, err := lexer.AllTokens()
+	if err != nil {
+		t.Fatalf("Failed to parse tokens: %v", err)
+	}
+	var names []string
+	for _, token := range tokens {
+		if token.Type != TokenTypeEof && !token.IsKeyword("\n") {
+			names = append(names, token.GetName())
+		}
+	}
+	expected := []string{"-5", "(", "-3.14", ")", "a", "-", "5", "(", "a", ")", "-", "0x10", "[", "-2i8", "]"}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected tokens %q, got %q", expected, names)
+	}
+	if tokens[0].Value.Val.(*big.Int).Int64() != -5 || tokens[0].Location.Pos != 0 || tokens[0].Location.Len != 2 {
+		t.Errorf("Expected -5 at 0 with length 2, got %v at %d with length %d",
+			tokens[0].Value.Val, tokens[0].Location.Pos, tokens[0].Location.Len)
+	}
+	if tokens[2].Value.Val.(float64) != -3.14 || tokens[2].BigFloat.Sign() >= 0 {
+		t.Errorf("Expected -3.14, got %v", tokens[2].Value.Val)
+	}
+	if tokens[13].IntWidth != 8 || !tokens[13].IntSigned || tokens[13].Value.Val.(*big.Int).Int64() != -2 {
+		t.Errorf("Expected -2i8 to be a signed 8-bit -2")
+	}
+
+	// Widths are checked after the sign is applied.
+	for _, test := range []struct {
+		text string
+		err  string
+	}{
+		{"-128i8", ""},
+		{"-129i8", "Integer -129 does not fit in i8"},
+		{"-0u8", ""},
+		{"-5u8", "Integer -5 does not fit in u8"},
+	} {
+		lexer = newLexer(test.text)
+		lexer.AllowNegativeNumberLiterals = true
+		token, err := lexer.ParseToken()
+		if test.err != "" {
+			if err == nil || err.Error() != "testdata/test:1: "+test.err {
+				t.Errorf("%s: expected error %q, got %v", test.text, test.err, err)
+			}
+		} else if err != nil || token.GetName() != test.text {
+			t.Errorf("%s: expected a number, got %v, %v", test.text, token, err)
+		}
+	}
+
+	lexer = newLexer("-5")
+	createKeyword(lexer.Keytab, "-")
+	token, err := lexer.ParseToken()
+	if err != nil || !token.IsKeyword("-") {
+		t.Errorf("Expected '-' keyword without the flag, got %v, %v", token, err)
+	}
+}
+
+func TestLeadingWhitespaceTest(t *testing.T) {
+	lexer := newLexer("a b\tc/* x */d// y\ne")
+	expRes := []bool{false, true, true, true, true, false}
+
+	for i, expected := range expRes {
+		token, err := lexer.ParseToken()
+		if err != nil {
+			t.Fatalf("Token %d: failed to parse: %v", i, err)
+		}
+		if token.LeadingWhitespace != expected {
+			t.Errorf("Token %d '%s': expected LeadingWhitespace %v", i, token.GetName(), expected)
+		}
+	}
+}
+
 func TestParseEscapedIdentTest(t *testing.T) {
 	lexer := newLexer("\\if \\+ \\test")
 	expRes := []string{"if", "+", "test"}
@@ -432,3 +824,440 @@ func TestBlockCommentTest(t *testing.T) {
 		}
 	}
 }
+
+func TestBlockCommentLinesTest(t *testing.T) {
+	lexer := newLexer("1 /* First\n  second /* nested\n */\n third */ 2\n3")
+	expLines := []uint32{1, 4}
+	for i, expLine := range expLines {
+		token, err := lexer.ParseToken()
+		if err != nil {
+			t.Fatalf("Token %d: failed to parse: %v", i, err)
+		}
+		if token.Type != TokenTypeInteger {
+			t.Fatalf("Token %d: expected TokenTypeInteger, got %v", i, token.Type)
+		}
+		if token.Location.Line != expLine {
+			t.Errorf("Token %d: expected line %d, got %d", i, expLine, token.Location.Line)
+		}
+	}
+}
+
+func TestCarriageReturnNewlinesTest(t *testing.T) {
+	for _, text := range []string{"1 // one\r\n2\r\n\r\n3", "1 // one\r2\r\r3"} {
+		lexer := newLexer(text)
+		expRes := []struct {
+			isNewline bool
+			line      uint32
+		}{
+			{false, 1},
+			{true, 2},
+			{false, 2},
+			{true, 3},
+			{true, 4},
+			{false, 4},
+			{true, 5},
+		}
+		for i, exp := range expRes {
+			token, err := lexer.ParseToken()
+			if err != nil {
+				t.Fatalf("%q token %d: failed to parse: %v", text, i, err)
+			}
+			if token.IsKeyword("\n") != exp.isNewline {
+				t.Errorf("%q token %d: expected newline %v, got %v", text, i, exp.isNewline, token.Type)
+			}
+			if token.Location.Line != exp.line {
+				t.Errorf("%q token %d: expected line %d, got %d", text, i, exp.line, token.Location.Line)
+			}
+		}
+		token, err := lexer.ParseToken()
+		if err != nil || !token.IsEof() {
+			t.Errorf("%q: expected EOF, got %v, %v", text, token, err)
+		}
+	}
+}
+
+func TestKeepCommentsTest(t *testing.T) {
+	lexer := newLexer("1 // Line comment\n/* Block /* nested */\n comment */ 2")
+	lexer.KeepComments = true
+	expRes := []struct {
+		tokenType TokenType
+		text      string
+		line      uint32 // 0 if not checked
+	}{
+		{TokenTypeInteger, "", 1},
+		{TokenTypeComment, "// Line comment", 1},
+		{TokenTypeKeyword, "\n", 0},
+		{TokenTypeComment, "/* Block /* nested */\n comment */", 2},
+		{TokenTypeInteger, "", 3},
+		{TokenTypeKeyword, "\n", 0},
+		{TokenTypeEof, "", 0},
+	}
+
+	for i, exp := range expRes {
+		token, err := lexer.ParseToken()
+		if err != nil {
+			t.Fatalf("Token %d: failed to parse: %v", i, err)
+		}
+		if token.Type != exp.tokenType {
+			t.Errorf("Token %d: expected %v, got %v", i, exp.tokenType, token.Type)
+			continue
+		}
+		if exp.tokenType == TokenTypeComment && token.Value.Val.(string) != exp.text {
+			t.Errorf("Token %d: expected comment %q, got %q", i, exp.text, token.Value.Val.(string))
+		}
+		if exp.line != 0 && token.Location.Line != exp.line {
+			t.Errorf("Token %d: expected line %d, got %d", i, exp.line, token.Location.Line)
+		}
+	}
+}
+
+func TestNestedBlockCommentsTest(t *testing.T) {
+	source := "/* a /* b */ c */ 1"
+	lexer := newLexer(source)
+	lexer.KeepComments = true
+	token, err := lexer.ParseToken()
+	if err != nil || token.Type != TokenTypeComment || token.Value.Val.(string) != "/* a /* b */ c */" {
+		t.Fatalf("Expected the nested comment, got %v, %v", token, err)
+	}
+	if token, err = lexer.ParseToken(); err != nil || token.Type != TokenTypeInteger {
+		t.Errorf("Expected an integer after the comment, got %v, %v", token, err)
+	}
+
+	// Without nesting, the first "*/" ends the comment.
+	tokens, err := Tokenize("test.txt", source, LexerOptions{
+		Keywords:          []string{"*", "/"},
+		KeepComments:      true,
+		FlatBlockComments: true,
+	})
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	var names []string
+	for _, token := range tokens {
+		if token.Type == TokenTypeComment {
+			names = append(names, token.Value.Val.(string))
+		} else {
+			names = append(names, token.GetName())
+		}
+	}
+	if s := strings.Join(names, ","); s != "/* a /* b */,c,*,/,1,\n,EOF" {
+		t.Errorf("Expected the comment to end at the first */, got %q", s)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	source := "x = 42 + 'a' // sum\nprint(\"hi\", -1.5)"
+	opts := LexerOptions{
+		Keywords:                    []string{"=", "+", "(", ")", ",", "print"},
+		KeepComments:                true,
+		AllowNegativeNumberLiterals: true,
+	}
+	tokens, err := Tokenize("test.txt", source, opts)
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	expected := []TokenType{
+		TokenTypeIdent, TokenTypeKeyword, TokenTypeInteger, TokenTypeKeyword,
+		TokenTypeInteger, TokenTypeComment, TokenTypeKeyword,
+		TokenTypeKeyword, TokenTypeKeyword, TokenTypeString, TokenTypeKeyword,
+		TokenTypeFloat, TokenTypeKeyword, TokenTypeKeyword, TokenTypeEof,
+	}
+	var types []string
+	for _, token := range tokens {
+		types = append(types, token.Type.String())
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d: %s", len(expected), len(tokens), strings.Join(types, " "))
+	}
+	for i, token := range tokens {
+		if token.Type != expected[i] {
+			t.Errorf("Token %d: expected %v, got %v: %s", i, expected[i], token.Type, strings.Join(types, " "))
+		}
+	}
+	if !tokens[6].IsKeyword("\n") || tokens[7].Location.Line != 2 {
+		t.Errorf("Expected a newline ending line 1, got %q", tokens[6].GetName())
+	}
+
+	// Input that is not a keyword is an error.
+	tokens, err = Tokenize("test.txt", "a ; b", LexerOptions{})
+	if err == nil || len(tokens) != 1 {
+		t.Errorf("Expected an error after one token, got %d tokens and %v", len(tokens), err)
+	}
+}
+
+func TestBracedEscapedIdentTest(t *testing.T) {
+	lexer := newLexer("\\{my ident} \\{schön + 1} \\plain")
+	expRes := []string{"my ident", "schön + 1", "plain"}
+	for i, expected := range expRes {
+		token, err := lexer.ParseToken()
+		if err != nil {
+			t.Fatalf("Token %d: failed to parse: %v", i, err)
+		}
+		if token.Type != TokenTypeIdent {
+			t.Errorf("Token %d: expected TokenTypeIdent, got %v", i, token.Type)
+			continue
+		}
+		if name := token.Value.Val.(*Sym).Name; name != expected {
+			t.Errorf("Token %d: expected %q, got %q", i, expected, name)
+		}
+	}
+
+	errors := []struct {
+		text string
+		err  string
+	}{
+		{"\\{no end\n}", "Unterminated escaped identifier"},
+		{"\\{}", "Empty escaped identifier"},
+		{"\\{bad \xff}", "Invalid character"},
+	}
+	for _, e := range errors {
+		_, err := newLexer(e.text).ParseToken()
+		if err == nil || !strings.Contains(err.Error(), e.err) {
+			t.Errorf("%q: expected error %q, got %v", e.text, e.err, err)
+		}
+	}
+}
+
+// TestParseStringAllocs verifies that reading a string literal allocates the
+// same amount whatever its length, with and without escapes.
+func TestParseStringAllocs(t *testing.T) {
+	lexAllocs := func(text string) float64 {
+		return testing.AllocsPerRun(10, func() {
+			lexer := newLexer(text)
+			if _, err := lexer.AllTokens(); err != nil {
+				t.Fatalf("Failed to tokenize: %v", err)
+			}
+		})
+	}
+	for _, body := range []string{"abcdefgh", `abc\tdefg`} {
+		short := lexAllocs(`"` + body + `"`)
+		long := lexAllocs(`"` + strings.Repeat(body, 1000) + `"`)
+		// The builder for escapes grows a few times
+		if long > short+20 {
+			t.Errorf("Expected a long string to allocate about as much as a short one, got %v and %v", long, short)
+		}
+	}
+}
+
+// BenchmarkLexLongStrings tokenizes a file of long string literals.
+func BenchmarkLexLongStrings(b *testing.B) {
+	text := ""
+	for i := 0; i < 100; i++ {
+		text += `"` + strings.Repeat("long string ", 100) + `" "with\tan escape"` + "\n"
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lexer := newLexer(text)
+		if _, err := lexer.AllTokens(); err != nil {
+			b.Fatalf("Failed to tokenize: %v", err)
+		}
+	}
+}
+
+// TestByteOrderMark verifies that a UTF-8 byte order mark at the start of the
+// input is skipped, whether the text is set directly or read.
+func TestByteOrderMark(t *testing.T) {
+	lexer := newLexer("\xef\xbb\xbfhello world")
+	tokens, err := lexer.AllTokens()
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	if len(tokens) < 2 || tokens[0].GetName() != "hello" || tokens[1].GetName() != "world" {
+		t.Fatalf("Expected hello world, got %v", tokens)
+	}
+	if location := tokens[0].Location; location.Pos != 0 || location.Line != 1 || location.Column() != 1 {
+		t.Errorf("Expected hello at the start of line 1, got %+v", location)
+	}
+	if text := lexer.Filepath.Text; text != "hello world\n" {
+		t.Errorf("Expected the lexer's text without the byte order mark, got %q", text)
+	}
+
+	// The caller's file is not changed.
+	input := NewFilepath("bom", nil, false)
+	input.Text = "\xef\xbb\xbfx\n"
+	if _, err := NewLexer(input, NewKeytab(), false); err != nil {
+		t.Fatalf("NewLexer failed: %v", err)
+	}
+	if input.Text != "\xef\xbb\xbfx\n" {
+		t.Errorf("Expected the caller's text to keep its byte order mark, got %q", input.Text)
+	}
+
+	filepath := NewFilepath("bom", nil, false)
+	if err := filepath.ReadText(strings.NewReader("\xef\xbb\xbfx")); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if filepath.Text != "x\n" {
+		t.Errorf("Expected the byte order mark to be stripped, got %q", filepath.Text)
+	}
+}
+
+func TestTokensString(t *testing.T) {
+	lexer := newLexer("foo 42 \"bar\"")
+	createKeyword(lexer.Keytab, "foo")
+	if _, err := lexer.AllTokens(); err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	expected := []string{
+		`   0  KEYWORD       1:1    "foo"`,
+		`   1  INTEGER       1:5    "42"`,
+		`   2  STRING        1:8    "\"bar\""`,
+		`   3  KEYWORD       1:13   "\n"`,
+		`   4  EOF           2:1    "EOF"`,
+	}
+	rows := strings.Split(strings.TrimSuffix(lexer.TokensString(), "\n"), "\n")
+	if len(rows) != len(expected) {
+		t.Fatalf("Expected %d rows, got:\n%s", len(expected), lexer.TokensString())
+	}
+	for i, row := range rows {
+		if row != expected[i] {
+			t.Errorf("Row %d: expected %q, got %q", i, expected[i], row)
+		}
+	}
+}
+
+// indentTokenNames returns the names of tokens, with INDENT and DEDENT tokens
+// named by their type, and newlines as "NL".
+func indentTokenNames(tokens []*Token) string {
+	var names []string
+	for _, token := range tokens {
+		switch {
+		case token.Type == TokenTypeIndent || token.Type == TokenTypeDedent:
+			names = append(names, token.Type.String())
+		case token.IsKeyword("\n"):
+			names = append(names, "NL")
+		default:
+			names = append(names, token.GetName())
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func TestIndentSensitive(t *testing.T) {
+	source := "if a:\n  if b:\n    x\n\n    // comment\n  y\nz\n  w\n"
+	opts := LexerOptions{Keywords: []string{"if", ":"}, IndentSensitive: true}
+	tokens, err := Tokenize("test.txt", source, opts)
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	expected := "if a : NL INDENT if b : NL INDENT x NL NL NL DEDENT y NL DEDENT z NL INDENT w NL DEDENT EOF"
+	if s := indentTokenNames(tokens); s != expected {
+		t.Errorf("Expected %q, got %q", expected, s)
+	}
+	for _, token := range tokens {
+		if token.Type == TokenTypeIndent && token.Location.Len != 0 {
+			t.Errorf("Expected an empty INDENT token, got length %d", token.Location.Len)
+		}
+	}
+	if y := tokens[15]; y.GetName() != "y" || !y.LeadingWhitespace || y.Location.Line != 6 {
+		t.Errorf("Expected y indented on line 6 after a DEDENT, got %q on line %d", y.GetName(), y.Location.Line)
+	}
+
+	// Closing several levels at once returns a DEDENT for each, and so does
+	// reaching EOF.
+	tokens, err = Tokenize("test.txt", "a\n  b\n    c\nd\n    e", LexerOptions{IndentSensitive: true})
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	expected = "a NL INDENT b NL INDENT c NL DEDENT DEDENT d NL INDENT e NL DEDENT EOF"
+	if s := indentTokenNames(tokens); s != expected {
+		t.Errorf("Expected %q, got %q", expected, s)
+	}
+
+	// A dedent to a level that was never opened is an error.
+	_, err = Tokenize("test.txt", "a\n    b\n  c\n", LexerOptions{IndentSensitive: true})
+	if err == nil || err.Error() != "test.txt:3: Dedent does not match any outer indentation level" {
+		t.Errorf("Expected an inconsistent dedent error, got %v", err)
+	}
+	_, err = Tokenize("test.txt", "a\n  b\n    c\n\td\n", LexerOptions{IndentSensitive: true})
+	if err == nil || err.Error() != "test.txt:4: Dedent does not match any outer indentation level" {
+		t.Errorf("Expected a tab not to match space indentation, got %v", err)
+	}
+
+	// Without IndentSensitive, indentation is just space.
+	tokens, err = Tokenize("test.txt", "a\n  b\n", LexerOptions{})
+	if err != nil || indentTokenNames(tokens) != "a NL b NL EOF" {
+		t.Errorf("Expected no indentation tokens, got %q, %v", indentTokenNames(tokens), err)
+	}
+}
+
+func TestTokensOfType(t *testing.T) {
+	peg := newTestPeg(t, `goal := statement+
+statement := IDENT "=" (IDENT | STRING) ";"`)
+	node := parseTestInput(t, peg, `a = b; c = "s"; d = e;`)
+	lexer := node.ParseResult.Lexer()
+	var names []string
+	for _, token := range lexer.TokensOfType(TokenTypeIdent) {
+		names = append(names, token.GetName())
+	}
+	if s := strings.Join(names, " "); s != "a b c d e" {
+		t.Errorf("Expected the identifiers in order, got %q", s)
+	}
+	var matched []string
+	for _, token := range node.Tokens() {
+		if token.Type == TokenTypeIdent {
+			matched = append(matched, token.GetName())
+		}
+	}
+	if strings.Join(matched, " ") != strings.Join(names, " ") {
+		t.Errorf("Expected the tree's identifiers %v, got %v", names, matched)
+	}
+	if strs := lexer.TokensOfType(TokenTypeString); len(strs) != 1 || strs[0].Value.Val != "s" {
+		t.Errorf("Expected one string, got %v", strs)
+	}
+	if floats := lexer.TokensOfType(TokenTypeFloat); floats != nil {
+		t.Errorf("Expected no floats, got %v", floats)
+	}
+}
+
+func TestEscapeErrorLocation(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{`x = "a long string with \q in it"`, `x = "a long string with \q in it"` + "\n                        ^^"},
+		{`"\x4g"`, `"\x4g"` + "\n ^^^^"},
+		{`'\z'`, `'\z'` + "\n ^^"},
+	}
+	for _, test := range tests {
+		lexer := newLexer(test.text)
+		createKeyword(lexer.Keytab, "=")
+		lexer.ShowSnippets = true
+		_, err := lexer.AllTokens()
+		if err == nil || !strings.HasSuffix(err.Error(), "\n"+test.expected) {
+			t.Errorf("%s: expected the escape underlined:\n%s\ngot:\n%v", test.text, test.expected, err)
+		}
+	}
+}
+
+// TestSkipToNewline verifies SkipToNewline resumes lexing on the next line,
+// after a lexer error or in the middle of a line.
+func TestSkipToNewline(t *testing.T) {
+	lexer := newLexer("a @ b\nc d\r\ne")
+	expectName := func(name string, line uint32) {
+		t.Helper()
+		token, err := lexer.ParseToken()
+		if err != nil {
+			t.Fatalf("Expected %s, got error %v", name, err)
+		}
+		if token.GetName() != name || token.Location.Line != line {
+			t.Errorf("Expected %s at line %d, got %s at line %d", name, line, token.GetName(), token.Location.Line)
+		}
+	}
+	expectName("a", 1)
+	if _, err := lexer.ParseToken(); err == nil {
+		t.Fatalf("Expected an error for @")
+	}
+	lexer.SkipToNewline()
+	expectName("c", 2)
+	lexer.SkipToNewline()
+	expectName("e", 3)
+	lexer.SkipToNewline()
+	if token, err := lexer.ParseToken(); err != nil || !token.IsEof() {
+		t.Errorf("Expected EOF after the last line, got %v, %v", token, err)
+	}
+	lexer.SkipToNewline()
+	if lexer.Pos != lexer.Len || lexer.Line != 4 {
+		t.Errorf("Expected to stay at EOF, got %d of %d at line %d", lexer.Pos, lexer.Len, lexer.Line)
+	}
+}
@@ -16,9 +16,18 @@ package parser
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
+// maxSnippetWidth is how many characters of a long line Snippet shows around
+// the location.
+const maxSnippetWidth = 80
+
 // Filepath represents a source file path and its contents.
 type Filepath struct {
 	Name   string
@@ -26,6 +35,17 @@ type Filepath struct {
 	Text   string
 	IsDir  bool
 	Lexers []*Lexer // ArrayList relation
+
+	// TabWidth is how many columns a tab stop is in LineColumn: a tab
+	// advances the column to the one after the next multiple of TabWidth.
+	// If it is 0 or 1, a tab is one column.
+	TabWidth uint32
+
+	// Positions where each line starts, computed by LineColumn from lineText.
+	// Locations may be read concurrently, so these are locked.
+	lineLock   sync.Mutex
+	lineStarts []uint32
+	lineText   string
 }
 
 // NewFilepath creates a new Filepath.
@@ -48,13 +68,37 @@ func (fp *Filepath) ReadFile() error {
 	if err != nil {
 		return err
 	}
-	text := string(data)
-	// Ensure the file ends with a newline
-	if len(text) == 0 || text[len(text)-1] != '\n' {
+	fp.setText(data)
+	return nil
+}
+
+// ReadText reads the file contents from r until EOF.
+func (fp *Filepath) ReadText(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	fp.setText(data)
+	return nil
+}
+
+// setText sets the file contents, ensuring they end with a newline, which may
+// be a lone "\r".
+func (fp *Filepath) setText(data []byte) {
+	text := stripBOM(string(data))
+	if len(text) == 0 || (text[len(text)-1] != '\n' && text[len(text)-1] != '\r') {
 		text += "\n"
 	}
 	fp.Text = text
-	return nil
+}
+
+// utf8BOM is the byte order mark some editors write at the start of UTF-8 files.
+const utf8BOM = "\xef\xbb\xbf"
+
+// stripBOM returns text without a leading UTF-8 byte order mark, so positions
+// and columns count from the first real character.
+func stripBOM(text string) string {
+	return strings.TrimPrefix(text, utf8BOM)
 }
 
 // AppendLexer adds a lexer to this file (ArrayList relation).
@@ -67,11 +111,58 @@ func (fp *Filepath) GetLexers() []*Lexer {
 	return fp.Lexers
 }
 
+// LineColumn returns the 1-based line and column of the character at byte
+// offset pos in Text.  Columns count UTF-8 characters, not bytes, and a pos
+// inside a multibyte character gives that character's column.  Tabs are
+// expanded to TabWidth.  Lines end in "\n", "\r\n", or a lone "\r", as in the
+// lexer.
+func (fp *Filepath) LineColumn(pos uint32) (line, col uint32) {
+	fp.lineLock.Lock()
+	if fp.lineStarts == nil || fp.lineText != fp.Text {
+		fp.findLineStarts()
+	}
+	text, lineStarts := fp.lineText, fp.lineStarts
+	fp.lineLock.Unlock()
+	if pos > uint32(len(text)) {
+		pos = uint32(len(text))
+	}
+	index := sort.Search(len(lineStarts), func(i int) bool {
+		return lineStarts[i] > pos
+	}) - 1
+	start := lineStarts[index]
+	col = 1
+	for i := start; i < pos; i++ {
+		if text[i] == '\t' && fp.TabWidth > 1 {
+			col += fp.TabWidth - (col-1)%fp.TabWidth
+		} else if utf8.RuneStart(text[i]) {
+			col++
+		}
+	}
+	if pos < uint32(len(text)) && !utf8.RuneStart(text[pos]) {
+		col-- // pos is inside the previous character
+	}
+	return uint32(index) + 1, col
+}
+
+// findLineStarts records where each line of Text starts, for LineColumn, which
+// holds lineLock.
+func (fp *Filepath) findLineStarts() {
+	text := fp.Text
+	fp.lineStarts = []uint32{0}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c == '\n' || (c == '\r' && (i+1 == len(text) || text[i+1] != '\n')) {
+			fp.lineStarts = append(fp.lineStarts, uint32(i+1))
+		}
+	}
+	fp.lineText = text
+}
+
 // Location represents a position in source code.
 type Location struct {
 	Filepath *Filepath
-	Pos      uint32 // Character position in file
-	Len      uint32 // Length in characters (for error messages)
+	Pos      uint32 // Byte offset in the file's Text
+	Len      uint32 // Length in bytes; see CharLen for characters
 	Line     uint32 // Line number (1-indexed)
 }
 
@@ -95,6 +186,15 @@ func EmptyLocation() Location {
 	}
 }
 
+// CharLen returns the length of l in UTF-8 characters, which is less than Len
+// when it spans multibyte characters.  Without source text, it is Len.
+func (l Location) CharLen() uint32 {
+	if l.Filepath == nil || int(l.Pos+l.Len) > len(l.Filepath.Text) {
+		return l.Len
+	}
+	return uint32(utf8.RuneCountInString(l.Filepath.Text[l.Pos : l.Pos+l.Len]))
+}
+
 // Dump outputs debugging information about this location.
 func (l Location) Dump() {
 	if l.Filepath == nil {
@@ -111,3 +211,116 @@ func (l Location) Error(msg string) error {
 	}
 	return fmt.Errorf("error: %s", msg)
 }
+
+// ErrorWithSnippet is like Error, but follows the message with the source line
+// and a caret line underlining l, as returned by Snippet.
+func (l Location) ErrorWithSnippet(msg string) error {
+	snippet := l.Snippet()
+	if snippet == "" {
+		return l.Error(msg)
+	}
+	return fmt.Errorf("%v\n%s", l.Error(msg), snippet)
+}
+
+// Column returns the 1-based column where l starts, as computed by
+// Filepath.LineColumn, or 0 if l has no source.
+func (l Location) Column() uint32 {
+	if l.Filepath == nil {
+		return 0
+	}
+	_, col := l.Filepath.LineColumn(l.Pos)
+	return col
+}
+
+// Snippet returns the source line containing l, followed by a line of carets
+// under l's characters, like:
+//
+//	x := 1 +* 2
+//	        ^
+//
+// Only l's first line is underlined, and at least one caret is shown.  Tabs
+// before l are copied to the caret line, so it lines up however wide they are.
+// Lines longer than maxSnippetWidth characters are cut to show l, with "..."
+// marking the missing text.  It returns "" if l has no source.
+func (l Location) Snippet() string {
+	if l.Filepath == nil || l.Pos > uint32(len(l.Filepath.Text)) {
+		return ""
+	}
+	text := l.Filepath.Text
+	start := strings.LastIndexAny(text[:l.Pos], "\r\n") + 1
+	end := len(text)
+	if i := strings.IndexAny(text[start:], "\r\n"); i >= 0 {
+		end = start + i
+	}
+	line := []rune(text[start:end])
+	col := utf8.RuneCountInString(text[start:min(int(l.Pos), end)])
+	errEnd := col + 1
+	if locEnd := int(l.Pos + l.Len); locEnd > int(l.Pos) && int(l.Pos) < end {
+		errEnd = col + utf8.RuneCountInString(text[l.Pos:min(locEnd, end)])
+	}
+
+	// Cut long lines to a window around the location.
+	first, last := 0, len(line)
+	prefix, suffix := "", ""
+	if len(line) > maxSnippetWidth {
+		first = max(0, min(col-maxSnippetWidth/2, len(line)-maxSnippetWidth))
+		last = first + maxSnippetWidth
+		errEnd = min(errEnd, last)
+		if first > 0 {
+			prefix = "..."
+		}
+		if last < len(line) {
+			suffix = "..."
+		}
+	}
+
+	var carets strings.Builder
+	carets.WriteString(strings.Repeat(" ", len(prefix)))
+	for _, r := range line[first:col] {
+		if r == '\t' {
+			carets.WriteByte('\t')
+		} else {
+			carets.WriteByte(' ')
+		}
+	}
+	carets.WriteString(strings.Repeat("^", max(1, errEnd-col)))
+	return prefix + string(line[first:last]) + suffix + "\n" + carets.String()
+}
+
+// Merge returns the smallest location covering both l and other.  An empty
+// location merges as the other location.  Locations in different files can't
+// be merged, and give an empty location.
+func (l Location) Merge(other Location) Location {
+	if l.Filepath == nil {
+		return other
+	}
+	if other.Filepath == nil {
+		return l
+	}
+	if l.Filepath != other.Filepath {
+		return EmptyLocation()
+	}
+	first := l
+	if other.Pos < l.Pos {
+		first = other
+	}
+	end := l.Pos + l.Len
+	if otherEnd := other.Pos + other.Len; otherEnd > end {
+		end = otherEnd
+	}
+	return NewLocation(l.Filepath, first.Pos, end-first.Pos, first.Line)
+}
+
+// Contains returns true if the byte offset pos is inside l.
+func (l Location) Contains(pos uint32) bool {
+	return pos >= l.Pos && pos < l.Pos+l.Len
+}
+
+// Overlaps returns true if l and other share at least one byte.
+// Locations in different files never overlap.
+func (l Location) Overlaps(other Location) bool {
+	if l.Filepath == nil || l.Filepath != other.Filepath {
+		return false
+	}
+	return l.Pos < other.Pos+other.Len && other.Pos < l.Pos+l.Len
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLocationMergeTest(t *testing.T) {
+	filepath := NewFilepath("test_filepath", nil, false)
+	filepath.Text = "first line\nsecond line\n"
+	first := NewLocation(filepath, 0, 5, 1)   // "first"
+	line := NewLocation(filepath, 6, 4, 1)    // "line"
+	whole := NewLocation(filepath, 0, 10, 1)  // "first line"
+	second := NewLocation(filepath, 11, 6, 2) // "second"
+
+	tests := []struct {
+		a, b     Location
+		pos, len uint32
+	}{
+		{first, NewLocation(filepath, 5, 1, 1), 0, 6}, // Adjacent
+		{line, whole, 0, 10},                          // Nested
+		{NewLocation(filepath, 3, 5, 1), line, 3, 7},  // Overlapping
+		{second, first, 0, 17},                        // Disjoint
+	}
+	for i, test := range tests {
+		merged := test.a.Merge(test.b)
+		if merged.Pos != test.pos || merged.Len != test.len || merged.Line != 1 {
+			t.Errorf("Test %d: expected pos %d len %d line 1, got pos %d len %d line %d",
+				i, test.pos, test.len, merged.Pos, merged.Len, merged.Line)
+		}
+		if merged != test.b.Merge(test.a) {
+			t.Errorf("Test %d: Merge should be symmetric", i)
+		}
+	}
+
+	if first.Merge(EmptyLocation()) != first || EmptyLocation().Merge(first) != first {
+		t.Errorf("Merging with an empty location should return the other location")
+	}
+	other := NewFilepath("other", nil, false)
+	if merged := first.Merge(NewLocation(other, 0, 5, 1)); merged.Filepath != nil {
+		t.Errorf("Merging locations in different files should give an empty location")
+	}
+}
+
+func TestLocationContainsTest(t *testing.T) {
+	filepath := NewFilepath("test_filepath", nil, false)
+	line := NewLocation(filepath, 6, 4, 1)
+	for pos, expected := range map[uint32]bool{5: false, 6: true, 9: true, 10: false} {
+		if line.Contains(pos) != expected {
+			t.Errorf("Contains(%d): expected %v", pos, expected)
+		}
+	}
+}
+
+func TestLocationOverlapsTest(t *testing.T) {
+	filepath := NewFilepath("test_filepath", nil, false)
+	first := NewLocation(filepath, 0, 5, 1)
+	adjacent := NewLocation(filepath, 5, 1, 1)
+	nested := NewLocation(filepath, 1, 2, 1)
+	disjoint := NewLocation(filepath, 11, 6, 2)
+
+	if first.Overlaps(adjacent) || adjacent.Overlaps(first) {
+		t.Errorf("Adjacent locations should not overlap")
+	}
+	if !first.Overlaps(nested) || !nested.Overlaps(first) {
+		t.Errorf("Nested locations should overlap")
+	}
+	if first.Overlaps(disjoint) {
+		t.Errorf("Disjoint locations should not overlap")
+	}
+	other := NewFilepath("other", nil, false)
+	if first.Overlaps(NewLocation(other, 0, 5, 1)) {
+		t.Errorf("Locations in different files should not overlap")
+	}
+}
+
+func TestLineColumnTest(t *testing.T) {
+	filepath := NewFilepath("test_filepath", nil, false)
+	filepath.Text = "ab\nx\u00e9y\r\n\rz\n"
+	tests := []struct {
+		pos, line, col uint32
+	}{
+		{0, 1, 1},  // "a"
+		{2, 1, 3},  // First "\n"
+		{3, 2, 1},  // "x"
+		{4, 2, 2},  // First byte of "\u00e9"
+		{5, 2, 2},  // Second byte of "\u00e9"
+		{6, 2, 3},  // "y"
+		{8, 2, 5},  // "\n" of "\r\n"
+		{9, 3, 1},  // Lone "\r"
+		{10, 4, 1}, // "z"
+		{12, 5, 1}, // End of text
+	}
+	for _, test := range tests {
+		line, col := filepath.LineColumn(test.pos)
+		if line != test.line || col != test.col {
+			t.Errorf("Pos %d: expected %d:%d, got %d:%d", test.pos, test.line, test.col, line, col)
+		}
+	}
+
+	// The line starts are recomputed when the text changes.
+	filepath.Text = "\n\nab"
+	if line, col := filepath.LineColumn(3); line != 3 || col != 2 {
+		t.Errorf("Expected 3:2 after changing text, got %d:%d", line, col)
+	}
+}
+
+func TestSnippetTest(t *testing.T) {
+	filepath := NewFilepath("test_filepath", nil, false)
+	filepath.Text = "first line\n\tx := 1 +* 2\n"
+	location := NewLocation(filepath, 19, 2, 2) // "+*"
+	expected := "\tx := 1 +* 2\n\t       ^^"
+	if snippet := location.Snippet(); snippet != expected {
+		t.Errorf("Expected snippet %q, got %q", expected, snippet)
+	}
+	err := location.ErrorWithSnippet("bad operator")
+	if err == nil || err.Error() != "test_filepath:2: bad operator\n"+expected {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// Long lines are cut around the location.
+	filepath.Text = strings.Repeat("a", 100) + "@" + strings.Repeat("b", 100) + "\n"
+	location = NewLocation(filepath, 100, 1, 1)
+	lines := strings.Split(location.Snippet(), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "...aaa") || !strings.HasSuffix(lines[0], "bbb...") {
+		t.Fatalf("Expected a cut line, got %q", lines)
+	}
+	if col := strings.Index(lines[1], "^"); col != strings.Index(lines[0], "@") || strings.Count(lines[1], "^") != 1 {
+		t.Errorf("Caret not under the location: %q", lines)
+	}
+}
+
+func TestTabWidthTest(t *testing.T) {
+	filepath := NewFilepath("test_filepath", nil, false)
+	filepath.Text = "\tx\n  \ty\nab\tc\n"
+	tests := []struct {
+		pos  uint32
+		cols [3]uint32 // With TabWidth 0, 4 and 8
+	}{
+		{1, [3]uint32{2, 5, 9}},  // x
+		{6, [3]uint32{4, 5, 9}},  // y
+		{11, [3]uint32{4, 5, 9}}, // c
+		{10, [3]uint32{3, 3, 3}}, // The tab before c
+	}
+	for i, tabWidth := range []uint32{0, 4, 8} {
+		filepath.TabWidth = tabWidth
+		for _, test := range tests {
+			if _, col := filepath.LineColumn(test.pos); col != test.cols[i] {
+				t.Errorf("TabWidth %d, pos %d: expected column %d, got %d", tabWidth, test.pos, test.cols[i], col)
+			}
+		}
+	}
+}
+
+func TestLocationCharLenTest(t *testing.T) {
+	lexer := newLexer("schön x")
+	tokens, err := lexer.AllTokens()
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	word := tokens[0].Location
+	if word.Len != 6 || word.CharLen() != 5 {
+		t.Errorf("Expected 6 bytes and 5 characters, got %d and %d", word.Len, word.CharLen())
+	}
+	if name := tokens[0].GetName(); name != "schön" {
+		t.Errorf("Expected schön, got %q", name)
+	}
+	if x := tokens[1].Location; x.Pos != 7 || x.Len != 1 || x.CharLen() != 1 {
+		t.Errorf("Expected x at byte 7 with length 1, got %+v", x)
+	}
+	eof := tokens[len(tokens)-1].Location
+	if !tokens[len(tokens)-1].IsEof() || eof.Len != 0 || eof.CharLen() != 0 {
+		t.Errorf("Expected an empty EOF location, got %+v", eof)
+	}
+	if l := NewLocation(nil, 0, 3, 1); l.CharLen() != 3 {
+		t.Errorf("Expected CharLen to be Len without source, got %d", l.CharLen())
+	}
+}
@@ -14,7 +14,11 @@
 
 package parser
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
 
 // Node represents an AST (Abstract Syntax Tree) node, simplified from ParseResult.
 type Node struct {
@@ -23,6 +27,8 @@ type Node struct {
 	EndPos       uint32       // Token position where this node ends
 	Token        *Token       // If this node represents a single token
 	Location     Location
+	Label        string       // Label of the pexpr that matched this node, if any
+	SyntaxError  *SyntaxError // For a leaf of tokens skipped by error recovery
 
 	// DoublyLinked Node:"Parent" Node:"Child" cascade
 	parent           *Node
@@ -137,6 +143,63 @@ func (n *Node) InsertChildNode(child *Node) {
 	child.prevChildNode = nil
 }
 
+// InsertBefore inserts child just before ref, which must be a child of this
+// node.  A child with a parent is moved from it.  Nothing is done if ref is
+// not a child of this node.
+func (n *Node) InsertBefore(ref *Node, child *Node) {
+	if child == nil || ref == nil || ref.parent != n || child == ref {
+		return
+	}
+	if child.parent != nil {
+		child.parent.RemoveChildNode(child)
+	}
+	prev := ref.prevChildNode
+	if prev == nil {
+		n.InsertChildNode(child)
+		return
+	}
+	n.insertChildNodeAfter(prev, child)
+}
+
+// InsertAfter inserts child just after ref, which must be a child of this
+// node.  A child with a parent is moved from it.  Nothing is done if ref is
+// not a child of this node.
+func (n *Node) InsertAfter(ref *Node, child *Node) {
+	if child == nil || ref == nil || ref.parent != n || child == ref {
+		return
+	}
+	if child.parent != nil {
+		child.parent.RemoveChildNode(child)
+	}
+	n.insertChildNodeAfter(ref, child)
+}
+
+// ReplaceChild puts newChild in place of oldChild, which must be a child of
+// this node, and is removed.  A newChild with a parent is moved from it.
+// Nothing is done if oldChild is not a child of this node.
+func (n *Node) ReplaceChild(oldChild *Node, newChild *Node) {
+	if oldChild == nil || newChild == nil || oldChild.parent != n || newChild == oldChild {
+		return
+	}
+	n.InsertBefore(oldChild, newChild)
+	n.RemoveChildNode(oldChild)
+}
+
+// insertChildNodeAfter links child, which has no parent, in after prev, a
+// child of this node.
+func (n *Node) insertChildNodeAfter(prev *Node, child *Node) {
+	next := prev.nextChildNode
+	child.prevChildNode = prev
+	child.nextChildNode = next
+	prev.nextChildNode = child
+	if next == nil {
+		n.lastChildNode = child
+	} else {
+		next.prevChildNode = child
+	}
+	child.parent = n
+}
+
 // FirstChildNode returns the first child node.
 func (n *Node) FirstChildNode() *Node {
 	return n.firstChildNode
@@ -147,6 +210,21 @@ func (n *Node) LastChildNode() *Node {
 	return n.lastChildNode
 }
 
+// Parent returns the node this node is a child of, or nil for the root.
+func (n *Node) Parent() *Node {
+	return n.parent
+}
+
+// NextSibling returns the next child of this node's parent, or nil.
+func (n *Node) NextSibling() *Node {
+	return n.nextChildNode
+}
+
+// PrevSibling returns the previous child of this node's parent, or nil.
+func (n *Node) PrevSibling() *Node {
+	return n.prevChildNode
+}
+
 // ChildNodes returns a slice of all child nodes.
 func (n *Node) ChildNodes() []*Node {
 	var children []*Node
@@ -172,12 +250,16 @@ func (n *Node) SafeChildNodes() []*Node {
 // GetRuleSym returns the symbol for the rule this node matches, if any.
 // ============================================================================
 
-// GetRuleSym returns the rule symbol if this node represents a rule.
+// GetRuleSym returns the rule symbol if this node represents a rule.  If the
+// rule has a DisplayName, that is returned instead.
 func (n *Node) GetRuleSym() *Sym {
-	if n.ParseResult == nil || n.ParseResult.RuleParent() == nil {
+	if n.ParseResult == nil || n.ParseResult.Rule == nil {
 		return nil
 	}
-	return n.ParseResult.RuleParent().Sym
+	if rule := n.ParseResult.Rule; rule.DisplayName != nil {
+		return rule.DisplayName
+	}
+	return n.ParseResult.Rule.Sym
 }
 
 // GetKeywordSym returns the keyword symbol if this node represents a keyword.
@@ -226,12 +308,12 @@ func (n *Node) Simplify() {
 			break // Node already simplified away
 		}
 
-		if child.firstChildNode == nil {
+		if child.firstChildNode == nil && child.SyntaxError == nil {
 			// Leaf node - check if it should be removed
 			token := child.Token
 			rule := (*Rule)(nil)
 			if child.ParseResult != nil {
-				rule = child.ParseResult.RuleParent()
+				rule = child.ParseResult.Rule
 			}
 
 			// Condition 1: rule is null OR rule is weak
@@ -239,9 +321,10 @@ func (n *Node) Simplify() {
 			
 			// Condition 2: token is null OR token.pexpr is weak
 			tokenCondition := true
-			if token != nil && token.Pexpr != nil {
-				pexpr := token.Pexpr.(*Pexpr)
-				tokenCondition = pexpr.Weak
+			if token != nil {
+				if pexpr, ok := token.Pexpr.(*Pexpr); ok && pexpr != nil {
+					tokenCondition = pexpr.Weak
+				}
 			}
 
 			// Remove only if BOTH conditions are true
@@ -260,7 +343,7 @@ func (n *Node) Simplify() {
 // mergeChildNode merges this node's sole child into this node.
 func (n *Node) mergeChildNode() {
 	child := n.firstChildNode
-	if child == nil || child.nextChildNode != nil {
+	if child == nil || child.nextChildNode != nil || child.SyntaxError != nil {
 		return
 	}
 
@@ -268,10 +351,10 @@ func (n *Node) mergeChildNode() {
 	childRule := (*Rule)(nil)
 
 	if n.ParseResult != nil {
-		parentRule = n.ParseResult.RuleParent()
+		parentRule = n.ParseResult.Rule
 	}
 	if child.ParseResult != nil {
-		childRule = child.ParseResult.RuleParent()
+		childRule = child.ParseResult.Rule
 	}
 
 	parentStrong := parentRule != nil && !parentRule.Weak
@@ -295,6 +378,9 @@ func (n *Node) mergeChildNode() {
 
 	// Inherit child's token if any
 	n.Token = child.Token
+	if n.Label == "" {
+		n.Label = child.Label
+	}
 
 	// If child was a non-strong rule, adopt its ParseResult
 	if childRule != nil && !parentStrong {
@@ -338,7 +424,7 @@ func (n *Node) toStringIndented(depth uint32, printSpace bool) string {
 		for i := uint32(0); i < depth*2; i++ {
 			indent += " "
 		}
-		s += indent + rule.Sym.Name
+		s += indent + n.GetRuleSym().Name
 
 		needsParen = true
 	}
@@ -351,15 +437,21 @@ func (n *Node) toStringIndented(depth uint32, printSpace bool) string {
 		s += "("
 	}
 
-	if n.Token != nil {
+	if n.SyntaxError != nil {
+		if printSpace {
+			s += " "
+		}
+		s += "ERROR(" + n.SourceText() + ")"
+		printSpace = true
+	} else if n.Token != nil {
 		token := n.Token
 		if printSpace {
 			s += " "
 		}
 
-		isStrongKeyword := token.Type == TokenTypeKeyword && token.Pexpr != nil
-		pexpr := token.Pexpr.(*Pexpr)
-		if token.Type == TokenTypeKeyword && pexpr != nil {
+		// Keywords matched by weak pexprs, or by none, are not quoted
+		isStrongKeyword := false
+		if pexpr, ok := token.Pexpr.(*Pexpr); ok && pexpr != nil && token.Type == TokenTypeKeyword {
 			isStrongKeyword = !pexpr.Weak
 		}
 
@@ -393,6 +485,52 @@ func (n *Node) Dump() {
 	fmt.Println(n.ToString())
 }
 
+// ============================================================================
+// GraphViz output
+// ============================================================================
+
+// ToDOT returns the tree rooted at this node as a GraphViz digraph.  Rule
+// nodes are labelled with their rule name, and token leaves are boxes labelled
+// with the token text.
+func (n *Node) ToDOT() string {
+	var b strings.Builder
+	b.WriteString("digraph parseTree {\n")
+	numNodes := 0
+	n.writeDOT(&b, &numNodes)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// writeDOT writes this node and its subtree, and returns this node's vertex ID.
+func (n *Node) writeDOT(b *strings.Builder, numNodes *int) string {
+	id := fmt.Sprintf("n%d", *numNodes)
+	*numNodes++
+	if n.SyntaxError != nil {
+		fmt.Fprintf(b, "  %s [label=%s, shape=box, color=red];\n", id, dotQuote("ERROR"))
+	} else if n.Token != nil {
+		fmt.Fprintf(b, "  %s [label=%s, shape=box];\n", id, dotQuote(n.Token.GetName()))
+	} else {
+		label := ""
+		if sym := n.GetRuleSym(); sym != nil {
+			label = sym.Name
+		}
+		fmt.Fprintf(b, "  %s [label=%s];\n", id, dotQuote(label))
+	}
+	for child := n.firstChildNode; child != nil; child = child.nextChildNode {
+		childID := child.writeDOT(b, numNodes)
+		fmt.Fprintf(b, "  %s -> %s;\n", id, childID)
+	}
+	return id
+}
+
+// dotQuote returns s as a quoted GraphViz string.
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+	s = strings.ReplaceAll(s, "\n", "\\n")
+	return "\"" + s + "\""
+}
+
 // ============================================================================
 // Helper methods
 // ============================================================================
@@ -405,11 +543,88 @@ func (n *Node) SetToken(token *Token) {
 	}
 }
 
-// computeLocation computes the location from token positions.
+// computeLocation sets the location to span the tokens from StartPos up to
+// EndPos.  An empty match gets an empty location at its start token.  A final
+// EOF token is not included, so the goal rule does not span trailing comments.
 func (n *Node) computeLocation() {
-	// This will be filled in based on tokens when available
-	// For now, use default location
-	n.Location = Location{}
+	n.Location = EmptyLocation()
+	if n.ParseResult == nil || n.ParseResult.lexer == nil {
+		return
+	}
+	tokens := n.ParseResult.lexer.Tokens
+	if int(n.StartPos) >= len(tokens) {
+		return
+	}
+	first := tokens[n.StartPos].Location
+	if n.EndPos <= n.StartPos {
+		n.Location = NewLocation(first.Filepath, first.Pos, 0, first.Line)
+		return
+	}
+	endPos := n.EndPos
+	if int(endPos) > len(tokens) {
+		endPos = uint32(len(tokens))
+	}
+	if endPos-1 > n.StartPos && tokens[endPos-1].IsEof() {
+		endPos--
+	}
+	n.Location = first.Merge(tokens[endPos-1].Location)
+}
+
+// SourceText returns the source text this node matched, from the start of its
+// first token to the end of its last, or "" for an empty match.
+func (n *Node) SourceText() string {
+	location := n.Location
+	if location.Filepath == nil || location.Len == 0 {
+		return ""
+	}
+	text := location.Filepath.Text
+	end := location.Pos + location.Len
+	if int(end) > len(text) {
+		return ""
+	}
+	return text[location.Pos:end]
+}
+
+// firstToken returns the first token this node matched, or nil for an empty
+// match.
+func (n *Node) firstToken() *Token {
+	if n.Token != nil {
+		return n.Token
+	}
+	if n.ParseResult == nil || n.ParseResult.lexer == nil || n.EndPos <= n.StartPos {
+		return nil
+	}
+	tokens := n.ParseResult.lexer.Tokens
+	if int(n.StartPos) >= len(tokens) {
+		return nil
+	}
+	return tokens[n.StartPos]
+}
+
+// DocComment returns the doc comment attached to this node, or "".  A doc
+// comment is attached to the outermost node below the root that starts with
+// the token following the comment, so for a list of definitions it belongs to
+// the definition, not to the first keyword or identifier inside it.
+func (n *Node) DocComment() string {
+	token := n.firstToken()
+	if token == nil || n.parent == nil {
+		return ""
+	}
+	if n.parent.parent != nil && n.parent.firstToken() == token {
+		return ""
+	}
+	return token.DocComment
+}
+
+// Child returns the first child matched by a pexpr labelled label, as in
+// target=IDENT, or nil if there is none.
+func (n *Node) Child(label string) *Node {
+	for child := n.firstChildNode; child != nil; child = child.nextChildNode {
+		if child.Label == label {
+			return child
+		}
+	}
+	return nil
 }
 
 // CountChildNodes returns the number of child nodes.
@@ -432,3 +647,395 @@ func (n *Node) IndexChildNode(index uint32) *Node {
 	}
 	return nil
 }
+
+// Depth returns how many ancestors this node has, which is 0 for the root.
+func (n *Node) Depth() int {
+	depth := 0
+	for parent := n.parent; parent != nil; parent = parent.parent {
+		depth++
+	}
+	return depth
+}
+
+// Height returns the number of edges on the longest path from this node down
+// to a leaf, which is 0 for a leaf.
+func (n *Node) Height() int {
+	height := 0
+	for child := n.firstChildNode; child != nil; child = child.nextChildNode {
+		height = max(height, child.Height()+1)
+	}
+	return height
+}
+
+// ============================================================================
+// Tree traversal
+// ============================================================================
+
+// Walk does a depth-first traversal of the tree rooted at this node.  pre is
+// called before a node's children are visited; if it returns false, the
+// children are skipped.  post is called after the children have been visited.
+// Either callback may be nil.  The next sibling is fetched before descending,
+// so callbacks may remove the node they are handed from its parent.
+func (n *Node) Walk(pre func(*Node) bool, post func(*Node)) {
+	if pre != nil && !pre(n) {
+		return
+	}
+	child := n.firstChildNode
+	for child != nil {
+		next := child.nextChildNode
+		child.Walk(pre, post)
+		child = next
+	}
+	if post != nil {
+		post(n)
+	}
+}
+
+// Find returns all nodes in this tree, including this one, that were
+// generated by the rule named ruleName, in depth-first order.
+func (n *Node) Find(ruleName string) []*Node {
+	var nodes []*Node
+	n.Walk(func(node *Node) bool {
+		if sym := node.GetRuleSym(); sym != nil && sym.Name == ruleName {
+			nodes = append(nodes, node)
+		}
+		return true
+	}, nil)
+	return nodes
+}
+
+// NodeAtToken returns the deepest node in this tree whose token range,
+// [StartPos, EndPos), contains the token at pos, or nil if this node's range
+// doesn't, such as for a cursor position in an IDE.
+func (n *Node) NodeAtToken(pos uint32) *Node {
+	if pos < n.StartPos || pos >= n.EndPos {
+		return nil
+	}
+	for child := n.firstChildNode; child != nil; child = child.nextChildNode {
+		if node := child.NodeAtToken(pos); node != nil {
+			return node
+		}
+	}
+	return n
+}
+
+// MatchedTokens returns the tokens of the leaves of this node's tree, in order.
+// Since weak keywords are never added to the tree, for a tree built by Parse
+// these are the strong tokens the tree matched, simplified or not.
+func (n *Node) MatchedTokens() []*Token {
+	var tokens []*Token
+	n.Walk(func(node *Node) bool {
+		if node.Token != nil {
+			tokens = append(tokens, node.Token)
+		}
+		return true
+	}, nil)
+	return tokens
+}
+
+// Tokens returns the leaf tokens under this node in source order, as
+// MatchedTokens does.
+func (n *Node) Tokens() []*Token {
+	return n.MatchedTokens()
+}
+
+// ============================================================================
+// Tree comparison
+// ============================================================================
+
+// Equal returns true if the trees rooted at n and other have the same shape,
+// with the same rule names and token types and text at each node.  Locations
+// and labels are not compared, so trees parsed from differently laid out
+// inputs can be equal.
+func (n *Node) Equal(other *Node) bool {
+	return n.Diff(other) == ""
+}
+
+// Diff returns "" if n and other are Equal, and otherwise describes the first
+// difference found in a depth-first walk, prefixed by its path from the root,
+// such as `expr/term[2]/2[0]: token "2" != "7"`.  Each step of the path names
+// a node by its rule or token text, followed by its index among its siblings.
+// A nil tree is described as nil, such as `nil != expr`.
+func (n *Node) Diff(other *Node) string {
+	if n == nil || other == nil {
+		if n == other {
+			return ""
+		} else if n == nil {
+			return "nil != " + other.pathName()
+		}
+		return n.pathName() + " != nil"
+	}
+	return n.diff(other, n.pathName())
+}
+
+// diff returns the first difference between the trees rooted at n and other,
+// which are found at path.
+func (n *Node) diff(other *Node, path string) string {
+	if (n.SyntaxError == nil) != (other.SyntaxError == nil) {
+		return fmt.Sprintf("%s: error %t != %t", path, n.SyntaxError != nil, other.SyntaxError != nil)
+	}
+	if name, otherName := n.ruleName(), other.ruleName(); name != otherName {
+		return fmt.Sprintf("%s: rule %q != %q", path, name, otherName)
+	}
+	if (n.Token == nil) != (other.Token == nil) {
+		return fmt.Sprintf("%s: token %s != %s", path, n.tokenText(), other.tokenText())
+	}
+	if n.Token != nil {
+		if n.Token.Type != other.Token.Type {
+			return fmt.Sprintf("%s: token type %s != %s", path, n.Token.Type, other.Token.Type)
+		}
+		if n.Token.GetName() != other.Token.GetName() {
+			return fmt.Sprintf("%s: token %s != %s", path, n.tokenText(), other.tokenText())
+		}
+	}
+	child := n.firstChildNode
+	otherChild := other.firstChildNode
+	for index := 0; child != nil && otherChild != nil; index++ {
+		childPath := fmt.Sprintf("%s/%s[%d]", path, child.pathName(), index)
+		if diff := child.diff(otherChild, childPath); diff != "" {
+			return diff
+		}
+		child = child.nextChildNode
+		otherChild = otherChild.nextChildNode
+	}
+	if child != nil || otherChild != nil {
+		return fmt.Sprintf("%s: %d children != %d", path, n.CountChildNodes(), other.CountChildNodes())
+	}
+	return ""
+}
+
+// ruleName returns the name of this node's rule, or "".
+func (n *Node) ruleName() string {
+	if sym := n.GetRuleSym(); sym != nil {
+		return sym.Name
+	}
+	return ""
+}
+
+// tokenText returns this node's token text quoted, or "none".
+func (n *Node) tokenText() string {
+	if n.Token == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%q", n.Token.GetName())
+}
+
+// pathName returns the name of this node in a Diff path: its rule name, its
+// token text, or ERROR for skipped tokens.
+func (n *Node) pathName() string {
+	if n.SyntaxError != nil {
+		return "ERROR"
+	}
+	if name := n.ruleName(); name != "" {
+		return name
+	}
+	if n.Token != nil {
+		return n.Token.GetName()
+	}
+	return "node"
+}
+
+// ============================================================================
+// Unparsing
+// ============================================================================
+
+// UnparseOptions controls how Unparse lays out source text.
+type UnparseOptions struct {
+	// Indent is written at the start of each line, once per level of nesting.
+	// Levels opened by INDENT tokens are indented by two spaces if it is empty.
+	Indent string
+	// IndentRules names the rules whose contents are nested one level deeper
+	// than the rule itself, such as "block".
+	IndentRules []string
+}
+
+// unparser accumulates the text written by UnparseWithOptions.
+type unparser struct {
+	options     UnparseOptions
+	b           strings.Builder
+	prevToken   *Token
+	atLineStart bool
+	indents     int // Levels opened by INDENT tokens and not yet closed
+}
+
+// Unparse returns source text for the tree rooted at this node, with the
+// tokens it matched separated by single spaces where needed.  Weak keywords
+// that were left out of the tree are restored from the input.  INDENT and
+// DEDENT tokens start a new line, indented one level more or less.
+func (n *Node) Unparse() string {
+	return n.UnparseWithOptions(UnparseOptions{})
+}
+
+// UnparseWithOptions is like Unparse, but indents lines as options say.
+func (n *Node) UnparseWithOptions(options UnparseOptions) string {
+	u := &unparser{options: options, atLineStart: true}
+	u.writeNode(n, 0)
+	return u.b.String()
+}
+
+// lexer returns the lexer this node's tokens came from, or nil.
+func (n *Node) lexer() *Lexer {
+	if n.ParseResult != nil && n.ParseResult.lexer != nil {
+		return n.ParseResult.lexer
+	}
+	if n.Token != nil {
+		return n.Token.Lexer
+	}
+	return nil
+}
+
+// writeNode writes the tokens in this node's range, with those not covered by
+// a child written at depth.  A node without a range, such as one made by
+// NewNodeFromToken, writes its token or its children.
+func (u *unparser) writeNode(n *Node, depth int) {
+	childDepth := depth
+	if sym := n.GetRuleSym(); sym != nil {
+		for _, name := range u.options.IndentRules {
+			if name == sym.Name {
+				childDepth++
+			}
+		}
+	}
+	lexer := n.lexer()
+	if lexer == nil || n.EndPos <= n.StartPos {
+		if n.Token != nil {
+			u.writeToken(n.Token, depth)
+		}
+		for child := n.firstChildNode; child != nil; child = child.nextChildNode {
+			u.writeNode(child, childDepth)
+		}
+		return
+	}
+	pos := n.StartPos
+	for child := n.firstChildNode; child != nil; child = child.nextChildNode {
+		if child.EndPos > child.StartPos && child.StartPos >= pos {
+			u.writeTokens(lexer, pos, child.StartPos, depth)
+			pos = child.EndPos
+		}
+		u.writeNode(child, childDepth)
+	}
+	u.writeTokens(lexer, pos, n.EndPos, depth)
+}
+
+// writeTokens writes the lexer's tokens from startPos up to endPos.
+func (u *unparser) writeTokens(lexer *Lexer, startPos uint32, endPos uint32, depth int) {
+	for pos := startPos; pos < endPos && int(pos) < len(lexer.Tokens); pos++ {
+		u.writeToken(lexer.Tokens[pos], depth)
+	}
+}
+
+// writeToken writes token's text, preceded by indentation at the start of a
+// line, or by a space if it does not attach to the previous token.  Newline,
+// INDENT and DEDENT tokens end the line instead.
+func (u *unparser) writeToken(token *Token, depth int) {
+	if token.IsEof() {
+		return
+	}
+	if token.IsKeyword("\n") {
+		u.b.WriteString("\n")
+		u.atLineStart = true
+		u.prevToken = nil
+		return
+	}
+	if token.Type == TokenTypeIndent || token.Type == TokenTypeDedent {
+		if token.Type == TokenTypeIndent {
+			u.indents++
+		} else if u.indents != 0 {
+			u.indents--
+		}
+		if !u.atLineStart {
+			u.b.WriteString("\n")
+			u.atLineStart = true
+			u.prevToken = nil
+		}
+		return
+	}
+	text := token.GetName()
+	if u.atLineStart {
+		for i := 0; i < depth; i++ {
+			u.b.WriteString(u.options.Indent)
+		}
+		indent := u.options.Indent
+		if indent == "" {
+			indent = "  "
+		}
+		u.b.WriteString(strings.Repeat(indent, u.indents))
+		u.atLineStart = false
+	} else if u.prevToken != nil && needsSpace(u.prevToken, token) {
+		u.b.WriteString(" ")
+	}
+	u.b.WriteString(text)
+	u.prevToken = token
+}
+
+// needsSpace returns true if a space belongs between prev and next: there is
+// none after an opening bracket or ".", before a closing bracket or
+// punctuation, or before the "(" or "[" of a call or index.
+func needsSpace(prev *Token, next *Token) bool {
+	if prev.IsKeyword("(") || prev.IsKeyword("[") || prev.IsKeyword(".") {
+		return false
+	}
+	for _, name := range []string{")", "]", ",", ";", "."} {
+		if next.IsKeyword(name) {
+			return false
+		}
+	}
+	if next.IsKeyword("(") || next.IsKeyword("[") {
+		return !(prev.Type == TokenTypeIdent || prev.IsKeyword(")") || prev.IsKeyword("]"))
+	}
+	return true
+}
+
+// ============================================================================
+// JSON serialization
+// ============================================================================
+
+// jsonNode is the JSON form of a Node.
+type jsonNode struct {
+	Rule      string        `json:"rule,omitempty"`
+	Label     string        `json:"label,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Text      string        `json:"text,omitempty"`
+	TokenType string        `json:"tokenType,omitempty"`
+	Location  *jsonLocation `json:"location,omitempty"`
+	Children  []*Node       `json:"children,omitempty"`
+}
+
+// jsonLocation is the JSON form of a Location.
+type jsonLocation struct {
+	Line uint32 `json:"line"`
+	Pos  uint32 `json:"pos"`
+	Len  uint32 `json:"len"`
+}
+
+// MarshalJSON encodes the tree rooted at this node as JSON.  Each node has the
+// name of its rule, or the text and type of its token, or the error message
+// and skipped text of an error node, its location if known, and its children.
+// Empty fields are omitted.
+func (n *Node) MarshalJSON() ([]byte, error) {
+	jn := jsonNode{Label: n.Label, Children: n.ChildNodes()}
+	if sym := n.GetRuleSym(); sym != nil {
+		jn.Rule = sym.Name
+	}
+	if n.Token != nil {
+		jn.Text = n.Token.GetName()
+		jn.TokenType = n.Token.Type.String()
+	}
+	if n.SyntaxError != nil {
+		jn.Error = n.SyntaxError.Message
+		jn.Text = n.SourceText()
+	}
+	if n.Location.Line != 0 {
+		jn.Location = &jsonLocation{Line: n.Location.Line, Pos: n.Location.Pos, Len: n.Location.Len}
+	}
+	return json.Marshal(jn)
+}
+
+// ToJSON returns the tree rooted at this node as indented JSON.
+func (n *Node) ToJSON() (string, error) {
+	data, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,606 @@
+// Copyright 2023 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const exprGrammar = `expr := term (("+" | "-") term)*
+term := INTEGER`
+
+func TestNodeFind(t *testing.T) {
+	peg := newTestPeg(t, exprGrammar)
+	node := parseTestInput(t, peg, "1 + 2 - 3")
+
+	terms := node.Find("term")
+	if len(terms) != 3 {
+		t.Fatalf("Expected 3 term nodes, got %d:%s", len(terms), node.ToString())
+	}
+	for i, term := range terms {
+		if term.Token != nil || term.CountChildNodes() != 1 {
+			t.Errorf("term %d should have a single INTEGER child", i)
+		}
+	}
+	if exprs := node.Find("expr"); len(exprs) != 1 || exprs[0] != node {
+		t.Errorf("Expected the root to be the only expr node")
+	}
+	if found := node.Find("nosuchrule"); len(found) != 0 {
+		t.Errorf("Expected no nodes for an unknown rule, got %d", len(found))
+	}
+}
+
+func TestNodeNavigation(t *testing.T) {
+	peg := newTestPeg(t, exprGrammar)
+	node := parseTestInput(t, peg, "1 + 2 - 3")
+
+	// Walk down the first children to a leaf, then climb back to the root.
+	var path []*Node
+	leaf := node
+	for leaf.FirstChildNode() != nil {
+		path = append(path, leaf)
+		leaf = leaf.FirstChildNode()
+	}
+	if leaf.Token == nil || leaf.Token.GetName() != "1" {
+		t.Fatalf("Expected the first leaf to be 1:%s", node.ToString())
+	}
+	for up := leaf.Parent(); up != nil; up = up.Parent() {
+		if len(path) == 0 || path[len(path)-1] != up {
+			t.Fatalf("Parent() left the path down from the root")
+		}
+		path = path[:len(path)-1]
+	}
+	if len(path) != 0 {
+		t.Errorf("Parent() stopped %d nodes below the root", len(path))
+	}
+
+	children := node.ChildNodes()
+	for i, child := range children {
+		if child.Parent() != node {
+			t.Errorf("Child %d has the wrong parent", i)
+		}
+		var prev, next *Node
+		if i > 0 {
+			prev = children[i-1]
+		}
+		if i+1 < len(children) {
+			next = children[i+1]
+		}
+		if child.PrevSibling() != prev || child.NextSibling() != next {
+			t.Errorf("Child %d has the wrong siblings", i)
+		}
+	}
+	if node.Parent() != nil || node.NextSibling() != nil || node.PrevSibling() != nil {
+		t.Errorf("Expected the root to have no parent or siblings")
+	}
+}
+
+func TestNodeWalk(t *testing.T) {
+	peg := newTestPeg(t, exprGrammar)
+	node := parseTestInput(t, peg, "1 + 2")
+
+	var pre, post []*Node
+	node.Walk(func(n *Node) bool {
+		pre = append(pre, n)
+		return true
+	}, func(n *Node) {
+		post = append(post, n)
+	})
+	if len(pre) != len(post) {
+		t.Fatalf("pre visited %d nodes, post visited %d", len(pre), len(post))
+	}
+	if pre[0] != node || post[len(post)-1] != node {
+		t.Errorf("Root should be visited first by pre and last by post")
+	}
+
+	// Pruning at term nodes should hide their INTEGER tokens, leaving "+" and
+	// the EOF appended to the goal rule.
+	tokens := 0
+	node.Walk(func(n *Node) bool {
+		if n.Token != nil {
+			tokens++
+		}
+		sym := n.GetRuleSym()
+		return sym == nil || sym.Name != "term"
+	}, nil)
+	if tokens != 2 {
+		t.Errorf("Expected only the \"+\" and EOF tokens to be visited, got %d tokens", tokens)
+	}
+}
+
+func TestNodeMatchedTokens(t *testing.T) {
+	grammar := `goal := statement+
+statement : call | assign
+call := IDENT '(' args? ')' ';'
+args : expr (',' expr)*
+assign := IDENT "=" expr ';'
+expr : INTEGER | IDENT`
+	text := "f(1, x); y = 2; g();"
+	for _, simplify := range []bool{false, true} {
+		peg := newTestPeg(t, grammar)
+		peg.SetSimplifyNodes(simplify)
+		node := parseTestInput(t, peg, text)
+
+		var strong []string
+		for _, token := range node.ParseResult.Lexer().Tokens {
+			if pexpr, ok := token.Pexpr.(*Pexpr); ok && pexpr != nil && !pexpr.Weak {
+				strong = append(strong, token.GetName())
+			}
+		}
+		var matched []string
+		for _, token := range node.MatchedTokens() {
+			matched = append(matched, token.GetName())
+		}
+		if strings.Join(matched, " ") != strings.Join(strong, " ") {
+			t.Errorf("simplify=%v: expected tokens %v, got %v", simplify, strong, matched)
+		}
+		if got := strings.Join(matched, " "); got != "f 1 x y = 2 g EOF" {
+			t.Errorf("simplify=%v: expected weak punctuation to be dropped, got %s", simplify, got)
+		}
+	}
+}
+
+func TestNodeLocation(t *testing.T) {
+	peg := newTestPeg(t, `goal := call+
+call := IDENT "(" INTEGER* ")"`)
+	node := parseTestInput(t, peg, "f(1 2) g()")
+
+	calls := node.Find("call")
+	if len(calls) != 2 {
+		t.Fatalf("Expected 2 calls:%s", node.ToString())
+	}
+	location := calls[0].Location
+	if location.Filepath == nil || location.Pos != 0 || location.Len != 6 || location.Line != 1 {
+		t.Errorf("Expected f(1 2) to be at 0 with length 6, got %d %d", location.Pos, location.Len)
+	}
+	if location = calls[1].Location; location.Pos != 7 || location.Len != 3 {
+		t.Errorf("Expected g() to be at 7 with length 3, got %d %d", location.Pos, location.Len)
+	}
+
+	// An empty match is at its start token, the ")" of g().
+	empty := NewNode(nil, &ParseResult{lexer: node.ParseResult.Lexer()}, 7, 7)
+	if location = empty.Location; location.Pos != 9 || location.Len != 0 || location.Line != 1 {
+		t.Errorf("Expected empty location at 9, got %d %d", location.Pos, location.Len)
+	}
+}
+
+func TestNodeSourceText(t *testing.T) {
+	peg := newTestPeg(t, `goal := IDENT addOp
+addOp := "+" IDENT`)
+	node := parseTestInput(t, peg, "foo +   bar // done")
+
+	if text := node.SourceText(); text != "foo +   bar" {
+		t.Errorf("Expected the whole input without the comment, got %q", text)
+	}
+	addOps := node.Find("addOp")
+	if len(addOps) != 1 {
+		t.Fatalf("Expected 1 addOp:%s", node.ToString())
+	}
+	if text := addOps[0].SourceText(); text != "+   bar" {
+		t.Errorf("Expected \"+   bar\", got %q", text)
+	}
+	if text := addOps[0].LastChildNode().SourceText(); text != "bar" {
+		t.Errorf("Expected \"bar\", got %q", text)
+	}
+	if text := node.LastChildNode().SourceText(); text != "" {
+		t.Errorf("Expected EOF to have no text, got %q", text)
+	}
+}
+
+func TestNodeDocComment(t *testing.T) {
+	peg := newTestPeg(t, `file := (definition | '\n')*
+definition := 'func' IDENT '\n'`)
+	input := "/// Adds numbers.\n///   Returns the sum.\nfunc add\n\n" +
+		"/**\n * Block doc.\n *\n * More.\n */\nfunc sub\n" +
+		"/// Not a doc comment.\n// Plain comment.\nfunc mul\n" +
+		"/// Orphaned.\n\nfunc div\n"
+	node := parseTestInput(t, peg, input)
+
+	definitions := node.Find("definition")
+	expected := []string{"Adds numbers.\n  Returns the sum.", "Block doc.\n\nMore.", "", ""}
+	if len(definitions) != len(expected) {
+		t.Fatalf("Expected %d definitions, got %d:%s", len(expected), len(definitions), node.ToString())
+	}
+	for i, definition := range definitions {
+		if docComment := definition.DocComment(); docComment != expected[i] {
+			t.Errorf("definition %d: expected doc comment %q, got %q", i, expected[i], docComment)
+		}
+		if docComment := definition.FirstChildNode().DocComment(); docComment != "" {
+			t.Errorf("definition %d: expected no doc comment on its name, got %q", i, docComment)
+		}
+	}
+	if docComment := node.DocComment(); docComment != "" {
+		t.Errorf("Expected no doc comment on the root, got %q", docComment)
+	}
+}
+
+func TestNodeChildByLabel(t *testing.T) {
+	peg := newTestPeg(t, `assign := target=IDENT "=" value=expr
+expr := expr "+" INTEGER | INTEGER`)
+	if s := peg.FindRule(NewSym("assign")).ToString(); s != `assign: target=IDENT "=" value=expr` {
+		t.Errorf("Unexpected rule string %s", s)
+	}
+	node := parseTestInput(t, peg, "x = 1 + 2")
+
+	target := node.Child("target")
+	if target == nil || target.Token == nil || target.Token.GetName() != "x" {
+		t.Fatalf("Expected target to be x:%s", node.ToString())
+	}
+	value := node.Child("value")
+	if value == nil || value.GetRuleSym() == nil || value.GetRuleSym().Name != "expr" {
+		t.Fatalf("Expected value to be an expr:%s", node.ToString())
+	}
+	if value.SourceText() != "1 + 2" {
+		t.Errorf("Expected value to match 1 + 2, got %q", value.SourceText())
+	}
+	if node.Child("nosuchlabel") != nil || value.Child("value") != nil {
+		t.Errorf("Expected no children for unknown labels")
+	}
+}
+
+func TestNodeUnparse(t *testing.T) {
+	peg := newTestPeg(t, `file := (statement | '\n')*
+statement := IDENT '(' args? ')' '\n' | 'if' IDENT block
+block := '{' '\n' (statement | '\n')* '}' '\n'
+args := IDENT (',' IDENT)*`)
+	node := parseTestInput(t, peg, "if  x {\nf( a,b )\nif y {\ng()\n}\n}")
+
+	expected := "if x {\nf(a, b)\nif y {\ng()\n}\n}\n"
+	if text := node.Unparse(); text != expected {
+		t.Errorf("Expected %q, got %q", expected, text)
+	}
+	expected = "if x {\n  f(a, b)\n  if y {\n    g()\n  }\n}\n"
+	options := UnparseOptions{Indent: "  ", IndentRules: []string{"block"}}
+	if text := node.UnparseWithOptions(options); text != expected {
+		t.Errorf("Expected %q, got %q", expected, text)
+	}
+	args := node.Find("args")
+	if len(args) != 1 || args[0].Unparse() != "a, b" {
+		t.Errorf("Expected args a, b:%s", node.ToString())
+	}
+}
+
+// TestNodeUnparseIndent verifies INDENT and DEDENT tokens are unparsed as
+// newlines and indentation, so the text parses to the same tree.
+func TestNodeUnparseIndent(t *testing.T) {
+	peg := newTestPeg(t, `goal := statement+
+statement := "if" IDENT ":" block | IDENT
+block := INDENT statement+ DEDENT`)
+	node := parseTestInput(t, peg, "if a:\n    if b:\n      x\n    y\nz\n")
+
+	expected := "if a :\n  if b :\n    x\n  y\nz"
+	text := node.Unparse()
+	if text != expected {
+		t.Errorf("Expected %q, got %q", expected, text)
+	}
+	if reparsed := parseTestInput(t, peg, text); reparsed.ToString() != node.ToString() {
+		t.Errorf("Expected the unparsed text to parse to the same tree:%s", reparsed.ToString())
+	}
+	expected = "if a :\n\tif b :\n\t\tx\n\ty\nz"
+	if text := node.UnparseWithOptions(UnparseOptions{Indent: "\t"}); text != expected {
+		t.Errorf("Expected %q, got %q", expected, text)
+	}
+}
+
+func TestNodeToJSON(t *testing.T) {
+	peg := newTestPeg(t, exprGrammar)
+	node := parseTestInput(t, peg, "1 + 23")
+
+	text, err := node.ToJSON()
+	if err != nil {
+		t.Fatalf("ToJSON failed: %v", err)
+	}
+	var root map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &root); err != nil {
+		t.Fatalf("Failed to unmarshal JSON: %v\n%s", err, text)
+	}
+	if root["rule"] != "expr" {
+		t.Errorf("Expected root rule expr, got %v", root["rule"])
+	}
+	if _, ok := root["text"]; ok {
+		t.Errorf("Rule nodes should have no text field")
+	}
+
+	// expr(term(1) "+" term(23) EOF)
+	children, ok := root["children"].([]interface{})
+	if !ok || len(children) != 4 {
+		t.Fatalf("Expected 4 children of expr:\n%s", text)
+	}
+	term := children[2].(map[string]interface{})
+	if term["rule"] != "term" {
+		t.Errorf("Expected third child to be a term, got %v", term["rule"])
+	}
+	leaf := term["children"].([]interface{})[0].(map[string]interface{})
+	if leaf["text"] != "23" || leaf["tokenType"] != "INTEGER" {
+		t.Errorf("Expected INTEGER leaf 23, got %v", leaf)
+	}
+	if _, ok := leaf["children"]; ok {
+		t.Errorf("Leaf nodes should have no children field")
+	}
+	location := leaf["location"].(map[string]interface{})
+	if location["line"] != 1.0 || location["pos"] != 4.0 || location["len"] != 2.0 {
+		t.Errorf("Unexpected leaf location %v", location)
+	}
+	plus := children[1].(map[string]interface{})
+	if plus["text"] != "+" || plus["tokenType"] != "KEYWORD" {
+		t.Errorf("Expected keyword +, got %v", plus)
+	}
+}
+
+func TestNodeToDOT(t *testing.T) {
+	peg := newTestPeg(t, `goal := call+
+call := IDENT "(" STRING ")"`)
+	node := parseTestInput(t, peg, `print("say \"hi\"\n")`)
+
+	dot := node.ToDOT()
+	if !strings.HasPrefix(dot, "digraph parseTree {\n") || !strings.HasSuffix(dot, "}\n") {
+		t.Errorf("Expected a digraph:\n%s", dot)
+	}
+	for _, label := range []string{
+		`[label="goal"]`,
+		`[label="call"]`,
+		`[label="print", shape=box]`,
+		`[label="(", shape=box]`,
+		`[label="\"say \\\"hi\\\"\\n\"", shape=box]`,
+	} {
+		if !strings.Contains(dot, label) {
+			t.Errorf("Expected %s in:\n%s", label, dot)
+		}
+	}
+	numNodes := 0
+	node.Walk(func(*Node) bool {
+		numNodes++
+		return true
+	}, nil)
+	if edges := strings.Count(dot, " -> "); edges != numNodes-1 {
+		t.Errorf("Expected %d edges, got %d:\n%s", numNodes-1, edges, dot)
+	}
+}
+
+func TestNodeEqualAndDiff(t *testing.T) {
+	peg := newTestPeg(t, exprGrammar)
+	node := parseTestInput(t, peg, "1 + 2 - 3")
+
+	// Locations are not compared, so layout does not matter.
+	same := parseTestInput(t, peg, "1+2\n  -3")
+	if !node.Equal(same) || node.Diff(same) != "" {
+		t.Errorf("Expected identical parses to be equal, got: %s", node.Diff(same))
+	}
+
+	cases := []struct {
+		text string
+		diff string
+	}{
+		{"1 + 7 - 3", `expr/term[2]/2[0]: token "2" != "7"`},
+		{"1 + 2 + 3", `expr/-[3]: token "-" != "+"`},
+		{"1 + 2", `expr/-[3]: token type KEYWORD != EOF`},
+	}
+	for _, c := range cases {
+		other := parseTestInput(t, peg, c.text)
+		if node.Equal(other) {
+			t.Errorf("Expected %q to differ", c.text)
+		}
+		if diff := node.Diff(other); diff != c.diff {
+			t.Errorf("Expected diff %q for %q, got %q", c.diff, c.text, diff)
+		}
+	}
+
+	same.RemoveChildNode(same.LastChildNode())
+	if diff := node.Diff(same); diff != "expr: 6 children != 5" {
+		t.Errorf("Expected a child count mismatch, got %q", diff)
+	}
+
+	// Rule names are compared, even when the tokens match.
+	other := parseTestInput(t, newTestPeg(t, `expr := factor (("+" | "-") factor)*
+factor := INTEGER`), "1 + 2 - 3")
+	if diff := node.Diff(other); diff != `expr/term[0]: rule "term" != "factor"` {
+		t.Errorf("Expected a rule name mismatch, got %q", diff)
+	}
+
+	// Nil trees are described rather than dereferenced.
+	var none *Node
+	if diff := none.Diff(node); diff != "nil != expr" {
+		t.Errorf("Expected a nil receiver to be described, got %q", diff)
+	}
+	if diff := node.Diff(nil); diff != "expr != nil" {
+		t.Errorf("Expected a nil argument to be described, got %q", diff)
+	}
+	if diff := none.Diff(nil); diff != "" {
+		t.Errorf("Expected nil trees to be equal, got %q", diff)
+	}
+}
+
+func TestNodeAtToken(t *testing.T) {
+	peg := newTestPeg(t, exprGrammar)
+	node := parseTestInput(t, peg, "1 + 2 - 3")
+
+	// Tokens: 1 + 2 - 3 EOF.  The root's range includes the EOF, but its text
+	// doesn't.
+	if node.StartPos != 0 || node.EndPos != 6 || node.SourceText() != "1 + 2 - 3" {
+		t.Errorf("Expected the root to cover tokens [0, 6) and text %q, got [%d, %d) and %q",
+			"1 + 2 - 3", node.StartPos, node.EndPos, node.SourceText())
+	}
+	for pos, text := range []string{"1", "+", "2", "-", "3"} {
+		found := node.NodeAtToken(uint32(pos))
+		if found == nil || found.Token == nil || found.Token.GetName() != text {
+			t.Errorf("Expected the %s leaf at token %d:%s", text, pos, node.ToString())
+			continue
+		}
+		parent := found.Parent()
+		isTerm := parent != nil && parent.GetRuleSym() != nil && parent.GetRuleSym().Name == "term"
+		if isTerm != (pos%2 == 0) {
+			t.Errorf("Expected only numbers to be in term nodes, at token %d", pos)
+		}
+	}
+	if found := node.NodeAtToken(5); found == nil || !found.Token.IsEof() {
+		t.Errorf("Expected the EOF leaf at token 5")
+	}
+	if node.NodeAtToken(6) != nil || node.NodeAtToken(1000) != nil {
+		t.Errorf("Expected nil for positions past the end")
+	}
+	if term := node.Find("term")[1]; term.NodeAtToken(0) != nil || term.NodeAtToken(2) != term.FirstChildNode() {
+		t.Errorf("Expected a subtree to find only its own tokens")
+	}
+}
+
+func TestRuleDisplayName(t *testing.T) {
+	peg := newTestPeg(t, `expr := term (("+" | "-") term)*
+term -> Number := INTEGER`)
+	term := peg.RuleByName("term")
+	if term == nil || term.DisplayName == nil || term.DisplayName.Name != "Number" {
+		t.Fatalf("Expected rule term to be displayed as Number")
+	}
+	if s := term.ToString(); s != "term -> Number: INTEGER" {
+		t.Errorf("Expected the display name in the rule's string, got %q", s)
+	}
+	node := parseTestInput(t, peg, "1 + 2")
+	s := node.ToString()
+	if strings.Contains(s, "term") || strings.Count(s, "Number") != 2 {
+		t.Errorf("Expected terms to be shown as Number, got:%s", s)
+	}
+	if len(node.Find("Number")) != 2 {
+		t.Errorf("Expected to find nodes by their display name")
+	}
+}
+
+func TestNodeDepthAndHeight(t *testing.T) {
+	peg := newTestPeg(t, exprGrammar)
+	node := parseTestInput(t, peg, "1 + 2 - 3")
+	if node.Depth() != 0 || node.Height() != 2 {
+		t.Errorf("Expected the root at depth 0 with height 2, got %d and %d:%s", node.Depth(), node.Height(), node.ToString())
+	}
+	for _, term := range node.Find("term") {
+		leaf := term.FirstChildNode()
+		if term.Depth() != 1 || term.Height() != 1 || leaf.Depth() != 2 || leaf.Height() != 0 {
+			t.Errorf("Expected term at depth 1 and its INTEGER at depth 2, got %d and %d", term.Depth(), leaf.Depth())
+		}
+	}
+	if plus := node.IndexChildNode(1); plus.Token == nil || plus.Depth() != 1 || plus.Height() != 0 {
+		t.Errorf("Expected \"+\" to be a leaf at depth 1")
+	}
+
+	// Simplifying merges away weak rules, which shortens the tree.
+	peg = newTestPeg(t, `expr := value
+value : inner
+inner : INTEGER`)
+	peg.SetSimplifyNodes(false)
+	node = parseTestInput(t, peg, "7")
+	if node.Height() != 3 {
+		t.Errorf("Expected an unsimplified height of 3, got %d:%s", node.Height(), node.ToString())
+	}
+	node.Simplify()
+	if node.Height() != 1 || node.FirstChildNode().Depth() != 1 {
+		t.Errorf("Expected a simplified height of 1, got %d:%s", node.Height(), node.ToString())
+	}
+}
+
+func TestNodeWithoutPexpr(t *testing.T) {
+	lexer := newLexer("a + b")
+	createKeyword(lexer.Keytab, "+")
+	tokens, err := lexer.AllTokens()
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	root := NewNode(nil, nil, 0, 3)
+	for _, token := range tokens[:3] {
+		NewNodeFromToken(root, token)
+	}
+	// A Pexpr of another type is treated the same as none.
+	tokens[2].Pexpr = "not a pexpr"
+	if s := root.ToString(); s != "(a+b)" {
+		t.Errorf("Expected unquoted tokens, got %q", s)
+	}
+	// Tokens matched by no pexpr are weak, so they are simplified away.
+	root.Simplify()
+	if count := root.CountChildNodes(); count != 0 {
+		t.Errorf("Expected the tokens to be removed, got %d children", count)
+	}
+}
+
+// TestNodeMutation verifies ReplaceChild, InsertBefore and InsertAfter keep
+// the sibling and parent links consistent.
+func TestNodeMutation(t *testing.T) {
+	newChild := func(parent *Node, label string) *Node {
+		node := NewNode(parent, nil, 0, 0)
+		node.Label = label
+		return node
+	}
+	// checkChildren verifies the labels of root's children, walking both ways.
+	checkChildren := func(root *Node, expected string) {
+		t.Helper()
+		var forward, backward []string
+		var prev *Node
+		for child := root.FirstChildNode(); child != nil; child = child.NextSibling() {
+			if child.Parent() != root || child.PrevSibling() != prev {
+				t.Errorf("Bad links at %s", child.Label)
+			}
+			forward = append(forward, child.Label)
+			prev = child
+		}
+		if root.LastChildNode() != prev {
+			t.Errorf("Expected the last child to be %v", prev)
+		}
+		for child := root.LastChildNode(); child != nil; child = child.PrevSibling() {
+			backward = append([]string{child.Label}, backward...)
+		}
+		got := strings.Join(forward, " ")
+		if got != expected || strings.Join(backward, " ") != expected {
+			t.Errorf("Expected children %q, got %q forward and %q backward", expected, got, strings.Join(backward, " "))
+		}
+		if count := root.CountChildNodes(); int(count) != len(forward) {
+			t.Errorf("Expected %d children, got %d", len(forward), count)
+		}
+	}
+
+	root := NewNode(nil, nil, 0, 0)
+	a := newChild(root, "a")
+	b := newChild(root, "b")
+	c := newChild(root, "c")
+	checkChildren(root, "a b c")
+
+	x := newChild(nil, "x")
+	root.ReplaceChild(b, x)
+	checkChildren(root, "a x c")
+	if b.Parent() != nil || b.PrevSibling() != nil || b.NextSibling() != nil {
+		t.Errorf("Expected the replaced node to be unlinked")
+	}
+	root.ReplaceChild(a, b)
+	root.ReplaceChild(c, newChild(nil, "d"))
+	checkChildren(root, "b x d")
+
+	root.InsertBefore(b, a)
+	root.InsertAfter(root.LastChildNode(), c)
+	root.InsertBefore(x, newChild(nil, "y"))
+	root.InsertAfter(x, newChild(nil, "z"))
+	checkChildren(root, "a b y x z d c")
+
+	// Nodes with parents are moved, within a parent or between them.
+	root.InsertAfter(c, a)
+	root.InsertBefore(a, b)
+	checkChildren(root, "y x z d c b a")
+	other := NewNode(nil, nil, 0, 0)
+	o := newChild(other, "o")
+	other.ReplaceChild(o, x)
+	checkChildren(root, "y z d c b a")
+	checkChildren(other, "x")
+
+	// References that are not children are ignored.
+	root.InsertBefore(o, newChild(nil, "w"))
+	root.InsertAfter(nil, newChild(nil, "w"))
+	root.ReplaceChild(x, a)
+	checkChildren(root, "y z d c b a")
+}
@@ -14,7 +14,11 @@
 
 package parser
 
-import "fmt"
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
 
 // ============================================================================
 // MAIN ENTRY POINT: Parse grammar rules from .syn file
@@ -22,43 +26,157 @@ import "fmt"
 
 // ParseRules parses all rules from the syntax file.
 // This is Phase 2 implementation of the recursive descent parser for .syn files.
+// Any grammar parsed before is replaced, so a Peg can be reused for another
+// grammar by calling InsertLexer first.  It must not be called while inputs
+// are being parsed.
 func (p *Peg) ParseRules() error {
 	if p.lexer == nil {
 		return fmt.Errorf("ParseRules: no lexer available")
 	}
+	p.resetGrammar()
 
 	p.lexer.EnableWeakStrings(true)
 
-	for !p.lexer.Eof() {
-		err := p.parseRule()
-		if err != nil {
-			// Check if error is due to EOF - if so, we're done
-			if p.lexer.Eof() {
-				break
-			}
-			return err
-		}
+	p.warnings = nil
+	p.includeStack = []string{filepath.Clean(p.lexer.Filepath.Name)}
+	defer func() { p.includeStack = nil }()
+	if err := p.parseRuleList(); err != nil {
+		return err
+	}
+	p.moveGoalRuleFirst()
+
+	// Instantiate parameterized rules for the arguments passed to them
+	if err := p.instantiateParamRules(); err != nil {
+		return err
 	}
 
 	// Assign keyword numbers
 	p.numKeywords = p.Keytab.SetKeywordNums()
 
 	// Bind nonterminals to rules
-	if !p.bindNonterms() {
-		return fmt.Errorf("ParseRules: failed to bind nonterminals")
+	if undefined := p.bindNonterms(); len(undefined) != 0 {
+		return &UndefinedRuleError{Refs: undefined}
 	}
 
 	// Check for unused rules
-	if !p.checkForUnusedRules() {
-		return fmt.Errorf("ParseRules: unused rules detected")
+	if err := p.checkForUnusedRules(); err != nil {
+		return err
 	}
 
 	// Find first sets for all rules (includes left-recursion detection)
 	p.findFirstSets()
+	p.findFollowSets()
+	p.checkPexprs()
+
+	// Only direct left recursion is parsed correctly
+	if !p.allowIndirectLeftRecursion {
+		if cycle := p.findIndirectLeftRecursion(); cycle != nil {
+			names := make([]string, len(cycle))
+			for i, rule := range cycle {
+				names[i] = rule.Sym.Name
+			}
+			return fmt.Errorf("ParseRules: indirect left recursion at line %d: %s",
+				cycle[0].Location.Line, strings.Join(names, " -> "))
+		}
+	}
 
+	// Parsers only read the grammar from here on, so it can be shared
+	p.eofPexpr = NewPexpr(PexprTypeTerm, EmptyLocation())
+	p.eofPexpr.TokenType = TokenTypeEof
+	p.eofPexpr.Sym = p.kwEof.Sym
+	if p.Keytab.Lookup("\n") != nil {
+		p.newlinePexpr = p.newNewlinePexpr(EmptyLocation())
+	}
+	p.initialized = true
 	return nil
 }
 
+// parseRuleList parses the rules and include directives of the current lexer's
+// file.
+func (p *Peg) parseRuleList() error {
+	for {
+		// Stop at EOF, which may follow newlines and comments
+		token, err := p.peekToken(1)
+		if err != nil {
+			return err
+		}
+		if token.IsEof() {
+			return nil
+		}
+		included, err := p.parseInclude()
+		if err == nil && !included {
+			err = p.parseRule()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ============================================================================
+// parseInclude - Parse an include directive: include "path.syn"
+// ============================================================================
+
+// parseInclude parses the rules of the file named by an include directive, if
+// the next tokens are one, and returns true if they were.  Relative paths are
+// relative to the including file's directory.
+func (p *Peg) parseInclude() (bool, error) {
+	token, err := p.peekToken(1)
+	if err != nil || token.Type != TokenTypeIdent || token.Value.Val.(*Sym).Name != "include" {
+		return false, err
+	}
+	pathToken, err := p.peekToken(2)
+	if err != nil || pathToken.Type != TokenTypeString {
+		return false, err
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := p.parseToken(); err != nil {
+			return false, err
+		}
+	}
+
+	path := pathToken.Value.Val.(string)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(p.lexer.Filepath.Name), path)
+	}
+	path = filepath.Clean(path)
+	for i, includingPath := range p.includeStack {
+		if includingPath == path {
+			cycle := append(append([]string{}, p.includeStack[i:]...), path)
+			return false, fmt.Errorf("parseInclude: include cycle at line %d: %s",
+				token.Location.Line, strings.Join(cycle, " -> "))
+		}
+	}
+
+	lexer, err := NewLexer(NewFilepath(path, nil, false), p.PegKeytab, true)
+	if err != nil {
+		return false, fmt.Errorf("parseInclude: failed to include %s at line %d: %v", path, token.Location.Line, err)
+	}
+	lexer.EnableWeakStrings(true)
+	includingLexer := p.lexer
+	p.InsertLexer(lexer)
+	p.includeStack = append(p.includeStack, path)
+	err = p.parseRuleList()
+	p.includeStack = p.includeStack[:len(p.includeStack)-1]
+	p.InsertLexer(includingLexer)
+	p.savedTokens = nil
+	return err == nil, err
+}
+
+// moveGoalRuleFirst makes the first rule of the top-level file the first
+// ordered rule, which is the goal rule, even if it came after includes.
+func (p *Peg) moveGoalRuleFirst() {
+	for rule := p.firstOrderedRule; rule != nil; rule = rule.nextOrderedRule {
+		if rule.Location.Filepath == p.lexer.Filepath {
+			if rule != p.firstOrderedRule {
+				p.RemoveOrderedRule(rule)
+				p.InsertOrderedRule(rule)
+			}
+			return
+		}
+	}
+}
+
 // ============================================================================
 // parseRule - Parse a single rule: name := pexpr ;
 // ============================================================================
@@ -70,6 +188,18 @@ func (p *Peg) parseRule() error {
 		return err
 	}
 
+	// Parse parameters of a parameterized rule: name(param, ...)
+	params, err := p.parseRuleParams(identToken)
+	if err != nil {
+		return err
+	}
+
+	// Parse the optional name shown in the tree: name -> displayName
+	displayName, err := p.parseDisplayName()
+	if err != nil {
+		return err
+	}
+
 	// Parse ':' or ':='
 	token, err := p.parseToken()
 	if err != nil {
@@ -93,6 +223,12 @@ func (p *Peg) parseRule() error {
 		return err
 	}
 
+	// Parse optional %error and %precedence annotations
+	errorMessage, precedence, err := p.parseAnnotations(pexpr)
+	if err != nil {
+		return err
+	}
+
 	// Verify we're at end of rule
 	if !p.endOfRule() {
 		return fmt.Errorf("parseRule: unexpected token at end of rule")
@@ -100,8 +236,27 @@ func (p *Peg) parseRule() error {
 
 	// Create the rule and add it
 	sym := identToken.Value.Val.(*Sym)
+	other := p.FindRule(sym)
+	if other == nil {
+		other = p.findParamRule(sym)
+	}
+	if other != nil {
+		return fmt.Errorf("parseRule: duplicate rule %s at line %d, first defined in %s at line %d",
+			sym.Name, identToken.Location.Line, other.Location.Filepath.Name, other.Location.Line)
+	}
 	rule := NewRule(p, sym, pexpr, identToken.Location)
 	rule.Weak = isWeak
+	rule.ErrorMessage = errorMessage
+	rule.Precedence = precedence
+	rule.DisplayName = displayName
+	rule.Doc = identToken.DocComment
+
+	// Parameterized rules are only instantiated, in instantiateParamRules
+	if params != nil {
+		rule.Params = params
+		p.paramRules = append(p.paramRules, rule)
+		return nil
+	}
 
 	// Add to Peg (both hashed and ordered)
 	p.InsertRule(rule)
@@ -110,6 +265,60 @@ func (p *Peg) parseRule() error {
 	return nil
 }
 
+// parseRuleParams parses the parameter list of a parameterized rule, such as
+// (elem, sep) in list(elem, sep) := ..., if one follows identToken.  It
+// returns nil if there is none.
+func (p *Peg) parseRuleParams(identToken *Token) ([]*Sym, error) {
+	next, err := p.peekToken(1)
+	if err != nil || !p.isAdjacentOpenParen(identToken, next) {
+		return nil, err
+	}
+	if _, err := p.parseToken(); err != nil {
+		return nil, err
+	}
+	var params []*Sym
+	for {
+		paramToken, err := p.parseIdent()
+		if err != nil {
+			return nil, err
+		}
+		param := paramToken.Value.Val.(*Sym)
+		for _, other := range params {
+			if other == param {
+				return nil, fmt.Errorf("parseRuleParams: duplicate parameter %s at line %d", param.Name, paramToken.Location.Line)
+			}
+		}
+		params = append(params, param)
+		token, err := p.parseToken()
+		if err != nil {
+			return nil, err
+		}
+		if token.Type == TokenTypeKeyword && token.Keyword == p.kwCloseParen {
+			return params, nil
+		}
+		if token.Type != TokenTypeKeyword || token.Keyword != p.kwComma {
+			return nil, fmt.Errorf("parseRuleParams: expected ',' or ')', got %s at line %d", token.GetName(), token.Location.Line)
+		}
+	}
+}
+
+// parseDisplayName parses "-> displayName" after a rule's name, if present.  It
+// returns nil if there is none.
+func (p *Peg) parseDisplayName() (*Sym, error) {
+	token, err := p.peekToken(1)
+	if err != nil || token.Type != TokenTypeKeyword || token.Keyword != p.kwArrow {
+		return nil, err
+	}
+	if _, err := p.parseToken(); err != nil {
+		return nil, err
+	}
+	nameToken, err := p.parseIdent()
+	if err != nil {
+		return nil, err
+	}
+	return nameToken.Value.Val.(*Sym), nil
+}
+
 // ============================================================================
 // parsePexpr - Top-level expression dispatcher
 // ============================================================================
@@ -119,11 +328,12 @@ func (p *Peg) parsePexpr() (*Pexpr, error) {
 }
 
 // ============================================================================
-// parseChoicePexpr - Parse choice: e1 | e2 | e3
+// parseChoicePexpr - Parse choice: e1 | e2 | e3, or longest match: e1 / e2
 // ============================================================================
 
 func (p *Peg) parseChoicePexpr() (*Pexpr, error) {
 	var choicePexpr *Pexpr
+	var separator *Keyword
 
 	for {
 		pexpr, err := p.parseSequencePexpr()
@@ -136,8 +346,8 @@ func (p *Peg) parseChoicePexpr() (*Pexpr, error) {
 			return nil, err
 		}
 
-		// Check if next is pipe (|)
-		if nextToken.Type != TokenTypeKeyword || nextToken.Keyword != p.kwPipe {
+		// Check if next is pipe (|) or slash (/)
+		if nextToken.Type != TokenTypeKeyword || (nextToken.Keyword != p.kwPipe && nextToken.Keyword != p.kwSlash) {
 			// Not a choice, return single expression
 			if choicePexpr == nil {
 				return pexpr, nil
@@ -148,11 +358,18 @@ func (p *Peg) parseChoicePexpr() (*Pexpr, error) {
 
 		// Create choice if first time
 		if choicePexpr == nil {
-			choicePexpr = NewPexpr(PexprTypeChoice, pexpr.Location)
+			separator = nextToken.Keyword
+			pexprType := PexprTypeChoice
+			if separator == p.kwSlash {
+				pexprType = PexprTypeLongestChoice
+			}
+			choicePexpr = NewPexpr(pexprType, pexpr.Location)
+		} else if nextToken.Keyword != separator {
+			return nil, fmt.Errorf("parseChoicePexpr: '|' and '/' mixed without parentheses at line %d", nextToken.Location.Line)
 		}
 		choicePexpr.AppendChildPexpr(pexpr)
 
-		// Consume the pipe
+		// Consume the separator
 		if _, err := p.parseToken(); err != nil {
 			return nil, err
 		}
@@ -203,15 +420,21 @@ func (p *Peg) endOfSequence() bool {
 	switch token.Type {
 	case TokenTypeKeyword:
 		keyword := token.Keyword
-		// End of sequence at | (pipe) or ) (close paren)
-		return keyword == p.kwPipe || keyword == p.kwCloseParen
-	case TokenTypeIdent, TokenTypeString, TokenTypeWeakString:
+		// End of sequence at | (pipe), / (slash), ) (close paren), % (annotation)
+		// or , (between arguments)
+		return keyword == p.kwPipe || keyword == p.kwSlash || keyword == p.kwCloseParen ||
+			keyword == p.kwPercent || keyword == p.kwComma
+	case TokenTypeIdent, TokenTypeString, TokenTypeWeakString, TokenTypeCharClass:
+		return false
+	case TokenTypeInteger, TokenTypeFloat, TokenTypeBool, TokenTypeRandUint,
+		TokenTypeIntType, TokenTypeUintType:
+		// These can't start a pexpr, but a new rule's name would have been
+		// seen by endOfRule, so they are parsed as one, and parseBasicPexpr
+		// reports them where they are, rather than ending the rule early
 		return false
 	case TokenTypeEof:
 		return true
 	}
-	// Implicitly return false for any unhandled token types (like INTEGER, FLOAT, etc.)
-	// This matches the Rune code which has no default case
 	return false
 }
 
@@ -245,11 +468,40 @@ func (p *Peg) parsePrefixPexpr() (*Pexpr, error) {
 			}
 			return p.unaryPexpr(PexprTypeNot, pexpr, token.Location), nil
 		}
+	} else if token.Type == TokenTypeIdent {
+		return p.parseLabelledPexpr(token)
 	}
 
 	return p.parsePostfixPexpr()
 }
 
+// parseLabelledPexpr parses label=expr when the next tokens are an identifier
+// and "=", and otherwise parses a postfix expression.
+func (p *Peg) parseLabelledPexpr(token *Token) (*Pexpr, error) {
+	next, err := p.peekToken(2)
+	if err != nil {
+		return nil, err
+	}
+	if next.Type != TokenTypeKeyword || next.Keyword != p.kwEquals {
+		return p.parsePostfixPexpr()
+	}
+	// Consume the label and "="
+	for i := 0; i < 2; i++ {
+		if _, err := p.parseToken(); err != nil {
+			return nil, err
+		}
+	}
+	pexpr, err := p.parsePrefixPexpr()
+	if err != nil {
+		return nil, err
+	}
+	if pexpr.Label != "" {
+		return nil, fmt.Errorf("parseLabelledPexpr: expression already has label %s at line %d", pexpr.Label, token.Location.Line)
+	}
+	pexpr.Label = token.Value.Val.(*Sym).Name
+	return pexpr, nil
+}
+
 // ============================================================================
 // parsePostfixPexpr - Parse postfix operators: * + ?
 // ============================================================================
@@ -304,14 +556,27 @@ func (p *Peg) parseBasicPexpr() (*Pexpr, error) {
 
 	switch token.Type {
 	case TokenTypeIdent:
+		if p.isTextCapture(token) {
+			return p.parseTextPexpr(token)
+		}
 		// Nonterminal reference
 		pexpr := NewPexpr(PexprTypeNonterm, token.Location)
 		if val, ok := token.Value.Val.(*Sym); ok {
 			pexpr.Sym = val
 		}
+		if err := p.parseRuleArgs(token, pexpr); err != nil {
+			return nil, err
+		}
 		return pexpr, nil
 
 	case TokenTypeString, TokenTypeWeakString:
+		if isRange, err := p.atByteRange(token); err != nil || isRange {
+			if err != nil {
+				return nil, err
+			}
+			return p.parseByteRangePexpr(token)
+		}
+
 		// Keyword in quotes
 		pexpr := NewPexpr(PexprTypeKeyword, token.Location)
 		if str, ok := token.Value.Val.(string); ok {
@@ -325,6 +590,11 @@ func (p *Peg) parseBasicPexpr() (*Pexpr, error) {
 		}
 		return pexpr, nil
 
+	case TokenTypeCharClass:
+		pexpr := NewPexpr(PexprTypeCharClass, token.Location)
+		pexpr.CharClass = token.Value.Val.(*CharClass)
+		return pexpr, nil
+
 	case TokenTypeKeyword:
 		keyword := token.Keyword
 
@@ -333,6 +603,26 @@ func (p *Peg) parseBasicPexpr() (*Pexpr, error) {
 			return NewPexpr(PexprTypeEmpty, token.Location), nil
 		}
 
+		if keyword == p.kwSpace {
+			return NewPexpr(PexprTypeSpace, token.Location), nil
+		}
+
+		if keyword == p.kwCaret {
+			return NewPexpr(PexprTypeCut, token.Location), nil
+		}
+
+		if keyword == p.kwNewlineTerm {
+			return p.newNewlinePexpr(token.Location), nil
+		}
+
+		if keyword == p.kwAny {
+			return NewPexpr(PexprTypeAny, token.Location), nil
+		}
+
+		if keyword == p.kwSoftKw {
+			return p.parseSoftKeywordPexpr(token)
+		}
+
 		if keyword == p.kwOpenParen {
 			return p.parseParenPexpr()
 		}
@@ -345,9 +635,16 @@ func (p *Peg) parseBasicPexpr() (*Pexpr, error) {
 		}
 		pexpr.TokenType = tokenType
 		pexpr.Sym = keyword.Sym
+		if tokenType == TokenTypeIndent || tokenType == TokenTypeDedent {
+			p.indentSensitive = true
+		}
 		return pexpr, nil
 
 	default:
+		if token.Type != TokenTypeEof && token.Type != TokenTypeComment {
+			return nil, fmt.Errorf("parseBasicPexpr: unexpected %v %s at line %d; terminals are written as INTEGER, FLOAT, etc.",
+				token.Type, token.GetName(), token.Location.Line)
+		}
 		return nil, fmt.Errorf("parseBasicPexpr: unexpected token type %v at line %d", token.Type, token.Location.Line)
 	}
 }
@@ -375,6 +672,274 @@ func (p *Peg) parseParenPexpr() (*Pexpr, error) {
 	return pexpr, nil
 }
 
+// ============================================================================
+// parseByteRangePexpr - Parse a range of character literals: 'a'..'z'
+// ============================================================================
+
+// atByteRange returns true if token is followed by "..", starting a range of
+// character literals.
+func (p *Peg) atByteRange(token *Token) (bool, error) {
+	next, err := p.peekToken(1)
+	if err != nil {
+		return false, err
+	}
+	return next.Type == TokenTypeKeyword && next.Keyword == p.kwDotDot, nil
+}
+
+// parseByteRangePexpr parses the rest of a range of character literals, such as
+// 'a'..'z', which matches character literals like 'q' in the input, from
+// loToken.  The bounds are inclusive, and must be single-quoted single bytes.
+func (p *Peg) parseByteRangePexpr(loToken *Token) (*Pexpr, error) {
+	// Consume the ".."
+	if _, err := p.parseToken(); err != nil {
+		return nil, err
+	}
+	hiToken, err := p.parseToken()
+	if err != nil {
+		return nil, err
+	}
+	lo, err := p.byteRangeBound(loToken)
+	if err != nil {
+		return nil, err
+	}
+	hi, err := p.byteRangeBound(hiToken)
+	if err != nil {
+		return nil, err
+	}
+	if lo > hi {
+		return nil, fmt.Errorf("parseByteRangePexpr: reversed range %s..%s at line %d",
+			loToken.GetName(), hiToken.GetName(), loToken.Location.Line)
+	}
+	pexpr := NewPexpr(PexprTypeByteRange, loToken.Location)
+	pexpr.ByteRange = CharRange{rune(lo), rune(hi)}
+	return pexpr, nil
+}
+
+// byteRangeBound returns the byte given by a bound of a range of character
+// literals.
+func (p *Peg) byteRangeBound(token *Token) (byte, error) {
+	if token.Type != TokenTypeWeakString || len(token.Value.Val.(string)) != 1 {
+		return 0, fmt.Errorf("parseByteRangePexpr: expected a single-quoted byte, got %s at line %d",
+			token.GetName(), token.Location.Line)
+	}
+	return token.Value.Val.(string)[0], nil
+}
+
+// ============================================================================
+// parseTextPexpr - Parse text capture: text(e)
+// ============================================================================
+
+// isTextCapture returns true if token is the identifier "text" immediately
+// followed by '('.  With a space before the '(', "text" is an ordinary
+// nonterminal followed by a group.
+func (p *Peg) isTextCapture(token *Token) bool {
+	sym, ok := token.Value.Val.(*Sym)
+	if !ok || sym.Name != "text" {
+		return false
+	}
+	next, err := p.peekToken(1)
+	return err == nil && p.isAdjacentOpenParen(token, next)
+}
+
+// isAdjacentOpenParen returns true if next is a '(' immediately following
+// token, with no space between them.
+func (p *Peg) isAdjacentOpenParen(token, next *Token) bool {
+	if next.Type != TokenTypeKeyword || next.Keyword != p.kwOpenParen {
+		return false
+	}
+	return next.Location.Pos == token.Location.Pos+token.Location.Len
+}
+
+// ============================================================================
+// parseRuleArgs - Parse arguments of a parameterized rule: list(expr, ",")
+// ============================================================================
+
+// parseRuleArgs parses the arguments passed to a parameterized rule, if a '('
+// immediately follows identToken, and adds them to nonterm as children.  With
+// a space before the '(', the nonterminal is followed by a group.
+func (p *Peg) parseRuleArgs(identToken *Token, nonterm *Pexpr) error {
+	next, err := p.peekToken(1)
+	if err != nil || !p.isAdjacentOpenParen(identToken, next) {
+		return err
+	}
+	if _, err := p.parseToken(); err != nil {
+		return err
+	}
+	for {
+		arg, err := p.parsePexpr()
+		if err != nil {
+			return err
+		}
+		nonterm.AppendChildPexpr(arg)
+		token, err := p.parseToken()
+		if err != nil {
+			return err
+		}
+		if token.Type == TokenTypeKeyword && token.Keyword == p.kwCloseParen {
+			return nil
+		}
+		if token.Type != TokenTypeKeyword || token.Keyword != p.kwComma {
+			return fmt.Errorf("parseRuleArgs: expected ',' or ')', got %s at line %d", token.GetName(), token.Location.Line)
+		}
+	}
+}
+
+func (p *Peg) parseTextPexpr(textToken *Token) (*Pexpr, error) {
+	// Consume the '('
+	if _, err := p.parseToken(); err != nil {
+		return nil, err
+	}
+	pexpr, err := p.parseParenPexpr()
+	if err != nil {
+		return nil, err
+	}
+	pexpr.HasParens = false
+	return p.unaryPexpr(PexprTypeText, pexpr, textToken.Location), nil
+}
+
+// parseSoftKeywordPexpr parses the string after SOFTKW, which matches an
+// identifier spelled the same.  The string is not added to the keytab, so the
+// word is still an identifier everywhere else.
+func (p *Peg) parseSoftKeywordPexpr(softKwToken *Token) (*Pexpr, error) {
+	token, err := p.parseToken()
+	if err != nil {
+		return nil, err
+	}
+	str, ok := token.Value.Val.(string)
+	if !ok || (token.Type != TokenTypeString && token.Type != TokenTypeWeakString) {
+		return nil, fmt.Errorf("parseSoftKeywordPexpr: expected a string after SOFTKW at line %d", softKwToken.Location.Line)
+	}
+	pexpr := NewPexpr(PexprTypeSoftKeyword, softKwToken.Location)
+	pexpr.Sym = NewSym(str)
+	pexpr.Weak = token.Type == TokenTypeWeakString
+	return pexpr, nil
+}
+
+// ============================================================================
+// parseAnnotations - Parse rule annotations: %error "message" and
+// %precedence { left "+" "-"; left "*" "/" }
+// ============================================================================
+
+// parseAnnotations parses the optional annotations at the end of a rule with
+// parsing expression pexpr, returning the %error message, or "" if there is
+// none, and the %precedence levels, or nil if there are none.
+func (p *Peg) parseAnnotations(pexpr *Pexpr) (string, [][]*Sym, error) {
+	errorMessage := ""
+	var precedence [][]*Sym
+	for {
+		token, err := p.peekToken(1)
+		if err != nil || token.Type != TokenTypeKeyword || token.Keyword != p.kwPercent {
+			return errorMessage, precedence, err
+		}
+		if _, err := p.parseToken(); err != nil {
+			return "", nil, err
+		}
+
+		identToken, err := p.parseIdent()
+		if err != nil {
+			return "", nil, err
+		}
+		switch sym := identToken.Value.Val.(*Sym); sym.Name {
+		case "error":
+			errorMessage, err = p.parseErrorAnnotation()
+		case "precedence":
+			precedence, err = p.parsePrecedenceAnnotation(pexpr)
+		default:
+			err = fmt.Errorf("parseAnnotations: unknown annotation %%%s at line %d", sym.Name, identToken.Location.Line)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+// parseErrorAnnotation parses the message of a %error "message" annotation.
+func (p *Peg) parseErrorAnnotation() (string, error) {
+	token, err := p.parseToken()
+	if err != nil {
+		return "", err
+	}
+	if token.Type != TokenTypeString && token.Type != TokenTypeWeakString {
+		return "", fmt.Errorf("parseErrorAnnotation: expected error message string, got %s at line %d", token.GetName(), token.Location.Line)
+	}
+	return token.Value.Val.(string), nil
+}
+
+// parsePrecedenceAnnotation parses the levels of a %precedence annotation,
+// such as { left "+" "-"; left "*" "/" }, lowest precedence first.  The ';'
+// between levels is optional.  Each operator must be a keyword matched in
+// pexpr, the rule's parsing expression.
+func (p *Peg) parsePrecedenceAnnotation(pexpr *Pexpr) ([][]*Sym, error) {
+	token, err := p.parseToken()
+	if err != nil {
+		return nil, err
+	}
+	if token.Type != TokenTypeKeyword || token.Keyword != p.kwOpenBrace {
+		return nil, fmt.Errorf("parsePrecedenceAnnotation: expected '{', got %s at line %d", token.GetName(), token.Location.Line)
+	}
+	operators := make(map[*Sym]bool)
+	var precedence [][]*Sym
+	for {
+		token, err := p.parseToken()
+		if err != nil {
+			return nil, err
+		}
+		if token.Type == TokenTypeKeyword && token.Keyword == p.kwCloseBrace {
+			break
+		}
+		if token.Type == TokenTypeKeyword && token.Keyword == p.kwSemicolon && len(precedence) != 0 {
+			continue
+		}
+		if token.Type != TokenTypeIdent || token.Value.Val.(*Sym).Name != "left" {
+			return nil, fmt.Errorf("parsePrecedenceAnnotation: expected 'left' or '}', got %s at line %d", token.GetName(), token.Location.Line)
+		}
+		var level []*Sym
+		for {
+			token, err := p.peekToken(1)
+			if err != nil {
+				return nil, err
+			}
+			if token.Type != TokenTypeString && token.Type != TokenTypeWeakString {
+				break
+			}
+			if _, err := p.parseToken(); err != nil {
+				return nil, err
+			}
+			sym := NewSym(token.Value.Val.(string))
+			if operators[sym] {
+				return nil, fmt.Errorf("parsePrecedenceAnnotation: duplicate operator %q at line %d", sym.Name, token.Location.Line)
+			}
+			if !matchesKeyword(pexpr, sym) {
+				return nil, fmt.Errorf("parsePrecedenceAnnotation: operator %q at line %d is not matched by the rule", sym.Name, token.Location.Line)
+			}
+			operators[sym] = true
+			level = append(level, sym)
+		}
+		if level == nil {
+			return nil, fmt.Errorf("parsePrecedenceAnnotation: expected operators after 'left' at line %d", token.Location.Line)
+		}
+		precedence = append(precedence, level)
+	}
+	if precedence == nil {
+		return nil, fmt.Errorf("parsePrecedenceAnnotation: no precedence levels at line %d", token.Location.Line)
+	}
+	return precedence, nil
+}
+
+// matchesKeyword returns true if pexpr or one of its descendants matches the
+// keyword named by sym.
+func matchesKeyword(pexpr *Pexpr, sym *Sym) bool {
+	if pexpr.Type == PexprTypeKeyword && pexpr.Sym == sym {
+		return true
+	}
+	for _, child := range pexpr.ChildPexprs() {
+		if matchesKeyword(child, sym) {
+			return true
+		}
+	}
+	return false
+}
+
 // ============================================================================
 // Token reading with lookahead
 // ============================================================================
@@ -382,17 +947,16 @@ func (p *Peg) parseParenPexpr() (*Pexpr, error) {
 // parseToken reads and returns the next token.
 func (p *Peg) parseToken() (*Token, error) {
 	// Check lookahead buffer first
-	if p.savedToken1 != nil {
-		token := p.savedToken1
-		p.savedToken1 = p.savedToken2
-		p.savedToken2 = nil
+	if len(p.savedTokens) != 0 {
+		token := p.savedTokens[0]
+		p.savedTokens = p.savedTokens[1:]
 		return token, nil
 	}
 
 	return p.rawParseToken()
 }
 
-// rawParseToken reads from lexer, skipping newlines.
+// rawParseToken reads from lexer, skipping newlines and comments.
 func (p *Peg) rawParseToken() (*Token, error) {
 	for {
 		token, err := p.lexer.ParseToken()
@@ -400,41 +964,32 @@ func (p *Peg) rawParseToken() (*Token, error) {
 			return nil, err
 		}
 
-		// Skip newline tokens
+		// Skip newline and comment tokens
 		if token.Type == TokenTypeKeyword && token.Keyword == p.kwNewline {
 			continue
 		}
+		if token.Type == TokenTypeComment {
+			continue
+		}
 
 		return token, nil
 	}
 }
 
-// peekToken looks ahead 1 or 2 tokens without consuming them.
+// peekToken looks ahead depth tokens without consuming them.
 func (p *Peg) peekToken(depth int) (*Token, error) {
-	if depth < 1 || depth > 2 {
-		return nil, fmt.Errorf("peekToken: depth must be 1 or 2")
+	if depth < 1 {
+		return nil, fmt.Errorf("peekToken: depth must be at least 1")
 	}
 
-	if depth >= 1 && p.savedToken1 == nil {
+	for len(p.savedTokens) < depth {
 		token, err := p.rawParseToken()
 		if err != nil {
 			return nil, err
 		}
-		p.savedToken1 = token
+		p.savedTokens = append(p.savedTokens, token)
 	}
-
-	if depth >= 2 && p.savedToken2 == nil {
-		token, err := p.rawParseToken()
-		if err != nil {
-			return nil, err
-		}
-		p.savedToken2 = token
-	}
-
-	if depth == 1 {
-		return p.savedToken1, nil
-	}
-	return p.savedToken2, nil
+	return p.savedTokens[depth-1], nil
 }
 
 // ============================================================================
@@ -462,6 +1017,17 @@ func (p *Peg) unaryPexpr(pexprType PexprType, child *Pexpr, location Location) *
 	return parent
 }
 
+// newNewlinePexpr returns a strong "\n" keyword pexpr, as matched by NEWLINE.
+// Using it adds "\n" to the keytab, so input newlines are tokenized.
+func (p *Peg) newNewlinePexpr(location Location) *Pexpr {
+	pexpr := NewPexpr(PexprTypeKeyword, location)
+	keyword := p.Keytab.New("\n")
+	pexpr.Sym = keyword.Sym
+	keyword.AppendPexpr(pexpr)
+	pexpr.Keyword = keyword
+	return pexpr
+}
+
 // keywordToTokenType maps PEG keywords to TokenTypes.
 func (p *Peg) keywordToTokenType(keyword *Keyword, location Location) (TokenType, error) {
 	switch keyword {
@@ -481,6 +1047,10 @@ func (p *Peg) keywordToTokenType(keyword *Keyword, location Location) (TokenType
 		return TokenTypeIntType, nil
 	case p.kwUintType:
 		return TokenTypeUintType, nil
+	case p.kwIndent:
+		return TokenTypeIndent, nil
+	case p.kwDedent:
+		return TokenTypeDedent, nil
 	default:
 		return TokenTypeKeyword, fmt.Errorf("keywordToTokenType: unknown keyword %s", keyword.Sym.Name)
 	}
@@ -490,7 +1060,7 @@ func (p *Peg) keywordToTokenType(keyword *Keyword, location Location) (TokenType
 // End of rule is marked by seeing ':' or ':=' at lookahead(2), or being at logical EOF.
 func (p *Peg) endOfRule() bool {
 	// Check logical EOF: lexer at EOF AND no buffered tokens
-	if p.lexer.Eof() && p.savedToken1 == nil && p.savedToken2 == nil {
+	if p.lexer.Eof() && len(p.savedTokens) == 0 {
 		return true
 	}
 
@@ -513,61 +1083,202 @@ func (p *Peg) endOfRule() bool {
 		return false
 	}
 
-	// ':' or ':=' at lookahead(2) means the next rule is starting
+	// ':', ':=' or '->' at lookahead(2) means the next rule is starting
 	if token.Type != TokenTypeKeyword {
 		return false
 	}
 
-	return token.Keyword == p.kwColon || token.Keyword == p.kwColonEquals
+	if token.Keyword == p.kwColon || token.Keyword == p.kwColonEquals || token.Keyword == p.kwArrow {
+		return true
+	}
+	return p.atParamRuleHeader()
+}
+
+// atParamRuleHeader returns true if the next tokens start a parameterized
+// rule, like list(elem) :=, rather than passing arguments to one.
+func (p *Peg) atParamRuleHeader() bool {
+	identToken, err := p.peekToken(1)
+	if err != nil || identToken.Type != TokenTypeIdent {
+		return false
+	}
+	token, err := p.peekToken(2)
+	if err != nil || !p.isAdjacentOpenParen(identToken, token) {
+		return false
+	}
+	for depth := 3; ; depth += 2 {
+		token, err = p.peekToken(depth)
+		if err != nil || token.Type != TokenTypeIdent {
+			return false
+		}
+		token, err = p.peekToken(depth + 1)
+		if err != nil || token.Type != TokenTypeKeyword {
+			return false
+		}
+		if token.Keyword == p.kwCloseParen {
+			token, err = p.peekToken(depth + 2)
+			return err == nil && token.Type == TokenTypeKeyword &&
+				(token.Keyword == p.kwColon || token.Keyword == p.kwColonEquals || token.Keyword == p.kwArrow)
+		}
+		if token.Keyword != p.kwComma {
+			return false
+		}
+	}
 }
 
 // ============================================================================
-// Bind nonterminals to their rules
+// Instantiate parameterized rules
 // ============================================================================
 
-// bindNonterms links all nonterminal references in expressions to their Rule objects.
-func (p *Peg) bindNonterms() bool {
-	passed := true
-
-	for _, rule := range p.OrderedRules() {
-		if rule.pexpr != nil {
-			if !p.bindPexprNonterms(rule.pexpr) {
-				passed = false
+// maxRuleInstances is how many instances of parameterized rules a grammar may
+// have, which stops rules like f(x) := f(x x) from being instantiated forever.
+const maxRuleInstances = 1000
+
+// instantiateParamRules replaces each use of a parameterized rule, such as
+// list(expr), with a reference to a rule named "list(expr)" whose expression
+// is list's, with expr in place of its parameter.  Each rule is instantiated
+// once for each list of arguments, and instances are checked in turn, so rules
+// can pass their parameters on to other parameterized rules.
+func (p *Peg) instantiateParamRules() error {
+	numInstances := 0
+	for rule := p.firstOrderedRule; rule != nil; rule = rule.nextOrderedRule {
+		var nonterms []*Pexpr
+		walkPexprs(rule.pexpr, func(pexpr *Pexpr) {
+			if pexpr.Type == PexprTypeNonterm {
+				nonterms = append(nonterms, pexpr)
+			}
+		})
+		for _, nonterm := range nonterms {
+			instantiated, err := p.instantiateParamRule(nonterm)
+			if err != nil {
+				p.report(SeverityError, nonterm.Location, "%v", err)
+				return fmt.Errorf("ParseRules: %v at line %d", err, nonterm.Location.Line)
+			}
+			if instantiated {
+				numInstances++
+				if numInstances > maxRuleInstances {
+					return fmt.Errorf("ParseRules: more than %d instances of parameterized rules", maxRuleInstances)
+				}
 			}
 		}
 	}
-
-	return passed
+	return nil
 }
 
-// bindPexprNonterms recursively binds nonterminals in a Pexpr tree.
-func (p *Peg) bindPexprNonterms(pexpr *Pexpr) bool {
-	if pexpr == nil {
-		return true
+// instantiateParamRule makes nonterm refer to the instance of the
+// parameterized rule for its arguments, creating it if needed, in which case
+// it returns true.  References to rules that are not defined are left for
+// bindNonterms to report.
+func (p *Peg) instantiateParamRule(nonterm *Pexpr) (bool, error) {
+	args := nonterm.ChildPexprs()
+	paramRule := p.findParamRule(nonterm.Sym)
+	if paramRule == nil && len(args) != 0 {
+		paramRule = p.builtinParamRule(nonterm)
+	}
+	if paramRule == nil {
+		if len(args) != 0 && p.FindRule(nonterm.Sym) != nil {
+			return false, fmt.Errorf("rule '%s' has no parameters", nonterm.Sym.Name)
+		}
+		return false, nil
+	}
+	if len(args) != len(paramRule.Params) {
+		return false, fmt.Errorf("rule '%s' takes %d arguments, got %d",
+			nonterm.Sym.Name, len(paramRule.Params), len(args))
+	}
+	paramRule.instantiated = true
+	sym := NewSym(nonterm.RawToString())
+	for _, arg := range args {
+		nonterm.RemoveChildPexpr(arg)
+	}
+	nonterm.Sym = sym
+	if p.FindRule(sym) != nil {
+		return false, nil
 	}
+	argsByParam := make(map[*Sym]*Pexpr)
+	for i, param := range paramRule.Params {
+		argsByParam[param] = args[i]
+	}
+	instance := NewRule(p, sym, p.instantiatePexpr(paramRule.pexpr, argsByParam), paramRule.Location)
+	instance.Weak = paramRule.Weak
+	instance.ErrorMessage = paramRule.ErrorMessage
+	instance.DisplayName = paramRule.DisplayName
+	instance.Doc = paramRule.Doc
+	instance.Precedence = paramRule.Precedence
+	p.InsertRule(instance)
+	p.AppendOrderedRule(instance)
+	return true, nil
+}
 
-	passed := true
+// builtinParamRule returns the built-in parameterized rule referred to by
+// nonterm, unless the grammar defines a rule of the same name.  It is created
+// when first used, so it is never reported as unused.  The only built-in rule
+// is sepEndBy(elem, sep) := elem (sep elem)* sep?, for lists that allow a
+// trailing separator.
+func (p *Peg) builtinParamRule(nonterm *Pexpr) *Rule {
+	if nonterm.Sym.Name != "sepEndBy" || p.FindRule(nonterm.Sym) != nil {
+		return nil
+	}
+	location := nonterm.Location
+	elem, sep := NewSym("elem"), NewSym("sep")
+	ref := func(param *Sym) *Pexpr {
+		pexpr := NewPexpr(PexprTypeNonterm, location)
+		pexpr.Sym = param
+		return pexpr
+	}
+	repeated := NewPexpr(PexprTypeSequence, location)
+	repeated.AppendChildPexpr(ref(sep))
+	repeated.AppendChildPexpr(ref(elem))
+	repeated.HasParens = true
+	pexpr := NewPexpr(PexprTypeSequence, location)
+	pexpr.AppendChildPexpr(ref(elem))
+	pexpr.AppendChildPexpr(p.unaryPexpr(PexprTypeZeroOrMore, repeated, location))
+	pexpr.AppendChildPexpr(p.unaryPexpr(PexprTypeOptional, ref(sep), location))
+	rule := NewRule(p, nonterm.Sym, pexpr, location)
+	rule.Params = []*Sym{elem, sep}
+	p.paramRules = append(p.paramRules, rule)
+	return rule
+}
 
-	// If this is a nonterminal reference, bind it to its rule
-	if pexpr.Type == PexprTypeNonterm {
-		rule := p.FindRule(pexpr.Sym)
-		if rule == nil {
-			fmt.Printf("Error: undefined rule '%s' at line %d\n", pexpr.Sym.Name, pexpr.Location.Line)
-			passed = false
-		} else {
-			pexpr.NontermRule = rule
-			rule.AppendNontermPexpr(pexpr)
+// instantiatePexpr copies pexpr, replacing references to parameters with
+// copies of their arguments.
+func (p *Peg) instantiatePexpr(pexpr *Pexpr, argsByParam map[*Sym]*Pexpr) *Pexpr {
+	if arg := argsByParam[pexpr.Sym]; arg != nil && pexpr.Type == PexprTypeNonterm && pexpr.firstChildPexpr == nil {
+		newPexpr := p.clonePexpr(arg, nil)
+		if pexpr.Label != "" {
+			newPexpr.Label = pexpr.Label
 		}
+		return newPexpr
 	}
-
-	// Recursively bind children
+	newPexpr := p.clonePexprNode(pexpr, nil)
 	for _, child := range pexpr.ChildPexprs() {
-		if !p.bindPexprNonterms(child) {
-			passed = false
-		}
+		newPexpr.AppendChildPexpr(p.instantiatePexpr(child, argsByParam))
 	}
+	return newPexpr
+}
+
+// ============================================================================
+// Bind nonterminals to their rules
+// ============================================================================
 
-	return passed
+// bindNonterms links all nonterminal references in expressions to their Rule
+// objects, and returns the references to rules that are not defined.
+func (p *Peg) bindNonterms() []UndefinedRuleRef {
+	var undefined []UndefinedRuleRef
+	for _, rule := range p.OrderedRules() {
+		walkPexprs(rule.pexpr, func(pexpr *Pexpr) {
+			if pexpr.Type != PexprTypeNonterm {
+				return
+			}
+			target := p.FindRule(pexpr.Sym)
+			if target == nil {
+				p.report(SeverityError, pexpr.Location, "undefined rule '%s'", pexpr.Sym.Name)
+				undefined = append(undefined, UndefinedRuleRef{pexpr.Sym.Name, pexpr.Location})
+				return
+			}
+			pexpr.NontermRule = target
+			target.AppendNontermPexpr(pexpr)
+		})
+	}
+	return undefined
 }
 
 // ============================================================================
@@ -584,25 +1295,255 @@ func (p *Peg) findFirstSets() {
 	}
 }
 
+// findFollowSets computes the follow sets of all rules, for error recovery.
+// The goal rule is followed by EOF, and the rules used in each rule's
+// expression by what can come after them, which grows the follow sets of the
+// rules they use in turn, until none grow.
+func (p *Peg) findFollowSets() {
+	for _, rule := range p.OrderedRules() {
+		rule.FollowKeywords = make([]bool, p.numKeywords)
+	}
+	if p.firstOrderedRule == nil {
+		return
+	}
+	p.firstOrderedRule.FollowTokens[TokenTypeEof] = true
+	for grew := true; grew; {
+		grew = false
+		for _, rule := range p.OrderedRules() {
+			if rule.pexpr != nil && rule.pexpr.addFollowSets(rule.FollowKeywords, rule.FollowTokens) {
+				grew = true
+			}
+		}
+	}
+}
+
 // ============================================================================
 // Check for unused rules
 // ============================================================================
 
-// checkForUnusedRules reports rules that are never referenced.
-func (p *Peg) checkForUnusedRules() bool {
-	passed := true
-	firstTime := true
+// checkForUnusedRules reports rules, other than the goal rule, that are never
+// referenced.  They are warnings unless StrictUnusedRules is set, in which case
+// an error listing them is returned.
+func (p *Peg) checkForUnusedRules() error {
+	severity := SeverityWarning
+	if p.StrictUnusedRules {
+		severity = SeverityError
+	}
+	var unused []string
+	for _, rule := range p.OrderedRules() {
+		if rule != p.firstOrderedRule && rule.firstNontermPexpr == nil {
+			p.report(severity, rule.Location, "unused rule '%s'", rule.Sym.Name)
+			unused = append(unused, rule.Sym.Name)
+		}
+	}
+	for _, rule := range p.paramRules {
+		if !rule.instantiated {
+			p.report(severity, rule.Location, "unused rule '%s'", rule.Sym.Name)
+			unused = append(unused, rule.Sym.Name)
+		}
+	}
+	if p.StrictUnusedRules && len(unused) != 0 {
+		return fmt.Errorf("ParseRules: unused rules: %s", strings.Join(unused, ", "))
+	}
+	return nil
+}
 
+// ============================================================================
+// Check for repetitions of empty matches and unreachable alternatives
+// ============================================================================
+
+// checkPexprs warns about repetitions of expressions that can match empty
+// input, and choice alternatives that are never tried because an earlier
+// alternative always matches, is the same, or matches their start.  It must
+// be called after findFirstSets.
+func (p *Peg) checkPexprs() {
 	for _, rule := range p.OrderedRules() {
-		if !firstTime {
-			// Check if rule is referenced as a nonterminal
-			if rule.firstNontermPexpr == nil {
-				fmt.Printf("Warning: unused rule '%s' at line %d\n", rule.Sym.Name, rule.Location.Line)
-				// Don't fail on unused rules - just warn
+		walkPexprs(rule.pexpr, func(pexpr *Pexpr) {
+			switch pexpr.Type {
+			case PexprTypeZeroOrMore, PexprTypeOneOrMore:
+				if canMatchEmpty(pexpr.firstChildPexpr) {
+					p.report(SeverityWarning, pexpr.Location,
+						"%s in rule '%s' repeats an expression that can match empty input",
+						pexpr.ToString(), rule.Sym.Name)
+				}
+			case PexprTypeChoice:
+				p.checkChoiceAlternatives(rule, pexpr)
 			}
+		})
+	}
+}
+
+// checkChoiceAlternatives warns about the alternatives of choice that are
+// never tried.
+func (p *Peg) checkChoiceAlternatives(rule *Rule, choice *Pexpr) {
+	var earlier []*Pexpr
+	for alt := choice.firstChildPexpr; alt != nil; alt = alt.nextPexpr {
+		for _, prev := range earlier {
+			if alwaysMatches(prev) {
+				p.report(SeverityWarning, alt.Location,
+					"alternative %s in rule '%s' is never tried, since %s always matches",
+					alt.ToString(), rule.Sym.Name, prev.ToString())
+				return
+			}
+			if prev.Equal(alt) {
+				p.report(SeverityWarning, alt.Location,
+					"alternative %s in rule '%s' is a duplicate of an earlier alternative",
+					alt.ToString(), rule.Sym.Name)
+				break
+			}
+			if shadows(prev, alt) {
+				p.report(SeverityWarning, alt.Location,
+					"alternative %s in rule '%s' is never tried, since %s matches its start",
+					alt.ToString(), rule.Sym.Name, prev.ToString())
+				break
+			}
+		}
+		earlier = append(earlier, alt)
+	}
+}
+
+// shadows returns true if the alternative earlier matches wherever later
+// does, so later is never tried.  That is so when each element of earlier
+// matches whatever the element of later in the same place does, such as for
+// IDENT | IDENT "(" ")".
+func shadows(earlier *Pexpr, later *Pexpr) bool {
+	earlierElements := sequenceElements(earlier)
+	laterElements := sequenceElements(later)
+	if len(earlierElements) > len(laterElements) {
+		return false
+	}
+	for i, element := range earlierElements {
+		if !element.Equal(laterElements[i]) && !matchesTokensOf(element, laterElements[i]) {
+			return false
 		}
-		firstTime = false
 	}
+	return true
+}
 
-	return passed
+// sequenceElements returns the children of an unlabelled sequence, or else
+// pexpr itself.
+func sequenceElements(pexpr *Pexpr) []*Pexpr {
+	if pexpr.Type == PexprTypeSequence && pexpr.Label == "" {
+		return pexpr.ChildPexprs()
+	}
+	return []*Pexpr{pexpr}
+}
+
+// matchesTokensOf returns true if pexpr and other each match a single token,
+// and pexpr matches every token other does: ANY matches all but EOF, IDENT
+// matches soft keywords, INTEGER matches character literals, and weak and
+// strong keywords match the same token.
+func matchesTokensOf(pexpr *Pexpr, other *Pexpr) bool {
+	switch pexpr.Type {
+	case PexprTypeAny:
+		switch other.Type {
+		case PexprTypeKeyword, PexprTypeSoftKeyword, PexprTypeCharClass, PexprTypeByteRange, PexprTypeAny:
+			return true
+		case PexprTypeTerm:
+			return other.TokenType != TokenTypeEof
+		}
+	case PexprTypeTerm:
+		return (pexpr.TokenType == TokenTypeIdent && other.Type == PexprTypeSoftKeyword) ||
+			(pexpr.TokenType == TokenTypeInteger && other.Type == PexprTypeByteRange)
+	case PexprTypeKeyword:
+		return other.Type == PexprTypeKeyword && pexpr.Keyword == other.Keyword
+	}
+	return false
+}
+
+// canMatchEmpty returns true if pexpr can succeed without consuming input.
+// Unlike Pexpr.CanBeEmpty, it is valid for every pexpr, not just those
+// visited while finding first sets.
+func canMatchEmpty(pexpr *Pexpr) bool {
+	if pexpr == nil {
+		return false
+	}
+	switch pexpr.Type {
+	case PexprTypeNonterm:
+		return pexpr.NontermRule != nil && pexpr.NontermRule.IsNullable()
+	case PexprTypeEmpty, PexprTypeAnd, PexprTypeNot, PexprTypeSpace,
+		PexprTypeZeroOrMore, PexprTypeOptional, PexprTypeCut:
+		return true
+	case PexprTypeSequence:
+		for child := pexpr.firstChildPexpr; child != nil; child = child.nextPexpr {
+			if !canMatchEmpty(child) {
+				return false
+			}
+		}
+		return true
+	case PexprTypeChoice, PexprTypeLongestChoice:
+		for child := pexpr.firstChildPexpr; child != nil; child = child.nextPexpr {
+			if canMatchEmpty(child) {
+				return true
+			}
+		}
+		return false
+	case PexprTypeOneOrMore, PexprTypeText:
+		return canMatchEmpty(pexpr.firstChildPexpr)
+	}
+	return false
+}
+
+// alwaysMatches returns true if pexpr succeeds on any input.  Nonterminals
+// are conservatively assumed to be able to fail.
+func alwaysMatches(pexpr *Pexpr) bool {
+	switch pexpr.Type {
+	case PexprTypeEmpty, PexprTypeZeroOrMore, PexprTypeOptional, PexprTypeCut:
+		return true
+	case PexprTypeSequence:
+		for child := pexpr.firstChildPexpr; child != nil; child = child.nextPexpr {
+			if !alwaysMatches(child) {
+				return false
+			}
+		}
+		return true
+	case PexprTypeChoice, PexprTypeLongestChoice:
+		for child := pexpr.firstChildPexpr; child != nil; child = child.nextPexpr {
+			if alwaysMatches(child) {
+				return true
+			}
+		}
+		return false
+	case PexprTypeOneOrMore, PexprTypeText:
+		return pexpr.firstChildPexpr != nil && alwaysMatches(pexpr.firstChildPexpr)
+	}
+	return false
+}
+
+// ============================================================================
+// Check for indirect left recursion
+// ============================================================================
+
+// findIndirectLeftRecursion returns the first cycle of rules that call each
+// other without consuming input, such as [a b a], or nil if there is none.
+// A rule that calls only itself is direct left recursion, which is allowed.
+func (p *Peg) findIndirectLeftRecursion() []*Rule {
+	for _, rule := range p.OrderedRules() {
+		visited := make(map[*Rule]bool)
+		if cycle := p.findLeftCycle(rule, []*Rule{rule}, visited); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// findLeftCycle extends path, which starts at the rule we're looking for,
+// through the rules the last rule in path can call before consuming input.
+func (p *Peg) findLeftCycle(rule *Rule, path []*Rule, visited map[*Rule]bool) []*Rule {
+	last := path[len(path)-1]
+	for _, next := range leftRules(last.pexpr, nil) {
+		if next == rule {
+			if len(path) > 1 {
+				return append(path, next)
+			}
+			continue
+		}
+		if !visited[next] {
+			visited[next] = true
+			if cycle := p.findLeftCycle(rule, append(path, next), visited); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
 }
@@ -15,7 +15,11 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -32,7 +36,6 @@ func TestParseSimpleRule(t *testing.T) {
 		Keytab:       NewKeytab(),
 		numKeywords:  0,
 		initialized: false,
-		maxTokenPos: 0,
 		ruleTable:   make([]*Rule, 0),
 		numRules:    0,
 	}
@@ -92,7 +95,6 @@ func TestParseSequence(t *testing.T) {
 		Keytab:       NewKeytab(),
 		numKeywords:  0,
 		initialized: false,
-		maxTokenPos: 0,
 		ruleTable:   make([]*Rule, 0),
 		numRules:    0,
 	}
@@ -141,7 +143,6 @@ func TestParsePostfixOperators(t *testing.T) {
 		Keytab:       NewKeytab(),
 		numKeywords:  0,
 		initialized: false,
-		maxTokenPos: 0,
 		ruleTable:   make([]*Rule, 0),
 		numRules:    0,
 	}
@@ -190,7 +191,6 @@ digit := "0" | "1"`
 		Keytab:       NewKeytab(),
 		numKeywords:  0,
 		initialized: false,
-		maxTokenPos: 0,
 		ruleTable:   make([]*Rule, 0),
 		numRules:    0,
 	}
@@ -245,7 +245,6 @@ func TestParseWeakRule(t *testing.T) {
 		Keytab:       NewKeytab(),
 		numKeywords:  0,
 		initialized: false,
-		maxTokenPos: 0,
 		ruleTable:   make([]*Rule, 0),
 		numRules:    0,
 	}
@@ -286,7 +285,6 @@ func TestParseTerminalTokens(t *testing.T) {
 		Keytab:       NewKeytab(),
 		numKeywords:  0,
 		initialized: false,
-		maxTokenPos: 0,
 		ruleTable:   make([]*Rule, 0),
 		numRules:    0,
 	}
@@ -337,7 +335,6 @@ func TestFirstSets(t *testing.T) {
 		Keytab:       NewKeytab(),
 		numKeywords:  0,
 		initialized: false,
-		maxTokenPos: 0,
 		ruleTable:   make([]*Rule, 0),
 		numRules:    0,
 	}
@@ -378,6 +375,382 @@ func TestFirstSets(t *testing.T) {
 	t.Log("✅ TestFirstSets passed")
 }
 
+// TestGrammarSummary tests the grammar summary report.
+func TestGrammarSummary(t *testing.T) {
+	peg := newUnparsedTestPeg(t, `goal := statement*
+statement := expr ";" | block
+block := "{" statement* "}"
+expr := expr "+" term | term
+term := INTEGER | IDENT | "(" expr ")"
+list := item* ";"
+item := prefix? list
+prefix := IDENT?`)
+	peg.SetAllowIndirectLeftRecursion(true)
+	if err := peg.ParseRules(); err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+
+	expected := `Rules: 8
+Keywords: 6
+Terminals: INTEGER 1, IDENT 2
+Nullable rules: goal, prefix
+Left-recursive rules: expr, list, item
+Unreachable rules: list, item, prefix
+`
+	if summary := peg.Summary(); summary != expected {
+		t.Errorf("Expected summary:\n%s\ngot:\n%s", expected, summary)
+	}
+
+	// Parsing leaves the grammar unchanged.
+	parseTestInput(t, peg, "1 + x; { (2); }")
+	if summary := peg.Summary(); summary != expected {
+		t.Errorf("Expected summary after parsing:\n%s\ngot:\n%s", expected, summary)
+	}
+}
+
+// TestIndirectLeftRecursion tests that indirect left recursion is reported
+// unless it is allowed.
+func TestIndirectLeftRecursion(t *testing.T) {
+	grammar := `goal := a
+a := b "x" | "z"
+b := c "y"
+c := EMPTY a`
+	peg := newUnparsedTestPeg(t, grammar)
+	err := peg.ParseRules()
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> c -> a") {
+		t.Errorf("Expected the cycle a -> b -> c -> a to be reported, got %v", err)
+	}
+
+	peg = newUnparsedTestPeg(t, grammar)
+	peg.SetAllowIndirectLeftRecursion(true)
+	if err := peg.ParseRules(); err != nil {
+		t.Errorf("Expected indirect left recursion to be allowed, got %v", err)
+	}
+
+	// Direct left recursion is fine.
+	newTestPeg(t, `expr := expr "+" INTEGER | INTEGER`)
+}
+
+// TestShadowedAlternatives verifies that alternatives that are never tried
+// because an earlier one matches their start are warned about.
+func TestShadowedAlternatives(t *testing.T) {
+	peg := newTestPeg(t, `goal := call | stmt | literal | word
+call := IDENT | IDENT "(" ")"
+stmt := "if" IDENT | 'if' IDENT "then" | "while" IDENT
+literal := ANY | "x" | INTEGER "." | 'a'..'z'
+word := IDENT | SOFTKW "async" | "(" IDENT ")"`)
+	expected := []string{
+		`test.syn:2: warning: alternative IDENT "(" ")" in rule 'call' is never tried, since IDENT matches its start`,
+		`test.syn:3: warning: alternative "if" IDENT "then" in rule 'stmt' is never tried, since "if" IDENT matches its start`,
+		`test.syn:4: warning: alternative "x" in rule 'literal' is never tried, since ANY matches its start`,
+		`test.syn:4: warning: alternative INTEGER "." in rule 'literal' is never tried, since ANY matches its start`,
+		`test.syn:4: warning: alternative 'a'..'z' in rule 'literal' is never tried, since ANY matches its start`,
+		`test.syn:5: warning: alternative SOFTKW "async" in rule 'word' is never tried, since IDENT matches its start`,
+	}
+	warnings := peg.Warnings()
+	if len(warnings) != len(expected) {
+		t.Fatalf("Expected %d warnings, got %q", len(expected), warnings)
+	}
+	for i, warning := range warnings {
+		if warning != expected[i] {
+			t.Errorf("Warning %d: expected %q, got %q", i, expected[i], warning)
+		}
+	}
+
+	// The shipped grammar has no alternatives that are never tried.
+	runePeg, err := NewPeg("rune.syn")
+	if err != nil {
+		t.Fatalf("Failed to load rune.syn: %v", err)
+	}
+	if warnings := runePeg.Warnings(); len(warnings) != 0 {
+		t.Errorf("Expected no warnings for rune.syn, got %q", warnings)
+	}
+}
+
+func TestDiagnosticSink(t *testing.T) {
+	peg := newUnparsedTestPeg(t, `goal := item* | "a"
+item := IDENT? | INTEGER
+list := (IDENT | "," | IDENT)+
+orphan := "x"`)
+	var diagnostics []Diagnostic
+	peg.SetDiagnosticSink(func(d Diagnostic) {
+		diagnostics = append(diagnostics, d)
+	})
+	if err := peg.ParseRules(); err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	expected := []string{
+		"test.syn:3: warning: unused rule 'list'",
+		"test.syn:4: warning: unused rule 'orphan'",
+		`test.syn:1: warning: alternative "a" in rule 'goal' is never tried, since item* always matches`,
+		`test.syn:1: warning: item* in rule 'goal' repeats an expression that can match empty input`,
+		`test.syn:2: warning: alternative INTEGER in rule 'item' is never tried, since IDENT? always matches`,
+		`test.syn:3: warning: alternative IDENT in rule 'list' is a duplicate of an earlier alternative`,
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, got %v", len(expected), diagnostics)
+	}
+	for i, d := range diagnostics {
+		if d.String() != expected[i] {
+			t.Errorf("Diagnostic %d: expected %q, got %q", i, expected[i], d.String())
+		}
+	}
+
+	peg = newUnparsedTestPeg(t, `goal := missing`)
+	diagnostics = nil
+	peg.SetDiagnosticSink(func(d Diagnostic) {
+		diagnostics = append(diagnostics, d)
+	})
+	if err := peg.ParseRules(); err == nil {
+		t.Errorf("Expected an undefined rule to be an error")
+	}
+	if len(diagnostics) != 1 || diagnostics[0].Severity != SeverityError ||
+		diagnostics[0].Message != "undefined rule 'missing'" {
+		t.Errorf("Expected an undefined rule diagnostic, got %v", diagnostics)
+	}
+}
+
+// TestEscapedWeakStrings checks that escapes in single-quoted keywords give the
+// unescaped keyword, and that either quote can be escaped in either style.
+func TestEscapedWeakStrings(t *testing.T) {
+	peg := newTestPeg(t, `goal := line*
+line := IDENT quoted? '\n'
+quoted := '\'' IDENT '\'' | '\"' INTEGER "\'"`)
+	var names []string
+	for _, keyword := range peg.Keytab.OrderedKeywords() {
+		names = append(names, keyword.Sym.Name)
+	}
+	if expected := []string{"\n", "'", "\""}; fmt.Sprintf("%q", names) != fmt.Sprintf("%q", expected) {
+		t.Errorf("Expected keywords %q, got %q", expected, names)
+	}
+
+	var weak []bool
+	walkPexprs(peg.FindRule(NewSym("quoted")).Pexpr(), func(pexpr *Pexpr) {
+		if pexpr.Type == PexprTypeKeyword {
+			weak = append(weak, pexpr.Weak)
+		}
+	})
+	if fmt.Sprint(weak) != "[true true true false]" {
+		t.Errorf("Expected only the double-quoted keyword to be strong, got %v", weak)
+	}
+
+	node := parseTestInput(t, peg, "a\nb")
+	if lines := node.Find("line"); len(lines) != 2 {
+		t.Errorf("Expected 2 lines separated by '\\n':%s", node.ToString())
+	}
+}
+
+func TestRuleNames(t *testing.T) {
+	peg := newTestPeg(t, `goal := item*
+item := name | number
+name := IDENT
+number := INTEGER`)
+	expected := []string{"goal", "item", "name", "number"}
+	if names := peg.RuleNames(); fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("Expected rule names %q, got %q", expected, names)
+	}
+	if rule := peg.RuleByName("number"); rule == nil || rule.ToString() != "number: INTEGER" {
+		t.Errorf("Expected rule number, got %v", rule)
+	}
+	for _, name := range []string{"missing", "INTEGER", "noSuchRuleAnywhere"} {
+		if rule := peg.RuleByName(name); rule != nil {
+			t.Errorf("Expected no rule %s, got %s", name, rule.ToString())
+		}
+	}
+}
+
+func TestUnusedRuleWarnings(t *testing.T) {
+	grammar := `goal := item*
+item := IDENT
+spare := INTEGER
+other := FLOAT`
+	peg := newTestPeg(t, grammar)
+	expected := []string{
+		"test.syn:3: warning: unused rule 'spare'",
+		"test.syn:4: warning: unused rule 'other'",
+	}
+	if warnings := peg.Warnings(); fmt.Sprint(warnings) != fmt.Sprint(expected) {
+		t.Errorf("Expected warnings %q, got %q", expected, warnings)
+	}
+
+	peg = newUnparsedTestPeg(t, grammar)
+	peg.StrictUnusedRules = true
+	peg.SetDiagnosticSink(func(Diagnostic) {})
+	err := peg.ParseRules()
+	if err == nil || err.Error() != "ParseRules: unused rules: spare, other" {
+		t.Errorf("Expected an unused rules error, got %v", err)
+	}
+	if len(peg.Warnings()) != 0 {
+		t.Errorf("Expected unused rules to be errors, not warnings, got %q", peg.Warnings())
+	}
+
+	peg = newUnparsedTestPeg(t, `goal := item*
+item := IDENT`)
+	peg.StrictUnusedRules = true
+	if err := peg.ParseRules(); err != nil {
+		t.Errorf("Unexpected error with no unused rules: %v", err)
+	}
+}
+
+func TestUndefinedRules(t *testing.T) {
+	peg := newUnparsedTestPeg(t, `goal := item*
+item := IDENT | missing
+other := EMPTY`)
+	err := peg.ParseRules()
+	if err == nil || err.Error() != "ParseRules: undefined rule 'missing' at line 2" {
+		t.Fatalf("Expected an undefined rule error, got %v", err)
+	}
+	var undefinedErr *UndefinedRuleError
+	if !errors.As(err, &undefinedErr) || len(undefinedErr.Refs) != 1 ||
+		undefinedErr.Refs[0].Name != "missing" || undefinedErr.Refs[0].Location.Line != 2 {
+		t.Errorf("Expected an UndefinedRuleError for missing, got %#v", err)
+	}
+
+	peg = newUnparsedTestPeg(t, `goal := a b
+b := c`)
+	err = peg.ParseRules()
+	if err == nil || err.Error() != "ParseRules: undefined rule 'a' at line 1, undefined rule 'c' at line 2" {
+		t.Errorf("Expected both undefined rules, got %v", err)
+	}
+}
+
+func TestParamRules(t *testing.T) {
+	peg := newTestPeg(t, `goal := "names" list(IDENT, ",") "numbers" list(number, ";")
+number := INTEGER | FLOAT
+list(elem, sep) := elem (sep elem)*
+unusedList(elem) := elem+`)
+	for _, name := range []string{`list(IDENT, ",")`, `list(number, ";")`} {
+		if peg.FindRule(NewSym(name)) == nil {
+			t.Errorf("Expected rule %s to be instantiated", name)
+		}
+	}
+	if rule := peg.FindRule(NewSym(`list(number, ";")`)); rule.Pexpr().ToString() != `number (";" number)*` {
+		t.Errorf("Unexpected instance %s", rule.ToString())
+	}
+	expected := []string{"test.syn:4: warning: unused rule 'unusedList'"}
+	if warnings := peg.Warnings(); fmt.Sprint(warnings) != fmt.Sprint(expected) {
+		t.Errorf("Expected warnings %q, got %q", expected, warnings)
+	}
+
+	node := parseTestInput(t, peg, "names a, b, c numbers 1; 2.5")
+	if idents := node.Find(`list(IDENT, ",")`); len(idents) != 1 {
+		t.Errorf("Expected one list of names:%s", node.ToString())
+	}
+	if numbers := node.Find("number"); len(numbers) != 2 {
+		t.Errorf("Expected two numbers:%s", node.ToString())
+	}
+	expectParseError(t, peg, "names a; b numbers 1")
+
+	tests := []struct {
+		grammar string
+		err     string
+	}{
+		{"goal := list(IDENT)\nlist(a, b) := a b", "ParseRules: rule 'list' takes 2 arguments, got 1 at line 1"},
+		{"goal := item(IDENT)\nitem := IDENT", "ParseRules: rule 'item' has no parameters at line 1"},
+		{"goal := list\nlist(a) := a", "ParseRules: rule 'list' takes 1 arguments, got 0 at line 1"},
+	}
+	for _, test := range tests {
+		peg := newUnparsedTestPeg(t, test.grammar)
+		if err := peg.ParseRules(); err == nil || err.Error() != test.err {
+			t.Errorf("Expected error %q, got %v", test.err, err)
+		}
+	}
+}
+
+func TestSepEndBy(t *testing.T) {
+	peg := newTestPeg(t, `goal := "[" sepEndBy(INTEGER, ",")? "]"`)
+	rule := peg.FindRule(NewSym(`sepEndBy(INTEGER, ",")`))
+	if rule == nil {
+		t.Fatalf("Expected sepEndBy to be instantiated")
+	}
+	if rule.Pexpr().ToString() != `INTEGER ("," INTEGER)* ","?` {
+		t.Errorf("Unexpected instance %s", rule.ToString())
+	}
+	if warnings := peg.Warnings(); len(warnings) != 0 {
+		t.Errorf("Expected no warnings, got %q", warnings)
+	}
+	for _, input := range []string{"[1, 2, 3,]", "[1, 2, 3]", "[]"} {
+		node := parseTestInput(t, peg, input)
+		if input != "[]" && len(node.Find(`sepEndBy(INTEGER, ",")`)) != 1 {
+			t.Errorf("Expected one list parsing %q:%s", input, node.ToString())
+		}
+	}
+	for _, input := range []string{"[,]", "[1,, 2]"} {
+		expectParseError(t, peg, input)
+	}
+
+	// A rule of the same name replaces the built-in rule.
+	peg = newTestPeg(t, `goal := sepEndBy(IDENT, ";")
+sepEndBy(elem, sep) := elem (sep elem)*`)
+	if rule := peg.FindRule(NewSym(`sepEndBy(IDENT, ";")`)); rule.Pexpr().ToString() != `IDENT (";" IDENT)*` {
+		t.Errorf("Unexpected instance %s", rule.ToString())
+	}
+}
+
+// writeGrammarFiles writes each grammar in files to dir.
+func writeGrammarFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+}
+
+func TestIncludeGrammar(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "shared"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeGrammarFiles(t, dir, map[string]string{
+		"main.syn":          "include \"shared/tokens.syn\"\ngoal := (assign | number)*\nassign := name '=' number\n",
+		"shared/tokens.syn": "include \"name.syn\"\nnumber := INTEGER | FLOAT\n",
+		"shared/name.syn":   "name := IDENT\n",
+	})
+	peg, err := NewPeg(filepath.Join(dir, "main.syn"))
+	if err != nil {
+		t.Fatalf("Failed to load main.syn: %v", err)
+	}
+	for _, name := range []string{"goal", "assign", "number", "name"} {
+		if peg.FindRule(NewSym(name)) == nil {
+			t.Errorf("Expected rule %s to be defined", name)
+		}
+	}
+	if goal := peg.OrderedRules()[0]; goal.Sym.Name != "goal" {
+		t.Errorf("Expected goal to be the goal rule, got %s", goal.Sym.Name)
+	}
+	fp := NewFilepath("input", nil, false)
+	fp.Text = "x = 1 2.5\n"
+	if _, err := peg.Parse(fp, false); err != nil {
+		t.Errorf("Failed to parse with included rules: %v", err)
+	}
+}
+
+func TestIncludeGrammarErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeGrammarFiles(t, dir, map[string]string{
+		"a.syn":    "include \"b.syn\"\ngoal := item\n",
+		"b.syn":    "include \"a.syn\"\nitem := IDENT\n",
+		"dup.syn":  "include \"item.syn\"\ngoal := item\nitem := INTEGER\n",
+		"item.syn": "item := IDENT\n",
+	})
+	a := filepath.Join(dir, "a.syn")
+	b := filepath.Join(dir, "b.syn")
+	_, err := NewPeg(a)
+	if err == nil || !strings.Contains(err.Error(), "include cycle at line 1: "+a+" -> "+b+" -> "+a) {
+		t.Errorf("Expected an include cycle error, got %v", err)
+	}
+	_, err = NewPeg(filepath.Join(dir, "dup.syn"))
+	if err == nil || !strings.Contains(err.Error(), "duplicate rule item at line 3, first defined in "+
+		filepath.Join(dir, "item.syn")+" at line 1") {
+		t.Errorf("Expected a duplicate rule error, got %v", err)
+	}
+	_, err = NewPeg(filepath.Join(dir, "missing.syn"))
+	if err == nil {
+		t.Errorf("Expected an error for a missing grammar")
+	}
+}
+
 // RunParserTests runs all Phase 2 tests.
 func RunParserTests(t *testing.T) {
 	border := "════════════════════════════════════════════════════════════════════════"
@@ -397,3 +770,251 @@ func RunParserTests(t *testing.T) {
 	fmt.Println("✅ All Phase 2 tests passed!")
 	fmt.Println(border)
 }
+
+// TestPeekToken verifies lookahead works at any depth, skipping newlines and
+// comments, and that peeked tokens are returned by parseToken in order.
+func TestPeekToken(t *testing.T) {
+	peg := newUnparsedTestPeg(t, "a b\nc // comment\nd e")
+	names := []string{"a", "b", "c", "d", "e"}
+	for depth := 5; depth >= 1; depth-- {
+		token, err := peg.peekToken(depth)
+		if err != nil {
+			t.Fatalf("peekToken(%d) failed: %v", depth, err)
+		}
+		if token.GetName() != names[depth-1] {
+			t.Errorf("peekToken(%d): expected %s, got %s", depth, names[depth-1], token.GetName())
+		}
+	}
+	if _, err := peg.peekToken(0); err == nil {
+		t.Errorf("Expected peekToken(0) to fail")
+	}
+
+	// Consuming a token shifts the lookahead, and peeking past the buffered
+	// tokens reads more from the lexer.
+	if token, _ := peg.parseToken(); token.GetName() != "a" {
+		t.Errorf("Expected parseToken to return a, got %s", token.GetName())
+	}
+	for depth := 1; depth <= 5; depth++ {
+		token, err := peg.peekToken(depth)
+		if err != nil {
+			t.Fatalf("peekToken(%d) failed: %v", depth, err)
+		}
+		if depth < 5 && token.GetName() != names[depth] {
+			t.Errorf("peekToken(%d): expected %s, got %s", depth, names[depth], token.GetName())
+		}
+		if depth == 5 && !token.IsEof() {
+			t.Errorf("peekToken(5): expected EOF, got %s", token.GetName())
+		}
+	}
+	for _, name := range names[1:] {
+		if token, _ := peg.parseToken(); token.GetName() != name {
+			t.Errorf("Expected parseToken to return %s, got %s", name, token.GetName())
+		}
+	}
+}
+
+// TestSequenceBoundaries verifies sequences of each kind of terminal end at
+// the next rule, and that numbers in a grammar are reported where they are,
+// rather than ending the sequence.
+func TestSequenceBoundaries(t *testing.T) {
+	peg := newTestPeg(t, `goal := INTEGER FLOAT INTTYPE UINTTYPE | STRING IDENT x
+x := INTEGER
+y := goal INTEGER`)
+	expected := "goal: INTEGER FLOAT INTTYPE UINTTYPE | STRING IDENT x\nx: INTEGER\ny: goal INTEGER\n"
+	if s := peg.ToString(); s != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, s)
+	}
+
+	errors := []struct {
+		grammar string
+		err     string
+	}{
+		{"goal := IDENT 5 IDENT", "parseBasicPexpr: unexpected INTEGER 5 at line 1; terminals are written as INTEGER, FLOAT, etc."},
+		{"goal := IDENT\n  2.5\nx := IDENT", "parseBasicPexpr: unexpected FLOAT 2.5 at line 2; terminals are written as INTEGER, FLOAT, etc."},
+		{"goal := IDENT u8\nx := IDENT", "parseBasicPexpr: unexpected UINTTYPE u8 at line 1; terminals are written as INTEGER, FLOAT, etc."},
+		{"goal := IDENT\n7 := IDENT", "parseIdent: expected identifier, got INTEGER at line 2"},
+	}
+	for _, e := range errors {
+		err := newUnparsedTestPeg(t, e.grammar).ParseRules()
+		if err == nil || err.Error() != e.err {
+			t.Errorf("%q: expected error %q, got %v", e.grammar, e.err, err)
+		}
+	}
+}
+
+// TestReparseRules verifies ParseRules replaces the rules and keywords of the
+// grammar parsed before.
+func TestReparseRules(t *testing.T) {
+	peg := newTestPeg(t, `goal := "let" IDENT "=" INTEGER`)
+	fp := NewFilepath("other.syn", nil, false)
+	fp.Text = "goal := item*\nitem := IDENT \":\" STRING\n"
+	lexer, err := NewLexer(fp, peg.PegKeytab, false)
+	if err != nil {
+		t.Fatalf("Failed to create lexer: %v", err)
+	}
+	peg.InsertLexer(lexer)
+	if err := peg.ParseRules(); err != nil {
+		t.Fatalf("Failed to parse the second grammar: %v", err)
+	}
+	if names := strings.Join(peg.RuleNames(), " "); names != "goal item" {
+		t.Errorf("Expected only the second grammar's rules, got %s", names)
+	}
+	if peg.Keytab.Lookup("let") != nil || peg.Keytab.Lookup(":") == nil {
+		t.Errorf("Expected only the second grammar's keywords")
+	}
+	if peg.Keytab.Lookup(":").Num != 0 {
+		t.Errorf("Expected keywords to be numbered from 0")
+	}
+	parseTestInput(t, peg, `a: "x" b: "y"`)
+}
+
+func TestNullableAndFirstSets(t *testing.T) {
+	peg := newTestPeg(t, `goal := decl* stmt
+decl := "var" IDENT modifiers ";"
+modifiers := ("const" | "static")*
+stmt := block | IDENT "=" expr | EMPTY
+block := "{" stmt "}"
+expr := INTEGER | STRING | "(" expr ")"`)
+	tests := []struct {
+		rule       string
+		nullable   bool
+		keywords   string
+		tokenTypes string
+	}{
+		{"goal", true, "var {", "[IDENT]"},
+		{"decl", false, "var", "[]"},
+		{"modifiers", true, "const static", "[]"},
+		{"stmt", true, "{", "[IDENT]"},
+		{"block", false, "{", "[]"},
+		{"expr", false, "(", "[INTEGER STRING]"},
+	}
+	for _, test := range tests {
+		rule := peg.RuleByName(test.rule)
+		if rule.IsNullable() != test.nullable {
+			t.Errorf("%s: expected nullable %v", test.rule, test.nullable)
+		}
+		keywords, tokenTypes := rule.FirstSet()
+		if strings.Join(keywords, " ") != test.keywords || fmt.Sprint(tokenTypes) != test.tokenTypes {
+			t.Errorf("%s: expected first set %q %s, got %q %v", test.rule, test.keywords, test.tokenTypes, keywords, tokenTypes)
+		}
+	}
+
+	// Pexprs are nullable if their rules or all of a sequence's elements are.
+	pexpr := peg.RuleByName("decl").Pexpr()
+	if pexpr.IsNullable() {
+		t.Errorf("Expected %s not to be nullable", pexpr.ToString())
+	}
+	if modifiers := pexpr.ChildPexprs()[2]; modifiers.ToString() != "modifiers" || !modifiers.IsNullable() {
+		t.Errorf("Expected modifiers to be nullable")
+	}
+	if pexpr := peg.RuleByName("goal").Pexpr(); !pexpr.IsNullable() || !pexpr.FirstChildPexpr().IsNullable() {
+		t.Errorf("Expected %s to be nullable", pexpr.ToString())
+	}
+}
+
+// TestInlineGroups verifies that a parenthesized group used as an element of
+// a sequence is nested where the parentheses are, and that the parentheses
+// belong to the group, not its elements.
+func TestInlineGroups(t *testing.T) {
+	peg := newTestPeg(t, `expr := term (("+" | "-") term)*
+sum := term (op=("+" | "-") term)+
+term := INTEGER`)
+	repeat := peg.FindRule(NewSym("expr")).Pexpr().lastChildPexpr
+	group := repeat.FirstChildPexpr()
+	choice := group.FirstChildPexpr()
+	if repeat.Type != PexprTypeZeroOrMore || repeat.HasParens ||
+		group.Type != PexprTypeSequence || !group.HasParens ||
+		choice.Type != PexprTypeChoice || !choice.HasParens {
+		t.Fatalf("Unexpected structure: %v %v %v", repeat.Type, group.Type, choice.Type)
+	}
+	for _, alt := range choice.ChildPexprs() {
+		if alt.Type != PexprTypeKeyword || alt.HasParens {
+			t.Errorf("Expected an unparenthesized keyword, got %s", alt.ToString())
+		}
+	}
+
+	// The parentheses are needed, so they are written whether or not the
+	// grammar had them.
+	expected := map[string]string{
+		"expr": `term (("+" | "-") term)*`,
+		"sum":  `term (op=("+" | "-") term)+`,
+	}
+	for name, s := range expected {
+		pexpr := peg.FindRule(NewSym(name)).Pexpr()
+		if pexpr.ToString() != s {
+			t.Errorf("Expected %s to be %s, got %s", name, s, pexpr.ToString())
+		}
+		walkPexprs(pexpr, func(pexpr *Pexpr) {
+			pexpr.HasParens = false
+		})
+		if pexpr.ToString() != s {
+			t.Errorf("Expected %s without HasParens to be %s, got %s", name, s, pexpr.ToString())
+		}
+	}
+}
+
+func TestToStringRoundTrip(t *testing.T) {
+	peg := newTestPeg(t, `goal := (a | b c)* !(b | c) (a b)+ | x=(a b)? y=c | (&(a | b) c / c)
+a := "a" ("b" | "c") | ("a" "b")?
+b := !("c"* "d")+ ("e" / "f")
+c := INTEGER | (STRING IDENT)*`)
+	// Drop the original parentheses so ToString must work out where they go
+	// from precedence alone.
+	var text string
+	for _, rule := range peg.OrderedRules() {
+		walkPexprs(rule.Pexpr(), func(pexpr *Pexpr) {
+			pexpr.HasParens = false
+		})
+		text += rule.Sym.Name + " := " + rule.Pexpr().ToString() + "\n"
+	}
+	reparsed := newTestPeg(t, text)
+	if diffs := DiffGrammars(peg, reparsed); len(diffs) != 0 {
+		t.Errorf("Expected the reparsed grammar to match, got %v from:\n%s", diffs, text)
+	}
+	for _, rule := range reparsed.OrderedRules() {
+		walkPexprs(rule.Pexpr(), func(pexpr *Pexpr) {
+			pexpr.HasParens = false
+		})
+		original := peg.RuleByName(rule.Sym.Name).Pexpr().ToString()
+		if s := rule.Pexpr().ToString(); s != original {
+			t.Errorf("Expected %s to serialize as %s, got %s", rule.Sym.Name, original, s)
+		}
+	}
+}
+
+// TestPrecedenceAnnotation verifies %precedence levels are parsed and printed,
+// and that malformed ones are reported.
+func TestPrecedenceAnnotation(t *testing.T) {
+	peg := newTestPeg(t, `expr := INTEGER (("+" | "-" | "*") INTEGER)* %precedence { left "+" "-" left "*" } %error "expected an expression"
+x := IDENT`)
+	expected := `expr: INTEGER (("+" | "-" | "*") INTEGER)* %error "expected an expression" %precedence { left "+" "-"; left "*" }` + "\nx: IDENT\n"
+	if s := peg.ToString(); s != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, s)
+	}
+	rule := peg.RuleByName("expr")
+	if len(rule.Precedence) != 2 || rule.precedenceLevel(NewSym("-")) != 0 || rule.precedenceLevel(NewSym("*")) != 1 {
+		t.Errorf("Expected two precedence levels, got %v", rule.Precedence)
+	}
+	if clone := peg.Clone(); len(DiffGrammars(peg, clone)) != 0 {
+		t.Errorf("Expected the clone to keep the precedence levels")
+	}
+
+	errors := []struct {
+		grammar string
+		err     string
+	}{
+		{`e := INTEGER ("+" INTEGER)* %precedence left "+"`, "parsePrecedenceAnnotation: expected '{', got left at line 1"},
+		{`e := INTEGER ("+" INTEGER)* %precedence { right "+" }`, "parsePrecedenceAnnotation: expected 'left' or '}', got right at line 1"},
+		{`e := INTEGER ("+" INTEGER)* %precedence { left }`, "parsePrecedenceAnnotation: expected operators after 'left' at line 1"},
+		{`e := INTEGER ("+" INTEGER)* %precedence { }`, "parsePrecedenceAnnotation: no precedence levels at line 1"},
+		{`e := INTEGER ("+" INTEGER)* %precedence { left "+"; left "+" }`, `parsePrecedenceAnnotation: duplicate operator "+" at line 1`},
+		{`e := INTEGER ("+" INTEGER)* %precedence { left "-" }`, `parsePrecedenceAnnotation: operator "-" at line 1 is not matched by the rule`},
+		{`e := INTEGER %prec "x"`, "parseAnnotations: unknown annotation %prec at line 1"},
+	}
+	for _, e := range errors {
+		err := newUnparsedTestPeg(t, e.grammar).ParseRules()
+		if err == nil || err.Error() != e.err {
+			t.Errorf("%q: expected error %q, got %v", e.grammar, e.err, err)
+		}
+	}
+}
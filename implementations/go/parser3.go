@@ -15,27 +15,370 @@
 package parser
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"unicode/utf8"
 )
 
 // ============================================================================
 // Phase 3: PEG Engine - Parse input files using the grammar
 // ============================================================================
 
-// Parse parses an input file using the PEG grammar rules.
+// ctxCheckInterval is how many calls to parseUsingPexpr are made between
+// checks of the context passed to ParseContext.
+const ctxCheckInterval = 1024
+
+// Parser holds the state of one parse of an input file with a Peg's grammar:
+// the input's lexer and tokens, and the memoized ParseResults of each rule.
+// The Peg is not modified while parsing, so any number of Parsers made from one
+// Peg can parse concurrently, each in its own goroutine.  A Parser can be
+// reused for later inputs, but is not itself safe for concurrent use.
+type Parser struct {
+	peg   *Peg
+	lexer *Lexer // Lexer for the input being parsed
+	text  string // The text lexer's tokens were read from, for Reparse
+	goal  *Rule  // The rule the last parse started from, for Reparse
+
+	// Whether the goal rule may match a prefix of the input, and the token
+	// position where its last match ended.  lexErr is the error reading the
+	// token after those a partial parse matched, if one couldn't be read.
+	partial bool
+	endPos  uint32
+	lexErr  error
+
+	// Memoized ParseResults, by rule and position
+	memo map[memoKey]*ParseResult
+
+	maxTokenPos uint32
+	errorRule   *Rule  // Annotated rule that failed furthest into the input
+	errorPos    uint32 // Where errorRule failed
+
+	// cut is set when a cut (^) is passed in the current choice alternative,
+	// so later alternatives are not tried.  cutPexpr is the expression that
+	// failed furthest into the input after a cut, at cutPos.
+	cut      bool
+	cutPexpr *Pexpr
+	cutPos   uint32
+
+	// Options overriding the Peg's for the next parse, set by ParseFile
+	options *ParseOptions
+
+	// Whether trees are simplified, from the Peg or options
+	simplify bool
+
+	// Aborting: ctx is checked every ctxCheckInterval calls to
+	// parseUsingPexpr, and at most maxChoiceAttempts choice alternatives are
+	// tried, maxParseResults ParseResults created, and maxRecursionDepth rules
+	// nested, if they are not 0.  These come from the Peg, unless options
+	// override them.  abortErr is set when the parse is abandoned.
+	maxChoiceAttempts uint32
+	maxParseResults   uint32
+	maxRecursionDepth uint32
+	ctx               context.Context
+	abortErr          error
+	numPexprs         uint32
+	numChoiceAttempts uint32
+	numParseResults   uint32
+	ruleDepth         uint32
+
+	// Counts of the work done by the last parse, returned by Stats.  They are
+	// only counted if collectStats, from the Peg's SetCollectStats, is set.
+	collectStats bool
+	stats        ParseStats
+
+	// What the result of the rule being parsed depends on, which is recorded
+	// in its ParseResult for Reparse: examinedEnd is one past the furthest
+	// token examined, and seedRules are the left-recursive rules whose
+	// pending results at the same position were used.
+	examinedEnd uint32
+	seedRules   []*Rule
+
+	// Error recovery, when the Peg's RecoverErrors is set: the syntax errors
+	// found so far, by the token they were found at.  A sequence that fails at
+	// one of those tokens, after matching earlier ones, skips to a token that
+	// can follow its rule, and matches.  A repetition whose element fails to
+	// start at one skips to a token that can follow the element, and the goal
+	// rule skips to EOF from one it stopped at.  predicateDepth counts the
+	// lookahead predicates being parsed, in which sequences don't recover.
+	recoveries     map[uint32]*SyntaxError
+	predicateDepth uint32
+}
+
+// maxSyntaxErrors is how many syntax errors are reported when recovering from
+// errors, before the parse gives up.
+const maxSyntaxErrors = 100
+
+// parseRecord is what parsing a rule depended on and found, which is kept in
+// its ParseResult so Reparse can tell whether it is still valid, and repeat
+// its effect on syntax errors when it is reused.  The fields are as in Parser.
+type parseRecord struct {
+	examinedEnd uint32
+	seedRules   []*Rule
+	maxTokenPos uint32
+	errorRule   *Rule
+	errorPos    uint32
+	cutPexpr    *Pexpr
+	cutPos      uint32
+}
+
+// ParseStats counts the work done by a parse, to help tune grammars that
+// parse slowly.  Few memo hits relative to rule calls mean memoization is not
+// helping, and many ParseResults per token point to heavy backtracking.
+type ParseStats struct {
+	RuleCalls         uint32 // Rules tried at a position
+	MemoHits          uint32 // Rule calls answered from the memo table
+	MemoMisses        uint32 // Rule calls that parsed the rule
+	FirstSetSkips     uint32 // Rule calls answered by the rule's first set
+	ParseResults      uint32 // ParseResults created
+	MaxRecursionDepth uint32 // Deepest nesting of rules
+}
+
+// memoKey identifies a memoized ParseResult.
+type memoKey struct {
+	rule *Rule
+	pos  uint32
+}
+
+// NewParser creates a Parser for parsing input files with this Peg's grammar.
+func (p *Peg) NewParser() *Parser {
+	return &Parser{peg: p}
+}
+
+// Parse parses an input file using the PEG grammar rules.  It uses a new
+// Parser, so it is safe to call from multiple goroutines at once.
 // fileSpec can be a string (filename) or a *Filepath.
 // allowUnderscores determines if identifiers can contain underscores.
 func (p *Peg) Parse(fileSpec interface{}, allowUnderscores bool) (*Node, error) {
-	// Initialize on first parse
-	if !p.initialized {
-		p.addEOFToFirstRule()
-		p.initialized = true
+	parser := p.NewParser()
+	defer p.setStats(parser)
+	return parser.Parse(fileSpec, allowUnderscores)
+}
+
+// ParseContext is like Parse, but gives up and returns an error wrapping
+// ctx.Err() if ctx is cancelled or times out while parsing.
+func (p *Peg) ParseContext(ctx context.Context, fileSpec interface{}, allowUnderscores bool) (*Node, error) {
+	parser := p.NewParser()
+	defer p.setStats(parser)
+	return parser.ParseContext(ctx, fileSpec, allowUnderscores)
+}
+
+// ParseFrom is like Parse, but parses the input with the rule named ruleName,
+// rather than the goal rule, such as to parse just an expression with a
+// grammar for whole programs.  The rule must match all of the input.
+func (p *Peg) ParseFrom(ruleName string, fileSpec interface{}, allowUnderscores bool) (*Node, error) {
+	parser := p.NewParser()
+	defer p.setStats(parser)
+	return parser.ParseFrom(ruleName, fileSpec, allowUnderscores)
+}
+
+// ParsePartial parses a prefix of the input with the goal rule.  See
+// Parser.ParsePartial.
+func (p *Peg) ParsePartial(fileSpec interface{}, allowUnderscores bool) (*Node, uint32, error) {
+	parser := p.NewParser()
+	defer p.setStats(parser)
+	return parser.ParsePartial(fileSpec, allowUnderscores)
+}
+
+// ParseReader parses the text read from r, using name as the file name in
+// locations.  Errors reading r are returned before any parsing is done.
+func (p *Peg) ParseReader(name string, r io.Reader, allowUnderscores bool) (*Node, error) {
+	parser := p.NewParser()
+	defer p.setStats(parser)
+	return parser.ParseReader(name, r, allowUnderscores)
+}
+
+// MustParseString parses source, using name as the file name in locations, and
+// panics with the error if it doesn't parse.  It is meant for tests and
+// scripts whose inputs are known to be good, not for parsing user input.
+func (p *Peg) MustParseString(name, source string) *Node {
+	node, err := p.ParseReader(name, strings.NewReader(source), false)
+	if err != nil {
+		panic(fmt.Errorf("MustParseString(%q): %w", name, err))
+	}
+	return node
+}
+
+// ParseTopLevel parses src one top-level definition at a time.  See
+// Parser.ParseTopLevel.
+func (p *Peg) ParseTopLevel(src string, fn func(def *Node, err error)) {
+	parser := p.NewParser()
+	defer p.setStats(parser)
+	parser.ParseTopLevel(src, fn)
+}
+
+// ParseOptions configures ParseFile.  Limits that are 0 are taken from the
+// Peg, as set by SetMaxChoiceAttempts and friends.
+type ParseOptions struct {
+	AllowUnderscores bool  // Whether identifiers may contain underscores
+	Simplify         *bool // Whether the tree is simplified, if not nil; see SetSimplifyNodes
+
+	// Recover keeps parsing after a syntax error in a top-level definition,
+	// as ParseTopLevel does.  Each error is returned as a diagnostic, and the
+	// tree is a node without a rule whose children are the definitions that
+	// parsed.
+	Recover bool
+
+	MaxChoiceAttempts uint32
+	MaxParseResults   uint32
+	MaxRecursionDepth uint32
+}
+
+// ParseFile reads and parses the file at path, and returns its tree with the
+// problems found in it.  A syntax error is returned both as an error and as a
+// diagnostic at its location, unless opts.Recover is set, in which case only
+// errors that stop the parse, such as exceeding a limit, are returned.  If the
+// Peg recovers from errors, as set by SetRecoverErrors, each is a diagnostic,
+// and if the input parsed once they were skipped, the tree is returned with no
+// error.
+func (p *Peg) ParseFile(path string, opts ParseOptions) (*Node, []Diagnostic, error) {
+	filepath := NewFilepath(path, nil, false)
+	if err := filepath.ReadFile(); err != nil {
+		return nil, nil, fmt.Errorf("ParseFile: %w", err)
+	}
+	parser := p.NewParser()
+	parser.options = &opts
+	defer p.setStats(parser)
+
+	var diagnostics []Diagnostic
+	addSyntaxError := func(err error) bool {
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			return false
+		}
+		diagnostics = append(diagnostics, Diagnostic{SeverityError, syntaxErr.Location, syntaxErr.Message})
+		return true
+	}
+	if !opts.Recover {
+		node, err := parser.Parse(filepath, opts.AllowUnderscores)
+		var syntaxErrs SyntaxErrors
+		if errors.As(err, &syntaxErrs) {
+			for _, syntaxErr := range syntaxErrs {
+				addSyntaxError(syntaxErr)
+			}
+			if node != nil {
+				return node, diagnostics, nil
+			}
+		}
+		if err != nil {
+			addSyntaxError(err)
+			return nil, diagnostics, err
+		}
+		return node, nil, nil
+	}
+
+	root := NewNode(nil, nil, 0, 0)
+	var fatalErr error
+	parser.parseTopLevel(filepath, opts.AllowUnderscores, func(def *Node, err error) {
+		if def != nil {
+			root.AppendChildNode(def)
+		} else if fatalErr == nil && !addSyntaxError(err) {
+			fatalErr = err
+		}
+	})
+	if fatalErr != nil {
+		return nil, diagnostics, fatalErr
+	}
+	return root, diagnostics, nil
+}
+
+// Stats returns the counts of the work done by the last parse started with
+// one of this Peg's Parse methods to finish, if SetCollectStats was called.
+// Use Parser.Stats for a parse done with a Parser.
+func (p *Peg) Stats() ParseStats {
+	p.statsLock.Lock()
+	defer p.statsLock.Unlock()
+	return p.lastStats
+}
+
+// setStats records the stats of parser's last parse as this Peg's Stats.
+func (p *Peg) setStats(parser *Parser) {
+	p.statsLock.Lock()
+	defer p.statsLock.Unlock()
+	p.lastStats = parser.stats
+}
+
+// Parse parses an input file using the PEG grammar rules.
+// fileSpec can be a string (filename) or a *Filepath.
+// allowUnderscores determines if identifiers can contain underscores.
+func (p *Parser) Parse(fileSpec interface{}, allowUnderscores bool) (*Node, error) {
+	return p.ParseContext(context.Background(), fileSpec, allowUnderscores)
+}
+
+// ParseContext is like Parse, but gives up and returns an error wrapping
+// ctx.Err() if ctx is cancelled or times out while parsing.
+func (p *Parser) ParseContext(ctx context.Context, fileSpec interface{}, allowUnderscores bool) (*Node, error) {
+	// Start parsing from first rule
+	rule := p.peg.firstOrderedRule
+	if rule == nil {
+		return nil, fmt.Errorf("Parse: no rules defined")
+	}
+	return p.parseFrom(ctx, rule, p.peg.eofOptional, fileSpec, allowUnderscores)
+}
+
+// ParseFrom is like Parse, but parses the input with the rule named ruleName,
+// which must match all of it, rather than the goal rule.  Reparse starts from
+// the same rule.
+func (p *Parser) ParseFrom(ruleName string, fileSpec interface{}, allowUnderscores bool) (*Node, error) {
+	rule := p.peg.FindRule(NewSym(ruleName))
+	if rule == nil {
+		return nil, fmt.Errorf("ParseFrom: no rule named %s", ruleName)
+	}
+	return p.parseFrom(context.Background(), rule, p.peg.eofOptional, fileSpec, allowUnderscores)
+}
+
+// ParsePartial is like Parse, but the goal rule may match just a prefix of the
+// input, whatever SetRequireEOF says, such as one statement typed into a REPL.
+// The token position where the match ended is returned with the tree, which is
+// EOF's if the whole input matched.  If a token can't be read, the tokens
+// before it are parsed, and a match ending before it is returned as usual.  A
+// match that reaches it is returned with the lexer's error.
+func (p *Parser) ParsePartial(fileSpec interface{}, allowUnderscores bool) (*Node, uint32, error) {
+	rule := p.peg.firstOrderedRule
+	if rule == nil {
+		return nil, 0, fmt.Errorf("ParsePartial: no rules defined")
+	}
+	node, err := p.parseFrom(context.Background(), rule, true, fileSpec, allowUnderscores)
+	if node == nil {
+		return nil, 0, err
 	}
+	return node, p.endPos, err
+}
 
-	// Clear lookahead buffer
-	p.savedToken1 = nil
-	p.savedToken2 = nil
+// SkipToNewline returns the input of the last parse after the line it failed
+// on, which is the line of the furthest token reached, where a syntax error is
+// reported, or where a token couldn't be read, if the parse got that far.  A
+// REPL can report the error, and pass the rest to ParsePartial to resume with
+// the next line.  The tokens and memoized results of the last parse are
+// dropped, as they are for the old input, so it can't be reparsed.
+func (p *Parser) SkipToNewline() string {
+	lexer := p.lexer
+	if lexer == nil {
+		return ""
+	}
+	tokens := lexer.Tokens
+	if p.lexErr == nil && len(tokens) != 0 && tokens[len(tokens)-1].IsEof() {
+		// The input was read, so skip from where the parse got stuck
+		pos := p.maxTokenPos
+		if int(pos) >= len(tokens) {
+			pos = uint32(len(tokens) - 1)
+		}
+		lexer.Pos = tokens[pos].Location.Pos
+		lexer.Line = tokens[pos].Location.Line
+	}
+	lexer.SkipToNewline()
+	p.resetParse()
+	lexer.Tokens = nil
+	p.goal = nil
+	return lexer.Filepath.Text[lexer.Pos:]
+}
 
+// parseFrom parses the input with rule, which must be followed by EOF unless
+// partial is set.
+func (p *Parser) parseFrom(ctx context.Context, rule *Rule, partial bool, fileSpec interface{}, allowUnderscores bool) (*Node, error) {
 	// Create filepath from input
 	var filepath *Filepath
 	switch v := fileSpec.(type) {
@@ -47,106 +390,600 @@ func (p *Peg) Parse(fileSpec interface{}, allowUnderscores bool) (*Node, error)
 		return nil, fmt.Errorf("Parse: fileSpec must be string or *Filepath")
 	}
 
-	// Determine if we need to read the file
-	needRead := filepath.Text == ""
-
-	// Create new lexer for input file
-	lexer, err := NewLexer(filepath, p.Keytab, needRead)
-	if err != nil {
+	if err := p.startParse(filepath, allowUnderscores, partial); err != nil {
 		return nil, err
 	}
-	lexer.AllowIdentUnderscores = allowUnderscores
 
-	// Replace lexer if we had one
-	if p.lexer != nil {
-		// TODO: cleanup old lexer if needed
+	p.goal = rule
+	p.partial = partial
+	p.ctx = ctx
+	defer func() { p.ctx = nil }()
+	node, err := p.parseGoal(rule)
+	if p.lexErr != nil {
+		return p.checkLexError(node, err)
 	}
-	p.lexer = lexer
-
-	// Tokenize entire input upfront
-	p.tokenizeInput()
+	return node, err
+}
 
-	// Clear memoization caches from previous parses
-	for _, rule := range p.OrderedRules() {
-		rule.ClearHashedParseResults()
-		rule.ClearParseResults()
+// checkLexError returns the result of a partial parse of the tokens before one
+// that couldn't be read, given the tree and error found.  A match ending
+// before that token, or a syntax error found before it, is returned as it is,
+// and lexErr is cleared.  Otherwise the parse got as far as that token, and
+// the tree, if any, is returned with the lexer's error.
+func (p *Parser) checkLexError(node *Node, err error) (*Node, error) {
+	errorPos := uint32(len(p.lexer.Tokens) - 1) // The stand-in EOF
+	var syntaxErr *SyntaxError
+	if err == nil && p.endPos < errorPos || errors.As(err, &syntaxErr) && syntaxErr.tokenPos < errorPos {
+		p.lexErr = nil
+		return node, err
 	}
+	if err != nil && syntaxErr == nil {
+		// The parse was aborted
+		return nil, err
+	}
+	return node, p.lexErr
+}
 
-	// Start parsing from first rule
-	rule := p.firstOrderedRule
-	if rule == nil {
-		return nil, fmt.Errorf("Parse: no rules defined")
+// parseGoal parses the input from its first token with the goal rule, and
+// builds the parse tree.  If the Peg's RecoverErrors is set, each syntax error
+// is recovered from by parsing again, skipping the tokens at the error, until
+// the input parses or an error can't be recovered from.  The tree, if the
+// input parsed, is returned with the errors as SyntaxErrors.
+func (p *Parser) parseGoal(rule *Rule) (*Node, error) {
+	node, err := p.parseGoalOnce(rule)
+	if err == nil || !p.peg.recoverErrors {
+		return node, err
 	}
+	var syntaxErrs SyntaxErrors
+	p.recoveries = make(map[uint32]*SyntaxError)
+	for len(syntaxErrs) < maxSyntaxErrors {
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			return nil, err
+		}
+		if p.recoveries[syntaxErr.tokenPos] != nil {
+			// There was nothing to skip to
+			node = nil
+			break
+		}
+		syntaxErrs = append(syntaxErrs, syntaxErr)
+		p.recoveries[syntaxErr.tokenPos] = syntaxErr
+		p.resetParse()
+		node, err = p.parseGoalOnce(rule)
+		if err == nil {
+			break
+		}
+	}
+	return node, syntaxErrs
+}
 
+// parseGoalOnce parses the input with the goal rule, and builds the tree.
+// Once recovering from errors, an error at the first token is skipped like any
+// other, rather than being found again by checkFirstToken.
+func (p *Parser) parseGoalOnce(rule *Rule) (*Node, error) {
+	if p.recoveries == nil {
+		if err := p.checkFirstToken(rule); err != nil {
+			return nil, err
+		}
+	}
 	result := p.parseUsingRule(nil, rule, 0)
+	if p.abortErr != nil {
+		return nil, fmt.Errorf("Parse: %w", p.abortErr)
+	}
 	if !result.Success {
-		// Find where we got stuck
-		pos := p.maxTokenPos
-		if int(pos) >= len(p.lexer.Tokens) {
-			pos = uint32(len(p.lexer.Tokens) - 1)
-		}
-		token := p.lexer.Tokens[pos]
-		return nil, fmt.Errorf("Syntax error at line %d", token.Location.Line)
+		// Report where we got stuck
+		return nil, p.syntaxError(0)
 	}
 
-	// Build parse tree from first ParseResult
-	if len(p.lexer.ParseResults) == 0 {
-		return nil, fmt.Errorf("Parse: no parse results generated")
+	// Build parse tree from the goal rule's ParseResult.  An empty match may
+	// have been found from the first set alone, without one.
+	parseResult := p.memo[memoKey{rule, 0}]
+	if parseResult == nil {
+		parseResult = p.newParseResult(nil, rule, 0, result)
+		parseResult.record = p.record()
+	}
+	if !p.partial && len(p.recoveries) != 0 {
+		result = p.recoverGoalEnd(parseResult)
+	}
+	node := parseResult.BuildParseTree(false)
+	if !p.partial && !p.addEOFNode(node, result.Pos) {
+		return nil, p.syntaxError(0)
+	}
+	p.endPos = result.Pos
+	if p.simplify {
+		node.Simplify()
 	}
-	parseResult := p.lexer.ParseResults[0]
-	node := parseResult.BuildParseTree(p.simplifyNodes)
 
 	return node, nil
 }
 
-// tokenizeInput reads all tokens from the lexer into an array.
-func (p *Peg) tokenizeInput() {
-	// Clear any existing tokens
-	p.lexer.Tokens = make([]*Token, 0)
-	
-	for {
-		token, err := p.lexer.ParseToken()
-		if err != nil {
-			// On error, add an EOF token and stop
-			token = p.lexer.EofToken()
-			// Note: NewToken already calls lexer.AppendToken, so we don't need to call it again
-			break
+// checkFirstToken returns a syntax error if the first token can't start the
+// goal rule, and the rule can't match empty input, so input that can't parse
+// is rejected before any ParseResults are made.  The error gives the rule's
+// %error message if it has one, and otherwise names the token.
+func (p *Parser) checkFirstToken(rule *Rule) error {
+	if rule.CanBeEmpty || len(p.lexer.Tokens) == 0 {
+		return nil
+	}
+	token := p.lexer.Tokens[0]
+	if rule.canStart(token) {
+		return nil
+	}
+	if rule.ErrorMessage != "" {
+		return p.newSyntaxError(0, rule.ErrorMessage)
+	}
+	var desc string
+	switch {
+	case token.Type == TokenTypeKeyword:
+		desc = fmt.Sprintf("%q", token.Keyword.Sym.Name)
+	case token.IsEof():
+		desc = "EOF"
+	default:
+		desc = fmt.Sprintf("%v %s", token.Type, token.GetName())
+	}
+	return p.newSyntaxError(0, fmt.Sprintf("%s can't start with %s", rule.Sym.Name, desc))
+}
+
+// ParseReader parses the text read from r, using name as the file name in
+// locations.  Errors reading r are returned before any parsing is done.
+func (p *Parser) ParseReader(name string, r io.Reader, allowUnderscores bool) (*Node, error) {
+	filepath := NewFilepath(name, nil, false)
+	if err := filepath.ReadText(r); err != nil {
+		return nil, fmt.Errorf("ParseReader: failed to read %s: %w", name, err)
+	}
+	return p.Parse(filepath, allowUnderscores)
+}
+
+// TextEdit describes a change to the text of a file: Len bytes at byte offset
+// Pos are replaced with Text.
+type TextEdit struct {
+	Pos  uint32
+	Len  uint32
+	Text string
+}
+
+// Reparse applies edit to the text of the file last parsed, and parses it
+// again, for editors that reparse as the user types.  The memoized
+// ParseResults of rules that only examined tokens before the first token the
+// edit changed, or after the last, are reused, so only the part of the input
+// around the edit is parsed again.  The result is the same as parsing the
+// edited text from scratch.  Trees returned by earlier parses share
+// ParseResults and text with the new one, and should not be used after this.
+// If the edited text can't be tokenized, the error is returned, and a later
+// Reparse still starts from the last tokens parsed.
+func (p *Parser) Reparse(edit TextEdit) (*Node, error) {
+	if p.lexer == nil || p.memo == nil || p.goal == nil {
+		return nil, fmt.Errorf("Reparse: no input has been parsed")
+	}
+	lexer, oldText, oldMemo := p.lexer, p.text, p.memo
+	if len(p.recoveries) != 0 {
+		// Results parsed while recovering from errors are not reused
+		oldMemo = nil
+	}
+	filepath := lexer.Filepath
+	text := filepath.Text
+	if uint64(edit.Pos)+uint64(edit.Len) > uint64(len(text)) {
+		return nil, fmt.Errorf("Reparse: edit of bytes %d to %d is past the end of %s", edit.Pos, edit.Pos+edit.Len, filepath.Name)
+	}
+	filepath.Text = text[:edit.Pos] + edit.Text + text[edit.Pos+edit.Len:]
+	if err := p.startParse(filepath, lexer.AllowIdentUnderscores, false); err != nil {
+		// Keep the tokens the memoized results were parsed from.
+		p.lexer = lexer
+		return nil, err
+	}
+	p.reuseParseResults(oldText, lexer.Tokens, oldMemo)
+	return p.parseGoal(p.goal)
+}
+
+// reuseParseResults memoizes the ParseResults in oldMemo, parsed from
+// oldTokens of oldText, that are still valid for the new tokens.  The tokens
+// the old and new inputs start and end with are the same, and results of rules
+// that only examined those tokens are moved to their new positions.  Results
+// that used the pending result of a left-recursive rule are only kept if it
+// is.  Token pexprs, which decide which tokens are kept in the tree, are copied
+// too.  The results kept are stale until they are used, so that the first rule
+// to use one becomes its parent, as in a fresh parse.
+func (p *Parser) reuseParseResults(oldText string, oldTokens []*Token, oldMemo map[memoKey]*ParseResult) {
+	text := p.lexer.Filepath.Text
+	tokens := p.lexer.Tokens
+	prefix := 0
+	for prefix < len(oldTokens) && prefix < len(tokens) &&
+		sameToken(oldTokens[prefix], oldText, tokens[prefix], text) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldTokens)-prefix && suffix < len(tokens)-prefix &&
+		sameToken(oldTokens[len(oldTokens)-1-suffix], oldText, tokens[len(tokens)-1-suffix], text) {
+		suffix++
+	}
+	suffixStart := uint32(len(oldTokens) - suffix)
+	delta := len(tokens) - len(oldTokens)
+	for i := 0; i < prefix; i++ {
+		tokens[i].Pexpr = oldTokens[i].Pexpr
+	}
+	for i := int(suffixStart); i < len(oldTokens); i++ {
+		tokens[i+delta].Pexpr = oldTokens[i].Pexpr
+	}
+
+	kept := make(map[memoKey]bool)
+	for key, parseResult := range oldMemo {
+		if !parseResult.Pending && (parseResult.record.examinedEnd <= uint32(prefix) || key.pos >= suffixStart) {
+			kept[key] = true
 		}
-		// Note: NewToken already appends the token to lexer.Tokens, so we don't call AppendToken here
-		token.Pexpr = nil
-		if token.IsEof() {
-			break
+	}
+	for changed := true; changed; {
+		changed = false
+		for key := range kept {
+			for _, rule := range oldMemo[key].record.seedRules {
+				if !kept[memoKey{rule, key.pos}] {
+					delete(kept, key)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	moved := make(map[*ParseResult]bool)
+	for key := range kept {
+		parseResult := oldMemo[key]
+		shift := 0
+		if parseResult.record.examinedEnd > uint32(prefix) {
+			shift = delta
+		}
+		parseResult.move(shift, p.lexer, moved)
+		p.memo[memoKey{key.rule, shiftPos(key.pos, shift)}] = parseResult
+	}
+	// Results whose parents were not kept are attached to new ones when used.
+	for parseResult := range moved {
+		if parent := parseResult.parentParseResult; parent != nil && !moved[parent] {
+			parent.RemoveChildParseResult(parseResult)
+		}
+	}
+}
+
+// sameToken returns true if token a of aText and token b of bText would be
+// parsed the same way.
+func sameToken(a *Token, aText string, b *Token, bText string) bool {
+	return a.Type == b.Type && a.Keyword == b.Keyword && a.LeadingWhitespace == b.LeadingWhitespace &&
+		aText[a.Location.Pos:a.Location.Pos+a.Location.Len] == bText[b.Location.Pos:b.Location.Pos+b.Location.Len]
+}
+
+// shiftPos returns token position pos moved by shift tokens.
+func shiftPos(pos uint32, shift int) uint32 {
+	return uint32(int(pos) + shift)
+}
+
+// Stats returns the counts of the work done by the last parse, which are all
+// 0 unless the Peg's SetCollectStats was called.
+func (p *Parser) Stats() ParseStats {
+	return p.stats
+}
+
+// Tokens returns the tokens of the input last parsed, ending with EOF.
+func (p *Parser) Tokens() []*Token {
+	if p.lexer == nil {
+		return nil
+	}
+	return p.lexer.Tokens
+}
+
+// startParse prepares to parse filepath: it creates a lexer for the file,
+// reading it first if it has no text yet, tokenizes the input, and clears the
+// memoization table of any previous parse.  If a token can't be read, the
+// error is returned, unless the parse is partial, in which case the tokens
+// before it are parsed, followed by a stand-in EOF, and the error is kept in
+// lexErr.
+func (p *Parser) startParse(filepath *Filepath, allowUnderscores bool, partial bool) error {
+	if !p.peg.initialized {
+		return fmt.Errorf("Parse: grammar rules have not been parsed")
+	}
+
+	if p.peg.tabWidth != 0 && filepath.TabWidth != p.peg.tabWidth {
+		// Lex a copy with the Peg's tab width, leaving the caller's file as is
+		withTabs := NewFilepath(filepath.Name, filepath.Parent, filepath.IsDir)
+		withTabs.Text = filepath.Text
+		withTabs.TabWidth = p.peg.tabWidth
+		filepath = withTabs
+	}
+
+	// Determine if we need to read the file
+	needRead := filepath.Text == ""
+
+	// Create new lexer for input file
+	lexer, err := NewLexer(filepath, p.peg.Keytab, needRead)
+	if err != nil {
+		return err
+	}
+	lexer.AllowIdentUnderscores = allowUnderscores
+	lexer.ShowSnippets = p.peg.showSnippets
+	lexer.IndentSensitive = p.peg.indentSensitive
+	// Single quotes in input files are always character literals.
+	lexer.EnableWeakStrings(false)
+	// Other Parsers may be lexing with the same keytab.  Identifiers are
+	// interned only for this parse, unless the grammar has the same names.
+	lexer.sharedKeytab = true
+	lexer.syms = NewScopedSymTable()
+	p.lexer = lexer
+
+	// Tokenize entire input upfront
+	p.lexErr = nil
+	if err := p.tokenizeInput(); err != nil {
+		if !partial {
+			return err
 		}
+		p.lexErr = err
+		NewToken(lexer, TokenTypeEof, NewLocation(lexer.Filepath, lexer.StartPos, 0, lexer.Line), nil, NewValue(nil))
 	}
+	p.text = lexer.Filepath.Text
+
+	p.resetParse()
+	p.recoveries = nil
+	p.abortErr = nil
+	p.numPexprs = 0
+	p.numChoiceAttempts = 0
+	p.numParseResults = 0
+	p.stats = ParseStats{}
+	p.collectStats = p.peg.collectStats
+	p.simplify = p.peg.simplifyNodes
+	p.maxChoiceAttempts = p.peg.maxChoiceAttempts
+	p.maxParseResults = p.peg.maxParseResults
+	p.maxRecursionDepth = p.peg.maxRecursionDepth
+	if options := p.options; options != nil {
+		if options.Simplify != nil {
+			p.simplify = *options.Simplify
+		}
+		if options.MaxChoiceAttempts != 0 {
+			p.maxChoiceAttempts = options.MaxChoiceAttempts
+		}
+		if options.MaxParseResults != 0 {
+			p.maxParseResults = options.MaxParseResults
+		}
+		if options.MaxRecursionDepth != 0 {
+			p.maxRecursionDepth = options.MaxRecursionDepth
+		}
+	}
+	return nil
 }
 
-// addEOFToFirstRule appends an EOF terminal to the first (goal) rule.
-// This ensures the parser matches the entire input.
-func (p *Peg) addEOFToFirstRule() {
-	goal := p.firstOrderedRule
+// resetParse clears the memoization table and what has been found while
+// parsing, to parse the tokens again from the start.  Limits on the work done
+// still count the work done before.
+func (p *Parser) resetParse() {
+	p.memo = make(map[memoKey]*ParseResult)
+	for _, token := range p.lexer.Tokens {
+		token.Pexpr = nil
+	}
+	p.maxTokenPos = 0
+	p.errorRule = nil
+	p.cut = false
+	p.cutPexpr = nil
+	p.ruleDepth = 0
+	p.examinedEnd = 0
+	p.seedRules = nil
+	p.predicateDepth = 0
+}
+
+// newParseResult creates a ParseResult for rule at pos, and memoizes it.  The
+// parse is aborted if it creates more than SetMaxParseResults allows.
+func (p *Parser) newParseResult(parentParseResult *ParseResult, rule *Rule, pos uint32, result Match) *ParseResult {
+	p.numParseResults++
+	if p.collectStats {
+		p.stats.ParseResults++
+	}
+	if p.maxParseResults != 0 && p.numParseResults > p.maxParseResults && p.abortErr == nil {
+		p.abortErr = fmt.Errorf("exceeded the maximum of %d parse results", p.maxParseResults)
+	}
+	pr := newParseResult(parentParseResult, rule, pos, result, p.lexer)
+	p.memo[memoKey{rule, pos}] = pr
+	return pr
+}
+
+// ParseTopLevel parses src one top-level definition at a time, calling fn with
+// each definition's node as soon as it has been parsed.  The definitions are
+// the elements of the last repetition (e* or e+) in the goal rule, and anything
+// in the goal rule before the repetition, such as leading newlines, is matched
+// first.  When a definition fails to parse, fn is called once with a nil node
+// and the error, and parsing resumes at the next token where a definition
+// parses, so later definitions are still delivered.
+func (p *Parser) ParseTopLevel(src string, fn func(def *Node, err error)) {
+	filepath := NewFilepath("input", nil, false)
+	if len(src) == 0 || src[len(src)-1] != '\n' {
+		src += "\n"
+	}
+	filepath.Text = src
+	p.parseTopLevel(filepath, false, fn)
+}
+
+// parseTopLevel parses filepath one top-level definition at a time, as
+// ParseTopLevel does.
+func (p *Parser) parseTopLevel(filepath *Filepath, allowUnderscores bool, fn func(def *Node, err error)) {
+	p.goal = nil // Definitions can't be reparsed
+	if err := p.startParse(filepath, allowUnderscores, false); err != nil {
+		fn(nil, err)
+		return
+	}
+	goal := p.peg.firstOrderedRule
 	if goal == nil {
+		fn(nil, fmt.Errorf("ParseTopLevel: no rules defined"))
 		return
 	}
 
-	pexpr := goal.pexpr
-	if pexpr == nil {
+	// Find the repetition of definitions in the goal rule
+	var prefix []*Pexpr
+	var definition *Pexpr
+	children := []*Pexpr{goal.pexpr}
+	if goal.pexpr.Type == PexprTypeSequence {
+		children = goal.pexpr.ChildPexprs()
+	}
+	for i := len(children) - 1; i >= 0; i-- {
+		child := children[i]
+		if child.Type == PexprTypeZeroOrMore || child.Type == PexprTypeOneOrMore {
+			prefix = children[:i]
+			definition = child.FirstChildPexpr()
+			break
+		}
+	}
+	if definition == nil {
+		fn(nil, fmt.Errorf("ParseTopLevel: goal rule %s has no repeated definitions", goal.Sym.Name))
 		return
 	}
 
-	// If the goal rule isn't a sequence, make it one
-	if pexpr.Type != PexprTypeSequence {
-		goal.RemovePexpr(pexpr)
-		seqPexpr := NewPexpr(PexprTypeSequence, pexpr.Location)
-		seqPexpr.InsertChildPexpr(pexpr)
-		goal.InsertPexpr(seqPexpr)
-		pexpr = seqPexpr
+	pos := uint32(0)
+	for _, pexpr := range prefix {
+		result := p.parseUsingPexpr(p.newTopLevelParseResult(pos), pexpr, pos)
+		if !result.Success {
+			fn(nil, p.syntaxError(pos))
+			return
+		}
+		pos = result.Pos
 	}
 
-	// Add EOF terminal to end of sequence
-	eofPexpr := NewPexpr(PexprTypeTerm, pexpr.Location)
-	eofPexpr.TokenType = TokenTypeEof
-	eofPexpr.Sym = p.kwEof.Sym
-	pexpr.AppendChildPexpr(eofPexpr)
+	recovering := false
+	for int(pos) < len(p.lexer.Tokens) && !p.lexer.Tokens[pos].IsEof() {
+		p.maxTokenPos = pos
+		p.errorRule = nil
+		parseResult := p.newTopLevelParseResult(pos)
+		result := p.parseUsingPexpr(parseResult, definition, pos)
+		if p.abortErr != nil {
+			fn(nil, fmt.Errorf("ParseTopLevel: %w", p.abortErr))
+			return
+		}
+		if result.Success && result.Pos > pos {
+			recovering = false
+			parseResult.Result = result
+			fn(p.buildTopLevelNode(parseResult), nil)
+			pos = result.Pos
+			continue
+		}
+		if !recovering {
+			fn(nil, p.syntaxError(pos))
+			recovering = true
+		}
+		pos++
+	}
+}
+
+// newTopLevelParseResult returns a ParseResult with no rule, used to collect
+// the parse results of one top-level definition.  It is not memoized.
+func (p *Parser) newTopLevelParseResult(pos uint32) *ParseResult {
+	return &ParseResult{
+		Pos:    pos,
+		Result: Match{Success: false, Pos: pos},
+		lexer:  p.lexer,
+	}
+}
+
+// buildTopLevelNode builds the tree for a top-level definition.  If the
+// definition is a single rule, that rule's node is returned.
+func (p *Parser) buildTopLevelNode(parseResult *ParseResult) *Node {
+	node := parseResult.BuildParseTree(p.simplify)
+	if node.ParseResult == parseResult && node.CountChildNodes() == 1 {
+		child := node.firstChildNode
+		node.RemoveChildNode(child)
+		return child
+	}
+	return node
+}
+
+// SyntaxError is returned when input does not match the grammar.  Location is
+// the token the parser could not get past.
+type SyntaxError struct {
+	Location Location
+	Message  string
+	tokenPos uint32 // The position of the token at Location
+}
+
+// Error returns the message, such as "Syntax error at line 3".
+func (e *SyntaxError) Error() string {
+	return e.Message
+}
+
+// SyntaxErrors is returned by parses that recover from syntax errors, as set by
+// SetRecoverErrors, with the tree, if the input parsed once they were skipped.
+type SyntaxErrors []*SyntaxError
+
+// Error returns the messages of the errors, one per line.
+func (e SyntaxErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Message
+	}
+	return strings.Join(messages, "\n")
+}
+
+// syntaxError returns an error for the furthest token reached while parsing
+// from pos.  If a rule annotated with %error failed at that token, its message
+// is included.
+func (p *Parser) syntaxError(pos uint32) error {
+	if p.maxTokenPos > pos {
+		pos = p.maxTokenPos
+	}
+	errorRule := p.errorRule
+	if errorRule != nil && p.errorPos != pos {
+		errorRule = nil
+	}
+	cutPexpr := p.cutPexpr
+	if cutPexpr != nil && p.cutPos != pos {
+		cutPexpr = nil
+	}
+	if int(pos) >= len(p.lexer.Tokens) {
+		pos = uint32(len(p.lexer.Tokens) - 1)
+	}
+	detail := ""
+	if cutPexpr != nil {
+		// The parser committed to an alternative, so report what it expected
+		detail = "expected " + cutPexpr.ToString()
+	} else if errorRule != nil {
+		detail = errorRule.ErrorMessage
+	}
+	return p.newSyntaxError(pos, detail)
+}
+
+// newSyntaxError returns a syntax error at the token at pos, with detail, if
+// not empty, following the line number.
+func (p *Parser) newSyntaxError(pos uint32, detail string) *SyntaxError {
+	token := p.lexer.Tokens[pos]
+	msg := fmt.Sprintf("Syntax error at line %d", token.Location.Line)
+	if detail != "" {
+		msg += ": " + detail
+	}
+	if p.peg.showSnippets {
+		if snippet := token.Location.Snippet(); snippet != "" {
+			msg += "\n" + snippet
+		}
+	}
+	return &SyntaxError{Location: token.Location, Message: msg, tokenPos: pos}
+}
+
+// tokenizeInput reads all tokens from the lexer into an array, and returns
+// the lexer's error if the input can't be tokenized.
+func (p *Parser) tokenizeInput() error {
+	// Clear any existing tokens
+	p.lexer.Tokens = make([]*Token, 0)
+	// Note: NewToken already appends each token to lexer.Tokens
+	_, err := p.lexer.AllTokens()
+	return err
+}
+
+// addEOFNode checks that the goal rule's match ending at pos is followed by
+// EOF, and adds the EOF token to the end of node.  The goal rule itself is not
+// changed, so it can be used recursively and parsed from repeatedly.  If the
+// goal rule matched EOF itself, it is already in node.
+func (p *Parser) addEOFNode(node *Node, pos uint32) bool {
+	if pos > 0 && int(pos) == len(p.lexer.Tokens) && p.lexer.Tokens[pos-1].IsEof() {
+		return true
+	}
+	if int(pos) >= len(p.lexer.Tokens) || !p.lexer.Tokens[pos].IsEof() {
+		return false
+	}
+	token := p.lexer.Tokens[pos]
+	token.Pexpr = p.peg.eofPexpr
+	NewNode(node, nil, pos, pos+1).SetToken(token)
+	// The root's token range now ends with the EOF, so NodeAtToken finds it,
+	// but its Location still ends with the last token the goal rule matched
+	node.EndPos = pos + 1
+	return true
 }
 
 // ============================================================================
@@ -154,42 +991,95 @@ func (p *Peg) addEOFToFirstRule() {
 // ============================================================================
 
 // parseUsingRule attempts to parse input at position pos using the given rule.
-// Implements packrat parsing with memoization and handles left-recursion.
-func (p *Peg) parseUsingRule(parentParseResult *ParseResult, rule *Rule, pos uint32) Match {
+// The parse is aborted if rules are nested deeper than SetMaxRecursionDepth
+// allows.
+func (p *Parser) parseUsingRule(parentParseResult *ParseResult, rule *Rule, pos uint32) Match {
+	if p.maxRecursionDepth != 0 && p.ruleDepth >= p.maxRecursionDepth {
+		if p.abortErr == nil {
+			p.abortErr = fmt.Errorf("exceeded the maximum rule nesting depth of %d", p.maxRecursionDepth)
+		}
+		return Match{Success: false, Pos: pos}
+	}
+	p.ruleDepth++
+	if p.collectStats {
+		p.stats.RuleCalls++
+		if p.ruleDepth > p.stats.MaxRecursionDepth {
+			p.stats.MaxRecursionDepth = p.ruleDepth
+		}
+	}
+	// Cuts only commit to alternatives in the rule they are in
+	cut := p.cut
+	p.cut = false
+	result := p.parseUsingRuleImpl(parentParseResult, rule, pos)
+	p.cut = cut
+	p.ruleDepth--
+	return result
+}
+
+// noteErrorRule remembers rule, if it failed and has an %error message, for
+// syntaxError, if furthest, the furthest token it reached, is further into
+// the input than where any other annotated rule failed.
+func (p *Parser) noteErrorRule(rule *Rule, result Match, furthest uint32) {
+	if !result.Success && rule.ErrorMessage != "" && (p.errorRule == nil || furthest > p.errorPos) {
+		p.errorRule = rule
+		p.errorPos = furthest
+	}
+}
+
+// parseUsingRuleImpl implements packrat parsing with memoization and handles
+// left-recursion.
+func (p *Parser) parseUsingRuleImpl(parentParseResult *ParseResult, rule *Rule, pos uint32) Match {
 	// Check memoization table
-	parseResult := rule.FindHashedParseResult(pos)
+	parseResult := p.memo[memoKey{rule, pos}]
 	if parseResult != nil {
 		// Found cached result
+		if p.collectStats {
+			p.stats.MemoHits++
+		}
 		if parseResult.Pending {
 			// Detected left-recursion
 			parseResult.FoundRecursion = true
-		} else if parseResult.Result.Success && parentParseResult != nil && parseResult.parentParseResult == nil {
-			// Re-attach successful result to new parent
-			parentParseResult.AppendChildParseResult(parseResult)
+			p.addSeedRules(rule)
+		} else {
+			p.mergeRecord(&parseResult.record, parseResult.stale)
+			if parseResult.stale {
+				// Reused by Reparse, and not yet used in this parse
+				parseResult.claim()
+			}
+			if parseResult.Result.Success && parentParseResult != nil && (parseResult.parentParseResult == nil || parseResult.parentParseResult.stale) {
+				// Re-attach successful result to new parent
+				if oldParent := parseResult.parentParseResult; oldParent != nil {
+					oldParent.RemoveChildParseResult(parseResult)
+				}
+				parentParseResult.AppendChildParseResult(parseResult)
+			}
 		}
 		return parseResult.Result
 	}
 
-	// Check first-set optimization
+	// Check first-set optimization.  Rules are parsed at tokens with syntax
+	// errors, so repetitions in them can recover.
 	if int(pos) < len(p.lexer.Tokens) {
-		token := p.lexer.Tokens[pos]
-		if token.Type == TokenTypeKeyword {
-			if int(token.Keyword.Num) < len(rule.FirstKeywords) && !rule.FirstKeywords[token.Keyword.Num] {
-				// Token not in first set
-				return Match{Success: rule.CanBeEmpty, Pos: pos}
-			}
-		} else {
-			if int(token.Type) < len(rule.FirstTokens) && !rule.FirstTokens[int(token.Type)] {
-				// Token type not in first set
-				return Match{Success: rule.CanBeEmpty, Pos: pos}
+		p.examineTo(pos + 1)
+		if !rule.canStart(p.lexer.Tokens[pos]) && p.recoveries[pos] == nil {
+			// Token not in first set
+			if p.collectStats {
+				p.stats.FirstSetSkips++
 			}
+			result := Match{Success: rule.CanBeEmpty, Pos: pos}
+			p.noteErrorRule(rule, result, pos)
+			return result
 		}
 	}
 
+	if p.collectStats {
+		p.stats.MemoMisses++
+	}
+	outer := p.startRecord(pos)
+
 	// Use the "seed" approach for left-recursion handling
 	// Initialize with failure result
-	pres := NewParseResult(parentParseResult, rule, pos, Match{Success: false, Pos: pos})
-	// Note: NewParseResult already adds to rule's hash table and lexer
+	pres := p.newParseResult(parentParseResult, rule, pos, Match{Success: false, Pos: pos})
 
 	lastResult := Match{Success: false, Pos: pos}
 
@@ -216,21 +1106,228 @@ func (p *Peg) parseUsingRule(parentParseResult *ParseResult, rule *Rule, pos uin
 		}
 	}
 
+	if lastResult.Success && rule.Precedence != nil {
+		p.groupByPrecedence(pres)
+	}
+	p.noteErrorRule(rule, lastResult, max(pos, p.maxTokenPos))
+	p.finishRecord(pres, outer)
 	return lastResult
 }
 
+// precedenceGroup is an operand, or a binary operation on two groups, in an
+// expression matched by a rule with %precedence.
+type precedenceGroup struct {
+	startPos    uint32
+	endPos      uint32
+	left        *precedenceGroup // Nil for operands
+	right       *precedenceGroup // Nil for operands
+	parseResult *ParseResult     // Holds the group's tokens
+}
+
+// groupByPrecedence groups the flat list of operands and binary operators
+// matched by pres, whose rule has %precedence, into a ParseResult of the rule
+// per operation, nested by precedence climbing: higher levels bind tighter,
+// and operators of the same level group to the left.  pres becomes the
+// outermost operation.  Operators are the keywords in the rule's Precedence
+// matched by pres itself, rather than its children, that follow an operand,
+// so a leading "-" is left to the operand.
+func (p *Parser) groupByPrecedence(pres *ParseResult) {
+	rule := pres.Rule
+	children := pres.ChildParseResults()
+	var operators []uint32
+	operandStart := pres.Pos
+	for pos, i := pres.Pos, 0; pos < pres.Result.Pos; {
+		if i < len(children) && children[i].Pos <= pos {
+			if children[i].Result.Pos > pos {
+				pos = children[i].Result.Pos
+			}
+			i++
+			continue
+		}
+		token := p.lexer.Tokens[pos]
+		if pexpr, ok := token.Pexpr.(*Pexpr); ok && pexpr != nil && pexpr.Type == PexprTypeKeyword &&
+			pos > operandStart && rule.precedenceLevel(pexpr.Sym) >= 0 {
+			operators = append(operators, pos)
+			operandStart = pos + 1
+		}
+		pos++
+	}
+	if len(operators) > 0 && operandStart == pres.Result.Pos {
+		// An error was recovered from after the last operator
+		operators = operators[:len(operators)-1]
+	}
+	if len(operators) < 2 {
+		// Already grouped
+		return
+	}
+
+	level := func(i int) int {
+		return rule.precedenceLevel(p.lexer.Tokens[operators[i]].Pexpr.(*Pexpr).Sym)
+	}
+	next := 0 // The next operand, which follows operator next-1
+	var climb func(minLevel int) *precedenceGroup
+	climb = func(minLevel int) *precedenceGroup {
+		left := &precedenceGroup{startPos: pres.Pos, endPos: pres.Result.Pos}
+		if next > 0 {
+			left.startPos = operators[next-1] + 1
+		}
+		if next < len(operators) {
+			left.endPos = operators[next]
+		}
+		next++
+		for next <= len(operators) && level(next-1) >= minLevel {
+			right := climb(level(next-1) + 1)
+			left = &precedenceGroup{startPos: left.startPos, endPos: right.endPos, left: left, right: right}
+		}
+		return left
+	}
+	root := climb(0)
+	root.parseResult = pres
+
+	for _, child := range children {
+		pres.RemoveChildParseResult(child)
+	}
+	p.fillPrecedenceGroup(root, children)
+	textSpans, labelSpans, errorSpans := pres.textSpans, pres.labelSpans, pres.errorSpans
+	pres.textSpans, pres.labelSpans, pres.errorSpans = nil, nil, nil
+	for _, span := range textSpans {
+		owner := root.owner(span.startPos, span.endPos)
+		owner.textSpans = append(owner.textSpans, span)
+	}
+	for _, span := range labelSpans {
+		owner := root.owner(span.startPos, span.endPos)
+		owner.labelSpans = append(owner.labelSpans, span)
+	}
+	for _, span := range errorSpans {
+		owner := root.owner(span.startPos, span.endPos)
+		owner.errorSpans = append(owner.errorSpans, span)
+	}
+}
+
+// fillPrecedenceGroup adds a ParseResult for each operation within the
+// operation group to the group's ParseResult, and the children in its
+// operands, in position order.
+func (p *Parser) fillPrecedenceGroup(group *precedenceGroup, children []*ParseResult) {
+	for _, side := range []*precedenceGroup{group.left, group.right} {
+		if side.left == nil {
+			side.parseResult = group.parseResult
+			for _, child := range children {
+				if child.Pos >= side.startPos && child.Result.Pos <= side.endPos {
+					group.parseResult.AppendChildParseResult(child)
+				}
+			}
+			continue
+		}
+		side.parseResult = newParseResult(group.parseResult, group.parseResult.Rule, side.startPos,
+			Match{Success: true, Pos: side.endPos}, p.lexer)
+		p.fillPrecedenceGroup(side, children)
+	}
+}
+
+// owner returns the ParseResult of the innermost group containing the tokens
+// from startPos to endPos.
+func (group *precedenceGroup) owner(startPos, endPos uint32) *ParseResult {
+	for _, side := range []*precedenceGroup{group.left, group.right} {
+		if side != nil && startPos >= side.startPos && endPos <= side.endPos {
+			return side.owner(startPos, endPos)
+		}
+	}
+	return group.parseResult
+}
+
+// record returns what the parse so far of the rule being parsed depended on
+// and found.
+func (p *Parser) record() parseRecord {
+	return parseRecord{
+		examinedEnd: p.examinedEnd,
+		seedRules:   p.seedRules,
+		maxTokenPos: p.maxTokenPos,
+		errorRule:   p.errorRule,
+		errorPos:    p.errorPos,
+		cutPexpr:    p.cutPexpr,
+		cutPos:      p.cutPos,
+	}
+}
+
+// startRecord starts recording what parsing a rule at pos depends on and
+// finds, and returns the record of the enclosing rule, for finishRecord.
+func (p *Parser) startRecord(pos uint32) parseRecord {
+	outer := p.record()
+	p.examinedEnd, p.seedRules = pos, nil
+	p.maxTokenPos, p.errorRule, p.cutPexpr = 0, nil, nil
+	return outer
+}
+
+// finishRecord saves the record of parsing parseResult's rule in it, and
+// restores the record of the enclosing rule, outer, adding the saved one.
+func (p *Parser) finishRecord(parseResult *ParseResult, outer parseRecord) {
+	record := p.record()
+	record.seedRules = nil
+	for _, rule := range p.seedRules {
+		if rule != parseResult.Rule {
+			record.seedRules = append(record.seedRules, rule)
+		}
+	}
+	parseResult.record = record
+	p.examinedEnd, p.seedRules = outer.examinedEnd, outer.seedRules
+	p.maxTokenPos, p.errorRule, p.errorPos = outer.maxTokenPos, outer.errorRule, outer.errorPos
+	p.cutPexpr, p.cutPos = outer.cutPexpr, outer.cutPos
+	p.mergeRecord(&record, true)
+}
+
+// mergeRecord adds record to that of the rule being parsed, as if the parse it
+// records had just been done there.  What it found is only added if
+// withFindings is set, since each rule is only parsed once at a position, and
+// later uses of its ParseResult find nothing new.
+func (p *Parser) mergeRecord(record *parseRecord, withFindings bool) {
+	p.examineTo(record.examinedEnd)
+	p.addSeedRules(record.seedRules...)
+	if !withFindings {
+		return
+	}
+	if record.maxTokenPos > p.maxTokenPos {
+		p.maxTokenPos = record.maxTokenPos
+	}
+	if record.errorRule != nil && (p.errorRule == nil || record.errorPos > p.errorPos) {
+		p.errorRule, p.errorPos = record.errorRule, record.errorPos
+	}
+	if record.cutPexpr != nil && (p.cutPexpr == nil || record.cutPos >= p.cutPos) {
+		p.cutPexpr, p.cutPos = record.cutPexpr, record.cutPos
+	}
+}
+
+// examineTo records that the rule being parsed examined tokens before end.
+func (p *Parser) examineTo(end uint32) {
+	if end > p.examinedEnd {
+		p.examinedEnd = end
+	}
+}
+
+// addSeedRules records that the rule being parsed used the pending results of
+// the given left-recursive rules.
+func (p *Parser) addSeedRules(rules ...*Rule) {
+	for _, rule := range rules {
+		found := false
+		for _, other := range p.seedRules {
+			found = found || other == rule
+		}
+		if !found {
+			p.seedRules = append(p.seedRules, rule)
+		}
+	}
+}
+
 // pushRecursiveParseResult creates a new ParseResult to hold recursive match info.
-func (p *Peg) pushRecursiveParseResult(pres *ParseResult, rule *Rule) *ParseResult {
-	rule.RemoveHashedParseResult(pres)
+func (p *Parser) pushRecursiveParseResult(pres *ParseResult, rule *Rule) *ParseResult {
+	delete(p.memo, memoKey{rule, pres.Pos})
 	parent := pres.parentParseResult
 	if parent != nil {
 		parent.RemoveChildParseResult(pres)
 	}
 
 	// Create new ParseResult with same result
-	// Note: NewParseResult adds to rule's hash table and lexer automatically
 	result := pres.Result
-	newPres := NewParseResult(parent, rule, pres.Pos, result)
+	newPres := p.newParseResult(parent, rule, pres.Pos, result)
 	newPres.FoundRecursion = pres.FoundRecursion
 	newPres.Pending = pres.Pending
 	newPres.AppendChildParseResult(pres)
@@ -243,9 +1340,16 @@ func (p *Peg) pushRecursiveParseResult(pres *ParseResult, rule *Rule) *ParseResu
 // ============================================================================
 
 // parseUsingPexpr parses using a pexpr, tracking progress and pruning failures.
-func (p *Peg) parseUsingPexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
-	lastChild := parseResult.lastChildParseResult
+// Once the parse is aborted, it fails immediately so the parse unwinds.
+func (p *Parser) parseUsingPexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
+	if p.aborted() {
+		return Match{Success: false, Pos: pos}
+	}
+	mark := markParseResult(parseResult)
 	result := p.parseUsingPexprImpl(parseResult, pexpr, pos)
+	if result.Success && pexpr.Label != "" {
+		parseResult.labelSpans = append(parseResult.labelSpans, textSpan{pexpr, pos, result.Pos})
+	}
 
 	if result.Success && result.Pos > p.maxTokenPos {
 		p.maxTokenPos = result.Pos
@@ -253,29 +1357,74 @@ func (p *Peg) parseUsingPexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32
 
 	if !result.Success {
 		// Prune any successful ParseResults that we built before failing
-		for parseResult.lastChildParseResult != lastChild {
-			child := parseResult.lastChildParseResult
-			if child == nil {
-				break
-			}
-			parseResult.RemoveChildParseResult(child)
-		}
+		mark.prune()
 	}
 
 	return result
 }
 
+// parseResultMark records how much of a ParseResult has been built, so what
+// is added after it can be pruned.
+type parseResultMark struct {
+	parseResult   *ParseResult
+	lastChild     *ParseResult
+	numTextSpans  int
+	numLabelSpans int
+	numErrorSpans int
+}
+
+// markParseResult returns a mark of what has been built in parseResult.
+func markParseResult(parseResult *ParseResult) parseResultMark {
+	return parseResultMark{
+		parseResult:   parseResult,
+		lastChild:     parseResult.lastChildParseResult,
+		numTextSpans:  len(parseResult.textSpans),
+		numLabelSpans: len(parseResult.labelSpans),
+		numErrorSpans: len(parseResult.errorSpans),
+	}
+}
+
+// prune removes the child ParseResults and spans added since the mark.
+func (m parseResultMark) prune() {
+	parseResult := m.parseResult
+	for parseResult.lastChildParseResult != m.lastChild {
+		child := parseResult.lastChildParseResult
+		if child == nil {
+			break
+		}
+		parseResult.RemoveChildParseResult(child)
+	}
+	parseResult.textSpans = parseResult.textSpans[:m.numTextSpans]
+	parseResult.labelSpans = parseResult.labelSpans[:m.numLabelSpans]
+	parseResult.errorSpans = parseResult.errorSpans[:m.numErrorSpans]
+}
+
+// aborted counts calls to parseUsingPexpr, checking the parse's context every
+// ctxCheckInterval calls, and returns true once the parse has been abandoned.
+func (p *Parser) aborted() bool {
+	if p.abortErr != nil {
+		return true
+	}
+	p.numPexprs++
+	if p.ctx == nil || p.numPexprs%ctxCheckInterval != 0 {
+		return false
+	}
+	p.abortErr = p.ctx.Err()
+	return p.abortErr != nil
+}
+
 // ============================================================================
 // parseUsingPexprImpl - Dispatch by pexpr type
 // ============================================================================
 
 // parseUsingPexprImpl implements the actual matching logic for each pexpr type.
-func (p *Peg) parseUsingPexprImpl(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
+func (p *Parser) parseUsingPexprImpl(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
 	if int(pos) >= len(p.lexer.Tokens) {
 		return Match{Success: false, Pos: pos}
 	}
 
 	token := p.lexer.Tokens[pos]
+	p.examineTo(pos + 1)
 
 	switch pexpr.Type {
 	case PexprTypeNonterm:
@@ -299,18 +1448,75 @@ func (p *Peg) parseUsingPexprImpl(parseResult *ParseResult, pexpr *Pexpr, pos ui
 			return Match{Success: false, Pos: pos}
 		}
 		token.Pexpr = pexpr
+		if pexpr.Weak && p.peg.preserveNewlines && p.peg.newlinePexpr != nil &&
+			pexpr.Keyword == p.peg.newlinePexpr.Keyword {
+			token.Pexpr = p.peg.newlinePexpr
+		}
+		return Match{Success: true, Pos: pos + 1}
+
+	case PexprTypeSoftKeyword:
+		// Match an identifier spelled as the soft keyword
+		if token.Type != TokenTypeIdent || token.Value.Val != pexpr.Sym {
+			return Match{Success: false, Pos: pos}
+		}
+		token.Pexpr = pexpr
+		return Match{Success: true, Pos: pos + 1}
+
+	case PexprTypeCharClass:
+		// Match a token whose text is a single character in the class
+		if token.Type == TokenTypeEof {
+			return Match{Success: false, Pos: pos}
+		}
+		name := token.GetName()
+		r, size := utf8.DecodeRuneInString(name)
+		if size == 0 || size != len(name) || !pexpr.CharClass.Contains(r) {
+			return Match{Success: false, Pos: pos}
+		}
+		token.Pexpr = pexpr
+		return Match{Success: true, Pos: pos + 1}
+
+	case PexprTypeByteRange:
+		// Match a character literal, which is an integer, in the range
+		if token.Type != TokenTypeInteger {
+			return Match{Success: false, Pos: pos}
+		}
+		value, ok := token.Value.Val.(*big.Int)
+		if !ok || !value.IsInt64() || value.Int64() < int64(pexpr.ByteRange.Lo) || value.Int64() > int64(pexpr.ByteRange.Hi) {
+			return Match{Success: false, Pos: pos}
+		}
+		token.Pexpr = pexpr
+		return Match{Success: true, Pos: pos + 1}
+
+	case PexprTypeAny:
+		// Match any token but EOF
+		if token.Type == TokenTypeEof {
+			return Match{Success: false, Pos: pos}
+		}
+		token.Pexpr = pexpr
 		return Match{Success: true, Pos: pos + 1}
 
 	case PexprTypeEmpty:
 		// Empty always succeeds
 		return Match{Success: true, Pos: pos}
 
+	case PexprTypeCut:
+		// A cut always succeeds, committing to the current alternative
+		p.cut = true
+		return Match{Success: true, Pos: pos}
+
+	case PexprTypeSpace:
+		// Succeeds without consuming if whitespace precedes the token
+		return Match{Success: token.LeadingWhitespace, Pos: pos}
+
 	case PexprTypeSequence:
 		return p.parseUsingSequencePexpr(parseResult, pexpr, pos)
 
 	case PexprTypeChoice:
 		return p.parseUsingChoicePexpr(parseResult, pexpr, pos)
 
+	case PexprTypeLongestChoice:
+		return p.parseUsingLongestChoicePexpr(parseResult, pexpr, pos)
+
 	case PexprTypeZeroOrMore:
 		return p.parseUsingZeroOrMorePexpr(parseResult, pexpr, pos)
 
@@ -326,6 +1532,9 @@ func (p *Peg) parseUsingPexprImpl(parseResult *ParseResult, pexpr *Pexpr, pos ui
 	case PexprTypeNot:
 		return p.parseUsingNotPexpr(parseResult, pexpr, pos)
 
+	case PexprTypeText:
+		return p.parseUsingTextPexpr(parseResult, pexpr, pos)
+
 	default:
 		return Match{Success: false, Pos: pos}
 	}
@@ -336,34 +1545,152 @@ func (p *Peg) parseUsingPexprImpl(parseResult *ParseResult, pexpr *Pexpr, pos ui
 // ============================================================================
 
 // parseUsingSequencePexpr matches all children in sequence.
-func (p *Peg) parseUsingSequencePexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
+func (p *Parser) parseUsingSequencePexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
 	childPos := pos
 	for _, child := range pexpr.ChildPexprs() {
 		result := p.parseUsingPexpr(parseResult, child, childPos)
 		if !result.Success {
+			if p.cut && (p.cutPexpr == nil || childPos >= p.cutPos) {
+				p.cutPexpr = child
+				p.cutPos = childPos
+			}
+			if childPos > pos {
+				if endPos, ok := p.recover(parseResult, child, childPos); ok {
+					return Match{Success: true, Pos: endPos}
+				}
+			}
 			return Match{Success: false, Pos: pos}
 		}
 		childPos = result.Pos
 		if int(childPos) >= len(p.lexer.Tokens) {
+			// Past EOF, only what can match nothing is left to match
+			for next := child.nextPexpr; next != nil; next = next.nextPexpr {
+				if !next.CanBeEmpty {
+					return Match{Success: false, Pos: pos}
+				}
+			}
 			return result
 		}
 	}
 	return Match{Success: true, Pos: childPos}
 }
 
-// parseUsingChoicePexpr tries each alternative until one succeeds.
-func (p *Peg) parseUsingChoicePexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
+// recover recovers from a syntax error found at pos, if there is one and
+// parseResult's rule is not being parsed in a predicate, where pexpr failed
+// after the sequence it is in matched earlier tokens.  The tokens from pos to
+// the first that can follow the rule, or EOF, are recorded in parseResult as
+// an error span, and the position after them is returned, where the sequence
+// matches.
+func (p *Parser) recover(parseResult *ParseResult, pexpr *Pexpr, pos uint32) (uint32, bool) {
+	if parseResult.Rule == nil {
+		return 0, false
+	}
+	return p.skipError(parseResult, pexpr, pos, pos, parseResult.Rule)
+}
+
+// recoverRepetition recovers from a syntax error found at pos, where child,
+// the element of a repetition, failed to start, so that the repetition can go
+// on.  At least the token at pos is skipped, up to the first token that can
+// follow the element's rule, which includes those that can start another
+// element, or that can follow parseResult's rule if the element is not a
+// rule.
+func (p *Parser) recoverRepetition(parseResult *ParseResult, child *Pexpr, pos uint32) (uint32, bool) {
+	rule := parseResult.Rule
+	if child.Type == PexprTypeNonterm && child.NontermRule != nil {
+		rule = child.NontermRule
+	}
+	if rule == nil || int(pos) >= len(p.lexer.Tokens)-1 {
+		return 0, false
+	}
+	return p.skipError(parseResult, child, pos, pos+1, rule)
+}
+
+// recoverGoalEnd recovers from a syntax error found where parseResult, the
+// goal rule's match, stopped before EOF, by skipping the tokens up to EOF.
+// It returns the match, extended to EOF if the error was recovered from.
+func (p *Parser) recoverGoalEnd(parseResult *ParseResult) Match {
+	pos := parseResult.Result.Pos
+	eofPos := uint32(len(p.lexer.Tokens) - 1)
+	if pos < eofPos {
+		if endPos, ok := p.skipError(parseResult, parseResult.Rule.pexpr, pos, eofPos, parseResult.Rule); ok {
+			parseResult.Result.Pos = endPos
+		}
+	}
+	return parseResult.Result
+}
+
+// skipError records the tokens from pos up to the first from minEndPos on
+// that can follow rule, or EOF, in parseResult as an error span, for the
+// syntax error found at pos, if there is one and no predicate is being
+// parsed.  It returns the position after the skipped tokens.
+func (p *Parser) skipError(parseResult *ParseResult, pexpr *Pexpr, pos uint32, minEndPos uint32, rule *Rule) (uint32, bool) {
+	syntaxErr := p.recoveries[pos]
+	if syntaxErr == nil || p.predicateDepth != 0 {
+		return 0, false
+	}
+	endPos := minEndPos
+	for tokens := p.lexer.Tokens; int(endPos) < len(tokens)-1 && !rule.canFollow(tokens[endPos]); endPos++ {
+	}
+	p.examineTo(endPos + 1)
+	parseResult.errorSpans = append(parseResult.errorSpans, errorSpan{textSpan{pexpr, pos, endPos}, syntaxErr})
+	return endPos, true
+}
+
+// parseUsingChoicePexpr tries each alternative until one succeeds, or one
+// fails after passing a cut, which commits to that alternative.  The parse
+// is aborted if it tries more alternatives than SetMaxChoiceAttempts allows.
+func (p *Parser) parseUsingChoicePexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
 	for _, child := range pexpr.ChildPexprs() {
+		p.numChoiceAttempts++
+		if p.maxChoiceAttempts != 0 && p.numChoiceAttempts > p.maxChoiceAttempts {
+			p.abortErr = fmt.Errorf("exceeded the maximum of %d choice alternatives tried", p.maxChoiceAttempts)
+			return Match{Success: false, Pos: pos}
+		}
+		cut := p.cut
+		p.cut = false
 		result := p.parseUsingPexpr(parseResult, child, pos)
+		committed := p.cut
+		p.cut = cut
 		if result.Success {
 			return result
 		}
+		if committed {
+			// A cut was passed, so the later alternatives are not tried
+			break
+		}
 	}
 	return Match{Success: false, Pos: pos}
 }
 
+// parseUsingLongestChoicePexpr tries every alternative, and matches the one
+// that consumes the most tokens, or the first of those that tie.  Each match is
+// pruned after it is tried, and the winner is parsed again, which is cheap
+// since its rules are memoized.
+func (p *Parser) parseUsingLongestChoicePexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
+	var best *Pexpr
+	bestResult := Match{Success: false, Pos: pos}
+	for _, child := range pexpr.ChildPexprs() {
+		p.numChoiceAttempts++
+		if p.maxChoiceAttempts != 0 && p.numChoiceAttempts > p.maxChoiceAttempts {
+			p.abortErr = fmt.Errorf("exceeded the maximum of %d choice alternatives tried", p.maxChoiceAttempts)
+			return Match{Success: false, Pos: pos}
+		}
+		mark := markParseResult(parseResult)
+		result := p.parseUsingPexpr(parseResult, child, pos)
+		mark.prune()
+		if result.Success && (best == nil || result.Pos > bestResult.Pos) {
+			best = child
+			bestResult = result
+		}
+	}
+	if best == nil {
+		return Match{Success: false, Pos: pos}
+	}
+	return p.parseUsingPexpr(parseResult, best, pos)
+}
+
 // parseUsingZeroOrMorePexpr matches the child zero or more times.
-func (p *Peg) parseUsingZeroOrMorePexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
+func (p *Parser) parseUsingZeroOrMorePexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
 	child := pexpr.FirstChildPexpr()
 	if child == nil {
 		return Match{Success: true, Pos: pos}
@@ -371,8 +1698,18 @@ func (p *Peg) parseUsingZeroOrMorePexpr(parseResult *ParseResult, pexpr *Pexpr,
 
 	lastResult := Match{Success: true, Pos: pos}
 	for {
+		mark := markParseResult(parseResult)
 		result := p.parseUsingPexpr(parseResult, child, lastResult.Pos)
 		if !result.Success {
+			if endPos, ok := p.recoverRepetition(parseResult, child, lastResult.Pos); ok {
+				lastResult = Match{Success: true, Pos: endPos}
+				continue
+			}
+			break
+		}
+		if result.Pos == lastResult.Pos {
+			// The child matched empty input, and would forever
+			mark.prune()
 			break
 		}
 		lastResult = result
@@ -381,7 +1718,7 @@ func (p *Peg) parseUsingZeroOrMorePexpr(parseResult *ParseResult, pexpr *Pexpr,
 }
 
 // parseUsingOneOrMorePexpr matches the child one or more times.
-func (p *Peg) parseUsingOneOrMorePexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
+func (p *Parser) parseUsingOneOrMorePexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
 	child := pexpr.FirstChildPexpr()
 	if child == nil {
 		return Match{Success: false, Pos: pos}
@@ -389,8 +1726,18 @@ func (p *Peg) parseUsingOneOrMorePexpr(parseResult *ParseResult, pexpr *Pexpr, p
 
 	lastResult := Match{Success: false, Pos: pos}
 	for {
+		mark := markParseResult(parseResult)
 		result := p.parseUsingPexpr(parseResult, child, lastResult.Pos)
 		if !result.Success {
+			if endPos, ok := p.recoverRepetition(parseResult, child, lastResult.Pos); ok {
+				lastResult = Match{Success: true, Pos: endPos}
+				continue
+			}
+			break
+		}
+		if lastResult.Success && result.Pos == lastResult.Pos {
+			// The child matched empty input, and would forever
+			mark.prune()
 			break
 		}
 		lastResult = result
@@ -399,7 +1746,7 @@ func (p *Peg) parseUsingOneOrMorePexpr(parseResult *ParseResult, pexpr *Pexpr, p
 }
 
 // parseUsingOptionalPexpr tries to match the child, succeeding either way.
-func (p *Peg) parseUsingOptionalPexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
+func (p *Parser) parseUsingOptionalPexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
 	child := pexpr.FirstChildPexpr()
 	if child == nil {
 		return Match{Success: true, Pos: pos}
@@ -413,25 +1760,44 @@ func (p *Peg) parseUsingOptionalPexpr(parseResult *ParseResult, pexpr *Pexpr, po
 }
 
 // parseUsingAndPexpr implements positive lookahead (match but don't consume).
-func (p *Peg) parseUsingAndPexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
+func (p *Parser) parseUsingAndPexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
 	child := pexpr.FirstChildPexpr()
 	if child == nil {
 		return Match{Success: false, Pos: pos}
 	}
 
+	p.predicateDepth++
 	result := p.parseUsingPexpr(parseResult, child, pos)
+	p.predicateDepth--
 	// Return success/failure but keep position at pos (don't consume)
 	return Match{Success: result.Success, Pos: pos}
 }
 
 // parseUsingNotPexpr implements negative lookahead (match if child fails).
-func (p *Peg) parseUsingNotPexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
+func (p *Parser) parseUsingNotPexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
 	child := pexpr.FirstChildPexpr()
 	if child == nil {
 		return Match{Success: true, Pos: pos}
 	}
 
+	p.predicateDepth++
 	result := p.parseUsingPexpr(parseResult, child, pos)
+	p.predicateDepth--
 	// Invert success and keep position at pos (don't consume)
 	return Match{Success: !result.Success, Pos: pos}
 }
+
+// parseUsingTextPexpr matches the child, and records the span it matched so
+// that BuildParseTree can replace it with a single text node.
+func (p *Parser) parseUsingTextPexpr(parseResult *ParseResult, pexpr *Pexpr, pos uint32) Match {
+	child := pexpr.FirstChildPexpr()
+	if child == nil {
+		return Match{Success: true, Pos: pos}
+	}
+
+	result := p.parseUsingPexpr(parseResult, child, pos)
+	if result.Success && result.Pos > pos {
+		parseResult.textSpans = append(parseResult.textSpans, textSpan{pexpr, pos, result.Pos})
+	}
+	return result
+}
@@ -1,6 +1,13 @@
 package parser
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -20,7 +27,6 @@ term := INTEGER`
 		Keytab:      NewKeytab(),
 		numKeywords: 0,
 		initialized: false,
-		maxTokenPos: 0,
 		ruleTable:   make([]*Rule, 0),
 		numRules:    0,
 	}
@@ -43,17 +49,17 @@ term := INTEGER`
 	inputFile := NewFilepath("test_input.txt", nil, false)
 	inputFile.Text = "42"  // Remove newline - it causes issues
 
-	node, err := peg.Parse(inputFile, false)
+	parser := peg.NewParser()
+	node, err := parser.Parse(inputFile, false)
 	if err != nil {
 		// Debug: print tokens
-		if peg.lexer != nil && len(peg.lexer.Tokens) > 0 {
-			t.Logf("Tokens parsed (%d total):", len(peg.lexer.Tokens))
-			for i, tok := range peg.lexer.Tokens {
-				t.Logf("  [%d] Type=%d, Name=%s", i, tok.Type, tok.GetName())
-			}
+		if parser.lexer != nil && len(parser.lexer.Tokens) > 0 {
+			t.Logf("Tokens parsed (%d total):\n%s", len(parser.lexer.Tokens), parser.lexer.TokensString())
 		}
 		t.Logf("First rule: %s", peg.firstOrderedRule.Sym.Name)
-		t.Logf("Lexer Pos=%d, Len=%d", peg.lexer.Pos, peg.lexer.Len)
+		if parser.lexer != nil {
+			t.Logf("Lexer Pos=%d, Len=%d", parser.lexer.Pos, parser.lexer.Len)
+		}
 		t.Fatalf("Failed to parse input: %v", err)
 	}
 
@@ -77,7 +83,6 @@ func TestSequenceParsing(t *testing.T) {
 		Keytab:      NewKeytab(),
 		numKeywords: 0,
 		initialized: false,
-		maxTokenPos: 0,
 		ruleTable:   make([]*Rule, 0),
 		numRules:    0,
 	}
@@ -125,7 +130,6 @@ func TestChoiceParsing(t *testing.T) {
 		Keytab:      NewKeytab(),
 		numKeywords: 0,
 		initialized: false,
-		maxTokenPos: 0,
 		ruleTable:   make([]*Rule, 0),
 		numRules:    0,
 	}
@@ -160,13 +164,11 @@ func TestChoiceParsing(t *testing.T) {
 	inputFile2 := NewFilepath("test_choice_input2.txt", nil, false)
 	inputFile2.Text = "bar\n"
 
-	node2, err := peg.Parse(inputFile2, false)
+	parser := peg.NewParser()
+	node2, err := parser.Parse(inputFile2, false)
 	if err != nil {
-		t.Logf("Lexer has %d tokens:", len(peg.lexer.Tokens))
-		for i, tok := range peg.lexer.Tokens {
-			t.Logf("  [%d] Type=%d, Name=%s", i, tok.Type, tok.GetName())
-		}
-		t.Logf("Lexer has %d ParseResults", len(peg.lexer.ParseResults))
+		t.Logf("Lexer has %d tokens:\n%s", len(parser.lexer.Tokens), parser.lexer.TokensString())
+		t.Logf("Lexer has %d ParseResults", len(parser.lexer.ParseResults))
 		t.Logf("First rule: %s, pexpr type: %d", peg.firstOrderedRule.Sym.Name, peg.firstOrderedRule.pexpr.Type)
 		t.Logf("First rule has %d children", len(peg.firstOrderedRule.pexpr.ChildPexprs()))
 		if len(peg.firstOrderedRule.pexpr.ChildPexprs()) > 0 {
@@ -185,3 +187,1392 @@ func TestChoiceParsing(t *testing.T) {
 
 	t.Logf("✅ Successfully parsed both alternatives")
 }
+
+// newTestPeg builds a Peg from grammar text, the same way the tests above do
+// by hand, with node simplification enabled.
+func newTestPeg(t *testing.T, grammar string) *Peg {
+	t.Helper()
+	peg := newUnparsedTestPeg(t, grammar)
+	if err := peg.ParseRules(); err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	return peg
+}
+
+// newUnparsedTestPeg is like newTestPeg, but lets the caller configure the Peg
+// before calling ParseRules.
+func newUnparsedTestPeg(t *testing.T, grammar string) *Peg {
+	t.Helper()
+	fp := NewFilepath("test.syn", nil, false)
+	fp.Text = grammar + "\n"
+
+	peg := &Peg{
+		PegKeytab:     NewKeytab(),
+		Keytab:        NewKeytab(),
+		ruleTable:     make([]*Rule, 0),
+		simplifyNodes: true,
+	}
+	peg.buildPegKeywordTable()
+
+	lexer, err := NewLexer(fp, peg.PegKeytab, false)
+	if err != nil {
+		t.Fatalf("Failed to create lexer: %v", err)
+	}
+	peg.InsertLexer(lexer)
+	peg.lexer.EnableWeakStrings(true)
+	return peg
+}
+
+// parseTestInput parses text with peg and fails the test on error.
+func parseTestInput(t *testing.T, peg *Peg, text string) *Node {
+	t.Helper()
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	inputFile.Text = text + "\n"
+	node, err := peg.Parse(inputFile, false)
+	if err != nil {
+		t.Fatalf("Failed to parse %q: %v", text, err)
+	}
+	return node
+}
+
+// expectParseError parses text with peg, failing the test if it parses, and
+// returns the error.
+func expectParseError(t *testing.T, peg *Peg, text string) error {
+	t.Helper()
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	inputFile.Text = text + "\n"
+	_, err := peg.Parse(inputFile, false)
+	if err == nil {
+		t.Fatalf("Expected %q to fail to parse", text)
+	}
+	return err
+}
+
+// TestLexerErrorInput verifies a lexer error is returned by Parse, rather than
+// parsing the tokens before it as if the input ended there.
+func TestLexerErrorInput(t *testing.T) {
+	peg := newTestPeg(t, `goal := IDENT*`)
+	err := expectParseError(t, peg, "a b\nc @ d")
+	if err.Error() != "test_input.txt:2: Parser error: keyword not found" {
+		t.Errorf("Expected a keyword not found error on line 2, got %v", err)
+	}
+	// Newlines are skipped when the grammar doesn't use them.
+	node := parseTestInput(t, peg, "a b\nc d")
+	if len(node.MatchedTokens()) != 5 {
+		t.Errorf("Expected 4 identifiers and EOF:%s", node.ToString())
+	}
+}
+
+// TestBadEscapeInput verifies a bad escape is reported as such, on its line,
+// instead of as a syntax error where the lexer stopped.
+func TestBadEscapeInput(t *testing.T) {
+	peg := newTestPeg(t, `goal := STRING*`)
+	err := expectParseError(t, peg, "\"ok\"\n\"bad \\q escape\"")
+	if err.Error() != "test_input.txt:2: Invalid escape sequence" {
+		t.Errorf("Expected an invalid escape sequence error on line 2, got %v", err)
+	}
+}
+
+// TestCharLiteralInput verifies single quotes in input files are character
+// literals, even though the grammar's lexer treats them as weak strings.
+func TestCharLiteralInput(t *testing.T) {
+	peg := newTestPeg(t, `goal := 'x' INTEGER "+" INTEGER`)
+	node := parseTestInput(t, peg, "x 'a' + '\\n'")
+
+	var values []*Token
+	node.Walk(func(n *Node) bool {
+		if n.Token != nil && n.Token.Type == TokenTypeInteger {
+			values = append(values, n.Token)
+		}
+		return true
+	}, nil)
+	if len(values) != 2 {
+		t.Fatalf("Expected 2 INTEGER tokens, got %d:%s", len(values), node.ToString())
+	}
+	if !values[0].IsValue(uint8('a')) || !values[1].IsValue(uint8('\n')) {
+		t.Errorf("Expected 'a' and '\\n', got %v and %v", values[0].Value.Val, values[1].Value.Val)
+	}
+}
+
+// TestTextCapture verifies text(e) replaces the tokens and rules it matched
+// with a single STRING node holding their text.
+func TestTextCapture(t *testing.T) {
+	for _, grammar := range []string{
+		`goal := "import" text(IDENT ("." IDENT)*) ";"`,
+		"goal := \"import\" text(path) \";\"\npath := IDENT (\".\" IDENT)*",
+	} {
+		peg := newTestPeg(t, grammar)
+		node := parseTestInput(t, peg, "import a . b.c;")
+		if len(node.Find("path")) != 0 {
+			t.Errorf("path node should have been replaced by text:%s", node.ToString())
+		}
+
+		var texts []*Token
+		node.Walk(func(n *Node) bool {
+			if n.Token != nil && n.Token.Type == TokenTypeString {
+				texts = append(texts, n.Token)
+			}
+			return true
+		}, nil)
+		if len(texts) != 1 {
+			t.Fatalf("Expected 1 text node, got %d:%s", len(texts), node.ToString())
+		}
+		if !texts[0].IsValue("a.b.c") {
+			t.Errorf("Expected text \"a.b.c\", got %q", texts[0].Value.Val)
+		}
+		if texts[0].GetName() != "a . b.c" {
+			t.Errorf("Expected location to span \"a . b.c\", got %q", texts[0].GetName())
+		}
+		if node.CountChildNodes() != 4 {
+			t.Errorf("Expected import, text, ';' and EOF nodes:%s", node.ToString())
+		}
+	}
+
+	// With a space, "text" is just a nonterminal.
+	peg := newTestPeg(t, "goal := text (\"a\")\ntext := \"b\"")
+	if peg.firstOrderedRule.pexpr.firstChildPexpr.Type != PexprTypeNonterm {
+		t.Errorf("Expected text to be a nonterminal: %s", peg.ToString())
+	}
+}
+
+// TestCharClassParsing verifies character classes match single-character
+// tokens.
+func TestCharClassParsing(t *testing.T) {
+	peg := newTestPeg(t, `goal := [a-fA-F0-9]+ ";"`)
+	parseTestInput(t, peg, "a B 7 ;")
+	for _, bad := range []string{"g;", "ab;", "12;"} {
+		expectParseError(t, peg, bad)
+	}
+
+	peg = newTestPeg(t, `goal := [^x] ";"`)
+	parseTestInput(t, peg, "y;")
+	expectParseError(t, peg, "x;")
+	if s := peg.firstOrderedRule.ToString(); s != `goal: [^x] ";"` {
+		t.Errorf("Unexpected rule string %s", s)
+	}
+}
+
+// TestParseTopLevel verifies good definitions are delivered around a
+// malformed one.
+func TestParseTopLevel(t *testing.T) {
+	peg := newTestPeg(t, `goal := ";"* def*
+def := "func" IDENT "(" ")" "{" "}"`)
+
+	var names []string
+	var errs []error
+	peg.ParseTopLevel("; func a() {} func b( {} func c() {}", func(def *Node, err error) {
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		if sym := def.GetRuleSym(); sym == nil || sym.Name != "def" {
+			t.Errorf("Expected a def node, got:%s", def.ToString())
+			return
+		}
+		names = append(names, def.IndexChildNode(1).Token.GetName())
+	})
+
+	if len(errs) != 1 {
+		t.Errorf("Expected 1 error, got %v", errs)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "c" {
+		t.Errorf("Expected definitions a and c, got %v", names)
+	}
+}
+
+// TestErrorAnnotation verifies a %error message is reported when its rule
+// fails at the furthest token reached.
+func TestErrorAnnotation(t *testing.T) {
+	peg := newTestPeg(t, `goal := statement+
+statement := "print" IDENT ";" | "let" IDENT "=" INTEGER ";" %error "expected a statement"`)
+	if msg := peg.FindRule(NewSym("statement")).ErrorMessage; msg != "expected a statement" {
+		t.Fatalf("Expected error message on statement, got %q", msg)
+	}
+	parseTestInput(t, peg, "print a; let b = 1;")
+
+	err := expectParseError(t, peg, "print a; 5;")
+	if err.Error() != "Syntax error at line 1: expected a statement" {
+		t.Errorf("Expected custom error message, got %v", err)
+	}
+
+	// The statement fails furthest into the input mid-rule, after "let b =".
+	err = expectParseError(t, peg, "print a;\nlet b = c;")
+	if err.Error() != "Syntax error at line 2: expected a statement" {
+		t.Errorf("Expected custom error message mid-rule, got %v", err)
+	}
+
+	// When another rule gets further than the annotated one, the error is
+	// generic.
+	peg = newTestPeg(t, `goal := statement+ | IDENT IDENT IDENT
+statement := "print" IDENT ";" %error "expected a statement"`)
+	err = expectParseError(t, peg, "a b 5")
+	if err.Error() != "Syntax error at line 1" {
+		t.Errorf("Expected generic error message, got %v", err)
+	}
+}
+
+// TestSyntaxErrorSnippet verifies syntax errors show the offending line when
+// snippets are enabled.
+func TestSyntaxErrorSnippet(t *testing.T) {
+	peg := newTestPeg(t, `goal := statement+
+statement := "print" IDENT ";"`)
+	peg.SetShowSnippets(true)
+	err := expectParseError(t, peg, "print a;\nprint 5;")
+	expected := "Syntax error at line 2\nprint 5;\n      ^"
+	if err.Error() != expected {
+		t.Errorf("Expected %q, got %v", expected, err)
+	}
+}
+
+// errReader is an io.Reader that always fails.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+// TestParseReader verifies input can be parsed from an io.Reader, and that read
+// errors are reported as such.
+func TestParseReader(t *testing.T) {
+	peg := newTestPeg(t, `goal := "print" IDENT ";"`)
+	node, err := peg.ParseReader("stdin", strings.NewReader("print a;"), false)
+	if err != nil {
+		t.Fatalf("Failed to parse from reader: %v", err)
+	}
+	found := false
+	node.Walk(func(n *Node) bool {
+		found = found || (n.Token != nil && n.Token.GetName() == "a")
+		return true
+	}, nil)
+	if !found {
+		t.Errorf("Expected identifier a in tree:%s", node.ToString())
+	}
+
+	_, err = peg.ParseReader("stdin", errReader{}, false)
+	if err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("Expected read error, got %v", err)
+	}
+	_, err = peg.ParseReader("stdin", strings.NewReader("print;"), false)
+	if err == nil || !strings.HasPrefix(err.Error(), "Syntax error") {
+		t.Errorf("Expected syntax error, got %v", err)
+	}
+}
+
+// cancelAfterContext is a context that reports it was cancelled after its Err
+// method has been called checks times.
+type cancelAfterContext struct {
+	context.Context
+	checks int
+}
+
+func (c *cancelAfterContext) Err() error {
+	c.checks--
+	if c.checks < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+// TestParseContext verifies a parse stops with context.Canceled when its
+// context is cancelled partway through.
+func TestParseContext(t *testing.T) {
+	peg := newTestPeg(t, `goal := statement+
+statement := "print" IDENT ";"`)
+	text := strings.Repeat("print a; ", 10000)
+
+	ctx := &cancelAfterContext{Context: context.Background(), checks: 3}
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	inputFile.Text = text + "\n"
+	_, err := peg.ParseContext(ctx, inputFile, false)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if ctx.checks != -1 {
+		t.Errorf("Expected parsing to stop at the first cancelled check, %d checks left", ctx.checks)
+	}
+
+	// The Peg can be reused after a cancelled parse.
+	parseTestInput(t, peg, text)
+}
+
+// TestSpacePredicate verifies SPACE distinguishes tokens separated by
+// whitespace from adjacent ones.
+func TestSpacePredicate(t *testing.T) {
+	peg := newTestPeg(t, `goal := IDENT (increment | plusPlus) IDENT
+increment := "+" !SPACE "+"
+plusPlus := "+" SPACE "+"`)
+	if s := peg.FindRule(NewSym("increment")).ToString(); s != `increment: "+" !SPACE "+"` {
+		t.Errorf("Unexpected rule string %s", s)
+	}
+
+	node := parseTestInput(t, peg, "a ++ b")
+	if len(node.Find("increment")) != 1 || len(node.Find("plusPlus")) != 0 {
+		t.Errorf("Expected a ++ b to be an increment:%s", node.ToString())
+	}
+	node = parseTestInput(t, peg, "a + + b")
+	if len(node.Find("plusPlus")) != 1 || len(node.Find("increment")) != 0 {
+		t.Errorf("Expected a + + b to be a plusPlus:%s", node.ToString())
+	}
+	node = parseTestInput(t, peg, "a +/* comment */+ b")
+	if len(node.Find("plusPlus")) != 1 {
+		t.Errorf("Expected a comment to count as whitespace:%s", node.ToString())
+	}
+}
+
+// TestMaxChoiceAttempts verifies a parse that tries too many choice
+// alternatives is aborted.
+func TestMaxChoiceAttempts(t *testing.T) {
+	peg := newTestPeg(t, `goal := item+
+item := "a" | "b" | "c" | "d" | "e" | "f" | "g" | "h" | group
+group := "(" item* ")"`)
+	text := strings.Repeat("( h ( g ) ) ", 50)
+	parseTestInput(t, peg, text)
+
+	peg.SetMaxChoiceAttempts(500)
+	err := expectParseError(t, peg, text)
+	if !strings.Contains(err.Error(), "maximum of 500 choice alternatives") {
+		t.Errorf("Expected too many choice alternatives, got %v", err)
+	}
+
+	peg.SetMaxChoiceAttempts(100000)
+	parseTestInput(t, peg, text)
+}
+
+// TestMaxParseLimits verifies a parse that nests rules too deeply or memoizes
+// too many ParseResults is aborted with an error, rather than running out of
+// memory.
+func TestMaxParseLimits(t *testing.T) {
+	peg := newTestPeg(t, `goal := item+
+item := "a" | group
+group := "(" item* ")"`)
+	text := strings.Repeat("( ", 100) + "a" + strings.Repeat(" )", 100)
+	parseTestInput(t, peg, text)
+
+	peg.SetMaxRecursionDepth(50)
+	if err := expectParseError(t, peg, text); !strings.Contains(err.Error(), "maximum rule nesting depth of 50") {
+		t.Errorf("Expected rules nested too deeply, got %v", err)
+	}
+	peg.SetMaxRecursionDepth(1000)
+	parseTestInput(t, peg, text)
+
+	peg.SetMaxParseResults(100)
+	if err := expectParseError(t, peg, text); !strings.Contains(err.Error(), "maximum of 100 parse results") {
+		t.Errorf("Expected too many parse results, got %v", err)
+	}
+	peg.SetMaxParseResults(0)
+	parseTestInput(t, peg, text)
+}
+
+// TestLongestChoice verifies a / choice matches its longest alternative, where
+// a | choice matches its first.
+func TestLongestChoice(t *testing.T) {
+	rules := `
+short := IDENT
+long := IDENT IDENT`
+	first := newTestPeg(t, "goal := item*\nitem := short | long"+rules)
+	longest := newTestPeg(t, "goal := item*\nitem := short / long"+rules)
+	if s := longest.FindRule(NewSym("item")).ToString(); s != "item: short / long" {
+		t.Errorf("Unexpected rule string %s", s)
+	}
+
+	node := parseTestInput(t, first, "a b")
+	if len(node.Find("short")) != 2 || len(node.Find("long")) != 0 {
+		t.Errorf("Expected the first alternative to match twice:%s", node.ToString())
+	}
+	node = parseTestInput(t, longest, "a b")
+	if len(node.Find("long")) != 1 || len(node.Find("short")) != 0 {
+		t.Errorf("Expected only the longest alternative in the tree:%s", node.ToString())
+	}
+	node = parseTestInput(t, longest, "a b c")
+	if len(node.Find("long")) != 1 || len(node.Find("short")) != 1 {
+		t.Errorf("Expected a long then a short item:%s", node.ToString())
+	}
+
+	peg := newUnparsedTestPeg(t, "goal := a | b / c\na := IDENT\nb := INTEGER\nc := FLOAT")
+	if err := peg.ParseRules(); err == nil || !strings.Contains(err.Error(), "'|' and '/' mixed") {
+		t.Errorf("Expected an error mixing | and /, got %v", err)
+	}
+}
+
+// TestByteRange verifies a range of character literals matches the character
+// literals in it, and that bad ranges are rejected.
+func TestByteRange(t *testing.T) {
+	peg := newTestPeg(t, `goal := letter+
+letter := 'a'..'z' | '_'`)
+	if s := peg.RuleByName("letter").ToString(); s != `letter: 'a'..'z' | "_"` {
+		t.Errorf("Unexpected rule string %s", s)
+	}
+	node := parseTestInput(t, peg, "'a' 'q' 'z'")
+	if letters := node.Find("letter"); len(letters) != 3 {
+		t.Errorf("Expected 3 letters:%s", node.ToString())
+	}
+	for _, text := range []string{"'A'", "'{'", "a"} {
+		expectParseError(t, peg, text)
+	}
+	// Character literals are integers, so 97 is 'a'.
+	parseTestInput(t, peg, "97")
+
+	for _, grammar := range []string{"goal := 'z'..'a'", "goal := 'a'..\"z\"", "goal := 'ab'..'z'"} {
+		peg := newUnparsedTestPeg(t, grammar)
+		if err := peg.ParseRules(); err == nil {
+			t.Errorf("Expected an error for %s", grammar)
+		}
+	}
+}
+
+// TestEmptyRepetition verifies repetitions of expressions that match empty
+// input stop rather than looping forever, and are warned about.
+func TestEmptyRepetition(t *testing.T) {
+	peg := newTestPeg(t, `goal := (IDENT?)* list+ INTEGER
+list := (IDENT?)+
+empty := EMPTY* x
+x := x*`)
+	expected := []string{
+		"test.syn:3: warning: unused rule 'empty'",
+		"test.syn:1: warning: (IDENT?)* in rule 'goal' repeats an expression that can match empty input",
+		"test.syn:1: warning: list+ in rule 'goal' repeats an expression that can match empty input",
+		"test.syn:2: warning: (IDENT?)+ in rule 'list' repeats an expression that can match empty input",
+		"test.syn:3: warning: EMPTY* in rule 'empty' repeats an expression that can match empty input",
+		"test.syn:4: warning: x* in rule 'x' repeats an expression that can match empty input",
+	}
+	if warnings := peg.Warnings(); strings.Join(warnings, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected warnings:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(warnings, "\n"))
+	}
+	for _, text := range []string{"a b 1", "1"} {
+		parseTestInput(t, peg, text)
+	}
+}
+
+// TestRepeatedParse verifies parsing doesn't change the grammar, so a Peg
+// gives the same tree each time, and the goal rule can be recursive.
+func TestRepeatedParse(t *testing.T) {
+	peg := newTestPeg(t, `goal := "(" goal ")" | INTEGER`)
+	grammar := peg.ToString()
+
+	var trees []string
+	for i := 0; i < 3; i++ {
+		trees = append(trees, parseTestInput(t, peg, "((7))").ToString())
+		if peg.ToString() != grammar {
+			t.Errorf("Parse %d changed the grammar to:\n%s", i, peg.ToString())
+		}
+	}
+	if trees[0] != trees[1] || trees[1] != trees[2] {
+		t.Errorf("Expected identical trees, got:%s\n%s\n%s", trees[0], trees[1], trees[2])
+	}
+	if trees[0] != "\ngoal(\"(\"\n  goal(\"(\"\n    goal(7)\")\")\")\"EOF)" {
+		t.Errorf("Unexpected tree:%s", trees[0])
+	}
+
+	expectParseError(t, peg, "((7)")
+	expectParseError(t, peg, "(7) 8")
+
+	// An empty goal rule still gets a node.
+	peg = newTestPeg(t, `goal := INTEGER*`)
+	if node := parseTestInput(t, peg, ""); node.GetRuleSym() == nil || node.GetRuleSym().Name != "goal" {
+		t.Errorf("Expected a goal node for empty input:%s", node.ToString())
+	}
+}
+
+// TestConcurrentParse parses different inputs with one Peg from several
+// goroutines at once.  Run with -race to check that the grammar is not written.
+func TestConcurrentParse(t *testing.T) {
+	peg := newTestPeg(t, `goal := sum
+sum := sum "+" value | value
+value : INTEGER | IDENT`)
+	grammar := peg.ToString()
+
+	var inputs, expected []string
+	for i := 1; i <= 8; i++ {
+		input := "1"
+		for j := 2; j <= i; j++ {
+			if j%2 == 0 {
+				input += fmt.Sprintf(" + x%d", j)
+			} else {
+				input += fmt.Sprintf(" + %d", j)
+			}
+		}
+		inputs = append(inputs, input)
+		expected = append(expected, parseTestInput(t, peg, input).ToString())
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(inputs))
+	for i := range inputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			parser := peg.NewParser()
+			for n := 0; n < 20; n++ {
+				inputFile := NewFilepath(fmt.Sprintf("input%d.txt", i), nil, false)
+				inputFile.Text = inputs[i] + "\n"
+				node, err := parser.Parse(inputFile, false)
+				if err != nil {
+					errs <- fmt.Errorf("failed to parse %q: %v", inputs[i], err)
+					return
+				}
+				if node.ToString() != expected[i] {
+					errs <- fmt.Errorf("expected %q to parse as:%s\ngot:%s", inputs[i], expected[i], node.ToString())
+					return
+				}
+				inputFile = NewFilepath("bad.txt", nil, false)
+				inputFile.Text = inputs[i] + " +\n"
+				if _, err := peg.Parse(inputFile, false); err == nil {
+					errs <- fmt.Errorf("expected %q + to be rejected", inputs[i])
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if peg.ToString() != grammar {
+		t.Errorf("Parsing changed the grammar to:\n%s", peg.ToString())
+	}
+}
+
+func TestPegClone(t *testing.T) {
+	peg := newTestPeg(t, `goal := sum
+sum := sum "+" value | value
+value : INTEGER | IDENT | "(" sum ")"`)
+	clone := peg.Clone()
+	if clone.ToString() != peg.ToString() {
+		t.Fatalf("Expected clone to have the same rules:\n%s\ngot:\n%s", peg.ToString(), clone.ToString())
+	}
+	for _, rule := range clone.OrderedRules() {
+		if rule.peg != clone || clone.FindRule(rule.Sym) != rule || peg.FindRule(rule.Sym) == rule {
+			t.Errorf("Expected rule %s to belong only to the clone", rule.Sym.Name)
+		}
+		walkPexprs(rule.pexpr, func(pexpr *Pexpr) {
+			if pexpr.NontermRule != nil && pexpr.NontermRule != clone.FindRule(pexpr.Sym) {
+				t.Errorf("Expected %s in rule %s to be bound to the clone's rule", pexpr.Sym.Name, rule.Sym.Name)
+			}
+			if pexpr.Keyword != nil && pexpr.Keyword != clone.Keytab.Lookup(pexpr.Keyword.Sym.Name) {
+				t.Errorf("Expected %s in rule %s to use the clone's keyword", pexpr.Keyword.Sym.Name, rule.Sym.Name)
+			}
+		})
+	}
+
+	// Interleave parses with the original and the clone.
+	node := parseTestInput(t, peg, "1 + x")
+	cloneNode := parseTestInput(t, clone, "(a + 2)")
+	if expected := parseTestInput(t, peg, "1 + x").ToString(); node.ToString() != expected {
+		t.Errorf("Expected original parse to be unchanged:%s\ngot:%s", expected, node.ToString())
+	}
+	if expected := parseTestInput(t, peg, "(a + 2)").ToString(); cloneNode.ToString() != expected {
+		t.Errorf("Expected clone to parse like the original:%s\ngot:%s", expected, cloneNode.ToString())
+	}
+
+	// Settings are copied, not shared.
+	clone.SetSimplifyNodes(false)
+	if !peg.SimplifyNodes() {
+		t.Errorf("Expected clone settings not to affect the original")
+	}
+
+	// Parameterized rules are copied, and the diagnostic sink is not.
+	peg = newUnparsedTestPeg(t, `goal := list(IDENT, ",")
+list(elem, sep) := elem (sep elem)*`)
+	peg.SetDiagnosticSink(func(Diagnostic) {})
+	if err := peg.ParseRules(); err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+	clone = peg.Clone()
+	if len(clone.paramRules) != 1 || clone.paramRules[0] == peg.paramRules[0] {
+		t.Fatalf("Expected a copy of the parameterized rule")
+	}
+	if rule := clone.paramRules[0]; rule.peg != clone || rule.ToString() != peg.paramRules[0].ToString() {
+		t.Errorf("Expected %s, got %s", peg.paramRules[0].ToString(), rule.ToString())
+	}
+	if clone.diagnosticSink != nil {
+		t.Errorf("Expected the clone to have no diagnostic sink")
+	}
+}
+
+// expectPanic fails the test if fn doesn't panic with a message containing
+// expected.
+func expectPanic(t *testing.T, expected string, fn func()) {
+	t.Helper()
+	defer func() {
+		t.Helper()
+		r := recover()
+		if err, ok := r.(error); !ok || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected a panic with %q, got %v", expected, r)
+		}
+	}()
+	fn()
+}
+
+// TestMustParse verifies MustNewPeg and MustParseString return their results,
+// and panic with the error when the grammar or input is bad.
+func TestMustParse(t *testing.T) {
+	peg := MustNewPeg("test_simple.syn")
+	node := peg.MustParseString("greeting.txt", "hello world")
+	if tokens := node.MatchedTokens(); len(tokens) != 3 || tokens[1].GetName() != "world" {
+		t.Errorf("Expected to parse the greeting, got:%s", node.ToString())
+	}
+	expectPanic(t, `MustParseString("greeting.txt"): Syntax error at line 1`, func() {
+		peg.MustParseString("greeting.txt", "goodbye world")
+	})
+	expectPanic(t, `MustNewPeg("missing.syn")`, func() {
+		MustNewPeg("missing.syn")
+	})
+}
+
+// BenchmarkParseRuneSyn parses a Rune program with the rune.syn grammar.
+func BenchmarkParseRuneSyn(b *testing.B) {
+	peg, err := NewPeg("rune.syn")
+	if err != nil {
+		b.Fatalf("Failed to load rune.syn: %v", err)
+	}
+	text := ""
+	for i := 0; i < 200; i++ {
+		text += "println \"Hello, World!\"\n"
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		inputFile := NewFilepath("bench.rn", nil, false)
+		inputFile.Text = text
+		if _, err := peg.Parse(inputFile, false); err != nil {
+			b.Fatalf("Failed to parse: %v", err)
+		}
+	}
+}
+
+// TestCut verifies a cut commits to its alternative, so a malformed statement
+// reports what was expected rather than a failure of the whole choice.
+func TestCut(t *testing.T) {
+	peg := newTestPeg(t, `goal := stmt*
+stmt := "if" ^ IDENT "then" stmt | IDENT "=" IDENT`)
+	parseTestInput(t, peg, "if a then b = c")
+	err := expectParseError(t, peg, "if a b = c")
+	if err.Error() != `Syntax error at line 1: expected "then"` {
+		t.Errorf("Expected a missing \"then\" error, got: %v", err)
+	}
+
+	// Later alternatives are not tried after a cut, but are without one.
+	expectParseError(t, newTestPeg(t, `goal := "x" ^ "y" | "x" "z"`), "x z")
+	parseTestInput(t, newTestPeg(t, `goal := "x" "y" | "x" "z"`), "x z")
+
+	// A cut in a called rule does not commit the caller's choice.
+	parseTestInput(t, newTestPeg(t, `goal := xy | "x" "z"
+xy := "x" ^ "y"`), "x z")
+}
+
+// TestNewlines verifies NEWLINE matches newlines and keeps them in the tree,
+// and that SetPreserveNewlines keeps those matched by a weak '\n' too.
+func TestNewlines(t *testing.T) {
+	countNewlines := func(node *Node) int {
+		count := 0
+		for _, token := range node.MatchedTokens() {
+			if token.IsKeyword("\n") {
+				count++
+			}
+		}
+		return count
+	}
+	peg := newTestPeg(t, `goal := (stmt NEWLINE)*
+stmt := IDENT "=" INTEGER`)
+	if !strings.Contains(peg.ToString(), "(stmt NEWLINE)*") {
+		t.Errorf("Expected NEWLINE in the grammar:\n%s", peg.ToString())
+	}
+	// A strong "\n" is the same terminal, and is printed as NEWLINE too.
+	if s := newTestPeg(t, `goal := (IDENT "\n")*`).ToString(); s != "goal: (IDENT NEWLINE)*\n" {
+		t.Errorf("Expected a strong newline to print as NEWLINE, got %q", s)
+	}
+	if count := countNewlines(parseTestInput(t, peg, "a = 1\nb = 2")); count != 2 {
+		t.Errorf("Expected 2 newline nodes, got %d", count)
+	}
+	expectParseError(t, peg, "a = 1 b = 2")
+
+	peg = newTestPeg(t, `goal := (stmt '\n')*
+stmt := IDENT "=" INTEGER`)
+	if count := countNewlines(parseTestInput(t, peg, "a = 1\nb = 2")); count != 0 {
+		t.Errorf("Expected weak newlines to be left out of the tree, got %d", count)
+	}
+	peg.SetPreserveNewlines(true)
+	node := parseTestInput(t, peg, "a = 1\nb = 2")
+	if count := countNewlines(node); count != 2 {
+		t.Errorf("Expected 2 preserved newline nodes, got %d:%s", count, node.ToString())
+	}
+	if count := countNewlines(parseTestInput(t, peg.Clone(), "a = 1")); count != 1 {
+		t.Errorf("Expected a clone to preserve newlines, got %d", count)
+	}
+}
+
+// TestParseStats verifies the work done by a parse is counted, and that
+// backtracking into a rule at the same position hits the memo table.
+func TestParseStats(t *testing.T) {
+	peg := newTestPeg(t, `expr := term "+" expr | term
+term := INTEGER | "(" expr ")"`)
+	parseTestInput(t, peg, "(1 + 2) + 3")
+	if stats := peg.Stats(); stats != (ParseStats{}) {
+		t.Errorf("Expected no stats unless they are collected: %+v", stats)
+	}
+	peg.SetCollectStats(true)
+	parseTestInput(t, peg, "(1 + 2) + 3")
+	stats := peg.Stats()
+	if stats.MemoHits == 0 {
+		t.Errorf("Expected memo hits: %+v", stats)
+	}
+	if stats.RuleCalls != stats.MemoHits+stats.MemoMisses+stats.FirstSetSkips {
+		t.Errorf("Expected each rule call to be a hit, miss or skip: %+v", stats)
+	}
+	if stats.ParseResults < stats.MemoMisses || stats.MaxRecursionDepth < 4 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	// Each parse starts counting again.
+	parser := peg.NewParser()
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	inputFile.Text = "1\n"
+	if _, err := parser.Parse(inputFile, false); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if parserStats := parser.Stats(); parserStats.RuleCalls >= stats.RuleCalls || parserStats.MaxRecursionDepth != 2 {
+		t.Errorf("Expected fewer rule calls for a shorter input: %+v", parserStats)
+	}
+}
+
+// TestFirstTokenError verifies input whose first token can't start the goal
+// rule is rejected before any rules are tried, with an error naming the token.
+func TestFirstTokenError(t *testing.T) {
+	peg := newTestPeg(t, `goal := statement+
+statement := "print" IDENT ";" | IDENT "=" INTEGER ";"`)
+	peg.SetCollectStats(true)
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"5 = 1;", "Syntax error at line 1: goal can't start with INTEGER 5"},
+		{"\n;", `Syntax error at line 2: goal can't start with ";"`},
+	}
+	for _, test := range tests {
+		if err := expectParseError(t, peg, test.text); err.Error() != test.expected {
+			t.Errorf("%q: expected %q, got %v", test.text, test.expected, err)
+		}
+		if stats := peg.Stats(); stats.RuleCalls != 0 || stats.ParseResults != 0 {
+			t.Errorf("%q: expected no parsing work, got %+v", test.text, stats)
+		}
+	}
+
+	// The goal's %error message is used instead of naming the token.
+	peg = newTestPeg(t, `goal := statement+ %error "expected a statement"
+statement := "print" IDENT ";"`)
+	if err := expectParseError(t, peg, "5"); err.Error() != "Syntax error at line 1: expected a statement" {
+		t.Errorf("Expected the goal's error message, got %v", err)
+	}
+
+	// A goal that can match empty input is parsed as usual.
+	peg = newTestPeg(t, `goal := statement*
+statement := "print" IDENT ";"`)
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	inputFile.Text = "5"
+	if _, _, err := peg.ParsePartial(inputFile, false); err != nil {
+		t.Errorf("Expected an empty match, got %v", err)
+	}
+}
+
+// TestIndentDedent verifies grammars using INDENT and DEDENT parse input with
+// blocks delimited by indentation.
+func TestIndentDedent(t *testing.T) {
+	peg := newTestPeg(t, `goal := statement+
+statement := "if" IDENT ":" block | IDENT
+block := INDENT statement+ DEDENT`)
+	if !strings.Contains(peg.ToString(), "block: INDENT statement+ DEDENT") {
+		t.Errorf("Expected INDENT and DEDENT in the grammar:\n%s", peg.ToString())
+	}
+	node := parseTestInput(t, peg, "if a:\n  if b:\n    x\n  y\nz\n")
+	if s := node.ToString(); strings.Count(s, "block") != 2 {
+		t.Errorf("Expected two nested blocks, got:%s", s)
+	}
+
+	// Without the indentation, the if has no block.
+	expectParseError(t, peg, "if a:\nx")
+
+	// Grammars without INDENT and DEDENT ignore indentation.
+	peg = newTestPeg(t, `goal := IDENT+`)
+	parseTestInput(t, peg, "a\n  b\nc\n")
+}
+
+// TestAnyToken verifies ANY matches any token but EOF, so rules can skip
+// input up to a sentinel, whatever the first set of the skipped tokens.
+func TestAnyToken(t *testing.T) {
+	peg := newTestPeg(t, `goal := (stmt | junk ";")*
+stmt := IDENT "=" INTEGER ";"
+junk := (!";" ANY)*`)
+	if !strings.Contains(peg.ToString(), `junk: (!";" ANY)*`) {
+		t.Errorf("Expected ANY in the grammar:\n%s", peg.ToString())
+	}
+	node := parseTestInput(t, peg, `a = 1; 2 = "x" if 4.5 ; b = 3;`)
+	junk := node.Find("junk")
+	if len(junk) != 1 || len(junk[0].MatchedTokens()) != 5 {
+		t.Fatalf("Expected one junk node with 5 tokens:%s", node.ToString())
+	}
+	if stmts := node.Find("stmt"); len(stmts) != 2 {
+		t.Errorf("Expected 2 statements, got %d:%s", len(stmts), node.ToString())
+	}
+
+	// ANY* consumes everything but EOF.
+	peg = newTestPeg(t, `goal := ANY*`)
+	if tokens := parseTestInput(t, peg, `1 "two" three 'x' 4.0`).MatchedTokens(); len(tokens) != 6 {
+		t.Errorf("Expected 5 tokens and EOF, got %d", len(tokens))
+	}
+}
+
+// TestParseFile verifies ParseFile returns syntax errors as diagnostics, and
+// with Recover, keeps the definitions around them.
+func TestParseFile(t *testing.T) {
+	peg := newTestPeg(t, `goal := stmt*
+stmt := IDENT "=" INTEGER ";"`)
+	path := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(path, []byte("a = 1;\nb = ;\nc = 3;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	node, diagnostics, err := peg.ParseFile(path, ParseOptions{})
+	var syntaxErr *SyntaxError
+	if node != nil || !errors.As(err, &syntaxErr) || syntaxErr.Location.Line != 2 {
+		t.Errorf("Expected a syntax error on line 2, got %v", err)
+	}
+	if len(diagnostics) != 1 || diagnostics[0].String() != path+":2: error: Syntax error at line 2" {
+		t.Errorf("Expected one diagnostic on line 2, got %v", diagnostics)
+	}
+
+	simplify := true
+	node, diagnostics, err = peg.ParseFile(path, ParseOptions{Recover: true, Simplify: &simplify})
+	if err != nil {
+		t.Fatalf("Expected recovery from the syntax error, got %v", err)
+	}
+	if len(diagnostics) != 1 || diagnostics[0].Severity != SeverityError || diagnostics[0].Location.Line != 2 {
+		t.Errorf("Expected one error diagnostic on line 2, got %v", diagnostics)
+	}
+	if stmts := node.Find("stmt"); len(stmts) != 2 || node.CountChildNodes() != 2 {
+		t.Errorf("Expected the 2 good statements:%s", node.ToString())
+	}
+
+	// Limits override the Peg's, and stop the parse.
+	_, diagnostics, err = peg.ParseFile(path, ParseOptions{Recover: true, MaxParseResults: 1})
+	if err == nil || !strings.Contains(err.Error(), "maximum of 1 parse results") || len(diagnostics) != 0 {
+		t.Errorf("Expected the result limit to stop the parse, got %v and %v", err, diagnostics)
+	}
+	if _, _, err := peg.ParseFile(filepath.Join(t.TempDir(), "missing.txt"), ParseOptions{}); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+
+	// Files ending in a lone "\r" are read as Filepath.ReadFile reads them, and
+	// the Peg's SetSimplifyNodes applies unless Simplify is set.
+	peg = newTestPeg(t, `goal := stmt*
+stmt := IDENT "=" value ";"
+value : INTEGER`)
+	if err := os.WriteFile(path, []byte("a = 1;\rb = 2;\r"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected := parseTestInput(t, peg, "a = 1;\rb = 2;\r").ToString()
+	node, _, err = peg.ParseFile(path, ParseOptions{})
+	if err != nil || node.ToString() != expected {
+		t.Errorf("Expected the Peg's simplified tree:%s\ngot:%v", expected, err)
+	}
+	simplify = false
+	node, _, err = peg.ParseFile(path, ParseOptions{Simplify: &simplify})
+	if err != nil || node.ToString() == expected {
+		t.Errorf("Expected an unsimplified tree, got %v", err)
+	}
+}
+
+// TestTabWidth verifies SetTabWidth sets the tab stops used for the columns of
+// input locations.
+func TestTabWidth(t *testing.T) {
+	peg := newTestPeg(t, `goal := IDENT*`)
+	for _, test := range []struct{ tabWidth, col uint32 }{{0, 3}, {4, 9}, {8, 17}} {
+		peg.SetTabWidth(test.tabWidth)
+		tokens := parseTestInput(t, peg, "a\n\t\tb").MatchedTokens()
+		if col := tokens[1].Location.Column(); col != test.col {
+			t.Errorf("TabWidth %d: expected b in column %d, got %d", test.tabWidth, test.col, col)
+		}
+	}
+
+	// The caller's Filepath keeps its own TabWidth.
+	peg.SetTabWidth(4)
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	inputFile.Text = "a\n\t\tb\n"
+	node, err := peg.Parse(inputFile, false)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if col := node.MatchedTokens()[1].Location.Column(); col != 9 || inputFile.TabWidth != 0 {
+		t.Errorf("Expected b in column 9 and the input's TabWidth unchanged, got %d and %d", col, inputFile.TabWidth)
+	}
+}
+
+func TestReparse(t *testing.T) {
+	peg := newTestPeg(t, `goal := stmt*
+stmt := IDENT "=" expr ";" | "print" expr ";"
+expr := expr "+" term | expr "-" term | term
+term : INTEGER | IDENT | "(" expr ")" | name=text(STRING STRING*)`)
+	peg.SetCollectStats(true)
+	parser := peg.NewParser()
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	inputFile.Text = "a = 1 + 2;\nb = (a - 3) + 4;\nprint \"x\" \"y\";\nc = a + b;\nprint c;\n"
+	if _, err := parser.Parse(inputFile, false); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	fullStats := parser.Stats()
+
+	edits := []struct {
+		edit TextEdit
+		text string // The edited text
+	}{
+		{TextEdit{Pos: 20, Len: 1, Text: "30"}, "a = 1 + 2;\nb = (a - 30) + 4;\nprint \"x\" \"y\";\nc = a + b;\nprint c;\n"},
+		{TextEdit{Pos: 0, Len: 0, Text: "z = 9;\n"}, "z = 9;\na = 1 + 2;\nb = (a - 30) + 4;\nprint \"x\" \"y\";\nc = a + b;\nprint c;\n"},
+		{TextEdit{Pos: 49, Len: 0, Text: " \"w\""}, "z = 9;\na = 1 + 2;\nb = (a - 30) + 4;\nprint \"x\" \"y\" \"w\";\nc = a + b;\nprint c;\n"},
+		{TextEdit{Pos: 7, Len: 11, Text: ""}, "z = 9;\nb = (a - 30) + 4;\nprint \"x\" \"y\" \"w\";\nc = a + b;\nprint c;\n"},
+		{TextEdit{Pos: 61, Len: 1, Text: "(c - z)"}, "z = 9;\nb = (a - 30) + 4;\nprint \"x\" \"y\" \"w\";\nc = a + b;\nprint (c - z);\n"},
+	}
+	for i, test := range edits {
+		node, err := parser.Reparse(test.edit)
+		if err != nil {
+			t.Fatalf("Edit %d: failed to reparse: %v", i, err)
+		}
+		if inputFile.Text != test.text {
+			t.Fatalf("Edit %d: expected text %q, got %q", i, test.text, inputFile.Text)
+		}
+		stats := parser.Stats()
+		if stats.MemoHits == 0 || stats.MemoMisses >= fullStats.MemoMisses {
+			t.Errorf("Edit %d: expected memoized results to be reused, got %+v", i, stats)
+		}
+		expected := parseTestInput(t, peg, strings.TrimSuffix(test.text, "\n"))
+		if diff := node.Diff(expected); diff != "" {
+			t.Errorf("Edit %d: reparsed tree differs from a fresh parse: %s", i, diff)
+		}
+		// Labels and locations must match too.
+		got, _ := node.MarshalJSON()
+		want, _ := expected.MarshalJSON()
+		if string(got) != string(want) {
+			t.Errorf("Edit %d: expected %s, got %s", i, want, got)
+		}
+	}
+
+	// Syntax and lexer errors are reported, and later edits can fix them.
+	if _, err := parser.Reparse(TextEdit{Pos: 0, Len: 1, Text: "+"}); err == nil {
+		t.Errorf("Expected a syntax error")
+	}
+	if _, err := parser.Reparse(TextEdit{Pos: 0, Len: 1, Text: "@"}); err == nil {
+		t.Errorf("Expected a lexer error")
+	}
+	node, err := parser.Reparse(TextEdit{Pos: 0, Len: 1, Text: "y"})
+	if err != nil {
+		t.Fatalf("Failed to reparse the fixed input: %v", err)
+	}
+	if diff := node.Diff(parseTestInput(t, peg, strings.TrimSuffix(inputFile.Text, "\n"))); diff != "" {
+		t.Errorf("Reparsed tree differs from a fresh parse: %s", diff)
+	}
+	if _, err := parser.Reparse(TextEdit{Pos: 1000, Len: 1}); err == nil {
+		t.Errorf("Expected an error for an edit past the end of the input")
+	}
+	if _, err := peg.NewParser().Reparse(TextEdit{}); err == nil {
+		t.Errorf("Expected an error reparsing before parsing")
+	}
+}
+
+// TestRecoverErrors verifies that with SetRecoverErrors, every independent
+// syntax error is reported, and the statements around them are still parsed,
+// with the tokens skipped at each error in an error node.
+func TestRecoverErrors(t *testing.T) {
+	peg := newTestPeg(t, `goal := stmt*
+stmt := IDENT "=" expr ";" | "print" expr ";"
+expr := expr "+" term | term
+term : INTEGER | IDENT`)
+	keywords, tokenTypes := peg.FindRule(NewSym("stmt")).FollowSet()
+	if fmt.Sprint(keywords, tokenTypes) != fmt.Sprint([]string{"print"}, []TokenType{TokenTypeIdent, TokenTypeEof}) {
+		t.Errorf("Unexpected follow set of stmt: %v %v", keywords, tokenTypes)
+	}
+	peg.SetRecoverErrors(true)
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	inputFile.Text = "a = 1 2;\nb = 3;\nc = + ;\nprint b;\n"
+	node, err := peg.Parse(inputFile, false)
+	syntaxErrs, ok := err.(SyntaxErrors)
+	if !ok || len(syntaxErrs) != 2 {
+		t.Fatalf("Expected 2 syntax errors, got %v", err)
+	}
+	for i, line := range []uint32{1, 3} {
+		if syntaxErrs[i].Location.Line != line {
+			t.Errorf("Expected error %d on line %d, got %v", i, line, syntaxErrs[i])
+		}
+	}
+	if node == nil {
+		t.Fatalf("Expected a partial tree")
+	}
+	skippedText := func(node *Node) string {
+		var skipped []string
+		node.Walk(func(n *Node) bool {
+			if n.SyntaxError != nil {
+				skipped = append(skipped, n.SourceText())
+			}
+			return true
+		}, nil)
+		return strings.Join(skipped, "|")
+	}
+	if skipped := skippedText(node); skipped != "2|+ ;" {
+		t.Errorf("Expected error nodes for \"2\" and \"+ ;\", got %q", skipped)
+	}
+	if stmts := node.Find("stmt"); len(stmts) != 4 {
+		t.Errorf("Expected 4 statements, got %d:%s", len(stmts), node.ToString())
+	}
+
+	// A stray token between statements stops the repetition, which skips to
+	// the next statement.
+	inputFile.Text = "a = 1;\n+ ;\nb = 2;\n"
+	node, err = peg.Parse(inputFile, false)
+	if syntaxErrs, ok := err.(SyntaxErrors); !ok || len(syntaxErrs) != 1 || syntaxErrs[0].Location.Line != 2 {
+		t.Fatalf("Expected a syntax error on line 2, got %v", err)
+	}
+	if node == nil || skippedText(node) != "+ ;" || len(node.Find("stmt")) != 2 {
+		t.Errorf("Expected 2 statements around \"+ ;\", got %v", node)
+	}
+
+	// A stray token before the first statement is skipped too.
+	inputFile.Text = "+ a = 1;\nb = 2;\n"
+	node, err = peg.Parse(inputFile, false)
+	if syntaxErrs, ok := err.(SyntaxErrors); !ok || len(syntaxErrs) != 1 || syntaxErrs[0].Location.Line != 1 {
+		t.Fatalf("Expected a syntax error on line 1, got %v", err)
+	}
+	if node == nil || skippedText(node) != "+" || len(node.Find("stmt")) != 2 {
+		t.Errorf("Expected 2 statements after \"+\", got %v", node)
+	}
+
+	// When the goal can't start with the first token, the error naming it is
+	// found before parsing, and the token is then skipped.
+	firstPeg := newTestPeg(t, `goal := stmt+
+stmt := IDENT "=" INTEGER ";"`)
+	firstPeg.SetRecoverErrors(true)
+	inputFile.Text = "= a = 1;\nb = 2;\n"
+	node, err = firstPeg.Parse(inputFile, false)
+	if syntaxErrs, ok := err.(SyntaxErrors); !ok || len(syntaxErrs) != 1 ||
+		syntaxErrs[0].Message != `Syntax error at line 1: goal can't start with "="` {
+		t.Fatalf("Expected a syntax error for the first token, got %v", err)
+	}
+	if node == nil || skippedText(node) != "=" || len(node.Find("stmt")) != 2 {
+		t.Errorf("Expected 2 statements after \"=\", got %v", node)
+	}
+
+	// A goal that stops before EOF skips to it.
+	goalPeg := newTestPeg(t, `goal := stmt stmt
+stmt := IDENT "=" INTEGER ";"`)
+	goalPeg.SetRecoverErrors(true)
+	inputFile.Text = "a = 1;\nb = 2;\n= c\n"
+	node, err = goalPeg.Parse(inputFile, false)
+	if syntaxErrs, ok := err.(SyntaxErrors); !ok || len(syntaxErrs) != 1 || syntaxErrs[0].Location.Line != 3 {
+		t.Fatalf("Expected a syntax error on line 3, got %v", err)
+	}
+	if node == nil || skippedText(node) != "= c" || len(node.Find("stmt")) != 2 {
+		t.Errorf("Expected 2 statements before \"= c\", got %v", node)
+	}
+
+	// Without recovery, only the first error is reported.
+	peg.SetRecoverErrors(false)
+	if _, err := peg.Parse(inputFile, false); err == nil || strings.Contains(err.Error(), "\n") {
+		t.Errorf("Expected a single syntax error, got %v", err)
+	}
+}
+
+// TestSoftKeyword verifies that SOFTKW "async" matches the identifier async
+// where the grammar expects it, while async remains an ordinary identifier
+// everywhere else.
+func TestSoftKeyword(t *testing.T) {
+	peg := newTestPeg(t, `goal := stmt*
+stmt := asyncCall | assign
+asyncCall := SOFTKW "async" IDENT "(" ")" ";"
+assign := IDENT "=" IDENT ";"`)
+	if peg.Keytab.Lookup("async") != nil {
+		t.Errorf("Expected async not to be a keyword")
+	}
+	if s := peg.FindRule(NewSym("asyncCall")).ToString(); s != `asyncCall: SOFTKW "async" IDENT "(" ")" ";"` {
+		t.Errorf("Unexpected rule string: %s", s)
+	}
+	node := parseTestInput(t, peg, "async foo();\nasync = foo;\nx = async;")
+	calls := node.Find("asyncCall")
+	assigns := node.Find("assign")
+	if len(calls) != 1 || len(assigns) != 2 {
+		t.Fatalf("Expected 1 asyncCall and 2 assigns, got:%s", node.ToString())
+	}
+	if tokens := calls[0].MatchedTokens(); len(tokens) == 0 || tokens[0].Type != TokenTypeIdent || tokens[0].GetName() != "async" {
+		t.Errorf("Expected asyncCall to start with the identifier async, got %v", tokens)
+	}
+
+	// Other identifiers don't match the soft keyword.
+	expectParseError(t, peg, "sync foo();")
+}
+
+// TestEOFPredicates verifies that EOF can be matched and tested for in any
+// rule, not just after the goal rule.
+func TestEOFPredicates(t *testing.T) {
+	// &EOF makes the final statement's ";" optional
+	peg := newTestPeg(t, `goal := stmt*
+stmt := IDENT+ end
+end : ";" | &EOF`)
+	node := parseTestInput(t, peg, "a b; c d")
+	if s := node.ToString(); s != "\ngoal(\n  stmt(ab\";\")\n  stmt(cd)EOF)" {
+		t.Errorf("Unexpected tree: %s", s)
+	}
+
+	// !EOF rejects a trailing ","
+	peg = newTestPeg(t, `goal := item*
+item := IDENT ("," !EOF)?`)
+	parseTestInput(t, peg, "a, b, c")
+	expectParseError(t, peg, "a, b,")
+
+	// The goal rule can match EOF itself, and nothing but what can match
+	// nothing can follow it.
+	peg = newTestPeg(t, `goal := IDENT* last
+last := EOF ";"?`)
+	node = parseTestInput(t, peg, "a b")
+	if s := node.ToString(); s != "\ngoal(ab\n  last(EOF))" {
+		t.Errorf("Unexpected tree: %s", s)
+	}
+	peg = newTestPeg(t, `goal := IDENT* EOF ";"`)
+	expectParseError(t, peg, "a b")
+}
+
+// TestParseFrom verifies that inputs can be parsed with rules other than the
+// goal rule, which must still match the whole input.
+func TestParseFrom(t *testing.T) {
+	peg := newTestPeg(t, `goal := statement*
+statement := IDENT "=" expr ";"
+expr := expr "+" term | term
+term : INTEGER | IDENT | "(" expr ")"`)
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	inputFile.Text = "a + (b + 1)\n"
+	node, err := peg.ParseFrom("expr", inputFile, false)
+	if err != nil {
+		t.Fatalf("Failed to parse an expression: %v", err)
+	}
+	if sym := node.GetRuleSym(); sym == nil || sym.Name != "expr" {
+		t.Errorf("Expected an expr node, got %s", node.ToString())
+	}
+	if tokens := node.MatchedTokens(); len(tokens) == 0 || !tokens[len(tokens)-1].IsEof() {
+		t.Errorf("Expected the tree to end with EOF, got %v", tokens)
+	}
+	expectParseError(t, peg, "a + (b + 1)")
+
+	// The rest of the input must match too.
+	inputFile.Text = "a + b;\n"
+	if _, err := peg.ParseFrom("expr", inputFile, false); err == nil {
+		t.Errorf("Expected a syntax error for input after the expression")
+	}
+	inputFile.Text = "x = a + b;\n"
+	if _, err := peg.ParseFrom("statement", inputFile, false); err != nil {
+		t.Errorf("Failed to parse a statement: %v", err)
+	}
+	if _, err := peg.ParseFrom("missing", inputFile, false); err == nil {
+		t.Errorf("Expected an error for an undefined rule")
+	}
+
+	// Reparse starts from the same rule.
+	parser := peg.NewParser()
+	inputFile.Text = "a + b\n"
+	if _, err := parser.ParseFrom("expr", inputFile, false); err != nil {
+		t.Fatalf("Failed to parse an expression: %v", err)
+	}
+	node, err = parser.Reparse(TextEdit{Pos: 4, Len: 1, Text: "(c + 2)"})
+	if err != nil {
+		t.Fatalf("Failed to reparse an expression: %v", err)
+	}
+	if sym := node.GetRuleSym(); sym == nil || sym.Name != "expr" {
+		t.Errorf("Expected an expr node, got %s", node.ToString())
+	}
+}
+
+// TestParsePartial verifies that the goal rule can match a prefix of the
+// input, and that where it stopped is returned.
+func TestParsePartial(t *testing.T) {
+	peg := newTestPeg(t, `goal := expr ";"
+expr := expr "+" term | term
+term : INTEGER | IDENT`)
+	expectParseError(t, peg, "1 + 2; leftover")
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	inputFile.Text = "1 + 2; leftover\n"
+	parser := peg.NewParser()
+	node, pos, err := parser.ParsePartial(inputFile, false)
+	if err != nil {
+		t.Fatalf("Failed to parse a prefix: %v", err)
+	}
+	if token := parser.Tokens()[pos]; token.GetName() != "leftover" {
+		t.Errorf("Expected parsing to stop at leftover, got %q", token.GetName())
+	}
+	if s := node.ToString(); strings.Contains(s, "leftover") || strings.Contains(s, "EOF") {
+		t.Errorf("Expected only the prefix in the tree, got %s", s)
+	}
+
+	// A whole input stops at EOF.
+	inputFile.Text = "1 + 2;\n"
+	_, pos, err = parser.ParsePartial(inputFile, false)
+	if err != nil || !parser.Tokens()[pos].IsEof() {
+		t.Errorf("Expected parsing to stop at EOF, got %d, %v", pos, err)
+	}
+
+	// SetRequireEOF(false) lets Parse match a prefix too.
+	peg.SetRequireEOF(false)
+	inputFile.Text = "1 + 2; leftover\n"
+	if _, err := peg.Parse(inputFile, false); err != nil {
+		t.Errorf("Expected a prefix to parse without EOF required: %v", err)
+	}
+}
+
+// TestInlineGroupParsing verifies that a grouped choice inside a repetition
+// matches each operator and operand in turn.
+func TestInlineGroupParsing(t *testing.T) {
+	peg := newTestPeg(t, `expr := term (op=("+" | "-") term)*
+term := INTEGER`)
+	node := parseTestInput(t, peg, "1 + 2 - 3")
+	if s := node.ToString(); s != "\nexpr(\n  term(1)\"+\"\n  term(2)\"-\"\n  term(3)EOF)" {
+		t.Errorf("Unexpected tree: %s", s)
+	}
+	var ops []string
+	for child := node.FirstChildNode(); child != nil; child = child.NextSibling() {
+		if child.Label == "op" {
+			ops = append(ops, child.Token.GetName())
+		}
+	}
+	if strings.Join(ops, " ") != "+ -" {
+		t.Errorf("Expected the operators to be labelled op, got %v", ops)
+	}
+	expectParseError(t, peg, "1 + - 3")
+}
+
+// FuzzParse lexes and parses arbitrary input with the Rune grammar, checking
+// that errors are returned rather than panics, and that parsed trees can be
+// printed and unparsed.
+func FuzzParse(f *testing.F) {
+	for _, path := range []string{"test_prog.txt", "test_input.txt", "../../examples/inputs/helloworld.rn"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatalf("Failed to read seed %s: %v", path, err)
+		}
+		f.Add(string(data))
+	}
+	for _, seed := range []string{`"\x4g"`, `'\q'`, `0x1fu8 -5 1.5e3f32`, "/* /* */", `\{a b}`, "\"\"\"raw\"\"\""} {
+		f.Add(seed)
+	}
+	peg, err := NewPeg("rune.syn")
+	if err != nil {
+		f.Fatalf("Failed to load rune.syn: %v", err)
+	}
+	keywords := peg.Keytab.OrderedKeywords()
+	names := make([]string, len(keywords))
+	for i, keyword := range keywords {
+		names[i] = keyword.Sym.Name
+	}
+	f.Fuzz(func(t *testing.T, source string) {
+		Tokenize("fuzz.rn", source, LexerOptions{
+			Keywords:                    names,
+			KeepComments:                true,
+			AllowNegativeNumberLiterals: true,
+		})
+		Tokenize("fuzz.syn", source, LexerOptions{UseWeakStrings: true, IndentSensitive: true})
+		node, err := peg.ParseReader("fuzz.rn", strings.NewReader(source), false)
+		if err != nil {
+			return
+		}
+		node.ToString()
+		node.Unparse()
+	})
+}
+
+// TestPrecedence verifies a rule with %precedence groups its operands by
+// operator precedence, left-associatively.
+func TestPrecedence(t *testing.T) {
+	peg := newTestPeg(t, `goal := expr
+expr := term (("+" | "-" | "*" | "/") term)* %precedence { left "+" "-"; left "*" "/" }
+term : INTEGER | "(" expr ")" | "-" term`)
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"7", "\ngoal(\n  expr(7)EOF)"},
+		{"1 + 2", "\ngoal(\n  expr(1\"+\"2)EOF)"},
+		{"1 + 2 * 3", "\ngoal(\n  expr(1\"+\"\n    expr(2\"*\"3))EOF)"},
+		{"1 * 2 + 3", "\ngoal(\n  expr(\n    expr(1\"*\"2)\"+\"3)EOF)"},
+		{"1 - 2 - 3", "\ngoal(\n  expr(\n    expr(1\"-\"2)\"-\"3)EOF)"},
+		{"1 * 2 + 3 * 4 - 5", "\ngoal(\n  expr(\n    expr(\n      expr(1\"*\"2)\"+\"\n      expr(3\"*\"4))\"-\"5)EOF)"},
+		{"(1 + 2) * -3", "\ngoal(\n  expr(\n    term(\"(\"\n      expr(1\"+\"2)\")\")\"*\"\n    term(\"-\"3))EOF)"},
+	}
+	for _, test := range tests {
+		if s := parseTestInput(t, peg, test.text).ToString(); s != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.text, test.expected, s)
+		}
+	}
+
+	// Incremental reparses group the same way as fresh parses.
+	parser := peg.NewParser()
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	inputFile.Text = "1 + 2 * 3\n"
+	if _, err := parser.Parse(inputFile, false); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	node, err := parser.Reparse(TextEdit{Pos: 4, Len: 1, Text: "4 - 5 / 6"})
+	if err != nil {
+		t.Fatalf("Failed to reparse: %v", err)
+	}
+	if diff := node.Diff(parseTestInput(t, peg, "1 + 4 - 5 / 6 * 3")); diff != "" {
+		t.Errorf("Reparsed tree differs from a fresh parse: %s", diff)
+	}
+}
+
+// TestReplSkipToNewline verifies a REPL loop can report a syntax or lexer error,
+// skip the rest of its line, and parse the statements after it.
+func TestReplSkipToNewline(t *testing.T) {
+	peg := newTestPeg(t, `goal := stmt
+stmt := IDENT "=" INTEGER ";"`)
+	parser := peg.NewParser()
+	inputFile := NewFilepath("test_input.txt", nil, false)
+	parseAll := func(text string) (parsed, errors []string) {
+		for text != "" {
+			inputFile.Text = text
+			node, pos, err := parser.ParsePartial(inputFile, false)
+			if node != nil {
+				parsed = append(parsed, node.MatchedTokens()[0].GetName())
+			}
+			if err != nil {
+				errors = append(errors, err.Error())
+				text = parser.SkipToNewline()
+				continue
+			}
+			token := parser.Tokens()[pos]
+			if token.IsEof() {
+				break
+			}
+			text = text[token.Location.Pos:]
+		}
+		return parsed, errors
+	}
+	// The lexer error is on the first line, so it is reported first.
+	parsed, errors := parseAll("e = @;\na = 1;\nb = = 2; x = 9;\nc = 3; d = 4;\n")
+	if s := strings.Join(parsed, " "); s != "a c d" {
+		t.Errorf("Expected statements a c d, got %q", s)
+	}
+	if len(errors) != 2 || !strings.Contains(errors[0], "keyword not found") || !strings.HasPrefix(errors[1], "Syntax error at line 1") {
+		t.Errorf("Expected a lexer error and a syntax error, got %q", errors)
+	}
+	// The statements before a lexer error are still parsed.
+	parsed, errors = parseAll("a = 1;\nb = 2;\nc = @;\nd = 4;\n")
+	if s := strings.Join(parsed, " "); s != "a b d" {
+		t.Errorf("Expected statements a b d, got %q", s)
+	}
+	if len(errors) != 1 || !strings.Contains(errors[0], "keyword not found") {
+		t.Errorf("Expected a lexer error, got %q", errors)
+	}
+	// A statement ending where a token can't be read is returned with the error.
+	parsed, errors = parseAll("a = 1;@\nb = 2;\n")
+	if s := strings.Join(parsed, " "); s != "a b" {
+		t.Errorf("Expected statements a b, got %q", s)
+	}
+	if len(errors) != 1 || !strings.Contains(errors[0], "keyword not found") {
+		t.Errorf("Expected a lexer error, got %q", errors)
+	}
+	if parser.SkipToNewline(); len(parser.Tokens()) != 0 {
+		t.Errorf("Expected the tokens to be dropped")
+	}
+}
@@ -46,9 +46,6 @@ type ParseResult struct {
 	prevRuleParseResult     *ParseResult
 	nextRuleParseResult     *ParseResult
 
-	// Hashed Rule:"Hashed" ParseResult:"Hashed" cascade ("pos")
-	nextHashedRuleParseResult *ParseResult
-
 	// DoublyLinked Lexer ParseResult cascade
 	lexer                     *Lexer
 	prevLexerParseResult      *ParseResult
@@ -63,10 +60,46 @@ type ParseResult struct {
 
 	// For collecting tokens/parse tree building
 	lastChildParseResultSnapshot *ParseResult
+	textSpans                    []textSpan // Token spans matched by text(e)
+	labelSpans                   []textSpan // Token spans matched by label=e
+
+	// Token spans skipped by error recovery
+	errorSpans []errorSpan
+
+	// For Parser.Reparse: what parsing the rule depended on and found, and
+	// whether this was reused from the last parse, and not yet used in this
+	// one.
+	record parseRecord
+	stale  bool
+}
+
+// textSpan records the tokens matched by a text(e) or label=e pexpr.
+type textSpan struct {
+	pexpr    *Pexpr
+	startPos uint32
+	endPos   uint32
+}
+
+// errorSpan records the tokens skipped to recover from a syntax error, after
+// pexpr failed at startPos.
+type errorSpan struct {
+	textSpan
+	syntaxErr *SyntaxError
+}
+
+// NewParseResult creates a new ParseResult for the tokens of lexer, and adds
+// it to the rule's ParseResults.
+func NewParseResult(parentParseResult *ParseResult, rule *Rule, pos uint32, result Match, lexer *Lexer) *ParseResult {
+	pr := newParseResult(parentParseResult, rule, pos, result, lexer)
+
+	// Add to rule's doubly-linked list
+	rule.AppendParseResult(pr)
+	return pr
 }
 
-// NewParseResult creates a new ParseResult.
-func NewParseResult(parentParseResult *ParseResult, rule *Rule, pos uint32, result Match) *ParseResult {
+// newParseResult creates a new ParseResult for the tokens of lexer, without
+// adding it to the rule, which may be shared by concurrent parses.
+func newParseResult(parentParseResult *ParseResult, rule *Rule, pos uint32, result Match, lexer *Lexer) *ParseResult {
 	pr := &ParseResult{
 		Rule:              rule,
 		Pos:               pos,
@@ -77,18 +110,13 @@ func NewParseResult(parentParseResult *ParseResult, rule *Rule, pos uint32, resu
 		node:              nil,
 	}
 
-	// Add to rule's hashed table and doubly-linked list
-	rule.InsertHashedParseResult(pr)
-	rule.AppendParseResult(pr)
-
 	// Add to parent if provided
 	if parentParseResult != nil {
 		parentParseResult.AppendChildParseResult(pr)
 	}
 
 	// Add to lexer so we can access parse results later
-	if rule.peg != nil && rule.peg.lexer != nil {
-		lexer := rule.peg.lexer
+	if lexer != nil {
 		lexer.AppendParseResult(pr)
 	}
 
@@ -103,6 +131,53 @@ func NewParseResult(parentParseResult *ParseResult, rule *Rule, pos uint32, resu
 	return pr
 }
 
+// move moves this ParseResult and its descendants shift tokens, and adds them
+// to lexer, for reuse by Parser.Reparse.  ParseResults in moved are skipped,
+// and the others are added to it.
+func (pr *ParseResult) move(shift int, lexer *Lexer, moved map[*ParseResult]bool) {
+	if moved[pr] {
+		return
+	}
+	moved[pr] = true
+	pr.stale = true
+	pr.Pos = shiftPos(pr.Pos, shift)
+	pr.Result.Pos = shiftPos(pr.Result.Pos, shift)
+	pr.record.examinedEnd = shiftPos(pr.record.examinedEnd, shift)
+	if pr.record.maxTokenPos != 0 {
+		pr.record.maxTokenPos = shiftPos(pr.record.maxTokenPos, shift)
+	}
+	if pr.record.errorRule != nil {
+		pr.record.errorPos = shiftPos(pr.record.errorPos, shift)
+	}
+	if pr.record.cutPexpr != nil {
+		pr.record.cutPos = shiftPos(pr.record.cutPos, shift)
+	}
+	for _, spans := range [][]textSpan{pr.textSpans, pr.labelSpans} {
+		for i := range spans {
+			spans[i].startPos = shiftPos(spans[i].startPos, shift)
+			spans[i].endPos = shiftPos(spans[i].endPos, shift)
+		}
+	}
+	pr.node = nil
+	pr.prevLexerParseResult = nil
+	pr.nextLexerParseResult = nil
+	pr.SetLexer(lexer)
+	for child := pr.firstChildParseResult; child != nil; child = child.nextChildParseResult {
+		child.move(shift, lexer, moved)
+	}
+}
+
+// claim marks this stale ParseResult and its descendants as used in the
+// current parse.
+func (pr *ParseResult) claim() {
+	pr.stale = false
+	for child := pr.firstChildParseResult; child != nil; child = child.nextChildParseResult {
+		if child.stale {
+			child.claim()
+		}
+	}
+}
+
 // ============================================================================
 // DoublyLinked Rule ParseResult cascade
 // ============================================================================
@@ -233,16 +308,41 @@ func (pr *ParseResult) BuildParseTree(simplify bool) *Node {
 	node := NewNode(parentNode, pr, pr.Pos, pr.Result.Pos)
 	pr.InsertNode(node)
 
-	// Add tokens from this parse result's range
+	// Add tokens from this parse result's range.  Text spans replace
+	// everything they cover, including child parse results.
 	pos := pr.Pos
-	for _, child := range pr.ChildParseResults() {
+	children := pr.ChildParseResults()
+	for {
+		for len(children) > 0 && children[0].Pos < pos {
+			children = children[1:]
+		}
+		limit := pr.Result.Pos
+		if len(children) > 0 {
+			limit = children[0].Pos
+		}
+		if span := pr.findErrorSpan(pos, limit); span != nil {
+			pr.addNodeTokens(node, pos, span.startPos)
+			pr.addErrorNode(node, span)
+			pos = span.endPos
+			continue
+		}
+		if span := pr.findTextSpan(pos, limit); span != nil {
+			pr.addNodeTokens(node, pos, span.startPos)
+			pr.addTextNode(node, span)
+			pos = span.endPos
+			continue
+		}
 		// Add any tokens between current pos and child's start
-		pr.addNodeTokens(node, pos, child.Pos)
-		child.BuildParseTree(simplify)
-		pos = child.Result.Pos
+		pr.addNodeTokens(node, pos, limit)
+		if len(children) == 0 {
+			break
+		}
+		children[0].BuildParseTree(simplify)
+		pos = children[0].Result.Pos
+		children = children[1:]
 	}
-	// Add remaining tokens
-	pr.addNodeTokens(node, pos, pr.Result.Pos)
+
+	pr.labelChildNodes(node)
 
 	// Simplify the node tree if requested
 	if simplify {
@@ -260,15 +360,95 @@ func (pr *ParseResult) addNodeTokens(node *Node, startPos uint32, endPos uint32)
 
 	for pos := startPos; pos < endPos && pos < uint32(len(pr.lexer.Tokens)); pos++ {
 		token := pr.lexer.Tokens[pos]
-		if token.Pexpr != nil {
-			pexpr := token.Pexpr.(*Pexpr)
-			if !pexpr.Weak {
-				NewNode(node, nil, pos, pos+1).SetToken(token)
+		// Tokens not matched by a pexpr, or matched by weak ones, are left out
+		if pexpr, ok := token.Pexpr.(*Pexpr); ok && pexpr != nil && !pexpr.Weak {
+			NewNode(node, nil, pos, pos+1).SetToken(token)
+		}
+	}
+}
+
+// labelChildNodes sets the labels of the children of node that are within the
+// spans matched by labelled pexprs.
+func (pr *ParseResult) labelChildNodes(node *Node) {
+	for _, span := range pr.labelSpans {
+		for child := node.firstChildNode; child != nil; child = child.nextChildNode {
+			if child.StartPos >= span.startPos && child.EndPos <= span.endPos {
+				child.Label = span.pexpr.Label
 			}
 		}
 	}
 }
 
+// findTextSpan returns the outermost text span starting in [startPos, limit],
+// or nil if there is none.
+func (pr *ParseResult) findTextSpan(startPos uint32, limit uint32) *textSpan {
+	var found *textSpan
+	for i := range pr.textSpans {
+		span := &pr.textSpans[i]
+		if span.startPos < startPos || span.startPos > limit {
+			continue
+		}
+		if found == nil || span.startPos < found.startPos ||
+			(span.startPos == found.startPos && span.endPos > found.endPos) {
+			found = span
+		}
+	}
+	return found
+}
+
+// findErrorSpan returns the first error span starting in [startPos, limit], or
+// nil if there is none.
+func (pr *ParseResult) findErrorSpan(startPos uint32, limit uint32) *errorSpan {
+	for i := range pr.errorSpans {
+		span := &pr.errorSpans[i]
+		if span.startPos >= startPos && span.startPos <= limit {
+			return span
+		}
+	}
+	return nil
+}
+
+// addErrorNode adds a leaf node for the tokens skipped in span, which has the
+// span's SyntaxError.  If no tokens were skipped, its location is empty, at
+// the token where the error was found.
+func (pr *ParseResult) addErrorNode(node *Node, span *errorSpan) {
+	child := NewNode(node, nil, span.startPos, span.endPos)
+	child.SyntaxError = span.syntaxErr
+	if pr.lexer == nil || int(span.startPos) >= len(pr.lexer.Tokens) {
+		return
+	}
+	first := pr.lexer.Tokens[span.startPos].Location
+	if span.endPos <= span.startPos {
+		child.Location = NewLocation(first.Filepath, first.Pos, 0, first.Line)
+		return
+	}
+	child.Location = first.Merge(pr.lexer.Tokens[span.endPos-1].Location)
+}
+
+// addTextNode adds a leaf node holding a STRING token whose value is the
+// concatenated text of the tokens in span.  The token is not added to the
+// lexer, so token positions are unaffected.  Since the node is a leaf with a
+// strong pexpr, simplification treats it like any other strong token.
+func (pr *ParseResult) addTextNode(node *Node, span *textSpan) {
+	if pr.lexer == nil || int(span.endPos) > len(pr.lexer.Tokens) {
+		return
+	}
+	text := ""
+	for pos := span.startPos; pos < span.endPos; pos++ {
+		text += pr.lexer.Tokens[pos].GetName()
+	}
+	first := pr.lexer.Tokens[span.startPos].Location
+	location := first.Merge(pr.lexer.Tokens[span.endPos-1].Location)
+	token := &Token{
+		Type:     TokenTypeString,
+		Location: location,
+		Value:    NewValue(text),
+		Lexer:    pr.lexer,
+		Pexpr:    span.pexpr,
+	}
+	NewNode(node, nil, span.startPos, span.endPos).SetToken(token)
+}
+
 // ============================================================================
 // String representation
 // ============================================================================
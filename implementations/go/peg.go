@@ -14,7 +14,11 @@
 
 package parser
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
 
 // Peg is the main PEG parser class.
 type Peg struct {
@@ -34,18 +38,76 @@ type Peg struct {
 	firstOrderedRule *Rule
 	lastOrderedRule  *Rule
 
-	// Parser state
-	maxTokenPos   uint32
-	savedToken1   *Token
-	savedToken2   *Token
+	// Parameterized rules, such as list(elem), in order.  They are not in the
+	// rule table, but are instantiated there for each list of arguments used.
+	paramRules []*Rule
+
+	// Grammar parser state
+	savedTokens   []*Token // Tokens read ahead by peekToken
 	numKeywords   uint32
-	initialized   bool
-	simplifyNodes bool // Whether to simplify the node tree after parsing
+	initialized   bool   // Whether ParseRules succeeded, so inputs can be parsed
+	eofPexpr      *Pexpr // Matches the EOF after the goal rule
+	newlinePexpr  *Pexpr // Strong newline, for '\n' matches when preserving newlines
+	simplifyNodes bool   // Whether to simplify the node tree after parsing
+
+	// Whether ParseRules accepts rules that are left recursive through other
+	// rules, which the parser does not handle reliably
+	allowIndirectLeftRecursion bool
+
+	// Receives the warnings and errors found by ParseRules, if set
+	diagnosticSink func(Diagnostic)
+	warnings       []string // Warnings found by ParseRules
+
+	// StrictUnusedRules makes rules that are never referenced an error in
+	// ParseRules, rather than a warning
+	StrictUnusedRules bool
+
+	// The grammar files being parsed, the top-level file first, so ParseRules
+	// can detect include cycles
+	includeStack []string
+
+	// At most maxChoiceAttempts choice alternatives are tried in one parse, if
+	// it is not 0
+	maxChoiceAttempts uint32
+
+	// At most maxParseResults ParseResults are memoized, and rules are
+	// nested at most maxRecursionDepth deep, in one parse, if they are not 0
+	maxParseResults   uint32
+	maxRecursionDepth uint32
+
+	// Whether errors parsing input files show the offending source line
+	showSnippets bool
+
+	// The TabWidth given to input files, if not 0
+	tabWidth uint32
+
+	// Whether newlines matched by weak '\n' keywords are kept in parse trees
+	preserveNewlines bool
+
+	// Whether parses recover from syntax errors, and report all of them
+	recoverErrors bool
+
+	// Whether the goal rule may match a prefix of the input, rather than all
+	// of it up to EOF
+	eofOptional bool
+
+	// Whether the grammar uses INDENT or DEDENT, so input is lexed with
+	// Lexer.IndentSensitive set
+	indentSensitive bool
+
+	// Whether parses count the work they do, for Stats
+	collectStats bool
+
+	// The stats of the last parse done by Parse and friends.  Parses may run
+	// concurrently, so these are locked.
+	statsLock sync.Mutex
+	lastStats ParseStats
 
 	// Builtin keywords for PEG syntax
 	kwColon       *Keyword
 	kwColonEquals *Keyword
 	kwPipe        *Keyword
+	kwSlash       *Keyword
 	kwOpenParen   *Keyword
 	kwCloseParen  *Keyword
 	kwStar        *Keyword
@@ -53,8 +115,21 @@ type Peg struct {
 	kwQuestion    *Keyword
 	kwAnd         *Keyword
 	kwNot         *Keyword
+	kwPercent     *Keyword
+	kwEquals      *Keyword
+	kwComma       *Keyword
+	kwDotDot      *Keyword
+	kwCaret       *Keyword
+	kwArrow       *Keyword
+	kwOpenBrace   *Keyword
+	kwCloseBrace  *Keyword
+	kwSemicolon   *Keyword
+	kwNewlineTerm *Keyword
+	kwAny         *Keyword
+	kwSoftKw      *Keyword
 	kwNewline     *Keyword
 	kwEmpty       *Keyword
+	kwSpace       *Keyword
 	kwEof         *Keyword
 	kwIdent       *Keyword
 	kwInteger     *Keyword
@@ -63,6 +138,8 @@ type Peg struct {
 	kwRandInt     *Keyword
 	kwIntType     *Keyword
 	kwUintType    *Keyword
+	kwIndent      *Keyword
+	kwDedent      *Keyword
 }
 
 // NewPeg creates a new Peg parser for the given syntax file.
@@ -72,7 +149,6 @@ func NewPeg(syntaxFileName string) (*Peg, error) {
 		Keytab:        NewKeytab(),
 		numKeywords:   0,
 		initialized:   false,
-		maxTokenPos:   0,
 		ruleTable:     make([]*Rule, 0),
 		numRules:      0,
 		simplifyNodes: true, // Default to simplifying nodes
@@ -99,6 +175,17 @@ func NewPeg(syntaxFileName string) (*Peg, error) {
 	return peg, nil
 }
 
+// MustNewPeg is like NewPeg, but panics if the grammar can't be read or
+// parsed.  Like regexp.MustCompile, it is meant for tests and tools whose
+// grammars are known to be good, not for grammars supplied by users.
+func MustNewPeg(syntaxFileName string) *Peg {
+	peg, err := NewPeg(syntaxFileName)
+	if err != nil {
+		panic(fmt.Errorf("MustNewPeg(%q): %w", syntaxFileName, err))
+	}
+	return peg
+}
+
 // ============================================================================
 // Hashed Peg Rule cascade ("sym")
 // ============================================================================
@@ -118,6 +205,26 @@ func (p *Peg) FindRule(sym *Sym) *Rule {
 	return nil
 }
 
+// RuleByName looks up a Rule by name, or returns nil if there is none.
+func (p *Peg) RuleByName(name string) *Rule {
+	// Names that were never interned can't be rules
+	sym := globalSyms.Lookup(name)
+	if sym == nil {
+		return nil
+	}
+	return p.FindRule(sym)
+}
+
+// findParamRule finds the parameterized rule named sym, or returns nil.
+func (p *Peg) findParamRule(sym *Sym) *Rule {
+	for _, rule := range p.paramRules {
+		if rule.Sym == sym {
+			return rule
+		}
+	}
+	return nil
+}
+
 // InsertRule adds a Rule to the hash table.
 func (p *Peg) InsertRule(rule *Rule) {
 	if rule == nil {
@@ -205,6 +312,52 @@ func (p *Peg) AppendOrderedRule(rule *Rule) {
 	rule.nextOrderedRule = nil
 }
 
+// InsertOrderedRule adds a Rule to the front of the ordered list.
+func (p *Peg) InsertOrderedRule(rule *Rule) {
+	if rule == nil {
+		return
+	}
+
+	rule.nextOrderedRule = p.firstOrderedRule
+	rule.prevOrderedRule = nil
+	if p.firstOrderedRule == nil {
+		p.lastOrderedRule = rule
+	} else {
+		p.firstOrderedRule.prevOrderedRule = rule
+	}
+	p.firstOrderedRule = rule
+	rule.peg = p
+}
+
+// RemoveOrderedRule removes a Rule from the ordered list.
+func (p *Peg) RemoveOrderedRule(rule *Rule) {
+	if rule == nil {
+		return
+	}
+
+	if rule.prevOrderedRule == nil {
+		p.firstOrderedRule = rule.nextOrderedRule
+	} else {
+		rule.prevOrderedRule.nextOrderedRule = rule.nextOrderedRule
+	}
+	if rule.nextOrderedRule == nil {
+		p.lastOrderedRule = rule.prevOrderedRule
+	} else {
+		rule.nextOrderedRule.prevOrderedRule = rule.prevOrderedRule
+	}
+	rule.nextOrderedRule = nil
+	rule.prevOrderedRule = nil
+}
+
+// RuleNames returns the names of all rules in order, the goal rule first.
+func (p *Peg) RuleNames() []string {
+	var names []string
+	for rule := p.firstOrderedRule; rule != nil; rule = rule.nextOrderedRule {
+		names = append(names, rule.Sym.Name)
+	}
+	return names
+}
+
 // OrderedRules returns a slice of all rules in order.
 func (p *Peg) OrderedRules() []*Rule {
 	var rules []*Rule
@@ -218,7 +371,8 @@ func (p *Peg) OrderedRules() []*Rule {
 // OneToOne Peg Lexer cascade
 // ============================================================================
 
-// InsertLexer sets the current lexer.
+// InsertLexer sets the current lexer.  Call ParseRules to replace the grammar
+// with the one the lexer reads.
 func (p *Peg) InsertLexer(lexer *Lexer) {
 	if lexer == nil {
 		return
@@ -227,6 +381,23 @@ func (p *Peg) InsertLexer(lexer *Lexer) {
 	lexer.peg = p
 }
 
+// resetGrammar removes the rules and input keywords of the grammar last parsed,
+// so ParseRules can parse a new one.  Options are kept.
+func (p *Peg) resetGrammar() {
+	p.ruleTable = make([]*Rule, 0)
+	p.numRules = 0
+	p.firstOrderedRule = nil
+	p.lastOrderedRule = nil
+	p.paramRules = nil
+	p.savedTokens = nil
+	p.Keytab.Clear()
+	p.numKeywords = 0
+	p.initialized = false
+	p.eofPexpr = nil
+	p.newlinePexpr = nil
+	p.indentSensitive = false
+}
+
 // ============================================================================
 // Keyword table building
 // ============================================================================
@@ -236,6 +407,7 @@ func (p *Peg) buildPegKeywordTable() {
 	p.kwColon = NewKeyword(p.PegKeytab, ":")
 	p.kwColonEquals = NewKeyword(p.PegKeytab, ":=")
 	p.kwPipe = NewKeyword(p.PegKeytab, "|")
+	p.kwSlash = NewKeyword(p.PegKeytab, "/")
 	p.kwOpenParen = NewKeyword(p.PegKeytab, "(")
 	p.kwCloseParen = NewKeyword(p.PegKeytab, ")")
 	p.kwStar = NewKeyword(p.PegKeytab, "*")
@@ -243,9 +415,22 @@ func (p *Peg) buildPegKeywordTable() {
 	p.kwQuestion = NewKeyword(p.PegKeytab, "?")
 	p.kwAnd = NewKeyword(p.PegKeytab, "&")
 	p.kwNot = NewKeyword(p.PegKeytab, "!")
+	p.kwPercent = NewKeyword(p.PegKeytab, "%")
+	p.kwEquals = NewKeyword(p.PegKeytab, "=")
+	p.kwComma = NewKeyword(p.PegKeytab, ",")
+	p.kwDotDot = NewKeyword(p.PegKeytab, "..")
+	p.kwCaret = NewKeyword(p.PegKeytab, "^")
+	p.kwArrow = NewKeyword(p.PegKeytab, "->")
+	p.kwOpenBrace = NewKeyword(p.PegKeytab, "{")
+	p.kwCloseBrace = NewKeyword(p.PegKeytab, "}")
+	p.kwSemicolon = NewKeyword(p.PegKeytab, ";")
 	p.kwNewline = NewKeyword(p.PegKeytab, "\n")
 	p.kwEmpty = NewKeyword(p.PegKeytab, "EMPTY")
+	p.kwSpace = NewKeyword(p.PegKeytab, "SPACE")
 	p.kwEof = NewKeyword(p.PegKeytab, "EOF")
+	p.kwNewlineTerm = NewKeyword(p.PegKeytab, "NEWLINE")
+	p.kwAny = NewKeyword(p.PegKeytab, "ANY")
+	p.kwSoftKw = NewKeyword(p.PegKeytab, "SOFTKW")
 	p.kwIdent = NewKeyword(p.PegKeytab, "IDENT")
 	p.kwInteger = NewKeyword(p.PegKeytab, "INTEGER")
 	p.kwFloat = NewKeyword(p.PegKeytab, "FLOAT")
@@ -253,6 +438,8 @@ func (p *Peg) buildPegKeywordTable() {
 	p.kwRandInt = NewKeyword(p.PegKeytab, "RANDUINT")
 	p.kwIntType = NewKeyword(p.PegKeytab, "INTTYPE")
 	p.kwUintType = NewKeyword(p.PegKeytab, "UINTTYPE")
+	p.kwIndent = NewKeyword(p.PegKeytab, "INDENT")
+	p.kwDedent = NewKeyword(p.PegKeytab, "DEDENT")
 }
 
 // ============================================================================
@@ -264,6 +451,82 @@ func (p *Peg) SetSimplifyNodes(simplify bool) {
 	p.simplifyNodes = simplify
 }
 
+// SetAllowIndirectLeftRecursion controls whether ParseRules accepts grammars
+// where rules are left recursive through other rules, such as a := b "x" and
+// b := a "y" | "z".  By default this is an error, since only direct left
+// recursion is parsed correctly.  It must be called before ParseRules.
+func (p *Peg) SetAllowIndirectLeftRecursion(allow bool) {
+	p.allowIndirectLeftRecursion = allow
+}
+
+// SetMaxChoiceAttempts limits how many choice alternatives a single parse may
+// try before it is aborted with an error.  This bounds the work done with
+// untrusted grammars.  0, the default, means no limit.
+func (p *Peg) SetMaxChoiceAttempts(maxAttempts uint32) {
+	p.maxChoiceAttempts = maxAttempts
+}
+
+// SetMaxParseResults limits how many ParseResults a single parse may memoize
+// before it is aborted with an error.  This bounds the memory used to parse
+// large or adversarial inputs.  0, the default, means no limit.
+func (p *Peg) SetMaxParseResults(maxParseResults uint32) {
+	p.maxParseResults = maxParseResults
+}
+
+// SetMaxRecursionDepth limits how deeply rules may be nested while parsing,
+// such as by deeply nested parentheses in the input, before the parse is
+// aborted with an error.  0, the default, means no limit.
+func (p *Peg) SetMaxRecursionDepth(maxDepth uint32) {
+	p.maxRecursionDepth = maxDepth
+}
+
+// SetCollectStats controls whether parses count the work they do, such as
+// rule calls and memo hits, as returned by Stats.  It is off by default, so
+// parses don't pay for the counting.
+func (p *Peg) SetCollectStats(collect bool) {
+	p.collectStats = collect
+}
+
+// SetShowSnippets controls whether errors parsing input files are followed by
+// the source line where they were found, with carets under the offending
+// token, as returned by Location.Snippet.
+func (p *Peg) SetShowSnippets(show bool) {
+	p.showSnippets = show
+}
+
+// SetTabWidth sets the TabWidth of input files, so the columns of their
+// locations match an editor with tab stops every tabWidth columns.  A file
+// with a different TabWidth is parsed from a copy, so the caller's Filepath is
+// not changed.  0, the default, leaves each file's TabWidth as it is.
+func (p *Peg) SetTabWidth(tabWidth uint32) {
+	p.tabWidth = tabWidth
+}
+
+// SetPreserveNewlines controls whether newlines matched by a weak '\n' are
+// kept in parse trees, as if the grammar had matched them with NEWLINE, so
+// formatters can see where lines were broken.  Newlines are only tokenized
+// when the grammar matches them somewhere.
+func (p *Peg) SetPreserveNewlines(preserve bool) {
+	p.preserveNewlines = preserve
+}
+
+// SetRecoverErrors controls whether parses recover from syntax errors, rather
+// than stopping at the first.  The tokens where a rule's sequence fails, after
+// matching earlier tokens, are skipped up to one that can follow the rule, and
+// appear in the parse tree as error nodes.  All the errors found are returned
+// as SyntaxErrors, with the tree.
+func (p *Peg) SetRecoverErrors(recover bool) {
+	p.recoverErrors = recover
+}
+
+// SetRequireEOF controls whether parses must match all of the input, up to
+// EOF, which is the default.  When EOF is not required, the goal rule's match
+// of a prefix of the input is returned, without an EOF node.  ParsePartial
+// returns where it stopped.
+func (p *Peg) SetRequireEOF(require bool) {
+	p.eofOptional = !require
+}
+
 // SimplifyNodes returns whether node simplification is enabled.
 func (p *Peg) SimplifyNodes() bool {
 	return p.simplifyNodes
@@ -300,3 +563,250 @@ func (p *Peg) ToString() string {
 func (p *Peg) Dump() {
 	fmt.Println(p.ToString())
 }
+
+// ============================================================================
+// Grammar summary
+// ============================================================================
+
+// Summary returns a short report on the grammar: how many rules and keywords
+// it has, how often each terminal is used, and which rules are nullable,
+// left-recursive, or unreachable from the goal rule.
+func (p *Peg) Summary() string {
+	rules := p.OrderedRules()
+	s := fmt.Sprintf("Rules: %d\n", len(rules))
+	s += fmt.Sprintf("Keywords: %d\n", len(p.Keytab.OrderedKeywords()))
+
+	// Count terminals in order of first use
+	var terminals []string
+	termCounts := make(map[string]int)
+	for _, rule := range rules {
+		walkPexprs(rule.pexpr, func(pexpr *Pexpr) {
+			if pexpr.Type != PexprTypeTerm {
+				return
+			}
+			if termCounts[pexpr.Sym.Name] == 0 {
+				terminals = append(terminals, pexpr.Sym.Name)
+			}
+			termCounts[pexpr.Sym.Name]++
+		})
+	}
+	var termStrings []string
+	for _, name := range terminals {
+		termStrings = append(termStrings, fmt.Sprintf("%s %d", name, termCounts[name]))
+	}
+	s += "Terminals: " + joinOrNone(termStrings) + "\n"
+
+	reachable := make(map[*Rule]bool)
+	if p.firstOrderedRule != nil {
+		p.findReachableRules(p.firstOrderedRule, reachable)
+	}
+	var nullable, leftRecursive, unreachable []string
+	for _, rule := range rules {
+		if rule.CanBeEmpty {
+			nullable = append(nullable, rule.Sym.Name)
+		}
+		if p.isLeftRecursive(rule) {
+			leftRecursive = append(leftRecursive, rule.Sym.Name)
+		}
+		if !reachable[rule] {
+			unreachable = append(unreachable, rule.Sym.Name)
+		}
+	}
+	s += "Nullable rules: " + joinOrNone(nullable) + "\n"
+	s += "Left-recursive rules: " + joinOrNone(leftRecursive) + "\n"
+	s += "Unreachable rules: " + joinOrNone(unreachable) + "\n"
+	return s
+}
+
+// findReachableRules marks rule and every rule it references, directly or
+// indirectly, in reachable.
+func (p *Peg) findReachableRules(rule *Rule, reachable map[*Rule]bool) {
+	if reachable[rule] {
+		return
+	}
+	reachable[rule] = true
+	walkPexprs(rule.pexpr, func(pexpr *Pexpr) {
+		if pexpr.Type == PexprTypeNonterm && pexpr.NontermRule != nil {
+			p.findReachableRules(pexpr.NontermRule, reachable)
+		}
+	})
+}
+
+// isLeftRecursive returns true if rule can call itself, directly or through
+// other rules, without consuming any input.
+func (p *Peg) isLeftRecursive(rule *Rule) bool {
+	visited := make(map[*Rule]bool)
+	pending := leftRules(rule.pexpr, nil)
+	for len(pending) > 0 {
+		next := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if next == rule {
+			return true
+		}
+		if !visited[next] {
+			visited[next] = true
+			pending = leftRules(next.pexpr, pending)
+		}
+	}
+	return false
+}
+
+// leftRules appends to rules the rules pexpr can call before consuming any
+// input.
+func leftRules(pexpr *Pexpr, rules []*Rule) []*Rule {
+	if pexpr == nil {
+		return rules
+	}
+	switch pexpr.Type {
+	case PexprTypeNonterm:
+		if pexpr.NontermRule != nil {
+			rules = append(rules, pexpr.NontermRule)
+		}
+	case PexprTypeSequence:
+		for _, child := range pexpr.ChildPexprs() {
+			rules = leftRules(child, rules)
+			if !child.CanBeEmpty {
+				break
+			}
+		}
+	case PexprTypeChoice, PexprTypeLongestChoice:
+		for _, child := range pexpr.ChildPexprs() {
+			rules = leftRules(child, rules)
+		}
+	case PexprTypeZeroOrMore, PexprTypeOneOrMore, PexprTypeOptional,
+		PexprTypeAnd, PexprTypeNot, PexprTypeText:
+		rules = leftRules(pexpr.firstChildPexpr, rules)
+	}
+	return rules
+}
+
+// walkPexprs calls fn on pexpr and all of its descendants.
+func walkPexprs(pexpr *Pexpr, fn func(*Pexpr)) {
+	if pexpr == nil {
+		return
+	}
+	fn(pexpr)
+	for child := pexpr.firstChildPexpr; child != nil; child = child.nextPexpr {
+		walkPexprs(child, fn)
+	}
+}
+
+// joinOrNone joins names with commas, or returns "none" if there are none.
+func joinOrNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// ============================================================================
+// Cloning
+// ============================================================================
+
+// Clone returns a deep copy of the grammar: its keyword tables, rules and
+// pexprs, with nonterminals bound to the clone's rules.  Nothing that can
+// change is shared, so the clone can parse inputs, or have its rules modified,
+// independently of p.  Syms are interned, so they are shared.  The grammar
+// lexer is not copied, and the clone has no diagnostic sink, so that its
+// diagnostics are not mixed with p's; SetDiagnosticSink can give it one.
+func (p *Peg) Clone() *Peg {
+	clone := &Peg{
+		PegKeytab:                  NewKeytab(),
+		Keytab:                     p.Keytab.clone(),
+		ruleTable:                  make([]*Rule, 0),
+		numKeywords:                p.numKeywords,
+		initialized:                p.initialized,
+		simplifyNodes:              p.simplifyNodes,
+		allowIndirectLeftRecursion: p.allowIndirectLeftRecursion,
+		warnings:                   append([]string(nil), p.warnings...),
+		StrictUnusedRules:          p.StrictUnusedRules,
+		maxChoiceAttempts:          p.maxChoiceAttempts,
+		maxParseResults:            p.maxParseResults,
+		maxRecursionDepth:          p.maxRecursionDepth,
+		showSnippets:               p.showSnippets,
+		tabWidth:                   p.tabWidth,
+		preserveNewlines:           p.preserveNewlines,
+		recoverErrors:              p.recoverErrors,
+		eofOptional:                p.eofOptional,
+		indentSensitive:            p.indentSensitive,
+		collectStats:               p.collectStats,
+	}
+	clone.buildPegKeywordTable()
+
+	// Copy the rules first, so nonterminals can be bound to the copies
+	rules := make(map[*Rule]*Rule)
+	for _, rule := range p.OrderedRules() {
+		newRule := clone.cloneRule(rule)
+		clone.InsertRule(newRule)
+		clone.AppendOrderedRule(newRule)
+		rules[rule] = newRule
+	}
+	for _, rule := range p.paramRules {
+		newRule := clone.cloneRule(rule)
+		clone.paramRules = append(clone.paramRules, newRule)
+		rules[rule] = newRule
+	}
+	for _, rule := range append(p.OrderedRules(), p.paramRules...) {
+		if rule.pexpr != nil {
+			rules[rule].InsertPexpr(clone.clonePexpr(rule.pexpr, rules))
+		}
+	}
+	if p.eofPexpr != nil {
+		clone.eofPexpr = clone.clonePexpr(p.eofPexpr, rules)
+	}
+	if p.newlinePexpr != nil {
+		clone.newlinePexpr = clone.clonePexpr(p.newlinePexpr, rules)
+	}
+	return clone
+}
+
+// cloneRule copies rule into the clone p, without its pexpr.
+func (p *Peg) cloneRule(rule *Rule) *Rule {
+	newRule := NewRule(p, rule.Sym, nil, rule.Location)
+	newRule.Weak = rule.Weak
+	newRule.ErrorMessage = rule.ErrorMessage
+	newRule.DisplayName = rule.DisplayName
+	newRule.Doc = rule.Doc
+	newRule.Precedence = rule.Precedence
+	newRule.Params = append([]*Sym(nil), rule.Params...)
+	newRule.instantiated = rule.instantiated
+	newRule.FirstKeywords = append([]bool(nil), rule.FirstKeywords...)
+	newRule.FirstTokens = append([]bool(nil), rule.FirstTokens...)
+	newRule.FirstSetFound = rule.FirstSetFound
+	newRule.CanBeEmpty = rule.CanBeEmpty
+	newRule.FollowKeywords = append([]bool(nil), rule.FollowKeywords...)
+	newRule.FollowTokens = append([]bool(nil), rule.FollowTokens...)
+	return newRule
+}
+
+// clonePexpr copies pexpr and its children into the clone p, linking keyword
+// pexprs to p's keywords and nonterminals to the copies of their rules.
+func (p *Peg) clonePexpr(pexpr *Pexpr, rules map[*Rule]*Rule) *Pexpr {
+	newPexpr := p.clonePexprNode(pexpr, rules)
+	for _, child := range pexpr.ChildPexprs() {
+		newPexpr.AppendChildPexpr(p.clonePexpr(child, rules))
+	}
+	return newPexpr
+}
+
+// clonePexprNode copies pexpr without its children, like clonePexpr.
+func (p *Peg) clonePexprNode(pexpr *Pexpr, rules map[*Rule]*Rule) *Pexpr {
+	newPexpr := NewPexpr(pexpr.Type, pexpr.Location)
+	newPexpr.Sym = pexpr.Sym
+	newPexpr.TokenType = pexpr.TokenType
+	newPexpr.HasParens = pexpr.HasParens
+	newPexpr.CanBeEmpty = pexpr.CanBeEmpty
+	newPexpr.Weak = pexpr.Weak
+	newPexpr.CharClass = pexpr.CharClass
+	newPexpr.ByteRange = pexpr.ByteRange
+	newPexpr.Label = pexpr.Label
+	if pexpr.Keyword != nil {
+		newPexpr.Keyword = p.Keytab.Lookup(pexpr.Keyword.Sym.Name)
+		newPexpr.Keyword.AppendPexpr(newPexpr)
+	}
+	if pexpr.NontermRule != nil {
+		newPexpr.NontermRule = rules[pexpr.NontermRule]
+		newPexpr.NontermRule.AppendNontermPexpr(newPexpr)
+	}
+	return newPexpr
+}
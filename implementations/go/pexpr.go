@@ -14,7 +14,10 @@
 
 package parser
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // PexprType represents the type of a parsing expression.
 type PexprType uint32
@@ -31,8 +34,31 @@ const (
 	PexprTypeOptional                     // Optional: e?
 	PexprTypeAnd                          // And-predicate: &e (lookahead)
 	PexprTypeNot                          // Not-predicate: !e (negation)
+	PexprTypeText                         // Text capture: text(e)
+	PexprTypeCharClass                    // Character class: [a-z]
+	PexprTypeSpace                        // Whitespace precedes the next token: SPACE
+	PexprTypeLongestChoice                // Longest match: e1 / e2 / e3
+	PexprTypeByteRange                    // Range of character literals: 'a'..'z'
+	PexprTypeCut                          // Commit to the current alternative: ^
+	PexprTypeAny                          // Any single token but EOF: ANY
+	PexprTypeSoftKeyword                  // Identifier with given text: SOFTKW "async"
 )
 
+// pexprTypeNames are the names of the pexpr types, in order.
+var pexprTypeNames = []string{
+	"nonterm", "term", "keyword", "empty", "sequence", "choice", "zeroOrMore",
+	"oneOrMore", "optional", "and", "not", "text", "charClass", "space",
+	"longestChoice", "byteRange", "cut", "any", "softKeyword",
+}
+
+// String returns the name of the pexpr type, such as zeroOrMore.
+func (t PexprType) String() string {
+	if int(t) < len(pexprTypeNames) {
+		return pexprTypeNames[t]
+	}
+	return fmt.Sprintf("PexprType(%d)", uint32(t))
+}
+
 // Pexpr represents a Parsing Expression in a PEG grammar.
 type Pexpr struct {
 	Type              PexprType
@@ -44,6 +70,9 @@ type Pexpr struct {
 	Weak              bool       // If true, don't include in parse tree
 	Keyword           *Keyword   // For Keyword pexprs
 	NontermRule       *Rule      // For Nonterm pexprs (filled in by bindNonterms)
+	CharClass         *CharClass // For CharClass pexprs
+	ByteRange         CharRange  // For ByteRange pexprs: the bytes matched, inclusive
+	Label             string     // Set by label=expr, and copied to the nodes it matches
 
 	// TailLinked Pexpr:"Parent" Pexpr:"Child" cascade
 	firstChildPexpr *Pexpr
@@ -164,10 +193,75 @@ func (p *Pexpr) ChildPexprs() []*Pexpr {
 	return children
 }
 
+// ============================================================================
+// Comparison
+// ============================================================================
+
+// Equal returns true if this expression and other have the same structure:
+// the same types, symbols, token types, weakness and character classes,
+// recursively.  Locations and parentheses are ignored.  Two nil expressions
+// are equal, but nil is not equal to any other expression.
+func (p *Pexpr) Equal(other *Pexpr) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	a, _ := p.firstDifference(other)
+	return a == nil
+}
+
+// firstDifference returns the first pair of corresponding subexpressions of p
+// and other, in pre-order, that differ, or nil, nil if they are equal.
+func (p *Pexpr) firstDifference(other *Pexpr) (*Pexpr, *Pexpr) {
+	if !p.shallowEqual(other) {
+		return p, other
+	}
+	a := p.firstChildPexpr
+	b := other.firstChildPexpr
+	for a != nil && b != nil {
+		if diffA, diffB := a.firstDifference(b); diffA != nil {
+			return diffA, diffB
+		}
+		a = a.nextPexpr
+		b = b.nextPexpr
+	}
+	if a != nil || b != nil {
+		// Different numbers of children.
+		return p, other
+	}
+	return nil, nil
+}
+
+// shallowEqual compares this expression to other, ignoring children.
+func (p *Pexpr) shallowEqual(other *Pexpr) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	if p.Type != other.Type || p.TokenType != other.TokenType || p.Weak != other.Weak || p.Label != other.Label {
+		return false
+	}
+	if (p.Sym == nil) != (other.Sym == nil) || (p.Sym != nil && p.Sym.Name != other.Sym.Name) {
+		return false
+	}
+	if p.ByteRange != other.ByteRange {
+		return false
+	}
+	if (p.CharClass == nil) != (other.CharClass == nil) {
+		return false
+	}
+	return p.CharClass == nil || p.CharClass.ToString() == other.CharClass.ToString()
+}
+
 // ============================================================================
 // Methods for first set computation
 // ============================================================================
 
+// IsNullable returns true if this expression can match without consuming
+// input.  Unlike CanBeEmpty, it is valid for every pexpr, not just those
+// visited while finding first sets.
+func (p *Pexpr) IsNullable() bool {
+	return canMatchEmpty(p)
+}
+
 // FindFirstSet computes the first set of tokens that could start this expression.
 // It updates firstKeywords and firstTokens arrays.
 func (p *Pexpr) FindFirstSet(firstKeywords []bool, firstTokens []bool) {
@@ -205,7 +299,29 @@ func (p *Pexpr) FindFirstSet(firstKeywords []bool, firstTokens []bool) {
 			firstKeywords[p.Keyword.Num] = true
 		}
 
-	case PexprTypeEmpty, PexprTypeAnd, PexprTypeNot:
+	case PexprTypeCharClass, PexprTypeAny:
+		// ANY matches any token, and a character class any token whose text
+		// is one of its characters.  Which keywords and token types those are
+		// isn't worked out, so every one is added: the first set is an
+		// over-approximation, which only costs failed attempts to match.
+		for i := range firstKeywords {
+			firstKeywords[i] = true
+		}
+		for i := range firstTokens {
+			if TokenType(i) != TokenTypeEof {
+				firstTokens[i] = true
+			}
+		}
+
+	case PexprTypeByteRange:
+		// A byte range matches character literals, which are integers
+		firstTokens[TokenTypeInteger] = true
+
+	case PexprTypeSoftKeyword:
+		// A soft keyword matches an identifier
+		firstTokens[TokenTypeIdent] = true
+
+	case PexprTypeEmpty, PexprTypeAnd, PexprTypeNot, PexprTypeSpace, PexprTypeCut:
 		// These can all match empty input
 		p.CanBeEmpty = true
 
@@ -219,7 +335,7 @@ func (p *Pexpr) FindFirstSet(firstKeywords []bool, firstTokens []bool) {
 		}
 		p.CanBeEmpty = true
 
-	case PexprTypeChoice:
+	case PexprTypeChoice, PexprTypeLongestChoice:
 		// For choice, compute first set of all alternatives
 		for _, child := range p.ChildPexprs() {
 			child.FindFirstSet(firstKeywords, firstTokens)
@@ -235,8 +351,8 @@ func (p *Pexpr) FindFirstSet(firstKeywords []bool, firstTokens []bool) {
 			p.firstChildPexpr.FindFirstSet(firstKeywords, firstTokens)
 		}
 
-	case PexprTypeOneOrMore:
-		// OneOrMore: can be empty only if child can be empty
+	case PexprTypeOneOrMore, PexprTypeText:
+		// OneOrMore and Text: can be empty only if child can be empty
 		if p.firstChildPexpr != nil {
 			child := p.firstChildPexpr
 			child.FindFirstSet(firstKeywords, firstTokens)
@@ -245,6 +361,57 @@ func (p *Pexpr) FindFirstSet(firstKeywords []bool, firstTokens []bool) {
 	}
 }
 
+// addFollowSets adds the keywords and tokens that can follow this expression,
+// followKeywords and followTokens, and those that can follow its parts within
+// it, to the follow sets of the rules it refers to.  It returns true if any of
+// them grew.  Lookahead is not matched, so what follows it is what follows
+// the predicate.
+func (p *Pexpr) addFollowSets(followKeywords []bool, followTokens []bool) bool {
+	switch p.Type {
+	case PexprTypeNonterm:
+		if p.NontermRule == nil {
+			return false
+		}
+		return p.NontermRule.addFollowSet(followKeywords, followTokens)
+
+	case PexprTypeSequence:
+		// Each element is followed by the first sets of the elements after it,
+		// up to one that can't be empty.
+		grew := false
+		children := p.ChildPexprs()
+		keywords := append([]bool(nil), followKeywords...)
+		tokens := append([]bool(nil), followTokens...)
+		for i := len(children) - 1; i >= 0; i-- {
+			child := children[i]
+			grew = child.addFollowSets(keywords, tokens) || grew
+			if !child.IsNullable() {
+				clear(keywords)
+				clear(tokens)
+			}
+			child.FindFirstSet(keywords, tokens)
+		}
+		return grew
+
+	case PexprTypeZeroOrMore, PexprTypeOneOrMore:
+		// The child can be followed by another match of itself
+		child := p.firstChildPexpr
+		if child == nil {
+			return false
+		}
+		keywords := append([]bool(nil), followKeywords...)
+		tokens := append([]bool(nil), followTokens...)
+		child.FindFirstSet(keywords, tokens)
+		return child.addFollowSets(keywords, tokens)
+
+	default:
+		grew := false
+		for child := p.firstChildPexpr; child != nil; child = child.nextPexpr {
+			grew = child.addFollowSets(followKeywords, followTokens) || grew
+		}
+		return grew
+	}
+}
+
 // ============================================================================
 // String representation
 // ============================================================================
@@ -253,21 +420,50 @@ func (p *Pexpr) FindFirstSet(firstKeywords []bool, firstTokens []bool) {
 func (p *Pexpr) RawToString() string {
 	switch p.Type {
 	case PexprTypeNonterm:
-		if p.Sym != nil {
+		if p.Sym == nil {
+			return "?"
+		}
+		if p.firstChildPexpr == nil {
 			return p.Sym.Name
 		}
-		return "?"
+		// Arguments of a parameterized rule
+		args := make([]string, 0)
+		for _, child := range p.ChildPexprs() {
+			args = append(args, child.ToString())
+		}
+		return p.Sym.Name + "(" + strings.Join(args, ", ") + ")"
 
 	case PexprTypeTerm:
 		if p.Sym != nil {
 			return p.Sym.Name
 		}
-		return fmt.Sprintf("TokenType(%d)", p.TokenType)
+		return p.TokenType.String()
 
 	case PexprTypeEmpty:
 		return "EMPTY"
 
+	case PexprTypeCut:
+		return "^"
+
+	case PexprTypeAny:
+		return "ANY"
+
+	case PexprTypeSoftKeyword:
+		if p.Sym != nil && p.Weak {
+			return fmt.Sprintf(`SOFTKW '%s'`, p.Sym.Name)
+		}
+		if p.Sym != nil {
+			return fmt.Sprintf(`SOFTKW "%s"`, p.Sym.Name)
+		}
+		return `SOFTKW "?"`
+
+	case PexprTypeSpace:
+		return "SPACE"
+
 	case PexprTypeKeyword:
+		if p.Sym != nil && !p.Weak && p.Sym.Name == "\n" {
+			return "NEWLINE"
+		}
 		if p.Sym != nil {
 			return fmt.Sprintf(`"%s"`, p.Sym.Name)
 		}
@@ -285,64 +481,149 @@ func (p *Pexpr) RawToString() string {
 				s += " "
 			}
 			firstTime = false
-			s += child.ToString()
+			s += child.operandString(precPrefix)
 		}
 		return s
 
-	case PexprTypeChoice:
+	case PexprTypeChoice, PexprTypeLongestChoice:
+		separator := " | "
+		if p.Type == PexprTypeLongestChoice {
+			separator = " / "
+		}
 		s := ""
 		firstTime := true
 		for _, child := range p.ChildPexprs() {
 			if !firstTime {
-				s += " | "
+				s += separator
 			}
 			firstTime = false
-			s += child.ToString()
+			s += child.operandString(precSequence)
 		}
 		return s
 
 	case PexprTypeZeroOrMore:
 		if p.firstChildPexpr != nil {
-			return p.firstChildPexpr.ToString() + "*"
+			return p.firstChildPexpr.operandString(precPrimary) + "*"
 		}
 		return "*"
 
 	case PexprTypeOneOrMore:
 		if p.firstChildPexpr != nil {
-			return p.firstChildPexpr.ToString() + "+"
+			return p.firstChildPexpr.operandString(precPrimary) + "+"
 		}
 		return "+"
 
 	case PexprTypeOptional:
 		if p.firstChildPexpr != nil {
-			return p.firstChildPexpr.ToString() + "?"
+			return p.firstChildPexpr.operandString(precPrimary) + "?"
 		}
 		return "?"
 
 	case PexprTypeAnd:
 		if p.firstChildPexpr != nil {
-			return "&" + p.firstChildPexpr.ToString()
+			return "&" + p.firstChildPexpr.operandString(precPostfix)
 		}
 		return "&"
 
 	case PexprTypeNot:
 		if p.firstChildPexpr != nil {
-			return "!" + p.firstChildPexpr.ToString()
+			return "!" + p.firstChildPexpr.operandString(precPostfix)
 		}
 		return "!"
 
+	case PexprTypeCharClass:
+		if p.CharClass != nil {
+			return p.CharClass.ToString()
+		}
+		return "[]"
+
+	case PexprTypeText:
+		if p.firstChildPexpr != nil {
+			return "text(" + p.firstChildPexpr.ToString() + ")"
+		}
+		return "text()"
+
+	case PexprTypeByteRange:
+		return byteLiteralToString(p.ByteRange.Lo) + ".." + byteLiteralToString(p.ByteRange.Hi)
+
 	default:
-		return fmt.Sprintf("UnknownType(%d)", p.Type)
+		return p.Type.String()
 	}
 }
 
-// ToString returns the string representation of this expression, including parentheses if needed.
+// ToString returns the string representation of this expression, including
+// parentheses and its label if needed.
 func (p *Pexpr) ToString() string {
 	s := p.RawToString()
-	if !p.HasParens {
-		return s
+	if p.HasParens || (p.Label != "" && p.precedence() < precPrefix) {
+		s = "(" + s + ")"
+	}
+	if p.Label != "" {
+		s = p.Label + "=" + s
+	}
+	return s
+}
+
+// Operator precedences, from loosest to tightest binding, which decide where
+// ToString needs parentheses.
+const (
+	precChoice   = iota // e1 | e2, e1 / e2
+	precSequence        // e1 e2
+	precPrefix          // &e, !e, label=e
+	precPostfix         // e*, e+, e?
+	precPrimary         // Terminals, nonterminals and parenthesized groups
+)
+
+// precedence returns how tightly this expression's operator binds, ignoring
+// its parentheses and label.
+func (p *Pexpr) precedence() int {
+	switch p.Type {
+	case PexprTypeChoice, PexprTypeLongestChoice:
+		return precChoice
+	case PexprTypeSequence:
+		return precSequence
+	case PexprTypeAnd, PexprTypeNot:
+		return precPrefix
+	case PexprTypeZeroOrMore, PexprTypeOneOrMore, PexprTypeOptional:
+		return precPostfix
+	}
+	return precPrimary
+}
+
+// operandString returns ToString for this expression as the operand of an
+// operator that needs an operand of at least minPrecedence, adding
+// parentheses if it binds more loosely, whether or not it had them in the
+// grammar, so the string parses back to the same structure.
+func (p *Pexpr) operandString(minPrecedence int) string {
+	precedence := p.precedence()
+	if p.HasParens {
+		precedence = precPrimary
+	}
+	if p.Label != "" {
+		precedence = precPrefix
+	}
+	if precedence < minPrecedence {
+		return "(" + p.ToString() + ")"
+	}
+	return p.ToString()
+}
+
+// byteLiteralToString returns b as a single-quoted grammar literal.
+func byteLiteralToString(b rune) string {
+	switch b {
+	case '\'', '\\':
+		return `'\` + string(b) + `'`
+	case '\n':
+		return `'\n'`
+	case '\r':
+		return `'\r'`
+	case '\t':
+		return `'\t'`
+	}
+	if b < ' ' || b >= 0x7f {
+		return fmt.Sprintf(`'\x%02x'`, b)
 	}
-	return "(" + s + ")"
+	return "'" + string(b) + "'"
 }
 
 // Dump outputs debugging information about this expression.
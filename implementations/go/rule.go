@@ -14,7 +14,10 @@
 
 package parser
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // Rule represents a single grammar rule in a PEG grammar.
 type Rule struct {
@@ -22,6 +25,31 @@ type Rule struct {
 	Location Location
 	Weak     bool   // If true, this is a weak rule (collapsed in parse tree)
 
+	// ErrorMessage, set with %error "...", replaces the generic syntax error
+	// when this rule fails at the furthest token reached.
+	ErrorMessage string
+
+	// Precedence, set with %precedence { left "+" "-"; left "*" "/" }, lists
+	// the binary operators of an expression rule by precedence level, lowest
+	// first.  The rule matches a flat list of operands and operators, which is
+	// then grouped into nested ParseResults of the rule, left-associatively.
+	Precedence [][]*Sym
+
+	// Doc is the text of the "///" or "/** */" doc comment just before the
+	// rule, without the comment markers, or "" if there is none.
+	Doc string
+
+	// DisplayName, set with name -> displayName := ..., is the name nodes
+	// matched by this rule report in the tree, in place of Sym.  Rules are
+	// still found by Sym.
+	DisplayName *Sym
+
+	// Params are the parameters of a parameterized rule, such as elem in
+	// list(elem) := elem ("," elem)*.  Such rules are not parsed with
+	// directly, but instantiated for each list of arguments they are used with.
+	Params       []*Sym
+	instantiated bool // Whether a parameterized rule has been instantiated
+
 	// OneToOne Rule Pexpr cascade
 	pexpr *Pexpr
 
@@ -42,33 +70,33 @@ type Rule struct {
 	firstParseResult *ParseResult
 	lastParseResult  *ParseResult
 
-	// Hashed Rule:"Hashed" ParseResult:"Hashed" cascade ("pos")
-	hashedParseResultTable []*ParseResult
-	numHashedParseResults  uint32
-
 	// First set computation
 	FirstKeywords   []bool
 	FirstTokens     []bool
 	FirstSetFound   bool
 	findingFirstSet bool // For loop detection
 	CanBeEmpty      bool
+
+	// Follow set: the keywords and token types that can come after a match
+	// of this rule, which error recovery skips to
+	FollowKeywords []bool
+	FollowTokens   []bool
 }
 
 // NewRule creates a new grammar rule.
 func NewRule(peg *Peg, sym *Sym, pexpr *Pexpr, location Location) *Rule {
 	r := &Rule{
-		Sym:                    sym,
-		Location:               location,
-		Weak:                   false,
-		pexpr:                  pexpr,
-		peg:                    peg,
-		FirstKeywords:          make([]bool, 0),
-		FirstTokens:            make([]bool, 256), // Approximate for token types
-		FirstSetFound:          false,
-		findingFirstSet:        false,
-		CanBeEmpty:             false,
-		hashedParseResultTable: make([]*ParseResult, 0),
-		numHashedParseResults:  0,
+		Sym:             sym,
+		Location:        location,
+		Weak:            false,
+		pexpr:           pexpr,
+		peg:             peg,
+		FirstKeywords:   make([]bool, 0),
+		FirstTokens:     make([]bool, 256), // Approximate for token types
+		FollowTokens:    make([]bool, 256),
+		FirstSetFound:   false,
+		findingFirstSet: false,
+		CanBeEmpty:      false,
 	}
 
 	// If pexpr is provided, set the OneToOne relationship
@@ -199,94 +227,46 @@ func (r *Rule) ParseResults() []*ParseResult {
 // Hashed Rule:"Hashed" ParseResult:"Hashed" cascade ("pos")
 // ============================================================================
 
-// FindHashedParseResult looks up a ParseResult by position (hash key).
+// FindHashedParseResult returns the last ParseResult added to this rule at
+// pos, or nil if there is none.
+//
+// Deprecated: ParseResults are no longer hashed by position.  Use
+// ParseResults.
 func (r *Rule) FindHashedParseResult(pos uint32) *ParseResult {
-	if len(r.hashedParseResultTable) == 0 {
-		return nil
-	}
-
-	hash := pos & (uint32(len(r.hashedParseResultTable)) - 1)
-	for entry := r.hashedParseResultTable[hash]; entry != nil; entry = entry.nextHashedRuleParseResult {
-		if entry.Pos == pos {
-			return entry
+	for pr := r.lastParseResult; pr != nil; pr = pr.prevRuleParseResult {
+		if pr.Pos == pos {
+			return pr
 		}
 	}
 	return nil
 }
 
-// InsertHashedParseResult adds a ParseResult to the hash table.
+// InsertHashedParseResult adds a ParseResult to this rule, unless it has been
+// added already.
+//
+// Deprecated: ParseResults are no longer hashed by position.  Use
+// AppendParseResult.
 func (r *Rule) InsertHashedParseResult(pr *ParseResult) {
-	if pr == nil {
-		return
-	}
-
-	// Resize if needed
-	if r.numHashedParseResults == uint32(len(r.hashedParseResultTable)) {
-		if len(r.hashedParseResultTable) == 0 {
-			r.hashedParseResultTable = make([]*ParseResult, 32)
-		} else {
-			r.resizeHashedParseResultTable()
-		}
+	if pr != nil && pr.ruleParent != r {
+		r.AppendParseResult(pr)
 	}
-
-	hash := pr.Pos & (uint32(len(r.hashedParseResultTable)) - 1)
-	pr.nextHashedRuleParseResult = r.hashedParseResultTable[hash]
-	r.hashedParseResultTable[hash] = pr
-	r.numHashedParseResults++
 }
 
-// RemoveHashedParseResult removes a ParseResult from the hash table.
+// RemoveHashedParseResult removes a ParseResult from this rule.
+//
+// Deprecated: ParseResults are no longer hashed by position.  Use
+// RemoveParseResult.
 func (r *Rule) RemoveHashedParseResult(pr *ParseResult) {
-	if pr == nil || len(r.hashedParseResultTable) == 0 {
-		return
-	}
-
-	hash := pr.Pos & (uint32(len(r.hashedParseResultTable)) - 1)
-	var prev *ParseResult
-	for entry := r.hashedParseResultTable[hash]; entry != nil; entry = entry.nextHashedRuleParseResult {
-		if entry == pr {
-			if prev == nil {
-				r.hashedParseResultTable[hash] = pr.nextHashedRuleParseResult
-			} else {
-				prev.nextHashedRuleParseResult = pr.nextHashedRuleParseResult
-			}
-			pr.nextHashedRuleParseResult = nil
-			r.numHashedParseResults--
-			return
-		}
-		prev = entry
-	}
-}
-
-// resizeHashedParseResultTable doubles the hash table size and rehashes.
-func (r *Rule) resizeHashedParseResultTable() {
-	if len(r.hashedParseResultTable) == 0 {
-		return
-	}
-
-	oldTable := r.hashedParseResultTable
-	newSize := len(oldTable) * 2
-	r.hashedParseResultTable = make([]*ParseResult, newSize)
-
-	newMask := uint32(newSize - 1)
-
-	// Rehash all entries
-	for _, entry := range oldTable {
-		for entry != nil {
-			nextEntry := entry.nextHashedRuleParseResult
-			newHash := entry.Pos & newMask
-			entry.nextHashedRuleParseResult = r.hashedParseResultTable[newHash]
-			r.hashedParseResultTable[newHash] = entry
-			entry = nextEntry
-		}
-	}
+	r.RemoveParseResult(pr)
 }
 
 // ============================================================================
 // First set computation
 // ============================================================================
 
-// FindFirstSet computes the first set of tokens for this rule.
+// FindFirstSet computes the first set of tokens for this rule.  It may contain
+// tokens the rule can't start with, since character classes are assumed to
+// match every token but EOF.
 func (r *Rule) FindFirstSet() {
 	if r.FirstSetFound {
 		return
@@ -315,14 +295,106 @@ func (r *Rule) FindFirstSet() {
 	r.findingFirstSet = false
 }
 
+// IsNullable returns true if this rule can match without consuming input.
+// Its first set is found first, if it hasn't been.
+func (r *Rule) IsNullable() bool {
+	r.FindFirstSet()
+	return r.CanBeEmpty
+}
+
+// FirstSet returns the keywords and token types that can start a match of
+// this rule, keywords in the order the grammar first uses them, and token
+// types in TokenType order.  Its first set is found first, if it hasn't been.
+func (r *Rule) FirstSet() ([]string, []TokenType) {
+	r.FindFirstSet()
+	var keywords []string
+	if r.peg != nil {
+		for _, keyword := range r.peg.Keytab.OrderedKeywords() {
+			if int(keyword.Num) < len(r.FirstKeywords) && r.FirstKeywords[keyword.Num] {
+				keywords = append(keywords, keyword.Sym.Name)
+			}
+		}
+	}
+	var tokenTypes []TokenType
+	for i, found := range r.FirstTokens {
+		if found {
+			tokenTypes = append(tokenTypes, TokenType(i))
+		}
+	}
+	return keywords, tokenTypes
+}
+
+// canStart returns false if token is known not to be in this rule's first set.
+// Keywords and token types the first set was not sized for may start it.
+func (r *Rule) canStart(token *Token) bool {
+	if token.Type == TokenTypeKeyword {
+		return int(token.Keyword.Num) >= len(r.FirstKeywords) || r.FirstKeywords[token.Keyword.Num]
+	}
+	return int(token.Type) >= len(r.FirstTokens) || r.FirstTokens[token.Type]
+}
+
+// ============================================================================
+// Follow set computation
+// ============================================================================
+
+// FollowSet returns the keywords and token types that can follow a match of
+// this rule, in the same order as FirstSet.  EOF follows the goal rule.  Follow
+// sets are found by ParseRules.
+func (r *Rule) FollowSet() ([]string, []TokenType) {
+	var keywords []string
+	if r.peg != nil {
+		for _, keyword := range r.peg.Keytab.OrderedKeywords() {
+			if int(keyword.Num) < len(r.FollowKeywords) && r.FollowKeywords[keyword.Num] {
+				keywords = append(keywords, keyword.Sym.Name)
+			}
+		}
+	}
+	var tokenTypes []TokenType
+	for i, found := range r.FollowTokens {
+		if found {
+			tokenTypes = append(tokenTypes, TokenType(i))
+		}
+	}
+	return keywords, tokenTypes
+}
+
+// canFollow returns true if token is in this rule's follow set.
+func (r *Rule) canFollow(token *Token) bool {
+	if token.Type == TokenTypeKeyword {
+		return int(token.Keyword.Num) < len(r.FollowKeywords) && r.FollowKeywords[token.Keyword.Num]
+	}
+	return int(token.Type) < len(r.FollowTokens) && r.FollowTokens[token.Type]
+}
+
+// addFollowSet adds keywords and tokens to this rule's follow set, and returns
+// true if it grew.
+func (r *Rule) addFollowSet(keywords []bool, tokens []bool) bool {
+	grew := false
+	for i, found := range keywords {
+		if found && i < len(r.FollowKeywords) && !r.FollowKeywords[i] {
+			r.FollowKeywords[i] = true
+			grew = true
+		}
+	}
+	for i, found := range tokens {
+		if found && i < len(r.FollowTokens) && !r.FollowTokens[i] {
+			r.FollowTokens[i] = true
+			grew = true
+		}
+	}
+	return grew
+}
+
 // ============================================================================
 // Clear memoization caches (for starting a new parse)
 // ============================================================================
 
-// ClearHashedParseResults removes all ParseResults from the hash table.
+// ClearHashedParseResults removes all ParseResults from this rule.
+//
+// Deprecated: ParseResults are no longer hashed by position.  Use
+// ClearParseResults.
 func (r *Rule) ClearHashedParseResults() {
-	r.hashedParseResultTable = make([]*ParseResult, 0)
-	r.numHashedParseResults = 0
+	r.ClearParseResults()
 }
 
 // ClearParseResults removes all ParseResults from the doubly-linked list.
@@ -341,11 +413,53 @@ func (r *Rule) ToString() string {
 		return r.Sym.Name
 	}
 	s := r.Sym.Name
+	if r.Params != nil {
+		names := make([]string, len(r.Params))
+		for i, param := range r.Params {
+			names[i] = param.Name
+		}
+		s += "(" + strings.Join(names, ", ") + ")"
+	}
+	if r.DisplayName != nil {
+		s += " -> " + r.DisplayName.Name
+	}
 	s += ": "
 	s += r.pexpr.ToString()
+	if r.ErrorMessage != "" {
+		s += fmt.Sprintf(" %%error %q", r.ErrorMessage)
+	}
+	if r.Precedence != nil {
+		s += " %precedence {" + r.precedenceString() + " }"
+	}
 	return s
 }
 
+// precedenceString returns the levels of the rule's %precedence annotation,
+// such as ` left "+" "-"; left "*" "/"`.
+func (r *Rule) precedenceString() string {
+	levels := make([]string, len(r.Precedence))
+	for i, level := range r.Precedence {
+		levels[i] = " left"
+		for _, sym := range level {
+			levels[i] += fmt.Sprintf(" %q", sym.Name)
+		}
+	}
+	return strings.Join(levels, ";")
+}
+
+// precedenceLevel returns the level of the binary operator keyword sym in the
+// rule's Precedence, where 0 binds loosest, or -1 if sym is not an operator.
+func (r *Rule) precedenceLevel(sym *Sym) int {
+	for i, level := range r.Precedence {
+		for _, other := range level {
+			if other == sym {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
 // Dump outputs debugging information about this rule.
 func (r *Rule) Dump() {
 	fmt.Println(r.ToString())
@@ -33,9 +33,28 @@ const (
 	TokenTypeEof
 	TokenTypeRandUint
 	TokenTypeIntType
-	TokenTypeUintType // If this is not the last anymore, fix code that assumes this.
+	TokenTypeUintType
+	TokenTypeCharClass // Only used in parsing PEG rules
+	TokenTypeComment   // Only returned when Lexer.KeepComments is set
+	TokenTypeIndent    // Only returned when Lexer.IndentSensitive is set
+	TokenTypeDedent    // Only returned when Lexer.IndentSensitive is set
 )
 
+// tokenTypeNames are the names of the token types, as used in grammars.
+var tokenTypeNames = []string{
+	"KEYWORD", "IDENT", "INTEGER", "FLOAT", "BOOL", "STRING", "WEAKSTRING",
+	"EOF", "RANDUINT", "INTTYPE", "UINTTYPE", "CHARCLASS", "COMMENT", "INDENT",
+	"DEDENT",
+}
+
+// String returns the name of the token type, such as INTEGER.
+func (t TokenType) String() string {
+	if int(t) < len(tokenTypeNames) {
+		return tokenTypeNames[t]
+	}
+	return fmt.Sprintf("TokenType(%d)", uint32(t))
+}
+
 // Value represents a token's value as an interface{}.
 // It can hold: bool, string, *Sym, *Keyword, *big.Int, float64, etc.
 type Value struct {
@@ -53,9 +72,25 @@ type Token struct {
 	Location Location
 	Keyword  *Keyword  // For TokenTypeKeyword
 	Value    Value     // For other token types
+	BigFloat *big.Float // For TokenTypeFloat: the value before rounding to its width
 	Lexer    *Lexer
 	Pexpr    interface{} // For PEG parser use (will be *Pexpr during parsing)
-	
+
+	// For TokenTypeInteger literals: the width and signedness given by a
+	// suffix such as u16, or 0 if there is none, and the radix the literal
+	// was written in, 10 or 16.  IntRadix is 0 for character literals.
+	IntWidth  uint32
+	IntSigned bool
+	IntRadix  int
+
+	// LeadingWhitespace is true if spaces, tabs or a comment came before
+	// this token on its line.
+	LeadingWhitespace bool
+
+	// DocComment is the text of the "///" or "/** */" doc comment just before
+	// this token, without the comment markers, or "" if there is none.
+	DocComment string
+
 	// Previous/Next for DoublyLinked Keyword Token relation
 	PrevKeywordToken *Token
 	NextKeywordToken *Token
@@ -70,8 +105,11 @@ func NewToken(lexer *Lexer, tokenType TokenType, location Location, keyword *Key
 		Value:    value,
 		Lexer:    lexer,
 		Pexpr:    nil,
+
+		LeadingWhitespace: lexer.leadingWhitespace,
 	}
-	if keyword != nil {
+	token.DocComment = lexer.takeDocComment(token)
+	if keyword != nil && !lexer.sharedKeytab {
 		keyword.AppendToken(token)
 	}
 	lexer.AppendToken(token)
@@ -213,5 +251,9 @@ func (t *Token) GetName() string {
 // Dump outputs debugging information about this token.
 func (t *Token) Dump() {
 	t.Location.Dump()
+	if t.Keyword != nil {
+		fmt.Printf("Token: type=%v, keyword=%v\n", t.Type, t.Keyword)
+		return
+	}
 	fmt.Printf("Token: type=%v, name=%s\n", t.Type, t.GetName())
 }
@@ -182,3 +182,41 @@ func TestTokenIsTokenKeyword(t *testing.T) {
 		t.Errorf("IsKeyword should return false for 'other_kw'")
 	}
 }
+
+func TestEnumStrings(t *testing.T) {
+	tokenTypes := []string{"KEYWORD", "IDENT", "INTEGER", "FLOAT", "BOOL", "STRING", "WEAKSTRING",
+		"EOF", "RANDUINT", "INTTYPE", "UINTTYPE", "CHARCLASS", "COMMENT", "INDENT", "DEDENT"}
+	for i, name := range tokenTypes {
+		if s := TokenType(i).String(); s != name {
+			t.Errorf("TokenType(%d): expected %s, got %s", i, name, s)
+		}
+	}
+	if s := TokenType(len(tokenTypes)).String(); s != "TokenType(15)" {
+		t.Errorf("Expected an unknown token type to show its number, got %s", s)
+	}
+
+	pexprTypes := map[PexprType]string{
+		PexprTypeNonterm: "nonterm", PexprTypeTerm: "term", PexprTypeKeyword: "keyword",
+		PexprTypeEmpty: "empty", PexprTypeSequence: "sequence", PexprTypeChoice: "choice",
+		PexprTypeZeroOrMore: "zeroOrMore", PexprTypeOneOrMore: "oneOrMore",
+		PexprTypeOptional: "optional", PexprTypeAnd: "and", PexprTypeNot: "not",
+		PexprTypeText: "text", PexprTypeCharClass: "charClass", PexprTypeSpace: "space",
+		PexprTypeLongestChoice: "longestChoice", PexprTypeByteRange: "byteRange",
+		PexprTypeCut: "cut", PexprTypeAny: "any", PexprTypeSoftKeyword: "softKeyword",
+	}
+	for pexprType, name := range pexprTypes {
+		if s := pexprType.String(); s != name {
+			t.Errorf("PexprType(%d): expected %s, got %s", uint32(pexprType), name, s)
+		}
+	}
+	if s := PexprType(len(pexprTypes)).String(); s != "PexprType(19)" {
+		t.Errorf("Expected an unknown pexpr type to show its number, got %s", s)
+	}
+
+	keytab := NewKeytab()
+	for name, expected := range map[string]string{"if": `"if"`, "\n": `"\n"`, "+=": `"+="`} {
+		if s := keytab.New(name).String(); s != expected {
+			t.Errorf("Keyword %q: expected %s, got %s", name, expected, s)
+		}
+	}
+}